@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Record albums that were hardlinked into the target by hand, or by another
+// tool, as if flaclink had linked them, so they aren't linked a second time.
+// A target album is adopted if one of its files is a hardlink to a file of a
+// source album; nothing is created or changed on disk. Albums flaclink
+// already has a source for are left alone. With -n, only report matches.
+func runAdopt(args []string) {
+	flags := flag.NewFlagSet("adopt", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "report matches without writing the DB")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: flaclink adopt [-n] <source dir> <target dir>")
+		os.Exit(2)
+	}
+	sourceDir := filepath.Clean(flags.Arg(0))
+	targetDir := filepath.Clean(flags.Arg(1))
+
+	sources, err := albumScanner().Scan(sourceDir)
+	if err != nil {
+		fatalf("adopt: %v", err)
+	}
+	byFile := indexSourceFiles(sources)
+	log.Printf("Found %d albums in %s.", len(sources), sourceDir)
+
+	options := &bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: *dryRun}
+	db := openAlbumDb(options)
+	defer db.Close()
+	store := albumStore(db)
+
+	var adopted, known, unlinked int
+	for _, relPath := range targetAlbumDirs(targetDir, "", templateDepth()) {
+		targetPath := filepath.Join(targetDir, relPath)
+		if !albumScanner().IsAlbum(targetPath) {
+			continue
+		}
+		source := linkedSource(targetPath, byFile)
+		if source < 0 {
+			unlinked++
+			continue
+		}
+		album := sources[source]
+		if record, ok := store.Record(album); ok && record.Source != "" {
+			known++
+			continue
+		}
+		adopted++
+		fmt.Printf("adopt  %s <- %s\n", relPath, album.Path)
+		if *dryRun {
+			continue
+		}
+		album.DirName = relPath
+		if err := store.SaveRecord(album, rebuiltRecord(album, targetPath, "hardlink")); err != nil {
+			fatalf("adopt: %v", err)
+		}
+	}
+	verb := "Adopted"
+	if *dryRun {
+		verb = "Would adopt"
+	}
+	log.Printf("%s %d albums; %d were already in the DB and %d aren't hardlinked to the source.", verb, adopted, known, unlinked)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The catalog of the DB in use, cached in memory so that checking whether an
+// album is in the DB usually needs no transaction. It's loaded on first use
+// and reloaded at the start of each run, so a daemon sees albums other
+// processes added between its scans.
+var (
+	albumCacheMu sync.Mutex
+	albumCache   *flaclink.CachedStore
+	albumCacheDB *bolt.DB
+)
+
+// The album catalog for db. See backingStore.
+func albumStore(db *bolt.DB) flaclink.Store {
+	albumCacheMu.Lock()
+	defer albumCacheMu.Unlock()
+	if albumCache != nil && albumCacheDB == db {
+		return albumCache
+	}
+	cache, err := flaclink.NewCachedStore(backingStore(db))
+	if err != nil {
+		// Fall back to the uncached catalog, which reports its own errors.
+		log.Printf("Can't cache the album DB: %v", err)
+		return backingStore(db)
+	}
+	albumCache, albumCacheDB = cache, db
+	return albumCache
+}
+
+// Drop the cached catalog, so it's reloaded the next time it's used.
+func resetAlbumCache() {
+	albumCacheMu.Lock()
+	defer albumCacheMu.Unlock()
+	albumCache, albumCacheDB = nil, nil
+}
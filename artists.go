@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Credits for guest artists at the end of an artist name, e.g. " feat. Jay-Z"
+// or " (ft. Someone)".
+var featuringPattern = regexp.MustCompile(`(?i)\s*[(\[]?\b(feat\.?|ft\.|featuring)\s.*$`)
+
+// The artist to file an album under, given the artist name from its tags and
+// its MusicBrainz artist ID, if any. artist_aliases entries, keyed by ID or
+// by name (case-insensitively), take precedence. Otherwise, with
+// reconcile_artists, guest credits are dropped.
+func resolveArtist(name string, mbid string) string {
+	if alias, ok := artistAlias(mbid); ok && mbid != "" {
+		return alias
+	}
+	if alias, ok := artistAlias(name); ok {
+		return alias
+	}
+	if settings.ReconcileArtists {
+		if stripped := featuringPattern.ReplaceAllString(name, ""); stripped != "" {
+			return stripped
+		}
+	}
+	return name
+}
+
+func artistAlias(key string) (string, bool) {
+	for from, to := range settings.ArtistAliases {
+		if strings.EqualFold(from, key) {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+// A key under which spellings of the same artist name match: case, accents,
+// punctuation, a leading "The" and "&" versus "and" are ignored, so "AC/DC"
+// matches "ACDC" and "Sigur Rós" matches "Sigur Ros".
+func artistKey(name string) string {
+	name = featuringPattern.ReplaceAllString(name, "")
+	name = strings.ReplaceAll(name, "&", " and ")
+	var b strings.Builder
+	for _, r := range name {
+		r = unicode.ToUpper(r)
+		if folded, ok := initialFolds[r]; ok {
+			b.WriteString(folded)
+		} else if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' {
+			b.WriteRune(r)
+		}
+	}
+	words := strings.Fields(b.String())
+	if len(words) > 1 && words[0] == "THE" {
+		words = words[1:]
+	}
+	return strings.Join(words, "")
+}
+
+// With reconcile_artists, replace each directory in album.DirName above the
+// album's own with an existing directory in the target whose name matches it
+// by artistKey, so near-duplicate artist folders aren't created.
+func reconcileDirName(album *Album, targetDir string) {
+	if !settings.ReconcileArtists {
+		return
+	}
+	parts := strings.Split(album.DirName, string(filepath.Separator))
+	for i := 0; i < len(parts)-1; i++ {
+		parent := filepath.Join(append([]string{targetDir}, parts[:i]...)...)
+		existing, err := ioutil.ReadDir(parent)
+		if err != nil {
+			// Nothing deeper exists either.
+			break
+		}
+		key := artistKey(parts[i])
+		for _, dir := range existing {
+			if dir.IsDir() && dir.Name() != parts[i] && key != "" && artistKey(dir.Name()) == key {
+				parts[i] = dir.Name()
+				break
+			}
+		}
+	}
+	album.DirName = filepath.Join(parts...)
+}
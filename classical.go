@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+)
+
+// Classical albums are tagged by composer, work and performer rather than by
+// artist, and a box set's ARTIST tag may name a different soloist on every
+// disc, so "{artist}/{album}" scatters them. Routes can lay out the albums
+// they match by a template of their own, and "classical" stands for
+// classicalTemplate, which files albums by composer and then by work and
+// performer. The {composer}, {composer_sort}, {work}, {conductor} and
+// {performer} variables are available in any template.
+
+// The target template a route's "classical" stands for.
+const classicalTemplate = "{composer_sort}/{work} ({performer})"
+
+// Route template value that stands for classicalTemplate.
+const classicalRouteTemplate = "classical"
+
+// The composer, as in artist_aliases, or "Unknown Composer".
+func composer(meta *flacMetadata) string {
+	return resolveArtist(tagOr(meta, "COMPOSER", "Unknown Composer"), "")
+}
+
+// The composer as they should be sorted: the COMPOSERSORT tag if set,
+// otherwise the composer's last name first, so "Johann Sebastian Bach"
+// becomes "Bach, Johann Sebastian".
+func composerSort(meta *flacMetadata) string {
+	if sortName := tagOr(meta, "COMPOSERSORT", ""); sortName != "" {
+		return sortName
+	}
+	name := composer(meta)
+	if tagOr(meta, "COMPOSER", "") == "" || strings.Contains(name, ",") {
+		return name
+	}
+	words := strings.Fields(name)
+	if len(words) < 2 {
+		return name
+	}
+	return words[len(words)-1] + ", " + strings.Join(words[:len(words)-1], " ")
+}
+
+// The work, from the WORK tag, or else the album's title.
+func work(album Album, meta *flacMetadata) string {
+	return tagOr(meta, "WORK", tagOr(meta, "ALBUM", album.DirName))
+}
+
+// Who the album is by, for telling recordings of a work apart: the conductor,
+// or else the orchestra or ensemble, or else the first performer without
+// their instrument, or else the album artist.
+func performer(meta *flacMetadata) string {
+	for _, name := range []string{"CONDUCTOR", "ORCHESTRA", "ENSEMBLE", "PERFORMER"} {
+		value := tagOr(meta, name, "")
+		// PERFORMER is often "Name (instrument)".
+		if i := strings.LastIndex(value, " ("); i > 0 && strings.HasSuffix(value, ")") {
+			value = value[:i]
+		}
+		if value != "" {
+			return resolveArtist(value, "")
+		}
+	}
+	return albumArtist(meta)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Compilations, such as soundtracks and label samplers, have a different
+// artist on every track, so a target_template such as "{artist}/{album}"
+// files each under whichever artist happens to have its first track. With
+// compilations set, albums tagged as compilations are named by a template of
+// their own instead, and their FLAC files can be named after each track's
+// tags, e.g. "03 Some Artist - Some Title.flac". Albums are only told apart
+// when target_template is set, since otherwise they keep their source names.
+
+// MusicBrainz ID of the "Various Artists" special purpose artist.
+const variousArtistsMBID = "89ad4ac3-39f7-470e-963a-56509c546377"
+
+// Album artists that mark a compilation unless compilations lists others.
+var defaultCompilationArtists = []string{"Various Artists", "Various", "VA"}
+
+// Naming compilations in the target.
+type CompilationConfig struct {
+	// target_template for compilations, with the same variables. It must
+	// have as many folder levels as target_template, so the target can be
+	// scanned. Defaults to "Compilations/{album}".
+	Template string `json:"template"`
+	// Names for the FLAC files of compilations, without the extension, e.g.
+	// "{tracknumber} {artist} - {title}". Slashes make subfolders. Files keep
+	// their names if empty.
+	TrackTemplate string `json:"track_template"`
+	// Album artists, ignoring case, that mark an album as a compilation.
+	// Defaults to Various Artists, Various and VA.
+	Artists []string `json:"artists"`
+}
+
+func (cc *CompilationConfig) validate(targetTemplate string) error {
+	if err := validateTemplate(cc.Template); err != nil {
+		return fmt.Errorf("template: %v", err)
+	}
+	if targetTemplate != "" && templatePathDepth(cc.template()) != templatePathDepth(targetTemplate) {
+		return fmt.Errorf("template %q must have as many folder levels as target_template", cc.template())
+	}
+	for _, match := range templateVarPattern.FindAllStringSubmatch(cc.TrackTemplate, -1) {
+		if _, ok := trackVars[match[1]]; !ok {
+			return fmt.Errorf("track_template: unknown variable {%s}", match[1])
+		}
+	}
+	clean := filepath.Clean(filepath.FromSlash(cc.TrackTemplate))
+	if cc.TrackTemplate != "" && (filepath.IsAbs(clean) || clean == "." || strings.HasPrefix(clean, "..")) {
+		return fmt.Errorf("track_template must name a file inside the album")
+	}
+	return nil
+}
+
+func (cc *CompilationConfig) template() string {
+	if cc.Template != "" {
+		return cc.Template
+	}
+	return "Compilations/{album}"
+}
+
+// Reports whether the album with the tags in meta is a compilation: tagged
+// COMPILATION=1, or with an album artist that marks one. False if meta is
+// nil.
+func isCompilation(meta *flacMetadata) bool {
+	if meta == nil {
+		return false
+	}
+	if compilation := meta.tag("COMPILATION"); compilation == "1" || strings.EqualFold(compilation, "true") {
+		return true
+	}
+	if meta.tag("MUSICBRAINZ_ALBUMARTISTID") == variousArtistsMBID {
+		return true
+	}
+	artists := defaultCompilationArtists
+	if cc := settings.Compilations; cc != nil && len(cc.Artists) > 0 {
+		artists = cc.Artists
+	}
+	albumArtist := meta.tag("ALBUMARTIST")
+	for _, artist := range artists {
+		if strings.EqualFold(albumArtist, artist) {
+			return true
+		}
+	}
+	return false
+}
+
+// The target_template for the album with the tags in meta: the compilations
+// template for a compilation, if compilations is set.
+func albumTemplate(meta *flacMetadata) string {
+	if cc := settings.Compilations; cc != nil && isCompilation(meta) {
+		return cc.template()
+	}
+	return settings.TargetTemplate
+}
+
+// Variables available in track_template, each computed from the tags of the
+// track's FLAC file and its name in the source.
+var trackVars = map[string]func(meta *flacMetadata, name string) string{
+	// Zero-padded to two digits, e.g. "03".
+	"tracknumber": func(meta *flacMetadata, name string) string {
+		return fmt.Sprintf("%02d", leadingInt(meta.tag("TRACKNUMBER"), 0))
+	},
+	"discnumber": func(meta *flacMetadata, name string) string {
+		return fmt.Sprint(leadingInt(meta.tag("DISCNUMBER"), 1))
+	},
+	"artist": func(meta *flacMetadata, name string) string {
+		return resolveArtist(tagOr(meta, "ARTIST", "Unknown Artist"), tagOr(meta, "MUSICBRAINZ_ARTISTID", ""))
+	},
+	// The file's own name, less the extension, if it has no TITLE tag.
+	"title": func(meta *flacMetadata, name string) string {
+		return tagOr(meta, "TITLE", strings.TrimSuffix(name, filepath.Ext(name)))
+	},
+	"album": func(meta *flacMetadata, name string) string {
+		return tagOr(meta, "ALBUM", "")
+	},
+}
+
+// The part of the Linker.MapPath for album that names its FLAC files by
+// track_template, if it's a compilation, or nil if they keep their names.
+func compilationTrackMapper(album Album) func(string) string {
+	cc := settings.Compilations
+	if settings.TargetTemplate == "" || cc == nil || cc.TrackTemplate == "" || !isCompilation(albumMetadata(album)) {
+		return nil
+	}
+	return func(relPath string) string {
+		if !strings.EqualFold(filepath.Ext(relPath), ".flac") {
+			return relPath
+		}
+		meta, err := readFlacMetadata(filepath.Join(album.Path, relPath))
+		if err != nil {
+			return relPath
+		}
+		name := templateVarPattern.ReplaceAllStringFunc(cc.TrackTemplate, func(match string) string {
+			return templateValue(trackVars[match[1:len(match)-1]](meta, filepath.Base(relPath)))
+		})
+		return filepath.Join(filepath.Dir(relPath), filepath.FromSlash(templateParts(name))+filepath.Ext(relPath))
+	}
+}
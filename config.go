@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultIntervalMinutes = 15
+
+// Settings read from the flaclink config file,
+// $XDG_CONFIG_HOME/flaclink/config.json by default.
+type Config struct {
+	SourceDir string `json:"source_dir"`
+	// More source dirs, all linked into the one target dir, e.g. one per
+	// download category. See sources.go.
+	SourceDirs      []string `json:"source_dirs"`
+	TargetDir       string   `json:"target_dir"`
+	IntervalMinutes int      `json:"interval_minutes"`
+	// Seconds the daemon spends checking album sources after each cycle, as
+	// "flaclink check-source" does. Off if zero.
+	SourceCheckSeconds int `json:"source_check_seconds"`
+	// Checking the target's files against their checksums after each
+	// daemon cycle, as "flaclink scrub" does. See scrub.go.
+	Scrub *ScrubConfig `json:"scrub"`
+
+	// Address for the daemon's HTTP endpoints, e.g. "127.0.0.1:8686". Off if empty.
+	HTTPListen string `json:"http_listen"`
+	// Web dashboard served by the daemon. See dashboard.go.
+	Dashboard *DashboardConfig `json:"dashboard"`
+
+	// Glob patterns (as in filepath.Match) for names of files inside an album
+	// that should not be linked, e.g. "*.nfo".
+	ExcludeFiles []string `json:"exclude_files"`
+	// Which non-audio files to link, by extension, and folders inside
+	// albums to leave out. See filefilter.go.
+	FileFilter *FileFilterConfig `json:"file_filter"`
+	// Name patterns of hidden or system folders to scan anyway, e.g.
+	// ".sync". See hidden.go.
+	IncludeHiddenDirs []string `json:"include_hidden_dirs"`
+	// Seconds an album's files must go unchanged before it's linked, so
+	// albums still being written are left for a later run. Off if zero.
+	StableSeconds int `json:"stable_seconds"`
+	// Albums with fewer FLAC files, or fewer bytes of them, are skipped, e.g.
+	// stray single tracks. Off if zero.
+	MinTracks int   `json:"min_tracks"`
+	MinSize   int64 `json:"min_size"`
+	// Bytes to keep free on the target's filesystem: albums that would take
+	// it below this aren't linked. See space.go.
+	MinFreeSpace int64 `json:"min_free_space"`
+	// Name patterns of directories in the source dir to scan, and to leave
+	// alone, e.g. "*.incomplete". See dirfilter.go.
+	IncludeDirs []string `json:"include_dirs"`
+	ExcludeDirs []string `json:"exclude_dirs"`
+	// Directories of the source dirs and target scanned at once. Defaults
+	// to 8. See parallelscan.go.
+	ScanWorkers int `json:"scan_workers"`
+	// Caps on filesystem operations and bandwidth. See throttle.go.
+	Throttle *ThrottleConfig `json:"throttle"`
+
+	PostProcess []PostProcessCommand `json:"post_process"`
+
+	// Path prefixes to rewrite in paths a torrent client reports, for
+	// clients that see downloads at other paths, e.g. in another container.
+	// See container.go.
+	PathMappings []PathMapping `json:"path_mappings"`
+
+	// Layout of linked albums under the target dir, e.g.
+	// "{artist_initial}/{albumartist_sort}/{album}". See template.go for the
+	// variables. Empty means albums keep their source directory names.
+	TargetTemplate string `json:"target_template"`
+	// Naming of compilations, such as "Various Artists" albums, under
+	// target_template. See compilations.go.
+	Compilations *CompilationConfig `json:"compilations"`
+	// Articles moved to the end of {albumartist_sort}. Defaults to The, A and
+	// An; an empty list sorts names as they are.
+	SortArticles *[]string `json:"sort_articles"`
+	// Artist names to use in templates instead of the tagged ones, keyed by
+	// tagged name or MusicBrainz artist ID.
+	ArtistAliases map[string]string `json:"artist_aliases"`
+	// Drop guest credits from artist names, and reuse existing target
+	// folders whose names differ only in case, accents or punctuation.
+	ReconcileArtists bool `json:"reconcile_artists"`
+	// Permissions for directories created in the target. See targetdirs.go.
+	TargetDirs *TargetDirsConfig `json:"target_dirs"`
+
+	Plex     *PlexConfig     `json:"plex"`
+	Jellyfin *JellyfinConfig `json:"jellyfin"`
+	Subsonic *SubsonicConfig `json:"subsonic"`
+	MPD      *MPDConfig      `json:"mpd"`
+
+	Hooks *HooksConfig `json:"hooks"`
+	Feed  *FeedConfig  `json:"feed"`
+
+	Notifications []NotifyConfig `json:"notifications"`
+
+	LogFile *LogFileConfig `json:"log_file"`
+
+	// Queue new albums for "flaclink review" instead of linking them.
+	Review bool `json:"review"`
+	// Decode FLAC files before linking, quarantining albums with corrupt
+	// audio. See flacdecode.go.
+	VerifyAudio bool `json:"verify_audio"`
+	// What to do about albums that conflict with what's in the target, when
+	// there's no one to ask. See conflicts.go.
+	Conflicts *ConflictConfig `json:"conflicts"`
+	// Analyze FLAC files for signs of lossy transcodes. See transcodes.go.
+	TranscodeCheck *TranscodeCheckConfig `json:"transcode_check"`
+	// Split FLAC images with a CUE sheet into a file per track instead of
+	// linking them. See cue.go.
+	SplitCueImages bool `json:"split_cue_images"`
+	// How to lay out the discs of multi-disc albums in the target: "merge"
+	// or "folders", or empty to mirror the source. See discs.go.
+	DiscLayout string `json:"disc_layout"`
+	// Make directory and file names in the target safe for Windows
+	// filesystems and Samba shares. See sanitize.go.
+	SanitizeNames *SanitizeNamesConfig `json:"sanitize_names"`
+	// How files are linked into the target: "hardlink", the default, or
+	// "symlink". See linkmode.go.
+	LinkMode string `json:"link_mode"`
+	// Extract embedded cover art for albums without folder art, and scale
+	// down big scans. See coverart.go.
+	CoverArt *CoverArtConfig `json:"cover_art"`
+	// Remove albums from the target and the DB once their source is deleted,
+	// rather than keeping the target as the permanent copy. See gc.go.
+	SyncDeletes bool `json:"sync_deletes"`
+
+	// Processing stages to skip, e.g. "validate" or "notify". See pipeline.go.
+	DisabledStages []string `json:"disabled_stages"`
+
+	// Keep the album DB in the target dir, so it moves with the library.
+	// See portable.go.
+	PortableDb bool `json:"portable_db"`
+	// Keep the album catalog in a SQLite database at this path instead of
+	// the bolt database. See sqlite.go.
+	SQLitePath string `json:"sqlite_path"`
+
+	// Subfolders of the target that albums go in by their tags, format or
+	// folder name, e.g. "Classical". See routes.go.
+	Routes []RouteRule `json:"routes"`
+	// Named targets that albums are routed to instead of the target dir,
+	// e.g. one for hi-res albums. See profiles.go.
+	Profiles []ProfileConfig `json:"profiles"`
+
+	// The profile being linked, set by forProfile.
+	profile string
+}
+
+// Settings for the current run, loaded from ConfigPath at startup if it
+// exists. The daemon replaces them between cycles when its config is reloaded.
+var settings = Config{IntervalMinutes: defaultIntervalMinutes}
+
+// Read and validate the JSON config file at path, filling in defaults for
+// optional settings. Settings in the environment override the file's, and
+// the file can be missing if there are any. See container.go.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !(os.IsNotExist(err) && hasEnvConfig()) {
+		return cfg, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := applyEnvConfig(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.SourceDir != "" {
+		cfg.SourceDir = filepath.Clean(cfg.SourceDir)
+	}
+	if cfg.TargetDir != "" {
+		cfg.TargetDir = filepath.Clean(cfg.TargetDir)
+	}
+	if cfg.IntervalMinutes <= 0 {
+		cfg.IntervalMinutes = defaultIntervalMinutes
+	}
+	if err := validateTemplate(cfg.TargetTemplate); err != nil {
+		return cfg, fmt.Errorf("%s: target_template: %v", path, err)
+	}
+	if cfg.Compilations != nil {
+		if err := cfg.Compilations.validate(cfg.TargetTemplate); err != nil {
+			return cfg, fmt.Errorf("%s: compilations: %v", path, err)
+		}
+	}
+	for _, pattern := range cfg.ExcludeFiles {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return cfg, fmt.Errorf("%s: exclude_files: %q: %v", path, pattern, err)
+		}
+	}
+	if cfg.FileFilter != nil {
+		if err := cfg.FileFilter.validate(); err != nil {
+			return cfg, fmt.Errorf("%s: file_filter: %v", path, err)
+		}
+	}
+	for _, pattern := range cfg.IncludeHiddenDirs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return cfg, fmt.Errorf("%s: include_hidden_dirs: %q: %v", path, pattern, err)
+		}
+	}
+	if err := validateDirPatterns(cfg.IncludeDirs); err != nil {
+		return cfg, fmt.Errorf("%s: include_dirs: %v", path, err)
+	}
+	if err := validateDirPatterns(cfg.ExcludeDirs); err != nil {
+		return cfg, fmt.Errorf("%s: exclude_dirs: %v", path, err)
+	}
+	if cfg.Scrub != nil {
+		if err := cfg.Scrub.validate(); err != nil {
+			return cfg, fmt.Errorf("%s: scrub: %v", path, err)
+		}
+	}
+	if cfg.Conflicts != nil {
+		if err := cfg.Conflicts.validate(); err != nil {
+			return cfg, fmt.Errorf("%s: conflicts: %v", path, err)
+		}
+	}
+	if cfg.Throttle != nil {
+		if err := cfg.Throttle.validate(); err != nil {
+			return cfg, fmt.Errorf("%s: throttle: %v", path, err)
+		}
+	}
+	if cfg.TargetDirs != nil {
+		if err := cfg.TargetDirs.validate(); err != nil {
+			return cfg, fmt.Errorf("%s: target_dirs: %v", path, err)
+		}
+	}
+	if cfg.TranscodeCheck != nil {
+		if err := cfg.TranscodeCheck.validate(); err != nil {
+			return cfg, fmt.Errorf("%s: transcode_check: %v", path, err)
+		}
+	}
+	if cfg.CoverArt != nil {
+		if err := cfg.CoverArt.validate(); err != nil {
+			return cfg, fmt.Errorf("%s: cover_art: %v", path, err)
+		}
+	}
+	if cfg.SanitizeNames != nil {
+		if err := cfg.SanitizeNames.validate(); err != nil {
+			return cfg, fmt.Errorf("%s: sanitize_names: %v", path, err)
+		}
+	}
+	if cfg.Dashboard != nil {
+		if err := cfg.Dashboard.validate(); err != nil {
+			return cfg, fmt.Errorf("%s: dashboard: %v", path, err)
+		}
+	}
+	if cfg.PortableDb && cfg.TargetDir == "" {
+		return cfg, fmt.Errorf("%s: portable_db: target_dir isn't set", path)
+	}
+	if err := validateLinkMode(cfg.LinkMode); err != nil {
+		return cfg, fmt.Errorf("%s: link_mode: %v", path, err)
+	}
+	if err := validateDiscLayout(cfg.DiscLayout); err != nil {
+		return cfg, fmt.Errorf("%s: disc_layout: %v", path, err)
+	}
+	if err := validatePathMappings(cfg.PathMappings); err != nil {
+		return cfg, fmt.Errorf("%s: path_mappings: %v", path, err)
+	}
+	if err := validateDisabledStages(cfg.DisabledStages); err != nil {
+		return cfg, fmt.Errorf("%s: disabled_stages: %v", path, err)
+	}
+	if err := validateRoutes(cfg.Routes); err != nil {
+		return cfg, fmt.Errorf("%s: routes: %v", path, err)
+	}
+	if err := validateProfiles(cfg.Profiles, cfg); err != nil {
+		return cfg, fmt.Errorf("%s: profiles: %v", path, err)
+	}
+	for _, nc := range cfg.Notifications {
+		if notifyTypes[nc.Type] == nil {
+			return cfg, fmt.Errorf("%s: notifications: unknown type %q", path, nc.Type)
+		}
+	}
+	return cfg, nil
+}
+
+// Time to wait between the end of one scan and the start of the next.
+func (cfg Config) interval() time.Duration {
+	return time.Duration(cfg.IntervalMinutes) * time.Minute
+}
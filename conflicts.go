@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Some albums can't just be linked as they are, because of what's in the
+// target already:
+//
+//   - a name conflict: the album's name in the target is taken by
+//     something else
+//   - a duplicate: an album with the same files was linked from another
+//     source folder, which is still there
+//   - an edition conflict: an album whose name only differs in bracketed
+//     parts, such as "(Deluxe Edition)", is in the same folder
+//
+// Each is settled by a choice: skip the album for now, rename it, replace
+// what's in the target with it, or keep both. The choice comes from the
+// answers file given with -answers, if an entry there matches; otherwise,
+// in a run from a terminal, from asking; otherwise from the policy under
+// conflicts in the config file. The default policies do what flaclink
+// always did: quarantine albums whose name is taken, skip duplicates and
+// link other editions alongside. Editions can be settled by policy without
+// asking, too; see editions.go.
+
+// Kinds of conflict.
+const (
+	conflictName      = "name"
+	conflictDuplicate = "duplicate"
+	conflictEdition   = "edition"
+)
+
+// Ways to settle a conflict. Rename needs a name, so it can only come from
+// asking or the answers file, and quarantine only from a policy or the
+// answers file. Best only settles editions.
+const (
+	choiceSkip       = "skip"
+	choiceRename     = "rename"
+	choiceReplace    = "replace"
+	choiceKeepBoth   = "keep-both"
+	choiceBest       = "best"
+	choiceQuarantine = "quarantine"
+)
+
+// Policy for editions that asks even when a policy is set, and quarantines
+// without a terminal.
+const policyPrompt = "prompt"
+
+// The choices that make sense for each kind of conflict. A duplicate has the
+// same files as what it conflicts with, so there's nothing to rename or keep.
+var conflictChoices = map[string][]string{
+	conflictName:      {choiceSkip, choiceRename, choiceReplace, choiceKeepBoth, choiceQuarantine},
+	conflictDuplicate: {choiceSkip, choiceReplace},
+	conflictEdition:   {choiceSkip, choiceRename, choiceReplace, choiceKeepBoth, choiceBest, choiceQuarantine},
+}
+
+// Whether choice can settle a conflict of kind.
+func choiceFits(kind, choice string) bool {
+	for _, c := range conflictChoices[kind] {
+		if c == choice {
+			return true
+		}
+	}
+	return false
+}
+
+// What to do about each kind of conflict when there's no answer for it and
+// no one to ask.
+type ConflictConfig struct {
+	// Defaults to quarantine.
+	Name string `json:"name"`
+	// Defaults to skip.
+	Duplicate string `json:"duplicate"`
+	// Defaults to keep-both. Unlike the others, it's used without asking
+	// when set, unless it's prompt.
+	Edition string `json:"edition"`
+}
+
+func (cc *ConflictConfig) validate() error {
+	for kind, policy := range map[string]string{conflictName: cc.Name, conflictDuplicate: cc.Duplicate, conflictEdition: cc.Edition} {
+		if policy == "" {
+			continue
+		}
+		valid := false
+		for _, c := range policyChoices(kind) {
+			valid = valid || c == policy
+		}
+		if !valid {
+			return fmt.Errorf("%s: %q isn't one of %s", kind, policy, strings.Join(policyChoices(kind), ", "))
+		}
+	}
+	return nil
+}
+
+// The choices a policy for kind can make.
+func policyChoices(kind string) (choices []string) {
+	for _, c := range conflictChoices[kind] {
+		if c != choiceRename {
+			choices = append(choices, c)
+		}
+	}
+	if kind == conflictEdition {
+		choices = append(choices, policyPrompt)
+	}
+	return choices
+}
+
+// The policy for kind as configured, or "" if it isn't.
+func configuredPolicy(kind string) string {
+	if cc := settings.Conflicts; cc != nil {
+		return map[string]string{conflictName: cc.Name, conflictDuplicate: cc.Duplicate, conflictEdition: cc.Edition}[kind]
+	}
+	return ""
+}
+
+// The choice for kind when no one can be asked.
+func conflictPolicy(kind string) string {
+	switch policy := configuredPolicy(kind); policy {
+	case policyPrompt:
+		// Leave it for someone to decide.
+		return choiceQuarantine
+	case "":
+		return map[string]string{conflictName: choiceQuarantine, conflictDuplicate: choiceSkip, conflictEdition: choiceKeepBoth}[kind]
+	default:
+		return policy
+	}
+}
+
+// Whether to ask about a conflict of kind from a terminal, rather than use
+// the policy: always, except for editions with a policy other than prompt.
+func asksAbout(kind string) bool {
+	policy := configuredPolicy(kind)
+	return kind != conflictEdition || policy == "" || policy == policyPrompt
+}
+
+// A choice for conflicts of albums from matching sources, from the answers
+// file.
+type ConflictAnswer struct {
+	// Pattern, as in filepath.Match, for the absolute path of the album in
+	// the source. "*" doesn't match "/", so "*" alone matches nothing but
+	// top-level dirs; use a full pattern such as "/data/torrents/*".
+	Source string `json:"source"`
+	// Kind of conflict the choice is for. Any kind if empty.
+	Conflict string `json:"conflict"`
+	Choice   string `json:"choice"`
+	// Name in the target for rename.
+	Name string `json:"name"`
+}
+
+// Set by -answers and -no-prompt.
+var (
+	answersFile string
+	noPrompt    bool
+)
+
+// Whether conflicts are asked about, and the answers from the answers file.
+// Set up by setupConflicts.
+var (
+	promptConflicts bool
+	conflictAnswers []ConflictAnswer
+)
+
+func registerConflictFlags(flags *flag.FlagSet) {
+	flags.StringVar(&answersFile, "answers", "", "JSON file of choices for albums that conflict with what's in the target")
+	flags.BoolVar(&noPrompt, "no-prompt", false, "don't ask about conflicts on a terminal; use the answers file and conflicts policies")
+}
+
+// Read the answers file, if -answers was given, and ask about conflicts
+// from here on if prompt is set, -no-prompt isn't, and stdin and stderr are
+// terminals. Both, since stdin is /dev/null under cron, which looks like one.
+func setupConflicts(prompt bool) {
+	promptConflicts = prompt && !noPrompt && stdinIsTerminal() && stderrIsTerminal()
+	if answersFile == "" {
+		return
+	}
+	answers, err := loadConflictAnswers(answersFile)
+	if err != nil {
+		fatalf("answers: %v", err)
+	}
+	conflictAnswers = answers
+}
+
+func loadConflictAnswers(path string) ([]ConflictAnswer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var answers []ConflictAnswer
+	if err := json.Unmarshal(data, &answers); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, answer := range answers {
+		if _, err := filepath.Match(answer.Source, ""); err != nil || answer.Source == "" {
+			return nil, fmt.Errorf("%s: entry %d: source %q isn't a path pattern", path, i+1, answer.Source)
+		}
+		kinds := []string{answer.Conflict}
+		if answer.Conflict == "" {
+			kinds = []string{conflictName, conflictEdition}
+		} else if _, ok := conflictChoices[answer.Conflict]; !ok {
+			return nil, fmt.Errorf("%s: entry %d: unknown conflict %q", path, i+1, answer.Conflict)
+		}
+		for _, kind := range kinds {
+			if !choiceFits(kind, answer.Choice) {
+				return nil, fmt.Errorf("%s: entry %d: %q isn't a choice for a %s conflict", path, i+1, answer.Choice, kind)
+			}
+		}
+		if answer.Choice == choiceRename {
+			name, err := checkTargetName(answer.Name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: entry %d: %v", path, i+1, err)
+			}
+			answers[i].Name = name
+		}
+	}
+	return answers, nil
+}
+
+// name, given by hand, cleaned up and sanitized as a name in the target, or
+// an error if it isn't a name inside the target dir.
+func checkTargetName(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if name == "" || filepath.IsAbs(clean) || suspiciousName(clean) != "" {
+		return "", fmt.Errorf("%q must be a name inside the target dir", name)
+	}
+	return sanitizePath(clean), nil
+}
+
+// How to settle a conflict of kind over the album in job, described by
+// detail: the first matching entry of the answers file, or else the user's
+// answer, or else the policy. name is the new name for rename. Duplicates
+// only match answers file entries for duplicates, so that an entry for
+// every conflict can't replace albums by mistake.
+func resolveConflict(job *albumJob, kind, detail string) (choice, name string) {
+	source, _ := filepath.Abs(job.Album.Path)
+	for _, answer := range conflictAnswers {
+		if answer.Conflict != kind && (answer.Conflict != "" || kind == conflictDuplicate) {
+			continue
+		}
+		if matched, _ := filepath.Match(answer.Source, source); matched {
+			return answer.Choice, answer.Name
+		}
+	}
+	if promptConflicts && asksAbout(kind) {
+		if choice, name, ok := askConflict(job, kind, detail); ok {
+			return choice, name
+		}
+		// No one is there to answer the rest.
+		promptConflicts = false
+	}
+	return conflictPolicy(kind), ""
+}
+
+// Reads answers from stdin. Shared so input typed ahead isn't lost between
+// questions.
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// Ask on the terminal how to settle a conflict. ok is false if stdin is
+// closed.
+func askConflict(job *albumJob, kind, detail string) (choice, name string, ok bool) {
+	resume := pauseProgress()
+	defer resume()
+
+	keys := map[string]string{"s": choiceSkip, "n": choiceRename, "r": choiceReplace, "k": choiceKeepBoth, "b": choiceBest}
+	labels := map[string]string{
+		choiceSkip:     "s  skip it for now",
+		choiceRename:   "n  rename it",
+		choiceReplace:  "r  replace what's in the target with it, moving that to the trash",
+		choiceKeepBoth: "k  keep both",
+		choiceBest:     "b  keep whichever is better by bit depth and sample rate",
+	}
+	fmt.Fprintf(os.Stderr, "Album %s (from %s): %s.\n", job.Album.DirName, job.Album.Path, detail)
+	var offered []string
+	for _, c := range conflictChoices[kind] {
+		if label, ok := labels[c]; ok {
+			fmt.Fprintf(os.Stderr, "  %s\n", label)
+			offered = append(offered, label[:1])
+		}
+	}
+	for {
+		fmt.Fprintf(os.Stderr, "Choice [%s]: ", strings.Join(offered, "/"))
+		line, err := readAnswer()
+		if err != nil {
+			return "", "", false
+		}
+		choice := keys[line]
+		if choice == "" && choiceFits(kind, line) && line != choiceQuarantine {
+			choice = line
+		}
+		if choice == "" || !choiceFits(kind, choice) {
+			continue
+		}
+		if choice != choiceRename {
+			return choice, "", true
+		}
+		for {
+			fmt.Fprint(os.Stderr, "New name in the target: ")
+			line, err := readAnswer()
+			if err != nil {
+				return "", "", false
+			}
+			if name, err := checkTargetName(line); err == nil {
+				return choice, name, true
+			}
+			fmt.Fprintf(os.Stderr, "%q must be a name inside the target dir; slashes make subfolders.\n", line)
+		}
+	}
+}
+
+// A line from stdin, trimmed.
+func readAnswer() (string, error) {
+	line, err := stdinReader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// Settle the conflict, if the album in job's name is taken in the target,
+// before it's linked. Returns false if it shouldn't be linked, having
+// reported why.
+func settleNameConflict(job *albumJob) (bool, error) {
+	for {
+		path := albumTargetPath(job.Album, job.TargetDir)
+		if _, err := os.Lstat(path); err != nil {
+			return true, nil
+		}
+		choice, name := resolveConflict(job, conflictName, "its name is taken in the target")
+		switch choice {
+		case choiceSkip:
+			log.Printf("Skipping album %s for now, its name is taken in the target.", job.Album.DirName)
+			emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "name taken in the target"})
+			return false, nil
+		case choiceQuarantine:
+			// Not this album, or the DB would have had it since the run began.
+			err := fmt.Errorf("%s is taken in the target by something else", job.Album.DirName)
+			countError(job.Album.DirName, err)
+			return false, quarantineAlbum(job, "name taken in the target")
+		case choiceRename:
+			if name == job.Album.DirName {
+				// An answer that can't settle it; keep both instead.
+				job.Album.DirName = keepBothName(job.Album.DirName, job.TargetDir)
+			} else {
+				job.Album.DirName = name
+			}
+		case choiceKeepBoth:
+			job.Album.DirName = keepBothName(job.Album.DirName, job.TargetDir)
+		case choiceReplace:
+			if err := replaceInTarget(path, job.Album.DirName, job.TargetDir, job.DB); err != nil {
+				countError(job.Album.DirName, fmt.Errorf("can't replace %s: %v", path, err))
+				return false, nil
+			}
+		}
+	}
+}
+
+// The first of "dirName (2)", "dirName (3)" and so on that's free in
+// targetDir.
+func keepBothName(dirName, targetDir string) string {
+	for n := 2; ; n++ {
+		name := dirName + " (" + strconv.Itoa(n) + ")"
+		if _, err := os.Lstat(albumTargetPath(Album{DirName: name}, targetDir)); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+// Settle the conflict, if the album in job has the same files as an album
+// linked from another source folder that's still there. Returns true if the
+// album should be linked. Only looks when something other than the default
+// policy could come of it.
+func settleDuplicate(job *albumJob) bool {
+	if !promptConflicts && len(conflictAnswers) == 0 && conflictPolicy(conflictDuplicate) == choiceSkip {
+		return false
+	}
+	store := albumStore(job.DB)
+	record, ok := store.Record(job.Album)
+	source, _ := filepath.Abs(job.Album.Path)
+	if !ok || record.Source == "" || record.Target == "" || record.Source == source {
+		return false
+	}
+	if _, err := os.Stat(record.Source); err != nil {
+		// Moved rather than copied.
+		return false
+	}
+	choice, _ := resolveConflict(job, conflictDuplicate, fmt.Sprintf("the same album was linked from %s to %s", record.Source, record.DirName))
+	if choice != choiceReplace {
+		return false
+	}
+	if err := removeAlbum(job.Album, record, store, job.DB); err != nil {
+		countError(job.Album.DirName, fmt.Errorf("can't replace %s: %v", record.Target, err))
+		return false
+	}
+	return true
+}
+
+// Move what's at path in the target, the album dirName if flaclink knows it
+// or anything else, to the trash, forgetting the album. An album linked by
+// flaclink is left as it is if it holds anything flaclink didn't put there,
+// as by gc.
+func replaceInTarget(path, dirName, targetDir string, db *bolt.DB) error {
+	store := albumStore(db)
+	album, record, ok := recordedAlbum(store, dirName)
+	if ok && record.Target != "" {
+		return removeAlbum(album, record, store, db)
+	}
+	if err := moveToTrash(path, absTargetDir(targetDir)); err != nil {
+		return err
+	}
+	if ok {
+		return store.Remove(album)
+	}
+	return nil
+}
+
+// Stops store.ForEach in recordedAlbum.
+var errFoundAlbum = errors.New("found the album")
+
+// The album recorded in store under dirName, if there is one.
+func recordedAlbum(store flaclink.Store, dirName string) (album Album, record flaclink.AlbumRecord, ok bool) {
+	store.ForEach(func(contents []string, name string) error {
+		if name == dirName {
+			album = Album{DirName: name, Contents: contents}
+			ok = true
+			return errFoundAlbum
+		}
+		return nil
+	})
+	if !ok {
+		return album, record, false
+	}
+	record, _ = store.Record(album)
+	return album, record, true
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Running flaclink in a container, e.g. Docker. Everything can be set from
+// the environment:
+//
+//   - Each config file setting from FLACLINK_ and its key in upper case, e.g.
+//     FLACLINK_TARGET_DIR, overriding the config file, which can then be left
+//     out. Lists and objects are given as JSON; lists of strings can also be
+//     given comma-separated.
+//   - FLACLINK_DATA_DIR and FLACLINK_CONFIG, where the app data and the config
+//     file are, e.g. on a /config volume.
+//   - PUID and PGID, the user and group that flaclink runs as, so the files
+//     it creates belong to them rather than root.
+//
+// "flaclink entrypoint" then runs the daemon, after checking the mounts.
+
+// Prefix of environment variables holding config settings.
+const envConfigPrefix = "FLACLINK_"
+
+// Environment variables naming the app data dir and config file.
+const (
+	dataDirEnv = "FLACLINK_DATA_DIR"
+	configEnv  = "FLACLINK_CONFIG"
+)
+
+// A path prefix rewritten in paths reported by a torrent client that sees
+// downloads at other paths than flaclink does, e.g. /downloads in the
+// client's container and /data/downloads in flaclink's.
+type PathMapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func validatePathMappings(mappings []PathMapping) error {
+	for _, m := range mappings {
+		if m.From == "" || m.To == "" {
+			return fmt.Errorf("mapping %q to %q: from and to are both required", m.From, m.To)
+		}
+	}
+	return nil
+}
+
+// path with the longest matching path_mappings prefix rewritten, or as it is
+// if none matches. Prefixes match whole path elements, and slashes and
+// backslashes alike, so a Windows client's paths can be mapped too.
+func mapReportedPath(path string) string {
+	slashed := strings.ReplaceAll(path, `\`, "/")
+	found := false
+	var to, rest string
+	for _, m := range settings.PathMappings {
+		from := strings.TrimRight(strings.ReplaceAll(m.From, `\`, "/"), "/")
+		if slashed != from && !strings.HasPrefix(slashed, from+"/") {
+			continue
+		}
+		if !found || len(slashed)-len(from) < len(rest) {
+			found, to, rest = true, m.To, slashed[len(from):]
+		}
+	}
+	if !found {
+		return path
+	}
+	return filepath.Join(to, filepath.FromSlash(rest))
+}
+
+// The environment variable for the config setting with the given JSON key.
+func configEnvName(key string) string {
+	return envConfigPrefix + strings.ToUpper(key)
+}
+
+// Reports whether any config setting is set in the environment.
+func hasEnvConfig() bool {
+	found := false
+	applyConfigFields(&Config{}, func(key string, _ reflect.Value) {
+		if _, ok := os.LookupEnv(configEnvName(key)); ok {
+			found = true
+		}
+	})
+	return found
+}
+
+// Call fn with the JSON key and field of each setting in cfg.
+func applyConfigFields(cfg *Config, fn func(key string, field reflect.Value)) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" || !t.Field(i).IsExported() {
+			continue
+		}
+		fn(key, v.Field(i))
+	}
+}
+
+// Override settings in cfg with those set in the environment.
+func applyEnvConfig(cfg *Config) error {
+	var err error
+	applyConfigFields(cfg, func(key string, field reflect.Value) {
+		value, ok := os.LookupEnv(configEnvName(key))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := setConfigField(field, value); setErr != nil {
+			err = fmt.Errorf("%s: %v", configEnvName(key), setErr)
+		}
+	})
+	return err
+}
+
+// Set field from its value in the environment: strings as they are,
+// numbers and booleans parsed, and anything else as JSON.
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+		return nil
+	case reflect.Slice:
+		trimmed := strings.TrimSpace(value)
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(trimmed, "[") {
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+			return nil
+		}
+	}
+	return json.Unmarshal([]byte(value), field.Addr().Interface())
+}
+
+// Run as the user and group in PUID and PGID, if they're set and flaclink
+// was started as root, as container images conventionally do. Called before
+// anything is created, so the app data and everything in the target belongs
+// to them. Linked files keep their owner, as they're the source files.
+func dropPrivileges() {
+	puid, pgid := os.Getenv("PUID"), os.Getenv("PGID")
+	if puid == "" && pgid == "" {
+		return
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	var err error
+	if puid != "" {
+		if uid, err = strconv.Atoi(puid); err != nil || uid < 0 {
+			fatalf("PUID: %q isn't a user ID", puid)
+		}
+	}
+	if pgid != "" {
+		if gid, err = strconv.Atoi(pgid); err != nil || gid < 0 {
+			fatalf("PGID: %q isn't a group ID", pgid)
+		}
+	}
+	if uid == os.Getuid() && gid == os.Getgid() {
+		return
+	}
+	if os.Getuid() != 0 {
+		log.Printf("Warning: not running as root, so can't switch to PUID %d and PGID %d; running as uid %d, gid %d.", uid, gid, os.Getuid(), os.Getgid())
+		return
+	}
+	if err := setIDs(uid, gid); err != nil {
+		fatalf("switching to PUID %d and PGID %d: %v", uid, gid, err)
+	}
+	log.Printf("Running as uid %d, gid %d.", uid, gid)
+}
+
+// Run the daemon as a container's long-running process. Before starting
+// it, check that the source and target dirs are mounted, and that files can
+// be hardlinked from one to the other: two volumes count as different
+// filesystems even when they're on the same disk, so each source should be
+// mounted under the same volume as the target.
+func runEntrypoint(args []string) {
+	cfg, err := loadDaemonConfig(ConfigPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fatalf("entrypoint: no config file at %s and no %s settings in the environment; set at least %s and %s", ConfigPath, envConfigPrefix, configEnvName("source_dir"), configEnvName("target_dir"))
+		}
+		fatalf("entrypoint: %v", err)
+	}
+	targets := []string{cfg.TargetDir}
+	for _, p := range cfg.Profiles {
+		targets = append(targets, p.TargetDir)
+	}
+	targets = uniqueDirs(targets)
+	for _, dir := range append(cfg.sourceDirs(), targets...) {
+		if _, err := os.Stat(dir); err != nil {
+			fatalf("entrypoint: %v; is its volume mounted?", err)
+		}
+	}
+	if cfg.LinkMode != linkModeSymlink {
+		for _, source := range cfg.sourceDirs() {
+			for _, target := range targets {
+				if err := checkHardlinks(source, target); err != nil {
+					log.Printf("Warning: can't hardlink from %s to %s: %v. Mount both under one volume, or set link_mode to symlink.", source, target, err)
+				}
+			}
+		}
+	}
+	log.Printf("Starting the daemon with sources %s and target %s.", strings.Join(cfg.sourceDirs(), ", "), strings.Join(targets, ", "))
+	runDaemon(args)
+}
+
+var errFoundFile = errors.New("found a file")
+
+// Try hardlinking a file from source into target's staging dir, then remove
+// the link. Returns nil if it worked, or if source has no files to try.
+func checkHardlinks(source, target string) error {
+	var sample string
+	filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			sample = path
+			return errFoundFile
+		}
+		return nil
+	})
+	if sample == "" {
+		return nil
+	}
+	dir := filepath.Join(target, stagingDirName)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	probe := filepath.Join(dir, "linkcheck")
+	os.Remove(probe)
+	if err := os.Link(sample, probe); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			return fmt.Errorf("they're on different filesystems or volumes")
+		}
+		return err
+	}
+	err := os.Remove(probe)
+	removeStagingDir(target)
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The daemon's control socket speaks a one-line text protocol: the client
+// sends a command ("scan", "status" or "recent") followed by a newline, and
+// the daemon writes a plain text reply and closes the connection. "flaclink
+// import" also sends "import", the album path and the target dir, separated
+// by tabs, and the daemon replies once it has linked the album.
+
+// Path of the daemon's control socket.
+func controlSocketPath() string {
+	return libraryPath("sock")
+}
+
+// Listen on the control socket and serve commands in the background. Scan
+// and import requests are passed to the daemon's loop on scanRequests and
+// importRequests, which answers on the enclosed reply channels. Exits if
+// another daemon is already listening.
+func listenControl(state *daemonState, scanRequests chan<- chan string, importRequests chan<- importRequest) net.Listener {
+	socketPath := controlSocketPath()
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		fatalf("daemon: another flaclink daemon is already running (%s)", socketPath)
+	}
+	// Left behind by a daemon that didn't exit cleanly.
+	os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		fatalf("daemon: %v", err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		fatalf("daemon: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveControl(conn, state, scanRequests, importRequests)
+		}
+	}()
+	return listener
+}
+
+// Answer a single command on conn.
+func serveControl(conn net.Conn, state *daemonState, scanRequests chan<- chan string, importRequests chan<- importRequest) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	if fields := strings.Split(strings.TrimRight(line, "\r\n"), "\t"); fields[0] == "import" && len(fields) == 3 {
+		// The import waits for any running cycle, and then to be linked.
+		conn.SetDeadline(time.Time{})
+		reply := make(chan Run, 1)
+		importRequests <- importRequest{AlbumPath: fields[1], TargetDir: fields[2], Reply: reply}
+		run := <-reply
+		fmt.Fprintf(conn, "linked %d, %d errors, %d warnings\n", run.Linked, len(run.Errors), len(run.Warnings))
+		return
+	}
+
+	switch command := strings.TrimSpace(line); command {
+	case "scan":
+		reply := make(chan string, 1)
+		scanRequests <- reply
+		fmt.Fprintln(conn, <-reply)
+	case "status":
+		state.writeStatus(conn)
+	case "recent":
+		state.writeRecent(conn)
+	default:
+		fmt.Fprintf(conn, "Unknown command %q.\n", command)
+	}
+}
+
+func (s *daemonState) writeStatus(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "flaclink daemon running since %s (pid %d).\n", s.started.Format(time.RFC1123), os.Getpid())
+	if s.scanning {
+		fmt.Fprintf(w, "Scanning since %s.\n", s.lastStart.Format(time.RFC1123))
+	} else if !s.nextScan.IsZero() {
+		fmt.Fprintf(w, "Idle, next scan at %s.\n", s.nextScan.Format(time.RFC1123))
+	}
+	if !s.lastEnd.IsZero() {
+		fmt.Fprintf(w, "Last scan finished at %s.\n", s.lastEnd.Format(time.RFC1123))
+	}
+	fmt.Fprintf(w, "%d albums linked recently.\n", len(s.recent))
+}
+
+func (s *daemonState) writeRecent(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recent) == 0 {
+		fmt.Fprintln(w, "No albums linked since the daemon started.")
+		return
+	}
+	for i := len(s.recent) - 1; i >= 0; i-- {
+		fmt.Fprintf(w, "%s  %s\n", s.recent[i].Time.Format("2006-01-02 15:04:05"), s.recent[i].DirName)
+	}
+}
+
+// Send a command to the running daemon and print its reply.
+func runCtl(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: flaclink ctl <scan|status|recent>")
+		os.Exit(2)
+	}
+	conn, err := net.Dial("unix", controlSocketPath())
+	if err != nil {
+		fmt.Println("flaclink daemon is not running.")
+		os.Exit(1)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, args[0])
+	io.Copy(os.Stdout, conn)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Fetching cover art from the Cover Art Archive, https://coverartarchive.org,
+// for albums with neither folder nor embedded art. The archive serves the
+// front cover of each MusicBrainz release, which taggers such as Picard
+// record in the MUSICBRAINZ_ALBUMID tag.
+
+// Where the archive is. A variable so it can point at a mirror.
+var coverArtArchiveURL = "https://coverartarchive.org"
+
+var coverArtClient = &http.Client{Timeout: 30 * time.Second}
+
+// Cover art bigger than this is refused, in case the response is something
+// else entirely.
+const maxFetchedArtBytes = 50 << 20
+
+// What MusicBrainz IDs look like.
+var mbidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// The URL of the front cover of the MusicBrainz release with this ID, at
+// size pixels, or the original if size is zero.
+func coverArtArchiveFront(mbid string, size int) string {
+	front := "front"
+	if size > 0 {
+		front = fmt.Sprintf("front-%d", size)
+	}
+	return strings.TrimRight(coverArtArchiveURL, "/") + "/release/" + url.PathEscape(mbid) + "/" + front
+}
+
+// Fetch the front cover of album's MusicBrainz release from the archive and
+// write it to path, as writeCoverArt would. Returns the URL it was fetched
+// from, or "" if the album has no release ID or the archive has no art for
+// it. Failures are logged rather than returned, so missing art never keeps
+// an album from being linked.
+func fetchCoverArt(ctx context.Context, album Album, path string, ca *CoverArtConfig) string {
+	meta := albumMetadata(album)
+	if meta == nil {
+		return ""
+	}
+	mbid := strings.TrimSpace(meta.tag("MUSICBRAINZ_ALBUMID"))
+	if mbid == "" {
+		return ""
+	}
+	if !mbidPattern.MatchString(mbid) {
+		log.Printf("Not fetching cover art for album %s: %q isn't a MusicBrainz release ID.", album.DirName, mbid)
+		return ""
+	}
+
+	artURL := coverArtArchiveFront(mbid, ca.FetchSize)
+	data, mime, err := getCoverArt(ctx, artURL)
+	if err != nil {
+		log.Printf("Can't fetch cover art for album %s: %v", album.DirName, err)
+		return ""
+	}
+	if data == nil {
+		log.Printf("The Cover Art Archive has no front cover for album %s.", album.DirName)
+		return ""
+	}
+	if err := writeCoverArt(path, data, mimeFormat(mime), ca.MaxDimension, false); err != nil {
+		log.Printf("Can't save cover art fetched for album %s: %v", album.DirName, err)
+		return ""
+	}
+	log.Printf("Fetched cover art for album %s from %s.", album.DirName, artURL)
+	return artURL
+}
+
+// GET the image at artURL, following the archive's redirects to where it's
+// stored. Returns its data and MIME type, or nil data if there's none.
+func getCoverArt(ctx context.Context, artURL string) (data []byte, mime string, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", artURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "flaclink (https://github.com/kylegentle/flaclink)")
+	resp, err := coverArtClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: %s", artURL, resp.Status)
+	}
+	data, err = ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxFetchedArtBytes))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", artURL, err)
+	}
+	mime = strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]))
+	if mimeFormat(mime) == "" {
+		mime = http.DetectContentType(data)
+	}
+	return data, mime, nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Folder-level cover art in the target. Media servers pick up a cover.jpg
+// next to the tracks much more reliably than art embedded in them, so
+// albums with only embedded art get the front cover extracted into the
+// target. Oversized scans can be scaled down on the way, leaving the source
+// untouched.
+
+// File name extracted art is written to unless cover_art says otherwise.
+const defaultCoverArtName = "cover.jpg"
+
+// JPEG quality art is written with when it has to be encoded.
+const coverArtQuality = 90
+
+// The FLAC picture type of a front cover. Pictures of other types, such as
+// the back cover or the artist, are only used if there's no front cover.
+const flacPictureFrontCover = 3
+
+// Extracting and scaling cover art. With no cover_art in the config file,
+// albums' art is linked as it is.
+type CoverArtConfig struct {
+	// Name of the file embedded art is extracted to, which decides its
+	// format: .jpg, .jpeg or .png. Defaults to cover.jpg.
+	Name string `json:"name"`
+	// Art wider or taller than this many pixels is scaled down to fit when
+	// it's written. Off if zero.
+	MaxDimension int `json:"max_dimension"`
+	// Folder art files bigger than this many bytes are written to the target
+	// scaled down to max_dimension instead of being linked. Off if zero.
+	DownscaleOver int64 `json:"downscale_over"`
+	// Fetch art from the Cover Art Archive for albums with neither folder
+	// nor embedded art, by their MusicBrainz release ID. See
+	// coverarchive.go.
+	Fetch bool `json:"fetch"`
+	// Size of the fetched art: 250, 500 or 1200 pixels, or 0 for the
+	// archive's original.
+	FetchSize int `json:"fetch_size"`
+}
+
+func (ca *CoverArtConfig) validate() error {
+	if ca.Name != "" {
+		if strings.ContainsRune(ca.Name, filepath.Separator) {
+			return fmt.Errorf("name %q isn't a file name", ca.Name)
+		}
+		if coverArtFormat(ca.Name) == "" {
+			return fmt.Errorf("name %q should end in .jpg, .jpeg or .png", ca.Name)
+		}
+	}
+	if ca.MaxDimension < 0 || ca.DownscaleOver < 0 {
+		return fmt.Errorf("max_dimension and downscale_over can't be negative")
+	}
+	if ca.DownscaleOver > 0 && ca.MaxDimension == 0 {
+		return fmt.Errorf("downscale_over needs max_dimension")
+	}
+	switch ca.FetchSize {
+	case 0, 250, 500, 1200:
+	default:
+		return fmt.Errorf("fetch_size should be 250, 500, 1200 or 0, not %d", ca.FetchSize)
+	}
+	return nil
+}
+
+// The image format for an art file name, "jpeg" or "png", or "" if it's
+// neither.
+func coverArtFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".png":
+		return "png"
+	}
+	return ""
+}
+
+// A PICTURE metadata block of a FLAC file.
+type flacPicture struct {
+	Type int
+	MIME string
+	Data []byte
+}
+
+// Read the pictures embedded in the FLAC file at path.
+func readFlacPictures(path string) ([]flacPicture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "fLaC" {
+		return nil, errNotFlac
+	}
+
+	var pictures []flacPicture
+	for last := false; !last; {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return pictures, fmt.Errorf("%s: metadata block header: %v", path, err)
+		}
+		last = header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		if blockType != flacBlockPicture {
+			if _, err := r.Discard(length); err != nil {
+				return pictures, fmt.Errorf("%s: metadata block %d: %v", path, blockType, err)
+			}
+			continue
+		}
+		block := make([]byte, length)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return pictures, fmt.Errorf("%s: metadata block %d: %v", path, blockType, err)
+		}
+		picture, err := parseFlacPicture(block)
+		if err != nil {
+			return pictures, fmt.Errorf("%s: %v", path, err)
+		}
+		pictures = append(pictures, picture)
+	}
+	return pictures, nil
+}
+
+// Parse a PICTURE block: the picture type, MIME type and description, each
+// string preceded by its length, then the width, height, color depth and
+// palette size, and the picture data with its length.
+func parseFlacPicture(block []byte) (flacPicture, error) {
+	var picture flacPicture
+	errShort := errors.New("PICTURE block truncated")
+	next := func() ([]byte, error) {
+		if len(block) < 4 {
+			return nil, errShort
+		}
+		n := binary.BigEndian.Uint32(block)
+		block = block[4:]
+		if uint32(len(block)) < n {
+			return nil, errShort
+		}
+		field := block[:n]
+		block = block[n:]
+		return field, nil
+	}
+
+	if len(block) < 4 {
+		return picture, errShort
+	}
+	picture.Type = int(binary.BigEndian.Uint32(block))
+	block = block[4:]
+	mime, err := next()
+	if err != nil {
+		return picture, err
+	}
+	picture.MIME = strings.ToLower(string(mime))
+	if _, err := next(); err != nil { // description
+		return picture, err
+	}
+	if len(block) < 16 {
+		return picture, errShort
+	}
+	block = block[16:]
+	if picture.Data, err = next(); err != nil {
+		return picture, err
+	}
+	return picture, nil
+}
+
+// The album's front cover embedded in its FLAC files, or the first picture
+// of any other type if none has one. ok is false if there's no embedded art
+// to extract. A MIME type of "-->" marks a URL rather than a picture, which
+// isn't used.
+func embeddedCoverArt(album Album) (picture flacPicture, ok bool) {
+	for _, path := range albumFlacFiles(album.Path) {
+		pictures, err := readFlacPictures(path)
+		if err != nil {
+			log.Printf("Can't read pictures from %s: %v", path, err)
+		}
+		for _, p := range pictures {
+			if p.MIME == "-->" || len(p.Data) == 0 {
+				continue
+			}
+			if p.Type == flacPictureFrontCover {
+				return p, true
+			}
+			if !ok {
+				picture, ok = p, true
+			}
+		}
+	}
+	return picture, ok
+}
+
+// The format of image data with this MIME type, as coverArtFormat.
+func mimeFormat(mime string) string {
+	switch mime {
+	case "image/jpeg", "image/jpg":
+		return "jpeg"
+	case "image/png":
+		return "png"
+	}
+	return ""
+}
+
+// Write the image in data, of the given format, to path in the format its
+// name calls for, scaled down to fit maxDimension if it's bigger and
+// maxDimension isn't zero. Data that needs neither converting nor scaling
+// is written as it is, unless reencode is set.
+func writeCoverArt(path string, data []byte, format string, maxDimension int, reencode bool) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tooBig := maxDimension > 0 && (config.Width > maxDimension || config.Height > maxDimension)
+	want := coverArtFormat(path)
+	if !tooBig && !reencode && format == want {
+		return ioutil.WriteFile(path, data, 0664)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if tooBig {
+		img = scaleImage(img, maxDimension)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0664)
+	if err != nil {
+		return err
+	}
+	if want == "png" {
+		err = png.Encode(f, img)
+	} else {
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: coverArtQuality})
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Scale img down so that neither side is longer than maxDimension, keeping
+// its proportions, averaging the pixels each new pixel covers.
+func scaleImage(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := maxDimension, maxDimension
+	if srcW > srcH {
+		dstH = srcH * maxDimension / srcW
+	} else {
+		dstW = srcW * maxDimension / srcH
+	}
+	if dstW == 0 {
+		dstW = 1
+	}
+	if dstH == 0 {
+		dstH = 1
+	}
+	src := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, (y+1)*srcH/dstH
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, (x+1)*srcW/dstW
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			pixel := dst.Pix[y*dst.Stride+x*4:]
+			for c := range sum {
+				pixel[c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// The linker ignore func and added files for the album's cover art under
+// cover_art: the embedded front cover written to the target if the album has
+// no folder art, or with fetch, art from the Cover Art Archive if it has no
+// embedded art either, or its folder art scaled down if that's bigger than
+// downscale_over. The URL of fetched art is set in extras. add is nil if
+// there's nothing to do.
+func coverArtFiles(album Album, ignore func(string, bool) bool, extras *linkExtras) (func(string, bool) bool, func(context.Context, string) error) {
+	ca := settings.CoverArt
+	if ca == nil {
+		return ignore, nil
+	}
+	existing := coverArt(album.Path)
+	if existing == "" {
+		return ignore, func(ctx context.Context, dir string) error {
+			name := ca.Name
+			if name == "" {
+				name = defaultCoverArtName
+			}
+			picture, ok := embeddedCoverArt(album)
+			if !ok {
+				if ca.Fetch {
+					extras.FetchedArt = fetchCoverArt(ctx, album, filepath.Join(dir, name), ca)
+				}
+				return nil
+			}
+			if err := writeCoverArt(filepath.Join(dir, name), picture.Data, mimeFormat(picture.MIME), ca.MaxDimension, false); err != nil {
+				log.Printf("Can't extract cover art for album %s: %v", album.DirName, err)
+				return nil
+			}
+			log.Printf("Extracted embedded cover art for album %s to %s.", album.DirName, name)
+			return nil
+		}
+	}
+
+	sourcePath := filepath.Join(album.Path, existing)
+	info, err := os.Stat(sourcePath)
+	if ca.DownscaleOver == 0 || err != nil || info.Size() <= ca.DownscaleOver {
+		return ignore, nil
+	}
+	ignoring := func(path string, isDir bool) bool {
+		return path == sourcePath || ignore(path, isDir)
+	}
+	return ignoring, func(ctx context.Context, dir string) error {
+		targetPath := filepath.Join(dir, existing)
+		data, err := ioutil.ReadFile(sourcePath)
+		if err == nil {
+			err = writeCoverArt(targetPath, data, coverArtFormat(existing), ca.MaxDimension, true)
+		}
+		if err != nil {
+			log.Printf("Can't scale down cover art %s, linking it instead: %v", sourcePath, err)
+			return linkFile(sourcePath, targetPath)
+		}
+		log.Printf("Scaled down cover art %s of album %s.", existing, album.DirName)
+		return nil
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Albums shipped as one FLAC image of a whole disc with a CUE sheet listing
+// its tracks, rather than a file per track. They're linked like any other
+// album, image and all, and recorded as images. With split_cue_images, the
+// image is instead decoded and split into a FLAC file per track in the
+// target, since many players and media servers can't play a track out of
+// an image. The split tracks take space of their own, unlike hardlinks.
+
+// A parsed CUE sheet. Only what splitting needs is kept.
+type cueSheet struct {
+	Title     string
+	Performer string
+	// From REM DATE and REM GENRE.
+	Date  string
+	Genre string
+	Files []cueFile
+}
+
+// A FILE entry of a CUE sheet and its tracks.
+type cueFile struct {
+	Name   string
+	Tracks []cueTrack
+}
+
+type cueTrack struct {
+	Number    int
+	Title     string
+	Performer string
+	// INDEX 01, where the track starts, in CD frames of 1/75 second from
+	// the start of the file.
+	Start int64
+}
+
+// Parse a CUE sheet. Sheets that aren't UTF-8 are taken to be Latin-1, as
+// most older ripping software wrote them.
+func parseCueSheet(data []byte) (*cueSheet, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		data = []byte(string(runes))
+	}
+
+	sheet := &cueSheet{}
+	var file *cueFile
+	var track *cueTrack
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := cueFields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		arg := func(i int) string {
+			if i < len(fields) {
+				return fields[i]
+			}
+			return ""
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "REM":
+			switch strings.ToUpper(arg(1)) {
+			case "DATE":
+				sheet.Date = arg(2)
+			case "GENRE":
+				sheet.Genre = arg(2)
+			}
+		case "TITLE", "PERFORMER":
+			title, performer := &sheet.Title, &sheet.Performer
+			if track != nil {
+				title, performer = &track.Title, &track.Performer
+			}
+			if strings.EqualFold(fields[0], "TITLE") {
+				*title = arg(1)
+			} else {
+				*performer = arg(1)
+			}
+		case "FILE":
+			sheet.Files = append(sheet.Files, cueFile{Name: arg(1)})
+			file, track = &sheet.Files[len(sheet.Files)-1], nil
+		case "TRACK":
+			if file == nil {
+				return nil, fmt.Errorf("line %d: TRACK before FILE", line)
+			}
+			number, err := strconv.Atoi(arg(1))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad track number %q", line, arg(1))
+			}
+			file.Tracks = append(file.Tracks, cueTrack{Number: number, Start: -1})
+			track = &file.Tracks[len(file.Tracks)-1]
+		case "INDEX":
+			if track == nil || arg(1) != "01" {
+				continue
+			}
+			start, err := parseCueTime(arg(2))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			track.Start = start
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, f := range sheet.Files {
+		for _, t := range f.Tracks {
+			if t.Start < 0 {
+				return nil, fmt.Errorf("track %d has no INDEX 01", t.Number)
+			}
+		}
+	}
+	return sheet, nil
+}
+
+// Split a CUE sheet line into words, keeping quoted strings together.
+func cueFields(line string) []string {
+	var fields []string
+	line = strings.TrimSpace(line)
+	for line != "" {
+		var field string
+		if line[0] == '"' {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				field, line = line[1:], ""
+			} else {
+				field, line = line[1:end+1], line[end+2:]
+			}
+		} else if end := strings.IndexAny(line, " \t"); end >= 0 {
+			field, line = line[:end], line[end:]
+		} else {
+			field, line = line, ""
+		}
+		fields = append(fields, field)
+		line = strings.TrimLeft(line, " \t")
+	}
+	return fields
+}
+
+// Parse a CUE sheet time, mm:ss:ff, into CD frames of 1/75 second.
+func parseCueTime(s string) (int64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	var n [3]int64
+	for i, part := range parts {
+		v, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("bad time %q", s)
+		}
+		n[i] = v
+	}
+	return (n[0]*60+n[1])*75 + n[2], nil
+}
+
+// Paths of the CUE sheets in an album directory and its subdirectories, in
+// sorted order.
+func albumCueSheets(albumPath string) []string {
+	var paths []string
+	filepath.Walk(albumPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".cue") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths
+}
+
+// A FLAC image of a whole disc and the CUE sheet describing its tracks.
+type cueImage struct {
+	CuePath   string
+	ImagePath string
+	Sheet     *cueSheet
+}
+
+// The FLAC images in album: files that a CUE sheet next to them lists as its
+// only FILE, with more than one track. Sheets often name the WAV file the
+// image was made from, so a FLAC file with the same base name counts too.
+func albumCueImages(album Album) []cueImage {
+	var images []cueImage
+	for _, cuePath := range albumCueSheets(album.Path) {
+		data, err := ioutil.ReadFile(cuePath)
+		if err != nil {
+			continue
+		}
+		sheet, err := parseCueSheet(data)
+		if err != nil || len(sheet.Files) != 1 || len(sheet.Files[0].Tracks) < 2 {
+			continue
+		}
+		name := filepath.Join(filepath.Dir(cuePath), filepath.FromSlash(strings.ReplaceAll(sheet.Files[0].Name, `\`, "/")))
+		for _, candidate := range []string{name, strings.TrimSuffix(name, filepath.Ext(name)) + ".flac"} {
+			if filepath.Ext(candidate) != ".flac" {
+				continue
+			}
+			if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+				images = append(images, cueImage{CuePath: cuePath, ImagePath: candidate, Sheet: sheet})
+				break
+			}
+		}
+	}
+	return images
+}
+
+// Number of tracks in album: those its CUE sheets list for each image, plus
+// its other FLAC files.
+func albumTrackCount(album Album) int {
+	count := len(albumFlacFiles(album.Path))
+	for _, image := range albumCueImages(album) {
+		count += len(image.Sheet.Files[0].Tracks) - 1
+	}
+	return count
+}
+
+// A Linker.Ignore that leaves out album's CUE images and their sheets, to
+// be split instead.
+func ignoringCueImages(images []cueImage, ignore func(path string, isDir bool) bool) func(path string, isDir bool) bool {
+	skip := make(map[string]bool)
+	for _, image := range images {
+		skip[image.ImagePath], skip[image.CuePath] = true, true
+	}
+	return func(path string, isDir bool) bool {
+		return skip[path] || ignore(path, isDir)
+	}
+}
+
+// Split each of album's images into a FLAC file per track, under dir, where
+// the album is being linked. Track paths are mapped by mapPath, if it's not
+// nil, like the linker maps the album's files. Returns the paths of the
+// tracks, relative to dir.
+func splitCueImages(ctx context.Context, album Album, images []cueImage, dir string, mapPath func(string) string) ([]string, error) {
+	var tracks []string
+	for _, image := range images {
+		rel, err := filepath.Rel(album.Path, filepath.Dir(image.ImagePath))
+		if err != nil {
+			return tracks, err
+		}
+		trackPath := func(name string) string {
+			path := filepath.Join(rel, name)
+			if mapPath != nil {
+				path = mapPath(path)
+			}
+			return path
+		}
+		names, err := splitCueImage(ctx, image, func(name string) string {
+			return filepath.Join(dir, trackPath(name))
+		})
+		for _, name := range names {
+			tracks = append(tracks, trackPath(name))
+		}
+		if err != nil {
+			return tracks, fmt.Errorf("splitting %s: %v", image.ImagePath, err)
+		}
+	}
+	return tracks, nil
+}
+
+// Decode image and write each of its tracks to a FLAC file of its own at
+// the path trackPath gives for its name, tagged from the image and the CUE
+// sheet. Returns the names of the files written. Audio before the first
+// track goes in the first.
+func splitCueImage(ctx context.Context, image cueImage, trackPath func(name string) string) (names []string, err error) {
+	f, err := os.Open(image.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(throttledReader{f}, 1<<16)
+	meta, err := readFlacMetadataBlocks(image.ImagePath, r)
+	if err != nil {
+		return nil, err
+	}
+	if meta.SampleRate == 0 || meta.Channels == 0 {
+		return nil, fmt.Errorf("STREAMINFO has no sample rate or channels")
+	}
+
+	tracks := image.Sheet.Files[0].Tracks
+	starts := make([]uint64, len(tracks))
+	for i, track := range tracks[1:] {
+		starts[i+1] = uint64(track.Start) * uint64(meta.SampleRate) / 75
+		if starts[i+1] <= starts[i] {
+			return nil, fmt.Errorf("track %d doesn't start after track %d", track.Number, tracks[i].Number)
+		}
+	}
+	if meta.TotalSamples > 0 && starts[len(starts)-1] >= meta.TotalSamples {
+		return nil, fmt.Errorf("the CUE sheet's last track starts after the end of the image")
+	}
+
+	d := &flacDecoder{br: &flacBitReader{r: r}, meta: meta, md5: md5.New()}
+	var enc *flacEncoder
+	defer func() {
+		if enc != nil {
+			enc.close()
+		}
+	}()
+	current := -1
+	var pos uint64
+	view := make([][]int64, meta.Channels)
+	for frame := 0; ; frame++ {
+		if err := ctx.Err(); err != nil {
+			return names, err
+		}
+		n, err := d.decodeFrame()
+		if err == io.EOF || err == errFlacSync && meta.TotalSamples > 0 && pos >= meta.TotalSamples {
+			break
+		}
+		if err != nil {
+			return names, fmt.Errorf("frame %d: %v", frame, err)
+		}
+		for i := 0; i < n; {
+			for current+1 < len(tracks) && pos+uint64(i) >= starts[current+1] {
+				if enc != nil {
+					err := enc.close()
+					enc = nil
+					if err != nil {
+						return names, err
+					}
+				}
+				current++
+				name := cueTrackFileName(tracks[current])
+				path := trackPath(name)
+				if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+					return names, err
+				}
+				enc, err = createFlac(path, meta, cueTrackComments(image.Sheet, current, meta))
+				if err != nil {
+					return names, err
+				}
+				names = append(names, name)
+			}
+			end := n
+			if current+1 < len(tracks) && starts[current+1] < pos+uint64(n) {
+				end = int(starts[current+1] - pos)
+			}
+			for ch := range view {
+				view[ch] = d.channels[ch][i:end]
+			}
+			if err := enc.write(view, end-i); err != nil {
+				return names, err
+			}
+			i = end
+		}
+		pos += uint64(n)
+	}
+	if current < len(tracks)-1 {
+		return names, fmt.Errorf("the image ends before track %d", tracks[current+1].Number)
+	}
+	if meta.MD5 != [16]byte{} {
+		var sum [16]byte
+		copy(sum[:], d.md5.Sum(nil))
+		if sum != meta.MD5 {
+			return names, fmt.Errorf("audio MD5 %x doesn't match STREAMINFO's %x", sum, meta.MD5)
+		}
+	}
+	err = enc.close()
+	enc = nil
+	return names, err
+}
+
+// File name for a track split from an image, e.g. "01 - Title.flac".
+func cueTrackFileName(track cueTrack) string {
+	title := strings.TrimSpace(strings.ReplaceAll(track.Title, "/", "-"))
+	if title == "" {
+		return fmt.Sprintf("%02d.flac", track.Number)
+	}
+	return fmt.Sprintf("%02d - %s.flac", track.Number, title)
+}
+
+// Tags that describe a whole image or its sheet, so aren't copied to the
+// tracks split from it.
+var imageOnlyTags = map[string]bool{
+	"TITLE":       true,
+	"TRACKNUMBER": true,
+	"TRACKTOTAL":  true,
+	"TOTALTRACKS": true,
+	"CUESHEET":    true,
+}
+
+// Vorbis comments for the i'th track of sheet: the image's own tags, except
+// for those about the image as a whole, and the track's title, number and
+// performer from the sheet. Album tags the image lacks are taken from the
+// sheet.
+func cueTrackComments(sheet *cueSheet, i int, meta *flacMetadata) []string {
+	tracks := sheet.Files[0].Tracks
+	track := tracks[i]
+	tags := map[string][]string{
+		"TITLE":       {track.Title},
+		"TRACKNUMBER": {strconv.Itoa(track.Number)},
+		"TRACKTOTAL":  {strconv.Itoa(len(tracks))},
+	}
+	for name, values := range meta.Tags {
+		if !imageOnlyTags[name] && !strings.HasPrefix(name, "CUE_TRACK") {
+			tags[name] = values
+		}
+	}
+	fallbacks := [][2]string{
+		{"ALBUM", sheet.Title},
+		{"ALBUMARTIST", sheet.Performer},
+		{"ARTIST", sheet.Performer},
+		{"DATE", sheet.Date},
+		{"GENRE", sheet.Genre},
+	}
+	for _, fallback := range fallbacks {
+		if len(tags[fallback[0]]) == 0 && fallback[1] != "" {
+			tags[fallback[0]] = []string{fallback[1]}
+		}
+	}
+	if track.Performer != "" {
+		tags["ARTIST"] = []string{track.Performer}
+	}
+
+	var comments []string
+	for name, values := range tags {
+		for _, value := range values {
+			if value != "" {
+				comments = append(comments, name+"="+value)
+			}
+		}
+	}
+	sort.Strings(comments)
+	return comments
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Number of recently linked albums the daemon remembers for "flaclink ctl recent".
+const maxRecentLinks = 50
+
+// An album linked by the daemon, as reported by "flaclink ctl recent".
+type linkRecord struct {
+	Time    time.Time
+	DirName string
+}
+
+// What the daemon is doing, shared between the scan loop and the control socket.
+type daemonState struct {
+	mu        sync.Mutex
+	started   time.Time
+	scanning  bool
+	lastStart time.Time
+	lastEnd   time.Time
+	nextScan  time.Time
+	recent    []linkRecord // oldest first
+	// Albums that weren't linked, oldest first, for the dashboard.
+	problems []Event
+	// The config of the current or last cycle. Cycles change the global
+	// settings as they go, so other goroutines use this instead.
+	cfg Config
+	// Set if the dashboard is served, which shows the albums pending as of
+	// the end of the last cycle; see pendingAlbums.
+	dashboard      bool
+	pending        []string
+	pendingCount   int
+	pendingCounted bool
+}
+
+// Run scan/link cycles forever, waiting the configured interval between the
+// end of one cycle and the start of the next. The album DB stays open for the
+// life of the daemon. SIGHUP reloads the config file, which takes effect from
+// the next cycle; SIGTERM and SIGINT stop the cycle, removing any partly
+// linked album from the target, and exit.
+// "flaclink import" hands its albums to the daemon, which links them between
+// cycles. The daemon also listens on a control socket (see control.go) and, if
+// configured, on HTTP (see httpserver.go) and for the dashboard (see
+// dashboard.go).
+func runDaemon(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := flags.String("config", ConfigPath, "path to the config file")
+	events := registerEventFlags(flags)
+	registerVerifyFlags(flags)
+	registerMinimumFlags(flags)
+	registerThrottleFlags(flags)
+	registerWaitLockFlag(flags)
+	logging := registerLogFlags(flags)
+	flags.Var(&activeShard, "shard", "only scan the k-th of n slices of the source and target dirs, as k/n")
+	registerHiddenFlag(flags)
+	registerDirFilterFlags(flags)
+	registerPermFlags(flags)
+	registerFullScanFlag(flags)
+	registerConflictFlags(flags)
+	flags.Parse(args)
+	logging.setup()
+	events.open()
+	setupConflicts(false)
+
+	cfg, err := loadDaemonConfig(*configPath)
+	if err != nil {
+		fatalf("daemon: %v", err)
+	}
+	if *configPath != ConfigPath {
+		useAlbumDb(cfg)
+	}
+
+	// Claim the control socket first, so a second daemon reports that one is
+	// already running rather than timing out on the DB lock.
+	state := &daemonState{started: time.Now(), cfg: cfg, dashboard: cfg.Dashboard != nil}
+	scanRequests := make(chan chan string)
+	importRequests := make(chan importRequest)
+	control := listenControl(state, scanRequests, importRequests)
+	defer control.Close()
+	if cfg.HTTPListen != "" {
+		httpListener := listenHTTP(cfg.HTTPListen, state, scanRequests)
+		defer httpListener.Close()
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+	retryRequests := make(chan retryRequest)
+	if cfg.Dashboard != nil {
+		eventListener = state.recordEvent
+		dashboard := listenDashboard(cfg.Dashboard, state, db, scanRequests, retryRequests)
+		defer dashboard.Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cycleDone := startCycle(ctx, cfg, db, state)
+	var nextCycle <-chan time.Time
+	var nextScan time.Time
+	// Imports handed over while a cycle was running, and whether the
+	// interval ran out during an import, so that the scan is due.
+	var imports []importRequest
+	scanDue := false
+	for {
+		select {
+		case <-cycleDone:
+			cycleDone = nil
+			if len(imports) > 0 {
+				cycleDone = startImport(ctx, cfg, db, state, imports[0])
+				imports = imports[1:]
+				continue
+			}
+			if scanDue {
+				scanDue = false
+				cycleDone = startCycle(ctx, cfg, db, state)
+				continue
+			}
+			if nextCycle != nil {
+				// An import ran between scans.
+				state.setNextScan(nextScan)
+				continue
+			}
+			nextCycle = time.After(cfg.interval())
+			nextScan = time.Now().Add(cfg.interval())
+			state.setNextScan(nextScan)
+			log.Printf("Next scan in %d minutes.", cfg.IntervalMinutes)
+		case <-nextCycle:
+			nextCycle = nil
+			if cycleDone != nil {
+				scanDue = true
+				continue
+			}
+			cycleDone = startCycle(ctx, cfg, db, state)
+		case request := <-importRequests:
+			if cycleDone != nil {
+				imports = append(imports, request)
+				continue
+			}
+			cycleDone = startImport(ctx, cfg, db, state, request)
+		case reply := <-scanRequests:
+			if cycleDone != nil {
+				reply <- "A scan is already running."
+				continue
+			}
+			nextCycle = nil
+			cycleDone = startCycle(ctx, cfg, db, state)
+			reply <- "Scan started."
+		case request := <-retryRequests:
+			if cycleDone != nil {
+				request.Reply <- "A scan is already running; try again once it's finished."
+				continue
+			}
+			nextCycle = nil
+			cycleDone = startRetry(ctx, cfg, db, state, request.Source)
+			request.Reply <- "Retry started."
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				newCfg, err := loadDaemonConfig(*configPath)
+				if err != nil {
+					log.Printf("daemon: keeping current config: %v", err)
+					continue
+				}
+				cfg = newCfg
+				log.Printf("Reloaded config from %s.", *configPath)
+				continue
+			}
+			log.Printf("Received %v, shutting down.", sig)
+			cancel()
+			if cycleDone != nil {
+				<-cycleDone
+			}
+			return
+		}
+	}
+}
+
+// Load the daemon's config file, which unlike other commands' must name the
+// source and target dirs.
+func loadDaemonConfig(path string) (Config, error) {
+	cfg, err := loadConfig(path)
+	if err == nil && (len(cfg.sourceDirs()) == 0 || (cfg.TargetDir == "" && len(cfg.Profiles) == 0)) {
+		err = fmt.Errorf("%s: source_dir or source_dirs, and target_dir or profiles, are required", path)
+	}
+	return cfg, err
+}
+
+// Run one scan/link cycle in the background with cfg as the current settings.
+// The returned channel is closed when the cycle finishes.
+func startCycle(ctx context.Context, cfg Config, db *bolt.DB, state *daemonState) <-chan struct{} {
+	settings = cfg
+	state.cycleStarted(cfg)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		slot := acquireSlot(1)
+		defer slot.Close()
+		start := time.Now()
+		linked, _ := linkProfiles(ctx, "daemon", cfg.sourceDirs(), cfg.TargetDir, db)
+		countScan(start)
+		if state.dashboard && ctx.Err() == nil {
+			state.setPending(pendingAlbums(db))
+		}
+		if cfg.SourceCheckSeconds > 0 && ctx.Err() == nil {
+			checkSources(db, time.Duration(cfg.SourceCheckSeconds)*time.Second)
+		}
+		if cfg.Scrub != nil && cfg.Scrub.Seconds > 0 && ctx.Err() == nil {
+			scrubAlbums(ctx, db, time.Duration(cfg.Scrub.Seconds)*time.Second, cfg.Scrub.IOLimit, false)
+		}
+		state.cycleFinished(linked)
+	}()
+	return done
+}
+
+func (s *daemonState) cycleStarted(cfg Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	s.scanning = true
+	s.lastStart = time.Now()
+	s.nextScan = time.Time{}
+}
+
+func (s *daemonState) cycleFinished(linked []Album) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scanning = false
+	s.lastEnd = time.Now()
+	for _, album := range linked {
+		s.recent = append(s.recent, linkRecord{Time: s.lastEnd, DirName: album.DirName})
+	}
+	if len(s.recent) > maxRecentLinks {
+		s.recent = s.recent[len(s.recent)-maxRecentLinks:]
+	}
+}
+
+// The config of the current or last cycle.
+func (s *daemonState) config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+func (s *daemonState) setNextScan(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextScan = next
+}
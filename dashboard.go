@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A web dashboard served by the daemon: what it's doing, recent imports and
+// runs, albums waiting to be linked, albums that weren't linked and why, and
+// library totals, with buttons to start a scan or retry an album. Unlike the
+// http_listen endpoints, it needs a token, given once as ?token= in the URL,
+// which sets a cookie, or as an "Authorization: Bearer" header.
+type DashboardConfig struct {
+	// Address to serve the dashboard on. Defaults to 127.0.0.1:8687, so it's
+	// only reachable from this machine.
+	Listen string `json:"listen"`
+	// Token to log in with. If empty, one is generated and kept in the
+	// dashboard-token file in the app data dir.
+	Token string `json:"token"`
+}
+
+const defaultDashboardListen = "127.0.0.1:8687"
+
+// Shortest token accepted in the config file.
+const minDashboardTokenLength = 16
+
+// Number of problems, runs and imports the dashboard shows, and of pending
+// albums it lists.
+const (
+	maxProblems         = 50
+	dashboardRuns       = 10
+	dashboardImports    = 20
+	dashboardPendingMax = 50
+)
+
+const dashboardCookie = "flaclink_token"
+
+func (dc *DashboardConfig) validate() error {
+	if dc.Token != "" && len(dc.Token) < minDashboardTokenLength {
+		return fmt.Errorf("token must be at least %d characters", minDashboardTokenLength)
+	}
+	if dc.Listen != "" {
+		if _, _, err := net.SplitHostPort(dc.Listen); err != nil {
+			return fmt.Errorf("listen: %v", err)
+		}
+	}
+	return nil
+}
+
+func (dc *DashboardConfig) listen() string {
+	if dc.Listen == "" {
+		return defaultDashboardListen
+	}
+	return dc.Listen
+}
+
+// The configured token, or the one in the app data dir, generated the first
+// time it's needed.
+func (dc *DashboardConfig) token() (string, error) {
+	if dc.Token != "" {
+		return dc.Token, nil
+	}
+	path := filepath.Join(AppDataPath, "dashboard-token")
+	if data, err := ioutil.ReadFile(path); err == nil && len(bytes.TrimSpace(data)) > 0 {
+		return string(bytes.TrimSpace(data)), nil
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Printf("Generated a dashboard token in %s.", path)
+	return token, nil
+}
+
+// A request from the dashboard to link the album at Source again now. The
+// daemon's loop answers on Reply.
+type retryRequest struct {
+	Source string
+	Reply  chan string
+}
+
+// Reasons albums are skipped that aren't problems: they're linked already,
+// or someone has decided or will decide about them.
+var routineSkipReasons = map[string]bool{
+	"already in DB":      true,
+	"awaiting review":    true,
+	"queued for review":  true,
+	"rejected in review": true,
+	"in quarantine":      true,
+	"cancelled":          true,
+}
+
+// Note an event that shows an album wasn't linked, and forget an album's
+// problems once it's linked. Set as the eventListener.
+func (s *daemonState) recordEvent(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case event.Event == "linked":
+		kept := s.problems[:0]
+		for _, problem := range s.problems {
+			if problem.Source != event.Source {
+				kept = append(kept, problem)
+			}
+		}
+		s.problems = kept
+	case event.Event == "error", event.Event == "skipped" && !routineSkipReasons[event.Reason]:
+		// Keep only the latest problem with each album.
+		for i, problem := range s.problems {
+			if event.Source != "" && problem.Source == event.Source {
+				s.problems = append(s.problems[:i], s.problems[i+1:]...)
+				break
+			}
+		}
+		s.problems = append(s.problems, event)
+		if len(s.problems) > maxProblems {
+			s.problems = s.problems[len(s.problems)-maxProblems:]
+		}
+	}
+}
+
+// Reports whether source is an album with a problem, which may be retried.
+func (s *daemonState) hasProblem(source string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, problem := range s.problems {
+		if problem.Source == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve the dashboard as dc says, in the background. Scans and retries are
+// passed to the daemon's loop, as with the control socket.
+func listenDashboard(dc *DashboardConfig, state *daemonState, db *bolt.DB, scanRequests chan<- chan string, retryRequests chan<- retryRequest) net.Listener {
+	token, err := dc.token()
+	if err != nil {
+		fatalf("dashboard: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		var page bytes.Buffer
+		if err := dashboardPage.Execute(&page, dashboardData(state, db, r.URL.Query().Get("message"))); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		page.WriteTo(w)
+	})
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST to start a scan", http.StatusMethodNotAllowed)
+			return
+		}
+		reply := make(chan string, 1)
+		scanRequests <- reply
+		redirectWithMessage(w, r, <-reply)
+	})
+	mux.HandleFunc("/retry", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST to retry an album", http.StatusMethodNotAllowed)
+			return
+		}
+		source := r.FormValue("source")
+		if !state.hasProblem(source) {
+			redirectWithMessage(w, r, "That album has no problem to retry.")
+			return
+		}
+		reply := make(chan string, 1)
+		retryRequests <- retryRequest{Source: source, Reply: reply}
+		redirectWithMessage(w, r, <-reply)
+	})
+
+	listener, err := net.Listen("tcp", dc.listen())
+	if err != nil {
+		fatalf("dashboard: %v", err)
+	}
+	log.Printf("Serving the dashboard at http://%s/.", listener.Addr())
+	go http.Serve(listener, requireToken(token, mux))
+	return listener
+}
+
+// Let through requests with token in the Authorization header, the cookie,
+// or the URL. A token in the URL is moved to the cookie, so it doesn't stay
+// in the address bar or the browser history. The cookie is SameSite, so
+// other sites can't press the dashboard's buttons.
+func requireToken(token string, next http.Handler) http.Handler {
+	matches := func(given string) bool {
+		return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if given := r.URL.Query().Get("token"); given != "" && matches(given) {
+			http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+			query := r.URL.Query()
+			query.Del("token")
+			target := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+			http.Redirect(w, r, target.String(), http.StatusSeeOther)
+			return
+		}
+		cookie, err := r.Cookie(dashboardCookie)
+		if matches(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) || err == nil && matches(cookie.Value) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "open the dashboard with ?token=<token>; see the dashboard section of the README", http.StatusUnauthorized)
+	})
+}
+
+// Go back to the dashboard, showing message at the top.
+func redirectWithMessage(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, "/?"+url.Values{"message": {message}}.Encode(), http.StatusSeeOther)
+}
+
+// Link the album at source again now, as a run of its own, into the target
+// of the profile it's routed to, if there are profiles. The daemon runs it
+// in place of a cycle.
+func retryAlbum(ctx context.Context, source string, db *bolt.DB) (linked []Album) {
+	base := settings
+	defer func() { settings = base }()
+	albums := albumScanner().FindAlbums(source)
+	if len(albums) == 0 {
+		log.Printf("Not retrying %s, which has no FLAC files any more.", source)
+		return nil
+	}
+	target := base.TargetDir
+	if len(base.Profiles) > 0 {
+		target = ""
+		name := routeProfile(albums[0])
+		for _, p := range base.Profiles {
+			if p.Name == name {
+				settings = base.forProfile(p)
+				target = settings.TargetDir
+			}
+		}
+		if target == "" {
+			log.Printf("Not retrying %s, which no profile matches.", source)
+			return nil
+		}
+	}
+	log.Printf("Retrying %s.", source)
+	beginRun("retry", source)
+	if targetHasFreeSpace(target) {
+		linked = linkNewAlbums(ctx, albumChan(albums), target, db, nil)
+	}
+	finishRun(linked, target, db)
+	return linked
+}
+
+// Like startCycle, but retrying one album.
+func startRetry(ctx context.Context, cfg Config, db *bolt.DB, state *daemonState, source string) <-chan struct{} {
+	settings = cfg
+	state.cycleStarted(cfg)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		slot := acquireSlot(1)
+		defer slot.Close()
+		linked := retryAlbum(ctx, source, db)
+		if state.dashboard && ctx.Err() == nil {
+			state.setPending(pendingAlbums(db))
+		}
+		state.cycleFinished(linked)
+	}()
+	return done
+}
+
+// What the dashboard shows.
+type dashboardView struct {
+	Message  string
+	Now      time.Time
+	Started  time.Time
+	Scanning bool
+	LastEnd  time.Time
+	NextScan time.Time
+	// Library totals from the DB.
+	Albums int
+	Size   string
+	// Albums in the source that the next run would look at, up to
+	// dashboardPendingMax of them, and how many there are in all, as of the
+	// end of the last cycle. PendingCounted is false until then.
+	Pending        []string
+	PendingCount   int
+	PendingCounted bool
+	Review         int
+	Problems       []Event // newest first
+	Runs           []Run   // newest first
+	Imports        []LinkOp
+}
+
+// Gather what the dashboard shows, from state and db. Cycles change the
+// global settings as they go, so this only uses state's copy of the config.
+func dashboardData(state *daemonState, db *bolt.DB, message string) dashboardView {
+	view := dashboardView{Message: message, Now: time.Now()}
+	state.mu.Lock()
+	view.Started = state.started
+	view.Scanning = state.scanning
+	view.LastEnd = state.lastEnd
+	view.NextScan = state.nextScan
+	for i := len(state.problems) - 1; i >= 0; i-- {
+		view.Problems = append(view.Problems, state.problems[i])
+	}
+	view.Pending, view.PendingCount, view.PendingCounted = state.pending, state.pendingCount, state.pendingCounted
+	state.mu.Unlock()
+
+	var bytes int64
+	if records, err := storeRecords(catalogStoresFor(db, state.config())); err == nil {
+		view.Albums = len(records)
+		for _, record := range records {
+			bytes += record.Bytes
+		}
+	}
+	view.Size = formatSize(bytes)
+	queue, _ := reviewQueue(db)
+	view.Review = len(queue)
+	view.Runs, view.Imports = recentActivity(db)
+	return view
+}
+
+// Paths of the albums in the source dirs that aren't in any catalog, were not
+// rejected and aren't awaiting review, up to dashboardPendingMax of them,
+// and how many there are. Folders come from the scan cache, so at the end of
+// a cycle, when it's fresh, next to nothing is read again.
+func pendingAlbums(db *bolt.DB) (paths []string, count int) {
+	stores := catalogStores(db)
+	queue, _ := reviewQueue(db)
+	queued := make(map[string]bool)
+	for _, q := range queue {
+		queued[q.Album.Path] = true
+	}
+	cache := loadScanCache(db)
+	defer cache.save(db)
+	for _, dir := range settings.sourceDirs() {
+		contentPaths, _, err := sourceContentPaths(dir, cache)
+		if err != nil {
+			continue
+		}
+		for _, contentPath := range contentPaths {
+		albums:
+			for _, album := range cache.findAlbums(dir, contentPath) {
+				for _, store := range stores {
+					if _, ok := store.Lookup(album); ok {
+						continue albums
+					}
+				}
+				if path, _ := filepath.Abs(album.Path); queued[path] || isRejected(album, db) {
+					continue
+				}
+				count++
+				if len(paths) < dashboardPendingMax {
+					paths = append(paths, album.Path)
+				}
+			}
+		}
+	}
+	return paths, count
+}
+
+// Note the albums pendingAlbums found, for the dashboard.
+func (s *daemonState) setPending(paths []string, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending, s.pendingCount, s.pendingCounted = paths, count, true
+}
+
+// The latest runs and albums linked, newest first.
+func recentActivity(db *bolt.DB) (runs []Run, imports []LinkOp) {
+	db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(runsBucketName); bucket != nil {
+			cursor := bucket.Cursor()
+			for k, v := cursor.Last(); k != nil && len(runs) < dashboardRuns; k, v = cursor.Prev() {
+				var run Run
+				if gob.NewDecoder(bytes.NewReader(v)).Decode(&run) == nil {
+					runs = append(runs, run)
+				}
+			}
+		}
+		if bucket := tx.Bucket(linksBucketName); bucket != nil {
+			cursor := bucket.Cursor()
+			for k, v := cursor.Last(); k != nil && len(imports) < dashboardImports; k, v = cursor.Prev() {
+				var op LinkOp
+				if gob.NewDecoder(bytes.NewReader(v)).Decode(&op) == nil {
+					imports = append(imports, op)
+				}
+			}
+		}
+		return nil
+	})
+	return runs, imports
+}
+
+var dashboardFuncs = template.FuncMap{
+	"when": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+	"size": formatSize,
+	"took": func(run Run) time.Duration {
+		return run.End.Sub(run.Start).Round(time.Millisecond)
+	},
+}
+
+var dashboardPage = template.Must(template.New("dashboard").Funcs(dashboardFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>flaclink</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; padding: 0.2em 0.8em 0.2em 0; vertical-align: top; }
+form { display: inline; }
+.message { background: #ffd; padding: 0.5em; }
+.error { color: #a00; }
+</style>
+</head>
+<body>
+<h1>flaclink</h1>
+{{if .Message}}<p class="message">{{.Message}}</p>
+{{end}}<p>Running since {{when .Started}}.
+{{if .Scanning}}Scanning now.{{else}}Last scan finished {{when .LastEnd}}{{if not .NextScan.IsZero}}, next at {{when .NextScan}}{{end}}.{{end}}
+<form action="/scan" method="post"><button type="submit">Scan now</button></form></p>
+<p>{{.Albums}} albums in the library, {{.Size}}.</p>
+
+<h2>Pending</h2>
+{{if .PendingCounted}}<p>{{.PendingCount}} albums not linked yet{{if .Review}}, and {{.Review}} awaiting review{{end}}, as of the last scan.</p>
+{{else}}<p>Albums not linked yet are counted at the end of the first scan.{{if .Review}} {{.Review}} are awaiting review.{{end}}</p>
+{{end}}
+{{if .Pending}}<ul>
+{{range .Pending}}<li>{{.}}</li>
+{{end}}</ul>
+{{if gt .PendingCount (len .Pending)}}<p>The first {{len .Pending}} of {{.PendingCount}}.</p>{{end}}
+{{end}}
+<h2>Problems</h2>
+{{if .Problems}}<table>
+<tr><th>Time</th><th>Album</th><th>Problem</th><th></th></tr>
+{{range .Problems}}<tr><td>{{when .Time}}</td><td>{{.Album}}</td><td class="error">{{.Reason}}{{.Error}}</td>
+<td>{{if .Source}}<form action="/retry" method="post"><input type="hidden" name="source" value="{{.Source}}"><button type="submit">Retry</button></form>{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>None since the daemon started.</p>
+{{end}}
+<h2>Recent imports</h2>
+{{if .Imports}}<table>
+<tr><th>Time</th><th>Album</th><th>Files</th><th>Size</th></tr>
+{{range .Imports}}<tr><td>{{when .Time}}</td><td>{{.Album}}</td><td>{{.Files}}</td><td>{{size .Bytes}}</td></tr>
+{{end}}</table>
+{{else}}<p>No albums linked yet.</p>
+{{end}}
+<h2>Recent runs</h2>
+{{if .Runs}}<table>
+<tr><th>Started</th><th>Command</th><th>Linked</th><th>Skipped</th><th>Took</th><th>Errors</th></tr>
+{{range .Runs}}<tr><td>{{when .Start}}</td><td>{{.Command}}</td><td>{{.Linked}}</td><td>{{.Skipped}}</td><td>{{took .}}</td>
+<td class="error">{{range .Errors}}{{.}}<br>{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>No runs yet.</p>
+{{end}}<p><small>As of {{when .Now}}.</small></p>
+</body>
+</html>
+`))
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Maintenance commands for the album database.
+func runDb(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: flaclink db merge <other albums.db>")
+		fmt.Println("       flaclink db migrate")
+		fmt.Println("       flaclink db export > albums.json")
+		fmt.Println("       flaclink db import <albums.json>")
+		fmt.Println("       flaclink db rebuild [-n] <source dir> <target dir>")
+		fmt.Println("       flaclink db remap [-n] -from <old prefix> -to <new prefix>")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "merge":
+		runDbMerge(args[1:])
+	case "migrate":
+		runDbMigrate()
+	case "export":
+		runDbExport(args[1:])
+	case "import":
+		runDbImport(args[1:])
+	case "rebuild":
+		runDbRebuild(args[1:])
+	case "remap":
+		runDbRemap(args[1:])
+	default:
+		fmt.Printf("Unknown db command %q.\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// Copy entries that are missing from the local database out of another
+// flaclink database, such as one from a machine that linked a different
+// -shard. Entries already in the local database are left as they are. A
+// database at an older schema is upgraded first, in a temporary copy, so its
+// albums are stored as the local ones are; one from a newer flaclink is
+// refused. Albums go in the local catalog, which may be SQLite, and those in
+// profile catalogs in the same profile's catalog.
+func runDbMerge(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: flaclink db merge <other albums.db>")
+		os.Exit(2)
+	}
+	path, cleanup := upgradedCopy(args[0])
+	defer cleanup()
+	other, err := bolt.Open(path, 0640, &bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	if err != nil {
+		fatalf("db merge: %s: %v", args[0], err)
+	}
+	defer other.Close()
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+
+	added := 0
+	for _, namespace := range append([]string{""}, profileNamespaces(other)...) {
+		from, to := flaclink.Store(flaclink.NewStore(other)), backingStore(db)
+		if namespace != "" {
+			from, to = flaclink.NewNamespacedStore(other, namespace), flaclink.NewNamespacedStore(db, namespace)
+		}
+		n, err := mergeCatalog(from, to)
+		added += n
+		if err != nil {
+			fatalf("db merge: %v", err)
+		}
+	}
+
+	err = other.View(func(otherTx *bolt.Tx) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{provenanceBucketName, sourceChecksBucketName, checksumsBucketName, runsBucketName, linksBucketName} {
+				otherBucket := otherTx.Bucket(name)
+				if otherBucket == nil {
+					continue
+				}
+				bucket, err := tx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				err = otherBucket.ForEach(func(k, v []byte) error {
+					if bucket.Get(k) != nil {
+						return nil
+					}
+					return bucket.Put(k, v)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		fatalf("db merge: %v", err)
+	}
+	log.Printf("Merged %d albums from %s.", added, args[0])
+}
+
+// The path of the album database at path, or if it's at an older schema, of
+// an upgraded copy of it, which cleanup removes. Exits if it's from a newer
+// flaclink.
+func upgradedCopy(path string) (upgraded string, cleanup func()) {
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	if err != nil {
+		fatalf("db merge: %s: %v", path, err)
+	}
+	defer db.Close()
+	version := schemaVersion(db)
+	switch {
+	case version > currentSchemaVersion():
+		fatalf("db merge: %s has schema version %d, but this flaclink only knows up to %d; upgrade flaclink", path, version, currentSchemaVersion())
+	case version == currentSchemaVersion():
+		return path, func() {}
+	}
+	dir, err := ioutil.TempDir("", "flaclink-merge")
+	if err != nil {
+		fatalf("db merge: %v", err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	upgraded = filepath.Join(dir, "albums.db")
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(upgraded, 0600)
+	})
+	if err == nil {
+		var copied *bolt.DB
+		if copied, err = bolt.Open(upgraded, 0600, &bolt.Options{Timeout: 100 * time.Millisecond}); err == nil {
+			err = upgradeSchema(copied, version)
+			copied.Close()
+		}
+	}
+	if err != nil {
+		cleanup()
+		fatalf("db merge: upgrading a copy of %s: %v", path, err)
+	}
+	return upgraded, cleanup
+}
+
+// Add the albums in from that aren't in to, with their records, or just
+// their names for albums that were found in the target. Returns the number
+// added.
+func mergeCatalog(from, to flaclink.Store) (int, error) {
+	var albums []Album
+	err := from.ForEach(func(contents []string, dirName string) error {
+		albums = append(albums, Album{DirName: dirName, Contents: contents})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, album := range albums {
+		if _, ok := to.Lookup(album); ok {
+			continue
+		}
+		record, ok := from.Record(album)
+		if ok && !record.Time.IsZero() {
+			err = to.SaveRecord(album, record)
+		} else {
+			err = to.Add(album)
+		}
+		if err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Version of the JSON written by "flaclink db export".
+const dbJSONVersion = 1
+
+// The album catalog as JSON, for backing up, inspecting, editing and moving
+// it between machines.
+type dbJSON struct {
+	Version int         `json:"version"`
+	Albums  []albumJSON `json:"albums"`
+}
+
+// An album record as JSON. Only contents and dir_name are required.
+type albumJSON struct {
+	Contents  []string   `json:"contents"`
+	DirName   string     `json:"dir_name"`
+	Source    string     `json:"source,omitempty"`
+	Target    string     `json:"target,omitempty"`
+	Container string     `json:"container,omitempty"`
+	Time      *time.Time `json:"time,omitempty"`
+	FileCount int        `json:"file_count,omitempty"`
+	Bytes     int64      `json:"bytes,omitempty"`
+	Format    string     `json:"format,omitempty"`
+	LinkMode  string     `json:"link_mode,omitempty"`
+	// Bit depth and sample rate in Hz.
+	BitsPerSample int        `json:"bits_per_sample,omitempty"`
+	SampleRate    int        `json:"sample_rate,omitempty"`
+	Edition       string     `json:"edition,omitempty"`
+	Warnings      []string   `json:"warnings,omitempty"`
+	CueSheets     []string   `json:"cue_sheets,omitempty"`
+	Images        []string   `json:"images,omitempty"`
+	SplitTracks   []string   `json:"split_tracks,omitempty"`
+	FetchedArt    string     `json:"fetched_art,omitempty"`
+	Files         []fileJSON `json:"files,omitempty"`
+}
+
+type fileJSON struct {
+	Path   string `json:"path"`
+	Linked bool   `json:"linked"`
+	Size   int64  `json:"size"`
+	Target string `json:"target,omitempty"`
+}
+
+// Write every album in the DB to stdout as JSON, sorted by dir name.
+func runDbExport(args []string) {
+	if len(args) != 0 {
+		fmt.Println("Usage: flaclink db export > albums.json")
+		os.Exit(2)
+	}
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+	store := albumStore(db)
+
+	var albums []Album
+	err := store.ForEach(func(contents []string, dirName string) error {
+		albums = append(albums, Album{DirName: dirName, Contents: contents})
+		return nil
+	})
+	if err != nil {
+		fatalf("db export: %v", err)
+	}
+	sort.Slice(albums, func(i, j int) bool { return albums[i].DirName < albums[j].DirName })
+
+	out := dbJSON{Version: dbJSONVersion, Albums: []albumJSON{}}
+	for _, album := range albums {
+		record, ok := store.Record(album)
+		if !ok {
+			record = flaclink.AlbumRecord{DirName: album.DirName}
+		}
+		out.Albums = append(out.Albums, newAlbumJSON(album.Contents, record))
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		fatalf("db export: %v", err)
+	}
+	log.Printf("Exported %d albums.", len(out.Albums))
+}
+
+// Add the albums in a file written by "flaclink db export" to the DB. An
+// album already in the DB with the same contents is replaced, so edits to
+// the file take effect.
+func runDbImport(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: flaclink db import <albums.json>")
+		os.Exit(2)
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fatalf("db import: %v", err)
+	}
+	var in dbJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		fatalf("db import: %s: %v", args[0], err)
+	}
+	if in.Version > dbJSONVersion {
+		fatalf("db import: %s has version %d, but this flaclink only reads up to %d", args[0], in.Version, dbJSONVersion)
+	}
+	for i, a := range in.Albums {
+		if len(a.Contents) == 0 || a.DirName == "" {
+			fatalf("db import: %s: album %d needs contents and dir_name", args[0], i+1)
+		}
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+	store := albumStore(db)
+	added, replaced := 0, 0
+	for _, a := range in.Albums {
+		album := Album{DirName: a.DirName, Contents: flaclink.NormalizeContents(a.Contents)}
+		if _, ok := store.Lookup(album); ok {
+			replaced++
+		} else {
+			added++
+		}
+		if err := store.SaveRecord(album, a.record()); err != nil {
+			fatalf("db import: %v", err)
+		}
+	}
+	log.Printf("Imported %d new albums and replaced %d from %s.", added, replaced, args[0])
+}
+
+func newAlbumJSON(contents []string, record flaclink.AlbumRecord) albumJSON {
+	a := albumJSON{
+		Contents:  contents,
+		DirName:   record.DirName,
+		Source:    record.Source,
+		Target:    record.Target,
+		Container: record.Container,
+		FileCount: record.FileCount,
+		Bytes:     record.Bytes,
+		Format:    record.Format,
+		LinkMode:  record.LinkMode,
+
+		BitsPerSample: record.BitsPerSample,
+		SampleRate:    record.SampleRate,
+		Edition:       record.Edition,
+		Warnings:      record.Warnings,
+		CueSheets:     record.CueSheets,
+		Images:        record.Images,
+		SplitTracks:   record.SplitTracks,
+		FetchedArt:    record.FetchedArt,
+	}
+	if !record.Time.IsZero() {
+		a.Time = &record.Time
+	}
+	for _, f := range record.Files {
+		a.Files = append(a.Files, fileJSON{Path: f.Path, Linked: f.Linked, Size: f.Size, Target: f.Target})
+	}
+	return a
+}
+
+func (a albumJSON) record() flaclink.AlbumRecord {
+	record := flaclink.AlbumRecord{
+		DirName:   a.DirName,
+		Source:    a.Source,
+		Target:    a.Target,
+		Container: a.Container,
+		FileCount: a.FileCount,
+		Bytes:     a.Bytes,
+		Format:    a.Format,
+		LinkMode:  a.LinkMode,
+
+		BitsPerSample: a.BitsPerSample,
+		SampleRate:    a.SampleRate,
+		Edition:       a.Edition,
+		Warnings:      a.Warnings,
+		CueSheets:     a.CueSheets,
+		Images:        a.Images,
+		SplitTracks:   a.SplitTracks,
+		FetchedArt:    a.FetchedArt,
+	}
+	if a.Time != nil {
+		record.Time = *a.Time
+	}
+	for _, f := range a.Files {
+		record.Files = append(record.Files, FileDecision{Path: f.Path, Linked: f.Linked, Size: f.Size, Target: f.Target})
+	}
+	return record
+}
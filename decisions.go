@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+var filesBucketName = flaclink.FilesBucket
+
+// See flaclink.FileDecision.
+type FileDecision = flaclink.FileDecision
+
+// Reports whether a file with this name should be left out when linking.
+func excludedFile(name string) bool {
+	for _, pattern := range settings.ExcludeFiles {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the per-file decisions recorded for the album linked to dirName.
+// ok is false if the album was linked before decisions were recorded, or
+// wasn't linked by flaclink at all.
+func loadDecisions(dirName string, db *bolt.DB) (decisions []FileDecision, ok bool) {
+	return albumStore(db).Decisions(dirName)
+}
+
+// See flaclink.MatchesDecisions.
+func matchesDecisions(albumPath string, dirName string, db *bolt.DB) bool {
+	return flaclink.MatchesDecisions(albumStore(db), albumPath, dirName)
+}
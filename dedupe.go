@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Extensions of audio files, which dedupe leaves alone.
+var audioExtensions = map[string]bool{
+	".flac": true, ".mp3": true, ".m4a": true, ".ogg": true, ".opus": true,
+	".wav": true, ".aiff": true, ".ape": true, ".wv": true, ".dsf": true, ".dff": true,
+}
+
+// Find identical non-audio files in the target, such as artwork and booklets
+// shared by several albums, and replace copies with hardlinks to one of them.
+// Files still linked to their source are left alone, since replacing them
+// would free nothing and only cut them off from the source. With -n, only
+// report what would be done.
+func runDedupe(args []string) {
+	flags := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "report duplicates without linking them")
+	minSize := flags.Int64("min-size", 4096, "ignore files smaller than this many bytes")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: flaclink dedupe [-n] [-min-size bytes] <target dir>")
+		os.Exit(2)
+	}
+	targetDir := filepath.Clean(flags.Arg(0))
+	if !*dryRun {
+		lockInstance()
+	}
+
+	// Group candidates by size first, so only files with a possible duplicate
+	// are hashed.
+	bySize := make(map[int64][]string)
+	err := filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != targetDir && flaclinkDirs[info.Name()] {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && info.Size() >= *minSize && !audioExtensions[strings.ToLower(filepath.Ext(path))] {
+			bySize[info.Size()] = append(bySize[info.Size()], path)
+		}
+		return nil
+	})
+	if err != nil {
+		fatalf("dedupe: %v", err)
+	}
+
+	var linked, linkedToSource int
+	var reclaimed int64
+	for size, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+		byHash := make(map[[sha256.Size]byte][]string)
+		for _, path := range paths {
+			sum, err := fileSHA256(path)
+			if err != nil {
+				log.Printf("dedupe: %v", err)
+				continue
+			}
+			byHash[sum] = append(byHash[sum], path)
+		}
+		for _, same := range byHash {
+			// Keep the copy with the most links, which is usually one still
+			// linked to its source, so that copies made by other tools are
+			// the ones replaced.
+			sort.SliceStable(same, func(i, j int) bool { return linkCount(same[i]) > linkCount(same[j]) })
+			keep := same[0]
+			keepInfo, err := os.Stat(keep)
+			if err != nil {
+				continue
+			}
+			for _, dup := range same[1:] {
+				dupInfo, err := os.Stat(dup)
+				if err != nil || os.SameFile(keepInfo, dupInfo) {
+					continue
+				}
+				// Anything else linking to the duplicate, usually its source
+				// file, would keep its space in use.
+				if linkCount(dup) != 1 {
+					linkedToSource++
+					continue
+				}
+				if *dryRun {
+					fmt.Printf("would link %s to %s\n", dup, keep)
+				} else if err := replaceWithLink(keep, dup, os.Link); err != nil {
+					countError("", err)
+					log.Printf("dedupe: %v", err)
+					continue
+				} else {
+					fmt.Printf("linked %s to %s\n", dup, keep)
+				}
+				linked++
+				reclaimed += size
+			}
+		}
+	}
+
+	verb := "Linked"
+	if *dryRun {
+		verb = "Would link"
+	}
+	fmt.Printf("%s %d duplicate files, reclaiming %d bytes. Left %d duplicates alone that are linked to other files, usually their sources.\n", verb, linked, reclaimed, linkedToSource)
+}
+
+func fileSHA256(path string) (sum [sha256.Size]byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, throttledReader{f}); err != nil {
+		return sum, fmt.Errorf("%s: %v", path, err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// Replace dup with a link to keep made by link, such as os.Link, or create
+// it if it's missing. The link is made under a temporary name and renamed
+// over dup, so dup never goes missing.
+func replaceWithLink(keep, dup string, link func(oldname, newname string) error) error {
+	tmp := dup + ".flaclink-tmp"
+	if err := link(keep, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dup); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Number of hardlinks to the file at path, or 0 if it can't be read.
+func linkCount(path string) uint64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fileLinks(path, info)
+}
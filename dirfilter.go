@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Patterns given with -include-dir and -exclude-dir, on top of include_dirs
+// and exclude_dirs in the config file.
+var includeDirFlags, excludeDirFlags dirPatterns
+
+// Patterns for the names of directories in the source dir. Each is a glob,
+// as in filepath.Match, or a regular expression between slashes, e.g.
+// "/(?i)christmas/".
+type dirPatterns []string
+
+func (p *dirPatterns) String() string {
+	return strings.Join(*p, ", ")
+}
+
+func (p *dirPatterns) Set(value string) error {
+	if _, err := matchDirPattern(value, ""); err != nil {
+		return err
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+func registerDirFilterFlags(flags *flag.FlagSet) {
+	flags.Var(&includeDirFlags, "include-dir", "only scan source dirs whose names match this glob or /regexp/; repeatable")
+	flags.Var(&excludeDirFlags, "exclude-dir", "don't scan source dirs whose names match this glob or /regexp/; repeatable")
+}
+
+// Reports whether name matches pattern. Returns an error if pattern is
+// invalid.
+func matchDirPattern(pattern, name string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, fmt.Errorf("%q: %v", pattern, err)
+		}
+		return re.MatchString(name), nil
+	}
+	matched, err := filepath.Match(pattern, name)
+	if err != nil {
+		return false, fmt.Errorf("%q: %v", pattern, err)
+	}
+	return matched, nil
+}
+
+// Check the patterns of an include_dirs or exclude_dirs setting.
+func validateDirPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := matchDirPattern(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The first of patterns that name matches, or "" if none does.
+func matchingDirPattern(patterns []string, name string) string {
+	for _, pattern := range patterns {
+		if matched, _ := matchDirPattern(pattern, name); matched {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// Why the directory with this name in the source dir is filtered out by
+// the include and exclude patterns, or "" if it isn't.
+func dirFilterReason(name string) string {
+	include := append(append([]string(nil), settings.IncludeDirs...), includeDirFlags...)
+	exclude := append(append([]string(nil), settings.ExcludeDirs...), excludeDirFlags...)
+	if len(include) > 0 && matchingDirPattern(include, name) == "" {
+		return "it matches none of the include_dirs and -include-dir patterns"
+	}
+	if pattern := matchingDirPattern(exclude, name); pattern != "" {
+		return fmt.Sprintf("it matches the exclude pattern %s", pattern)
+	}
+	return ""
+}
+
+// Reports whether the directory with this name in the source dir should be
+// scanned: it matches an include pattern, if there are any, and no exclude
+// pattern.
+func sourceDirIncluded(name string) bool {
+	return dirFilterReason(name) == ""
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+)
+
+// Discography folders are split into their albums by flaclink.FindAlbums.
+// The folder each album came from is part of its record.
+var containersBucketName = flaclink.ContainersBucket
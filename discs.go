@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+)
+
+// Laying out multi-disc albums in the target. Sources name disc folders
+// every which way, "CD1", "Disc 01", "cd 2 - Bonus", which some players
+// show as separate albums. With disc_layout, albums with disc folders are
+// linked in a consistent layout instead of mirroring the source, which is
+// left as it is. Each file is still a hardlink to its source file; only its
+// path in the target changes.
+const (
+	// Every disc's files in the album directory, their names prefixed with
+	// the disc number, e.g. CD2/01 Intro.flac as 2-01 Intro.flac.
+	discLayoutMerge = "merge"
+	// Disc folders renamed Disc 1, Disc 2 and so on, keeping any disc title,
+	// e.g. "cd 2 - Bonus" as "Disc 2 - Bonus".
+	discLayoutFolders = "folders"
+)
+
+func validateDiscLayout(layout string) error {
+	switch layout {
+	case "", discLayoutMerge, discLayoutFolders:
+		return nil
+	}
+	return fmt.Errorf("unknown layout %q, want %q or %q", layout, discLayoutMerge, discLayoutFolders)
+}
+
+// The Linker.MapPath for album under the current disc_layout, or nil if the
+// album should mirror its source because there's no layout set or it has no
+// disc folders.
+func discLayoutMapper(album Album) func(string) string {
+	if settings.DiscLayout == "" || !hasDiscFolders(album) {
+		return nil
+	}
+	layout := settings.DiscLayout
+	return func(relPath string) string {
+		return discLayoutPath(layout, relPath)
+	}
+}
+
+// Reports whether any of the entries directly in album are named like disc
+// folders.
+func hasDiscFolders(album Album) bool {
+	for _, name := range album.Contents {
+		if _, _, ok := flaclink.DiscFolder(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The path in the target, under layout, of the file at relPath in an album.
+// Files that aren't in a disc folder keep their paths.
+func discLayoutPath(layout, relPath string) string {
+	parts := strings.SplitN(relPath, string(filepath.Separator), 2)
+	if len(parts) < 2 {
+		return relPath
+	}
+	disc, rest, ok := flaclink.DiscFolder(parts[0])
+	if !ok {
+		return relPath
+	}
+	switch layout {
+	case discLayoutMerge:
+		return fmt.Sprintf("%d-%s", disc, parts[1])
+	case discLayoutFolders:
+		dir := fmt.Sprintf("Disc %d", disc)
+		if rest != "" {
+			dir += " - " + rest
+		}
+		return filepath.Join(dir, parts[1])
+	}
+	return relPath
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bracketed parts of album names, such as "(2011 Remaster)" or "[FLAC 24-96]",
+// which are ignored when comparing names.
+var bracketedPattern = regexp.MustCompile(`\s*[(\[{][^)\]}]*[)\]}]`)
+
+// Leading track and disc numbers in track file names, such as "01 - " or
+// "2-05. ", which are ignored when comparing track lists.
+var trackNumberPattern = regexp.MustCompile(`^[\d\s._-]*`)
+
+// Track titles found in more albums than this, such as "Intro", don't count
+// towards track lists being similar.
+const maxTitleAlbums = 20
+
+// An album considered by dupes.
+type dupeAlbum struct {
+	record flaclink.AlbumRecord
+	// Paths of its linked FLAC files in the target, and their sizes.
+	flacs []string
+	sizes []int64
+}
+
+// Report albums in the library that are likely duplicates of each other, so
+// they can be pruned by hand: albums whose FLAC files have the same sizes,
+// albums whose names match once bracketed parts, case and punctuation are
+// ignored, and albums sharing most of their track titles. With -fs, files
+// with the same sizes are also hashed to tell identical albums apart from
+// coincidences, and albums tagged with the same MusicBrainz release are
+// reported too. Nothing is changed.
+func runDupes(args []string) {
+	flags := flag.NewFlagSet("dupes", flag.ExitOnError)
+	readFiles := flags.Bool("fs", false, "hash files and read tags in the target, rather than only using the DB")
+	similarity := flags.Float64("similarity", 0.8, "fraction of track titles two albums must share to be reported")
+	flags.Parse(args)
+	if flags.NArg() != 0 || *similarity <= 0 || *similarity > 1 {
+		fmt.Println("Usage: flaclink dupes [-fs] [-similarity fraction]")
+		os.Exit(2)
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	records, err := catalogRecords(db)
+	db.Close()
+	if err != nil {
+		fatalf("dupes: %v", err)
+	}
+	var albums []dupeAlbum
+	for _, record := range records {
+		// Albums found already in the target have nothing to compare.
+		if record.Target == "" {
+			continue
+		}
+		album := dupeAlbum{record: record}
+		for _, file := range record.Files {
+			if file.Linked && strings.EqualFold(filepath.Ext(file.Path), ".flac") {
+				album.flacs = append(album.flacs, filepath.Join(record.Target, file.TargetPath()))
+				album.sizes = append(album.sizes, file.Size)
+			}
+		}
+		albums = append(albums, album)
+	}
+
+	groups := newDupeGroups(len(albums))
+	matchBySizes(albums, groups, *readFiles)
+	if *readFiles {
+		matchByRelease(albums, groups)
+	}
+	matchByName(albums, groups)
+	matchByTracks(albums, groups, *similarity)
+	printDupeGroups(albums, groups)
+}
+
+// Albums joined into groups of likely duplicates, with why they were joined.
+type dupeGroups struct {
+	parent  []int
+	reasons map[int]map[string]bool
+}
+
+func newDupeGroups(n int) *dupeGroups {
+	groups := &dupeGroups{parent: make([]int, n), reasons: make(map[int]map[string]bool)}
+	for i := range groups.parent {
+		groups.parent[i] = i
+	}
+	return groups
+}
+
+func (g *dupeGroups) find(i int) int {
+	for g.parent[i] != i {
+		g.parent[i] = g.parent[g.parent[i]]
+		i = g.parent[i]
+	}
+	return i
+}
+
+// Put albums i and j in the same group, for the given reason.
+func (g *dupeGroups) join(i, j int, reason string) {
+	ri, rj := g.find(i), g.find(j)
+	if ri != rj {
+		g.parent[rj] = ri
+		for r := range g.reasons[rj] {
+			g.addReason(ri, r)
+		}
+		delete(g.reasons, rj)
+	}
+	g.addReason(ri, reason)
+}
+
+func (g *dupeGroups) addReason(root int, reason string) {
+	if g.reasons[root] == nil {
+		g.reasons[root] = make(map[string]bool)
+	}
+	g.reasons[root][reason] = true
+}
+
+// Join the albums in each set of indexes sharing a key.
+func (g *dupeGroups) joinAll(byKey map[string][]int, reason string) {
+	for _, indexes := range byKey {
+		for _, i := range indexes[1:] {
+			g.join(indexes[0], i, reason)
+		}
+	}
+}
+
+// Join albums whose FLAC files have the same sizes. With readFiles, those
+// are hashed, and only albums with identical files are joined.
+func matchBySizes(albums []dupeAlbum, groups *dupeGroups, readFiles bool) {
+	bySizes := make(map[string][]int)
+	for i, album := range albums {
+		if len(album.sizes) == 0 {
+			continue
+		}
+		sizes := append([]int64(nil), album.sizes...)
+		sort.Slice(sizes, func(a, b int) bool { return sizes[a] < sizes[b] })
+		key := fmt.Sprint(sizes)
+		bySizes[key] = append(bySizes[key], i)
+	}
+	if !readFiles {
+		groups.joinAll(bySizes, "same track sizes")
+		return
+	}
+	for _, indexes := range bySizes {
+		if len(indexes) < 2 {
+			continue
+		}
+		byHash := make(map[string][]int)
+		for _, i := range indexes {
+			key, err := albumFilesHash(albums[i].flacs)
+			if err != nil {
+				log.Printf("Not comparing the files of %s: %v", albums[i].record.DirName, err)
+				continue
+			}
+			byHash[key] = append(byHash[key], i)
+		}
+		groups.joinAll(byHash, "identical files")
+	}
+}
+
+// A hash of the contents of the files at paths, whatever their order.
+func albumFilesHash(paths []string) (string, error) {
+	var sums []string
+	for _, path := range paths {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return "", err
+		}
+		sums = append(sums, string(sum[:]))
+	}
+	sort.Strings(sums)
+	sum := sha256.Sum256([]byte(strings.Join(sums, "")))
+	return string(sum[:]), nil
+}
+
+// Join albums tagged with the same MusicBrainz release.
+func matchByRelease(albums []dupeAlbum, groups *dupeGroups) {
+	byRelease := make(map[string][]int)
+	for i, album := range albums {
+		meta := albumMetadata(Album{Path: album.record.Target})
+		if meta == nil {
+			continue
+		}
+		mbid := strings.ToLower(strings.TrimSpace(meta.tag("MUSICBRAINZ_ALBUMID")))
+		if mbidPattern.MatchString(mbid) {
+			byRelease[mbid] = append(byRelease[mbid], i)
+		}
+	}
+	groups.joinAll(byRelease, "same MusicBrainz release")
+}
+
+// Join albums whose names match by albumNameKey.
+func matchByName(albums []dupeAlbum, groups *dupeGroups) {
+	byName := make(map[string][]int)
+	for i, album := range albums {
+		if key := albumNameKey(album.record.DirName); key != "" {
+			byName[key] = append(byName[key], i)
+		}
+	}
+	groups.joinAll(byName, "similar names")
+}
+
+// A key under which spellings of the same album's directory name match:
+// bracketed parts, such as years, editions and formats, are ignored, and so
+// are case, accents and punctuation, as by artistKey.
+func albumNameKey(dirName string) string {
+	var words []string
+	for _, name := range strings.Split(filepath.ToSlash(dirName), "/") {
+		words = append(words, bracketedPattern.ReplaceAllString(name, ""))
+	}
+	return artistKey(strings.Join(words, " "))
+}
+
+// Join albums with at least three tracks that share at least similarity of
+// their track titles, counting the titles in either.
+func matchByTracks(albums []dupeAlbum, groups *dupeGroups, similarity float64) {
+	titleCounts := make([]int, len(albums))
+	byTitle := make(map[string][]int)
+	for i, album := range albums {
+		titles := make(map[string]bool)
+		for _, track := range albumTracks(album.record) {
+			name := strings.TrimSuffix(filepath.Base(track), filepath.Ext(track))
+			if title := artistKey(trackNumberPattern.ReplaceAllString(name, "")); title != "" {
+				titles[title] = true
+			}
+		}
+		if len(titles) < 3 {
+			continue
+		}
+		titleCounts[i] = len(titles)
+		for title := range titles {
+			byTitle[title] = append(byTitle[title], i)
+		}
+	}
+	shared := make(map[[2]int]int)
+	for _, indexes := range byTitle {
+		if len(indexes) > maxTitleAlbums {
+			continue
+		}
+		for a := 0; a < len(indexes); a++ {
+			for b := a + 1; b < len(indexes); b++ {
+				shared[[2]int{indexes[a], indexes[b]}]++
+			}
+		}
+	}
+	for pair, n := range shared {
+		if float64(n)/float64(titleCounts[pair[0]]+titleCounts[pair[1]]-n) >= similarity {
+			groups.join(pair[0], pair[1], "similar track lists")
+		}
+	}
+}
+
+// Print each group of likely duplicates, with the size of each album and
+// how much keeping only the largest would free, most first.
+func printDupeGroups(albums []dupeAlbum, groups *dupeGroups) {
+	members := make(map[int][]int)
+	for i := range albums {
+		root := groups.find(i)
+		members[root] = append(members[root], i)
+	}
+	type group struct {
+		reasons []string
+		albums  []dupeAlbum
+		freed   int64
+	}
+	var found []group
+	for root, indexes := range members {
+		if len(indexes) < 2 {
+			continue
+		}
+		var g group
+		for reason := range groups.reasons[root] {
+			g.reasons = append(g.reasons, reason)
+		}
+		sort.Strings(g.reasons)
+		for _, i := range indexes {
+			g.albums = append(g.albums, albums[i])
+		}
+		sort.Slice(g.albums, func(a, b int) bool { return g.albums[a].record.Bytes > g.albums[b].record.Bytes })
+		for _, album := range g.albums[1:] {
+			g.freed += album.record.Bytes
+		}
+		found = append(found, g)
+	}
+	sort.Slice(found, func(a, b int) bool { return found[a].freed > found[b].freed })
+
+	var freed int64
+	for _, g := range found {
+		fmt.Printf("%s (%s could be freed):\n", strings.Join(g.reasons, ", "), formatSize(g.freed))
+		for _, album := range g.albums {
+			format := album.record.Format
+			if format == "" {
+				format = "unknown"
+			}
+			fmt.Printf("    %10s  %-14s %s\n", formatSize(album.record.Bytes), format, album.record.Target)
+		}
+		freed += g.freed
+	}
+	if len(found) == 0 {
+		fmt.Println("No likely duplicates found.")
+		return
+	}
+	fmt.Printf("Groups of likely duplicates: %d. Keeping only the largest album of each would free up to %s.\n", len(found), formatSize(freed))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The same release often arrives more than once: a CD rip, then a 24-bit
+// remaster, then a deluxe edition. Albums in the same folder of the target
+// whose names match once bracketed parts, case and punctuation are ignored
+// are taken for editions of one release, and so is an album in the DB that
+// has the very name another would get, as with a target_template that leaves
+// out the edition. Each album's edition is recorded along with its bit depth
+// and sample rate. The edition policy under conflicts decides between them:
+// keep-both links every edition, naming one that would take another's name
+// after its edition or quality; best keeps only the edition with the highest
+// bit depth, then sample rate; prompt asks, or quarantines the album without
+// a terminal. Other policies settle editions as they do other conflicts.
+
+// Bracketed parts of a name, such as "(Deluxe Edition)", with what's in
+// the brackets as the submatch.
+var bracketedPartPattern = regexp.MustCompile(`[(\[{]([^)\]}]*)[)\]}]`)
+
+// The album's edition, e.g. "Deluxe Edition, 2011 Remaster": the bracketed
+// parts of its ALBUM tag, or else of its source folder's name, or "" if
+// neither has any.
+func albumEdition(album Album, meta *flacMetadata) string {
+	for _, name := range []string{tagOr(meta, "ALBUM", ""), filepath.Base(album.Path)} {
+		var parts []string
+		for _, match := range bracketedPartPattern.FindAllStringSubmatch(name, -1) {
+			if part := strings.TrimSpace(match[1]); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) > 0 {
+			return strings.Join(parts, ", ")
+		}
+	}
+	return ""
+}
+
+// Settle the conflict, if there's another edition in the target of the album
+// in job, once the album is named. Returns false if it shouldn't be linked,
+// having reported why. Only looks when something other than linking it
+// under its own name could come of it.
+func settleEditionConflict(job *albumJob) (bool, error) {
+	if !promptConflicts && len(conflictAnswers) == 0 && configuredPolicy(conflictEdition) == "" {
+		return true, nil
+	}
+	for {
+		other := otherEdition(job)
+		if other == "" {
+			return true, nil
+		}
+		meta := job.Meta
+		if meta == nil {
+			meta = albumMetadata(job.Album)
+		}
+		otherMeta := targetMetadata(other, job)
+		choice, name := resolveConflict(job, conflictEdition, fmt.Sprintf("%s in the target looks like another edition of it, %s there and %s here", other, metadataFormat(otherMeta), metadataFormat(meta)))
+		if choice == choiceBest {
+			if !betterQuality(meta, otherMeta) {
+				log.Printf("Skipping album %s, %s in the target is as good an edition or better.", job.Album.DirName, other)
+				emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "better edition in the target"})
+				return false, nil
+			}
+			log.Printf("Album %s is a better edition than %s in the target, replacing it.", job.Album.DirName, other)
+			choice = choiceReplace
+		}
+		switch choice {
+		case choiceSkip:
+			log.Printf("Skipping album %s for now, %s looks like another edition of it.", job.Album.DirName, other)
+			emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "other edition in the target"})
+			return false, nil
+		case choiceQuarantine:
+			return false, quarantineAlbum(job, "other edition in the target: "+other)
+		case choiceRename:
+			if name == job.Album.DirName {
+				return true, nil
+			}
+			job.Album.DirName = name
+		case choiceKeepBoth:
+			if other == job.Album.DirName {
+				job.Album.DirName = editionName(job.Album, meta, job.TargetDir)
+			}
+			return true, nil
+		case choiceReplace:
+			path := albumTargetPath(Album{DirName: other}, job.TargetDir)
+			if err := replaceInTarget(path, other, job.TargetDir, job.DB); err != nil {
+				countError(job.Album.DirName, fmt.Errorf("can't replace %s: %v", path, err))
+				return false, nil
+			}
+		}
+	}
+}
+
+// The name in the target of another edition of the album in job: an album in
+// the DB with the name the album is to get, or a dir next to it whose name
+// matches once bracketed parts, case and punctuation are ignored. "" if
+// there's none. Anything else with the album's name is a name conflict,
+// which the link stage settles.
+func otherEdition(job *albumJob) string {
+	dirName := job.Album.DirName
+	if _, err := os.Lstat(albumTargetPath(job.Album, job.TargetDir)); err == nil {
+		if _, _, ok := recordedAlbum(albumStore(job.DB), dirName); ok {
+			return dirName
+		}
+		return ""
+	}
+	key := albumNameKey(filepath.Base(dirName))
+	if key == "" {
+		return ""
+	}
+	parent := filepath.Dir(dirName)
+	throttleOp()
+	entries, err := os.ReadDir(filepath.Join(job.TargetDir, parent))
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && name != filepath.Base(dirName) && albumNameKey(name) == key {
+			return filepath.Join(parent, name)
+		}
+	}
+	return ""
+}
+
+// Bit depth and sample rate of the album dirName in the target, as recorded
+// if they were, or else read from its first FLAC file. nil if neither works.
+func targetMetadata(dirName string, job *albumJob) *flacMetadata {
+	if _, record, ok := recordedAlbum(albumStore(job.DB), dirName); ok && record.SampleRate > 0 {
+		return &flacMetadata{BitsPerSample: record.BitsPerSample, SampleRate: record.SampleRate}
+	}
+	return albumMetadata(Album{DirName: dirName, Path: albumTargetPath(Album{DirName: dirName}, job.TargetDir)})
+}
+
+// Reports whether meta is of a better quality than other: a higher bit depth,
+// or the same and a higher sample rate. An unreadable album is never better,
+// and anything readable is better than one.
+func betterQuality(meta, other *flacMetadata) bool {
+	switch {
+	case meta == nil || meta.SampleRate == 0:
+		return false
+	case other == nil || other.SampleRate == 0:
+		return true
+	case meta.BitsPerSample != other.BitsPerSample:
+		return meta.BitsPerSample > other.BitsPerSample
+	default:
+		return meta.SampleRate > other.SampleRate
+	}
+}
+
+// A name for album, whose name is taken by another edition, with its edition
+// added, e.g. "Album [Deluxe Edition]", or else its quality, e.g.
+// "Album [24-96]", whichever isn't in the name already and is free in
+// targetDir. Failing both, it's numbered as by keep-both.
+func editionName(album Album, meta *flacMetadata, targetDir string) string {
+	var suffixes []string
+	if edition := albumEdition(album, meta); edition != "" {
+		suffixes = append(suffixes, edition)
+	}
+	if meta != nil && meta.SampleRate > 0 {
+		suffixes = append(suffixes, meta.quality("-"))
+	}
+	for _, suffix := range suffixes {
+		if strings.Contains(album.DirName, suffix) {
+			continue
+		}
+		name := sanitizePath(album.DirName + " [" + strings.ReplaceAll(suffix, "/", "-") + "]")
+		if _, err := os.Lstat(albumTargetPath(Album{DirName: name}, targetDir)); os.IsNotExist(err) {
+			return name
+		}
+	}
+	return keepBothName(album.DirName, targetDir)
+}
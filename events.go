@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// One decision made during a run, written as a line of JSON when events are
+// enabled with -events jsonl or -json-events. Event is one of "discovered",
+// "linked", "skipped", "error" or, once at the end of each run,
+// "run_summary".
+type Event struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Album  string    `json:"album,omitempty"`
+	Source string    `json:"source,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	// Seconds taken to link the album, for "linked" events, or the run, for
+	// "run_summary" events.
+	Duration float64 `json:"duration,omitempty"`
+	// What the run did, for "run_summary" events.
+	Summary *RunSummary `json:"summary,omitempty"`
+}
+
+// Counts of what a run did, in its "run_summary" event.
+type RunSummary struct {
+	Linked   int `json:"linked"`
+	Skipped  int `json:"skipped"`
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+}
+
+var (
+	eventsMu  sync.Mutex
+	eventsOut *json.Encoder // nil unless events are enabled
+	// Called with every event, if set, as the daemon's dashboard does to
+	// keep track of albums that weren't linked.
+	eventListener func(Event)
+)
+
+// The -events, -events-out and -json-events flags shared by commands that
+// link albums.
+type eventFlags struct {
+	format *string
+	out    *string
+	json   *bool
+}
+
+func registerEventFlags(flags *flag.FlagSet) eventFlags {
+	return eventFlags{
+		format: flags.String("events", "", "write an event per decision as it's made; the only format is jsonl"),
+		out:    flags.String("events-out", "", "file or FIFO to write events to (default stdout)"),
+		json:   flags.Bool("json-events", false, "write events as JSON lines to stdout; short for -events jsonl"),
+	}
+}
+
+// Start writing events if the flags ask for them. Call after parsing flags.
+func (ef eventFlags) open() {
+	if *ef.json && *ef.format == "" {
+		*ef.format = "jsonl"
+	}
+	switch *ef.format {
+	case "":
+		return
+	case "jsonl":
+	default:
+		fatalf("unknown -events format %q, expected jsonl", *ef.format)
+	}
+
+	out := os.Stdout
+	if *ef.out != "" {
+		// Opening a FIFO blocks until something reads from it.
+		f, err := os.OpenFile(*ef.out, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fatalf("events: %v", err)
+		}
+		out = f
+	}
+	eventsOut = json.NewEncoder(out)
+}
+
+// Write an event, if events are enabled, and log it if JSON logging is on.
+// Safe for concurrent use.
+func emitEvent(event Event) {
+	logEvent(event)
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	event.Time = time.Now()
+	if eventListener != nil {
+		eventListener(event)
+	}
+	if eventsOut == nil {
+		return
+	}
+	if err := eventsOut.Encode(event); err != nil {
+		log.Printf("events: %v", err)
+		eventsOut = nil
+	}
+}
+
+// Record an error that doesn't stop the run, such as a failed post-process
+// command or media server refresh, in the metrics, as an event, and in the
+// run's notification summary.
+func countError(album string, err error) {
+	metrics.errors.Add(1)
+	recordRunError(album, err)
+	emitEvent(Event{Event: "error", Album: album, Error: err.Error()})
+}
+
+// Emit the "run_summary" event for run, which has ended.
+func emitRunSummary(run Run) {
+	emitEvent(Event{
+		Event:    "run_summary",
+		Source:   run.Source,
+		Target:   run.Target,
+		Duration: run.End.Sub(run.Start).Seconds(),
+		Summary: &RunSummary{
+			Linked:   run.Linked,
+			Skipped:  run.Skipped,
+			Errors:   len(run.Errors),
+			Warnings: len(run.Warnings),
+		},
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit statuses of the commands that link albums, so that wrappers can tell
+// what a run did. Bad command lines exit with 2, as with the flag package.
+const (
+	exitNothingLinked = 0
+	exitLinked        = 10
+	exitPartial       = 20
+	exitFatal         = 30
+)
+
+// When a run that linked albums still exits with exitPartial: "errors" if
+// anything went wrong, such as a failed post-process command, "warnings" if
+// also any album was rejected, or "never".
+type failPolicy string
+
+var failOn failPolicy = "errors"
+
+func (p *failPolicy) String() string { return string(*p) }
+
+func (p *failPolicy) Set(value string) error {
+	switch value {
+	case "warnings", "errors", "never":
+		*p = failPolicy(value)
+		return nil
+	}
+	return fmt.Errorf("expected warnings, errors or never")
+}
+
+func registerFailOnFlag(flags *flag.FlagSet) {
+	flags.Var(&failOn, "fail-on", "exit with status 20 on `warnings`, errors or never")
+}
+
+// The exit status for a finished run, according to -fail-on.
+func exitStatus(run Run) int {
+	switch {
+	case failOn != "never" && len(run.Errors) > 0:
+		return exitPartial
+	case failOn == "warnings" && len(run.Warnings) > 0:
+		return exitPartial
+	case run.Linked > 0:
+		return exitLinked
+	}
+	return exitNothingLinked
+}
+
+// Like log.Fatalf, but exits with exitFatal.
+func fatalf(format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...))
+	os.Exit(exitFatal)
+}
+
+// Like log.Fatal, but exits with exitFatal.
+func fatal(v ...interface{}) {
+	log.Output(2, fmt.Sprint(v...))
+	os.Exit(exitFatal)
+}
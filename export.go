@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Write the albums in the database out for other tools, so curation in them
+// can start from flaclink's inventory instead of a fresh scan of the disks.
+// The formats are:
+//
+//	beets        a beets import log listing each album's target dir, for
+//	             "beet import --from-logfile"
+//	musicbrainz  an HTML page with a MusicBrainz release editor seeding
+//	             form per album, filled in from the albums' FLAC tags
+//
+// The target dir defaults to target_dir from the config file.
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "beets", "beets or musicbrainz")
+	out := flags.String("o", "", "file to write to (default stdout)")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		fmt.Println("Usage: flaclink export [-format beets|musicbrainz] [-o file] [target dir]")
+		os.Exit(2)
+	}
+	targetDir := settings.TargetDir
+	if flags.NArg() == 1 {
+		targetDir = filepath.Clean(flags.Arg(0))
+	}
+	if targetDir == "" {
+		fatalf("export: no target dir given and target_dir isn't set in %s", ConfigPath)
+	}
+	var write func(io.Writer, []string, string) (int, error)
+	switch *format {
+	case "beets":
+		write = writeBeetsLog
+	case "musicbrainz":
+		write = writeMusicBrainzSeeds
+	default:
+		fatalf("export: unknown format %q, expected beets or musicbrainz", *format)
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	dirNames := albumDirNames(db)
+	db.Close()
+
+	w := os.Stdout
+	if *out != "" {
+		var err error
+		if w, err = os.Create(*out); err != nil {
+			fatalf("export: %v", err)
+		}
+		defer w.Close()
+	}
+	buffered := bufio.NewWriter(w)
+	exported, err := write(buffered, dirNames, targetDir)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		fatalf("export: %v", err)
+	}
+	log.Printf("Exported %d albums.", exported)
+}
+
+// Target dir names of every album in the database, sorted.
+func albumDirNames(db *bolt.DB) []string {
+	var dirNames []string
+	albumStore(db).ForEach(func(contents []string, dirName string) error {
+		dirNames = append(dirNames, dirName)
+		return nil
+	})
+	sort.Strings(dirNames)
+	return dirNames
+}
+
+// Write a beets import log marking each album as skipped, which "beet import
+// --from-logfile" reads as the list of directories to import.
+func writeBeetsLog(w io.Writer, dirNames []string, targetDir string) (int, error) {
+	fmt.Fprintf(w, "import started %s\n", time.Now().Format(time.ANSIC))
+	for i, dirName := range dirNames {
+		path, err := filepath.Abs(filepath.Join(targetDir, dirName))
+		if err != nil {
+			return i, err
+		}
+		if _, err := fmt.Fprintf(w, "skip %s\n", path); err != nil {
+			return i, err
+		}
+	}
+	return len(dirNames), nil
+}
+
+// A track as seeded into the MusicBrainz release editor.
+type seedTrack struct {
+	Disc   int
+	Number int
+	Title  string
+	Artist string
+	Length int64 // milliseconds
+}
+
+// The fields of a MusicBrainz release editor seeding form for one album, as
+// described at https://musicbrainz.org/doc/Development/Release_Editor_Seeding.
+type seedRelease struct {
+	DirName string
+	Fields  [][2]string
+}
+
+var musicBrainzSeedPage = template.Must(template.New("seed").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>flaclink: MusicBrainz seeds</title></head>
+<body>
+<h1>Add albums to MusicBrainz</h1>
+{{range .}}<form action="https://musicbrainz.org/release/add" method="post" target="_blank">
+{{range .Fields}}<input type="hidden" name="{{index . 0}}" value="{{index . 1}}">
+{{end}}<button type="submit">{{.DirName}}</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// Write an HTML page with a MusicBrainz release editor seeding form for
+// each album with FLAC files in the target.
+func writeMusicBrainzSeeds(w io.Writer, dirNames []string, targetDir string) (int, error) {
+	var releases []seedRelease
+	for _, dirName := range dirNames {
+		if release, ok := musicBrainzSeed(filepath.Join(targetDir, dirName), dirName); ok {
+			releases = append(releases, release)
+		}
+	}
+	return len(releases), musicBrainzSeedPage.Execute(w, releases)
+}
+
+func musicBrainzSeed(albumPath string, dirName string) (seedRelease, bool) {
+	release := seedRelease{DirName: dirName}
+	var albumMeta *flacMetadata
+	var tracks []seedTrack
+	for _, path := range albumFlacFiles(albumPath) {
+		meta, err := readFlacMetadata(path)
+		if err != nil {
+			continue
+		}
+		if albumMeta == nil {
+			albumMeta = meta
+		}
+		track := seedTrack{
+			Disc:   leadingInt(meta.tag("DISCNUMBER"), 1),
+			Number: leadingInt(meta.tag("TRACKNUMBER"), len(tracks)+1),
+			Title:  meta.tag("TITLE"),
+			Artist: meta.tag("ARTIST"),
+		}
+		if track.Title == "" {
+			track.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		if meta.SampleRate > 0 {
+			track.Length = int64(meta.TotalSamples * 1000 / uint64(meta.SampleRate))
+		}
+		tracks = append(tracks, track)
+	}
+	if albumMeta == nil {
+		return release, false
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if tracks[i].Disc != tracks[j].Disc {
+			return tracks[i].Disc < tracks[j].Disc
+		}
+		return tracks[i].Number < tracks[j].Number
+	})
+
+	add := func(name, value string) {
+		if value != "" {
+			release.Fields = append(release.Fields, [2]string{name, value})
+		}
+	}
+	title := albumMeta.tag("ALBUM")
+	if title == "" {
+		title = filepath.Base(dirName)
+	}
+	albumArtist := albumMeta.tag("ALBUMARTIST")
+	if albumArtist == "" {
+		albumArtist = albumMeta.tag("ARTIST")
+	}
+	add("name", title)
+	add("artist_credit.names.0.name", albumArtist)
+	add("barcode", albumMeta.tag("BARCODE"))
+	add("labels.0.name", albumMeta.tag("LABEL"))
+	add("labels.0.catalog_number", albumMeta.tag("CATALOGNUMBER"))
+	if date := strings.SplitN(albumMeta.tag("DATE"), "-", 3); date[0] != "" {
+		for i, part := range []string{"year", "month", "day"} {
+			if i < len(date) {
+				add("events.0.date."+part, date[i])
+			}
+		}
+	}
+
+	medium, disc, index := -1, 0, 0
+	for _, track := range tracks {
+		if medium < 0 || track.Disc != disc {
+			medium, disc, index = medium+1, track.Disc, 0
+			add(fmt.Sprintf("mediums.%d.format", medium), "Digital Media")
+		}
+		prefix := fmt.Sprintf("mediums.%d.track.%d.", medium, index)
+		index++
+		add(prefix+"name", track.Title)
+		add(prefix+"number", strconv.Itoa(track.Number))
+		if track.Length > 0 {
+			add(prefix+"length", strconv.FormatInt(track.Length, 10))
+		}
+		if track.Artist != "" && track.Artist != albumArtist {
+			add(prefix+"artist_credit.names.0.name", track.Artist)
+		}
+	}
+	add("edit_note", "Seeded by flaclink from FLAC tags.")
+	return release, true
+}
+
+// The number at the start of s, as in track numbers like "3/12". Returns def
+// if s doesn't start with a number.
+func leadingInt(s string, def int) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, err := strconv.Atoi(s[:end])
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Settings for an Atom feed of newly linked albums, under "feed" in the
+// config file. The feed is a static file, rewritten after every run that
+// links albums; the daemon also serves it at /feed.xml if HTTP is enabled.
+type FeedConfig struct {
+	Path  string `json:"path"`
+	Title string `json:"title"`
+	// URL the target dir is served at, if any. Entries link to the album
+	// directory and its cover art under it.
+	BaseURL string `json:"base_url"`
+	// Number of albums kept in the feed. Defaults to 50.
+	MaxEntries int `json:"max_entries"`
+}
+
+const defaultFeedEntries = 50
+
+// Cover art file names, in order of preference. Matched case-insensitively.
+var coverArtNames = []string{"cover.jpg", "folder.jpg", "front.jpg", "cover.png", "folder.png", "front.png"}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Links   []atomLink `xml:"link"`
+	Summary string     `xml:"summary,omitempty"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+// Add the albums linked into targetDir by a run to the feed, keeping the
+// newest MaxEntries. Does nothing unless a feed is configured.
+func writeFeed(linked []Album, targetDir string) {
+	fc := settings.Feed
+	if fc == nil || fc.Path == "" {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	feed := atomFeed{}
+	if data, err := ioutil.ReadFile(fc.Path); err == nil {
+		if err := xml.Unmarshal(data, &feed); err != nil {
+			log.Printf("feed: %s is unreadable, starting a new feed: %v", fc.Path, err)
+			feed = atomFeed{}
+		}
+	}
+	feed.Title = fc.Title
+	if feed.Title == "" {
+		feed.Title = "New in " + filepath.Base(targetDir)
+	}
+	feedDir, _ := filepath.Abs(targetDir)
+	feed.ID = "urn:flaclink:feed:" + url.PathEscape(feedDir)
+	feed.Updated = now
+	feed.Author = atomAuthor{Name: "flaclink"}
+	feed.Links = nil
+	if fc.BaseURL != "" {
+		feed.Links = []atomLink{{Href: fc.BaseURL}}
+	}
+
+	var entries []atomEntry
+	for i := len(linked) - 1; i >= 0; i-- {
+		entries = append(entries, feedEntry(linked[i], targetDir, now))
+	}
+	feed.Entries = append(entries, feed.Entries...)
+	max := fc.MaxEntries
+	if max <= 0 {
+		max = defaultFeedEntries
+	}
+	if len(feed.Entries) > max {
+		feed.Entries = feed.Entries[:max]
+	}
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Printf("feed: %v", err)
+		return
+	}
+	// Write to a temporary file and rename it over the feed, so feed readers
+	// never see a partly written feed.
+	tmp := fc.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append([]byte(xml.Header), data...), 0644); err != nil {
+		countError("", err)
+		log.Printf("feed: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, fc.Path); err != nil {
+		countError("", err)
+		log.Printf("feed: %v", err)
+	}
+}
+
+// Feed entry for a newly linked album, titled from its tags if it has any.
+func feedEntry(album Album, targetDir string, updated string) atomEntry {
+	entry := atomEntry{
+		Title:   album.DirName,
+		ID:      "urn:flaclink:album:" + url.PathEscape(album.DirName),
+		Updated: updated,
+		Author:  atomAuthor{Name: "flaclink"},
+		Summary: album.DirName,
+	}
+	if meta := albumMetadata(album); meta != nil {
+		artist := meta.tag("ALBUMARTIST")
+		if artist == "" {
+			artist = meta.tag("ARTIST")
+		}
+		if title := meta.tag("ALBUM"); artist != "" && title != "" {
+			entry.Title = artist + " - " + title
+			entry.Author.Name = artist
+			if year := meta.tag("DATE"); len(year) >= 4 {
+				entry.Title += " (" + year[:4] + ")"
+			}
+		}
+	}
+
+	base := settings.Feed.BaseURL
+	if base == "" {
+		return entry
+	}
+	albumURL := strings.TrimRight(base, "/") + "/" + escapePath(album.DirName) + "/"
+	entry.Links = []atomLink{{Href: albumURL}}
+	if cover := coverArt(albumTargetPath(album, targetDir)); cover != "" {
+		contentType := "image/jpeg"
+		if strings.EqualFold(filepath.Ext(cover), ".png") {
+			contentType = "image/png"
+		}
+		entry.Links = append(entry.Links, atomLink{Href: albumURL + url.PathEscape(cover), Rel: "enclosure", Type: contentType})
+	}
+	return entry
+}
+
+// Name of the cover art file directly in albumPath, or "" if there isn't one.
+func coverArt(albumPath string) string {
+	files, err := ioutil.ReadDir(albumPath)
+	if err != nil {
+		return ""
+	}
+	for _, want := range coverArtNames {
+		for _, file := range files {
+			if !file.IsDir() && strings.EqualFold(file.Name(), want) {
+				return file.Name()
+			}
+		}
+	}
+	return ""
+}
+
+// URL-escape each element of a slash-separated relative path.
+func escapePath(path string) string {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Choosing which of an album's non-audio files are linked along with its
+// FLAC files, by extension, and leaving out folders such as proof pictures
+// or screenshots by name. FLAC files are always linked unless exclude_files
+// or an ignore file says otherwise.
+type FileFilterConfig struct {
+	// Extensions of the non-audio files to link, e.g. "jpg" or ".cue". If
+	// set, all other non-audio files are left out.
+	KeepExtensions []string `json:"keep_extensions"`
+	// Extensions of non-audio files to leave out, e.g. "nfo".
+	DropExtensions []string `json:"drop_extensions"`
+	// Name patterns of folders inside albums to leave out, along with
+	// everything in them, e.g. "Proof". Globs or /regexps/, as for
+	// exclude_dirs.
+	DropDirs []string `json:"drop_dirs"`
+}
+
+func (ff *FileFilterConfig) validate() error {
+	for _, ext := range append(append([]string(nil), ff.KeepExtensions...), ff.DropExtensions...) {
+		if normalizeExtension(ext) == "." {
+			return fmt.Errorf("empty extension")
+		}
+	}
+	if err := validateDirPatterns(ff.DropDirs); err != nil {
+		return fmt.Errorf("drop_dirs: %v", err)
+	}
+	return nil
+}
+
+// ext lowercased with a leading dot, so "JPG" and ".jpg" compare equal.
+func normalizeExtension(ext string) string {
+	return "." + strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// Reports whether exts includes ext, which is normalized.
+func hasExtension(exts []string, ext string) bool {
+	for _, e := range exts {
+		if normalizeExtension(e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether file_filter leaves out files with this name.
+func filteredFile(name string) bool {
+	ff := settings.FileFilter
+	if ff == nil {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".flac" {
+		return false
+	}
+	if hasExtension(ff.DropExtensions, ext) {
+		return true
+	}
+	return len(ff.KeepExtensions) > 0 && !hasExtension(ff.KeepExtensions, ext)
+}
+
+// Reports whether file_filter leaves out folders inside albums with this
+// name.
+func filteredDir(name string) bool {
+	return settings.FileFilter != nil && matchingDirPattern(settings.FileFilter.DropDirs, name) != ""
+}
+
+// Wrap an exclude func for the linker so that it also leaves out the files
+// file_filter drops.
+func excludingFilteredFiles(exclude func(name string) bool) func(string) bool {
+	return func(name string) bool {
+		return filteredFile(name) || exclude(name)
+	}
+}
+
+// Wrap an ignore func for the linker so that it also leaves out the folders
+// file_filter drops.
+func ignoringFilteredDirs(ignore func(path string, isDir bool) bool) func(string, bool) bool {
+	return func(path string, isDir bool) bool {
+		return isDir && filteredDir(filepath.Base(path)) || ignore(path, isDir)
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// Decoding FLAC audio, to check a file's frames against their CRCs and its
+// audio against the MD5 in STREAMINFO, as "flac -t" does. See
+// https://xiph.org/flac/format.html for the format.
+
+var errFlacSync = errors.New("lost frame sync")
+
+// Decode every audio frame of the FLAC file at path. Returns an error if
+// a frame is malformed or fails its CRC, the audio is shorter or longer than
+// STREAMINFO says, or its MD5 differs from the one in STREAMINFO.
+func verifyFlacAudio(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(throttledReader{f}, 1<<16)
+	meta, err := readFlacMetadataBlocks(path, r)
+	if err != nil {
+		return err
+	}
+	if meta.SampleRate == 0 || meta.Channels == 0 {
+		return fmt.Errorf("%s: STREAMINFO has no sample rate or channels", path)
+	}
+
+	d := &flacDecoder{br: &flacBitReader{r: r}, meta: meta, md5: md5.New()}
+	var samples uint64
+	for frame := 0; ; frame++ {
+		n, err := d.decodeFrame()
+		if err == io.EOF {
+			break
+		}
+		if err == errFlacSync && meta.TotalSamples > 0 && samples >= meta.TotalSamples {
+			// Trailing junk, such as an ID3v1 tag, after the last frame.
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: frame %d: %v", path, frame, err)
+		}
+		samples += uint64(n)
+	}
+	if meta.TotalSamples > 0 && samples != meta.TotalSamples {
+		return fmt.Errorf("%s: %d samples per channel, but STREAMINFO says %d", path, samples, meta.TotalSamples)
+	}
+	if meta.MD5 != [16]byte{} {
+		var sum [16]byte
+		copy(sum[:], d.md5.Sum(nil))
+		if sum != meta.MD5 {
+			return fmt.Errorf("%s: audio MD5 %x doesn't match STREAMINFO's %x", path, sum, meta.MD5)
+		}
+	}
+	return nil
+}
+
+// Reads a FLAC stream bit by bit, most significant bit first, keeping the
+// CRC-8 and CRC-16 of the bytes read since the last reset. Bytes are only
+// read as their bits are needed, so the CRCs never cover the next frame.
+type flacBitReader struct {
+	r *bufio.Reader
+	// Unread bits, left-aligned, and how many there are.
+	buf   uint64
+	nbits uint
+	crc8  uint8
+	crc16 uint16
+}
+
+func (b *flacBitReader) resetCRC() {
+	b.crc8, b.crc16 = 0, 0
+}
+
+func (b *flacBitReader) fill() error {
+	c, err := b.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	b.crc8 = flacCRC8Table[b.crc8^c]
+	b.crc16 = b.crc16<<8 ^ flacCRC16Table[byte(b.crc16>>8)^c]
+	b.buf |= uint64(c) << (56 - b.nbits)
+	b.nbits += 8
+	return nil
+}
+
+// Read n bits, up to 56, as an unsigned number.
+func (b *flacBitReader) bits(n uint) (uint64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	for b.nbits < n {
+		if err := b.fill(); err != nil {
+			return 0, err
+		}
+	}
+	v := b.buf >> (64 - n)
+	b.buf <<= n
+	b.nbits -= n
+	return v, nil
+}
+
+// Read n bits, up to 56, as a two's complement number.
+func (b *flacBitReader) signed(n uint) (int64, error) {
+	v, err := b.bits(n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), nil
+}
+
+// Read a unary number: the count of zero bits before the next one bit.
+func (b *flacBitReader) unary() (uint64, error) {
+	var n uint64
+	for {
+		if b.nbits == 0 {
+			if err := b.fill(); err != nil {
+				return 0, err
+			}
+		}
+		zeros := uint(bits.LeadingZeros64(b.buf))
+		if zeros < b.nbits {
+			b.buf <<= zeros + 1
+			b.nbits -= zeros + 1
+			return n + uint64(zeros), nil
+		}
+		n += uint64(b.nbits)
+		b.buf, b.nbits = 0, 0
+	}
+}
+
+// Skip to the next byte boundary.
+func (b *flacBitReader) align() {
+	n := b.nbits % 8
+	b.buf <<= n
+	b.nbits -= n
+}
+
+type flacDecoder struct {
+	br   *flacBitReader
+	meta *flacMetadata
+	// Hash of the decoded audio, or nil to not hash it.
+	md5 hash.Hash
+	// Decoded samples of each channel of the current frame, reused.
+	channels  [][]int64
+	residual  []int64
+	sampleBuf []byte
+}
+
+// Decode the next frame, adding its audio to the MD5. Returns the number of
+// samples per channel in it, or io.EOF at the end of the stream.
+func (d *flacDecoder) decodeFrame() (int, error) {
+	br := d.br
+	br.resetCRC()
+	if _, err := br.r.Peek(1); err == io.EOF {
+		return 0, io.EOF
+	}
+	sync, err := br.bits(15)
+	if err != nil {
+		return 0, err
+	}
+	if sync != 0x3ffe<<1 {
+		return 0, errFlacSync
+	}
+	if _, err := br.bits(1); err != nil { // blocking strategy
+		return 0, err
+	}
+	codes, err := br.bits(16)
+	if err != nil {
+		return 0, err
+	}
+	blockSizeCode := codes >> 12
+	rateCode := codes >> 8 & 0xf
+	channelCode := codes >> 4 & 0xf
+	sizeCode := codes >> 1 & 0x7
+	if codes&1 != 0 {
+		return 0, errors.New("reserved bit set in frame header")
+	}
+	if err := d.skipCodedNumber(); err != nil {
+		return 0, err
+	}
+
+	var blockSize int
+	switch {
+	case blockSizeCode == 0:
+		return 0, errors.New("reserved block size")
+	case blockSizeCode == 1:
+		blockSize = 192
+	case blockSizeCode <= 5:
+		blockSize = 576 << (blockSizeCode - 2)
+	case blockSizeCode == 6, blockSizeCode == 7:
+		v, err := br.bits(uint(8 * (blockSizeCode - 5)))
+		if err != nil {
+			return 0, err
+		}
+		blockSize = int(v) + 1
+	default:
+		blockSize = 256 << (blockSizeCode - 8)
+	}
+	switch rateCode {
+	case 12:
+		_, err = br.bits(8)
+	case 13, 14:
+		_, err = br.bits(16)
+	case 15:
+		err = errors.New("invalid sample rate")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	bps := d.meta.BitsPerSample
+	switch sizeCode {
+	case 0:
+	case 1:
+		bps = 8
+	case 2:
+		bps = 12
+	case 4:
+		bps = 16
+	case 5:
+		bps = 20
+	case 6:
+		bps = 24
+	case 7:
+		bps = 32
+	default:
+		return 0, errors.New("reserved sample size")
+	}
+
+	var channels int
+	switch {
+	case channelCode < 8:
+		channels = int(channelCode) + 1
+	case channelCode <= 10:
+		channels = 2
+	default:
+		return 0, errors.New("reserved channel assignment")
+	}
+	if channels != d.meta.Channels {
+		return 0, fmt.Errorf("%d channels, but STREAMINFO says %d", channels, d.meta.Channels)
+	}
+
+	headerCRC := br.crc8
+	crc8, err := br.bits(8)
+	if err != nil {
+		return 0, err
+	}
+	if uint8(crc8) != headerCRC {
+		return 0, errors.New("frame header CRC mismatch")
+	}
+
+	for len(d.channels) < channels {
+		d.channels = append(d.channels, nil)
+	}
+	for ch := 0; ch < channels; ch++ {
+		// The side channel of stereo decorrelation needs an extra bit.
+		chBPS := bps
+		if (channelCode == 8 || channelCode == 10) && ch == 1 || channelCode == 9 && ch == 0 {
+			chBPS++
+		}
+		if cap(d.channels[ch]) < blockSize {
+			d.channels[ch] = make([]int64, blockSize)
+		}
+		d.channels[ch] = d.channels[ch][:blockSize]
+		if err := d.decodeSubframe(d.channels[ch], uint(chBPS)); err != nil {
+			return 0, fmt.Errorf("channel %d: %v", ch, err)
+		}
+	}
+
+	br.align()
+	frameCRC := br.crc16
+	crc16, err := br.bits(16)
+	if err != nil {
+		return 0, err
+	}
+	if uint16(crc16) != frameCRC {
+		return 0, errors.New("frame CRC mismatch")
+	}
+
+	d.decorrelate(channelCode, blockSize)
+	if d.md5 != nil {
+		d.hashSamples(channels, blockSize, bps)
+	}
+	return blockSize, nil
+}
+
+// Skip the frame or sample number, coded like UTF-8 in up to 7 bytes.
+func (d *flacDecoder) skipCodedNumber() error {
+	first, err := d.br.bits(8)
+	if err != nil {
+		return err
+	}
+	extra := bits.LeadingZeros8(^uint8(first))
+	switch {
+	case extra == 1 || extra > 7:
+		return errors.New("malformed frame number")
+	case extra > 1:
+		extra--
+	}
+	for i := 0; i < extra; i++ {
+		c, err := d.br.bits(8)
+		if err != nil {
+			return err
+		}
+		if c&0xc0 != 0x80 {
+			return errors.New("malformed frame number")
+		}
+	}
+	return nil
+}
+
+// Decode one channel's subframe into samples, at bps bits per sample.
+func (d *flacDecoder) decodeSubframe(samples []int64, bps uint) error {
+	br := d.br
+	header, err := br.bits(8)
+	if err != nil {
+		return err
+	}
+	if header&0x80 != 0 {
+		return errors.New("subframe padding bit set")
+	}
+	kind := header >> 1 & 0x3f
+	var wasted uint
+	if header&1 != 0 {
+		n, err := br.unary()
+		if err != nil {
+			return err
+		}
+		wasted = uint(n) + 1
+		if wasted >= bps {
+			return errors.New("too many wasted bits")
+		}
+		bps -= wasted
+	}
+
+	switch {
+	case kind == 0:
+		v, err := br.signed(bps)
+		if err != nil {
+			return err
+		}
+		for i := range samples {
+			samples[i] = v
+		}
+	case kind == 1:
+		for i := range samples {
+			if samples[i], err = br.signed(bps); err != nil {
+				return err
+			}
+		}
+	case kind >= 8 && kind <= 12:
+		order := int(kind - 8)
+		if err := d.decodeFixed(samples, bps, order); err != nil {
+			return err
+		}
+	case kind >= 32:
+		order := int(kind&0x1f) + 1
+		if err := d.decodeLPC(samples, bps, order); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("reserved subframe type %d", kind)
+	}
+
+	if wasted > 0 {
+		for i := range samples {
+			samples[i] <<= wasted
+		}
+	}
+	return nil
+}
+
+// Read order warm-up samples, then the residual for the rest of the block.
+func (d *flacDecoder) readWarmup(samples []int64, bps uint, order int) error {
+	if order > len(samples) {
+		return errors.New("predictor order exceeds block size")
+	}
+	for i := 0; i < order; i++ {
+		v, err := d.br.signed(bps)
+		if err != nil {
+			return err
+		}
+		samples[i] = v
+	}
+	return nil
+}
+
+func (d *flacDecoder) decodeFixed(samples []int64, bps uint, order int) error {
+	if err := d.readWarmup(samples, bps, order); err != nil {
+		return err
+	}
+	residual, err := d.decodeResidual(len(samples), order)
+	if err != nil {
+		return err
+	}
+	s := samples
+	for i := order; i < len(s); i++ {
+		r := residual[i-order]
+		switch order {
+		case 0:
+			s[i] = r
+		case 1:
+			s[i] = r + s[i-1]
+		case 2:
+			s[i] = r + 2*s[i-1] - s[i-2]
+		case 3:
+			s[i] = r + 3*s[i-1] - 3*s[i-2] + s[i-3]
+		case 4:
+			s[i] = r + 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+		}
+	}
+	return nil
+}
+
+func (d *flacDecoder) decodeLPC(samples []int64, bps uint, order int) error {
+	if err := d.readWarmup(samples, bps, order); err != nil {
+		return err
+	}
+	precision, err := d.br.bits(4)
+	if err != nil {
+		return err
+	}
+	if precision == 15 {
+		return errors.New("invalid LPC coefficient precision")
+	}
+	shift, err := d.br.signed(5)
+	if err != nil {
+		return err
+	}
+	if shift < 0 {
+		return errors.New("negative LPC shift")
+	}
+	coefs := make([]int64, order)
+	for i := range coefs {
+		if coefs[i], err = d.br.signed(uint(precision) + 1); err != nil {
+			return err
+		}
+	}
+	residual, err := d.decodeResidual(len(samples), order)
+	if err != nil {
+		return err
+	}
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, c := range coefs {
+			sum += c * samples[i-j-1]
+		}
+		samples[i] = residual[i-order] + sum>>uint(shift)
+	}
+	return nil
+}
+
+// Decode the Rice-coded residual of a block of blockSize samples, after
+// order warm-up samples.
+func (d *flacDecoder) decodeResidual(blockSize int, order int) ([]int64, error) {
+	br := d.br
+	method, err := br.bits(2)
+	if err != nil {
+		return nil, err
+	}
+	paramBits, escape := uint(4), uint64(15)
+	switch method {
+	case 0:
+	case 1:
+		paramBits, escape = 5, 31
+	default:
+		return nil, errors.New("reserved residual coding method")
+	}
+	partitionOrder, err := br.bits(4)
+	if err != nil {
+		return nil, err
+	}
+	partitions := 1 << partitionOrder
+	if blockSize%partitions != 0 || blockSize/partitions < order {
+		return nil, errors.New("invalid residual partition order")
+	}
+
+	if cap(d.residual) < blockSize {
+		d.residual = make([]int64, blockSize)
+	}
+	residual := d.residual[:blockSize-order]
+	i := 0
+	for p := 0; p < partitions; p++ {
+		n := blockSize / partitions
+		if p == 0 {
+			n -= order
+		}
+		param, err := br.bits(paramBits)
+		if err != nil {
+			return nil, err
+		}
+		if param == escape {
+			width, err := br.bits(5)
+			if err != nil {
+				return nil, err
+			}
+			for ; n > 0; n-- {
+				if residual[i], err = br.signed(uint(width)); err != nil {
+					return nil, err
+				}
+				i++
+			}
+			continue
+		}
+		for ; n > 0; n-- {
+			q, err := br.unary()
+			if err != nil {
+				return nil, err
+			}
+			low, err := br.bits(uint(param))
+			if err != nil {
+				return nil, err
+			}
+			u := q<<param | low
+			residual[i] = int64(u>>1) ^ -int64(u&1)
+			i++
+		}
+	}
+	return residual, nil
+}
+
+// Undo stereo decorrelation, leaving left and right in channels 0 and 1.
+func (d *flacDecoder) decorrelate(channelCode uint64, blockSize int) {
+	if channelCode < 8 {
+		return
+	}
+	a, b := d.channels[0][:blockSize], d.channels[1][:blockSize]
+	for i := range a {
+		switch channelCode {
+		case 8: // left, side
+			b[i] = a[i] - b[i]
+		case 9: // side, right
+			a[i] += b[i]
+		case 10: // mid, side
+			mid := a[i]<<1 | b[i]&1
+			a[i], b[i] = (mid+b[i])>>1, (mid-b[i])>>1
+		}
+	}
+}
+
+// Add the frame's samples to the MD5, interleaved and little-endian, in as
+// many bytes as bps needs, as the encoder did.
+func (d *flacDecoder) hashSamples(channels int, blockSize int, bps int) {
+	width := (bps + 7) / 8
+	size := channels * blockSize * width
+	if cap(d.sampleBuf) < size {
+		d.sampleBuf = make([]byte, size)
+	}
+	buf := d.sampleBuf[:size]
+	pos := 0
+	for i := 0; i < blockSize; i++ {
+		for ch := 0; ch < channels; ch++ {
+			v := d.channels[ch][i]
+			for k := 0; k < width; k++ {
+				buf[pos] = byte(v >> (8 * uint(k)))
+				pos++
+			}
+		}
+	}
+	d.md5.Write(buf)
+}
+
+// CRC tables for frame headers (CRC-8, polynomial x^8+x^2+x+1) and whole
+// frames (CRC-16, polynomial x^16+x^15+x^2+1).
+var (
+	flacCRC8Table  [256]uint8
+	flacCRC16Table [256]uint16
+)
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc8 := uint8(i)
+		crc16 := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc8&0x80 != 0 {
+				crc8 = crc8<<1 ^ 0x07
+			} else {
+				crc8 <<= 1
+			}
+			if crc16&0x8000 != 0 {
+				crc16 = crc16<<1 ^ 0x8005
+			} else {
+				crc16 <<= 1
+			}
+		}
+		flacCRC8Table[i] = crc8
+		flacCRC16Table[i] = crc16
+	}
+}
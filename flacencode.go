@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math/bits"
+	"os"
+)
+
+// Writing FLAC files, for the tracks split from a CD image. The encoder is
+// simple rather than small: each subframe uses the best of FLAC's fixed
+// predictors, with Rice-coded residuals in as many partitions as pays off,
+// and stereo frames use whichever of FLAC's channel decorrelations codes
+// smallest.
+
+// Samples per channel in each frame, the default of the reference encoder.
+const flacEncodeBlockSize = 4096
+
+type flacEncoder struct {
+	f *os.File
+	w *bufio.Writer
+	// Stream parameters, copied from the source.
+	sampleRate, channels, bps int
+
+	// Samples waiting to make up a full frame, one slice per channel.
+	pending  [][]int64
+	frames   uint64
+	samples  uint64
+	md5      hash.Hash
+	hashBuf  []byte
+	minFrame int
+	maxFrame int
+}
+
+// Create a FLAC file at path for audio with the stream parameters of meta,
+// tagged with comments, each "NAME=value".
+func createFlac(path string, meta *flacMetadata, comments []string) (*flacEncoder, error) {
+	if meta.Channels < 1 || meta.Channels > 8 || meta.BitsPerSample < 4 || meta.BitsPerSample > 24 {
+		return nil, errors.New("unsupported channel count or bit depth")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &flacEncoder{
+		f:          f,
+		w:          bufio.NewWriterSize(throttledWriter{f}, 1<<16),
+		sampleRate: meta.SampleRate,
+		channels:   meta.Channels,
+		bps:        meta.BitsPerSample,
+		pending:    make([][]int64, meta.Channels),
+		md5:        md5.New(),
+	}
+
+	// STREAMINFO is written again by close, once the sizes and MD5 are known.
+	e.w.WriteString("fLaC")
+	e.w.Write(flacBlockHeader(flacBlockStreamInfo, false, 34))
+	e.w.Write(e.streamInfo())
+	// Vorbis comment lengths are little-endian, unlike the rest of FLAC.
+	var comment []byte
+	appendLength := func(n int) {
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(n))
+		comment = append(comment, length[:]...)
+	}
+	vendor := "flaclink"
+	appendLength(len(vendor))
+	comment = append(comment, vendor...)
+	appendLength(len(comments))
+	for _, c := range comments {
+		appendLength(len(c))
+		comment = append(comment, c...)
+	}
+	e.w.Write(flacBlockHeader(flacBlockVorbisComment, true, len(comment)))
+	e.w.Write(comment)
+	return e, nil
+}
+
+func flacBlockHeader(blockType byte, last bool, length int) []byte {
+	if last {
+		blockType |= 0x80
+	}
+	return []byte{blockType, byte(length >> 16), byte(length >> 8), byte(length)}
+}
+
+func (e *flacEncoder) streamInfo() []byte {
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint16(info[0:], flacEncodeBlockSize)
+	binary.BigEndian.PutUint16(info[2:], flacEncodeBlockSize)
+	info[4], info[5], info[6] = byte(e.minFrame>>16), byte(e.minFrame>>8), byte(e.minFrame)
+	info[7], info[8], info[9] = byte(e.maxFrame>>16), byte(e.maxFrame>>8), byte(e.maxFrame)
+	packed := uint64(e.sampleRate)<<44 | uint64(e.channels-1)<<41 | uint64(e.bps-1)<<36 | e.samples&0xfffffffff
+	binary.BigEndian.PutUint64(info[10:], packed)
+	copy(info[18:], e.md5.Sum(nil))
+	return info
+}
+
+// Add the first n samples of each channel, writing out every full frame.
+func (e *flacEncoder) write(channels [][]int64, n int) error {
+	for ch := range e.pending {
+		e.pending[ch] = append(e.pending[ch], channels[ch][:n]...)
+	}
+	for len(e.pending[0]) >= flacEncodeBlockSize {
+		if err := e.writeFrame(flacEncodeBlockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write out the last, partial frame and the final STREAMINFO, and close the
+// file.
+func (e *flacEncoder) close() error {
+	err := func() error {
+		if n := len(e.pending[0]); n > 0 {
+			if err := e.writeFrame(n); err != nil {
+				return err
+			}
+		}
+		if err := e.w.Flush(); err != nil {
+			return err
+		}
+		_, err := e.f.WriteAt(e.streamInfo(), 8)
+		return err
+	}()
+	if closeErr := e.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Encode the first n pending samples of each channel as one frame.
+func (e *flacEncoder) writeFrame(n int) error {
+	block := make([][]int64, e.channels)
+	for ch := range block {
+		block[ch] = e.pending[ch][:n]
+	}
+	e.hashBlock(block, n)
+
+	bw := &flacBitWriter{}
+	bw.write(0x3ffe, 14)
+	bw.write(0, 2) // reserved, fixed block size
+	sizeCode := uint64(7)
+	if n == flacEncodeBlockSize {
+		sizeCode = 12
+	}
+	bw.write(sizeCode, 4)
+	bw.write(0, 4) // sample rate from STREAMINFO
+
+	// Channel assignment 0-7 is independent channels; 8, 9 and 10 are
+	// left/side, side/right and mid/side.
+	subframes := make([][]int64, e.channels)
+	copy(subframes, block)
+	assignment := uint64(e.channels - 1)
+	var extraBit [2]bool
+	if e.channels == 2 {
+		assignment, subframes, extraBit = bestStereo(block[0], block[1], e.bps)
+	}
+	bw.write(assignment, 4)
+	bw.write(0, 4) // sample size from STREAMINFO, reserved bit
+	bw.writeCodedNumber(e.frames)
+	if sizeCode == 7 {
+		bw.write(uint64(n-1), 16)
+	}
+	bw.write(uint64(flacCRC8(bw.buf)), 8)
+
+	for ch, samples := range subframes {
+		bps := e.bps
+		if ch < 2 && extraBit[ch] {
+			bps++
+		}
+		encodeSubframe(bw, samples, bps)
+	}
+	bw.align()
+	bw.write(uint64(flacCRC16(bw.buf)), 16)
+
+	if _, err := e.w.Write(bw.buf); err != nil {
+		return err
+	}
+	if size := len(bw.buf); e.frames == 0 || size < e.minFrame {
+		e.minFrame = size
+	}
+	if size := len(bw.buf); size > e.maxFrame {
+		e.maxFrame = size
+	}
+	e.frames++
+	e.samples += uint64(n)
+	for ch := range e.pending {
+		e.pending[ch] = append(e.pending[ch][:0], e.pending[ch][n:]...)
+	}
+	return nil
+}
+
+// Add a block to the MD5, the same way the decoder does.
+func (e *flacEncoder) hashBlock(block [][]int64, n int) {
+	width := (e.bps + 7) / 8
+	size := len(block) * n * width
+	if cap(e.hashBuf) < size {
+		e.hashBuf = make([]byte, size)
+	}
+	buf := e.hashBuf[:size]
+	pos := 0
+	for i := 0; i < n; i++ {
+		for ch := range block {
+			v := block[ch][i]
+			for k := 0; k < width; k++ {
+				buf[pos] = byte(v >> (8 * uint(k)))
+				pos++
+			}
+		}
+	}
+	e.md5.Write(buf)
+}
+
+// Choose how to code a stereo block: as left and right, or with the side
+// channel, left minus right, in place of one of them or alongside the mid
+// channel. Returns the channel assignment, the two channels to code, and
+// which of them is a side channel needing an extra bit.
+func bestStereo(left, right []int64, bps int) (assignment uint64, channels [][]int64, extraBit [2]bool) {
+	mid := make([]int64, len(left))
+	side := make([]int64, len(left))
+	for i := range left {
+		mid[i] = (left[i] + right[i]) >> 1
+		side[i] = left[i] - right[i]
+	}
+	l, r := subframeCost(left, bps), subframeCost(right, bps)
+	m, s := subframeCost(mid, bps), subframeCost(side, bps+1)
+	assignment, channels, best := 1, [][]int64{left, right}, l+r
+	if l+s < best {
+		assignment, channels, extraBit, best = 8, [][]int64{left, side}, [2]bool{false, true}, l+s
+	}
+	if s+r < best {
+		assignment, channels, extraBit, best = 9, [][]int64{side, right}, [2]bool{true, false}, s+r
+	}
+	if m+s < best {
+		assignment, channels, extraBit = 10, [][]int64{mid, side}, [2]bool{false, true}
+	}
+	return assignment, channels, extraBit
+}
+
+// How a subframe is coded: the fixed predictor order, or -1 for verbatim,
+// and the Rice partitioning of the residual.
+type subframePlan struct {
+	order    int
+	residual []int64
+	rice     ricePlan
+	bits     int
+}
+
+// Size in bits of samples coded as a subframe.
+func subframeCost(samples []int64, bps int) int {
+	return planSubframe(samples, bps).bits
+}
+
+func planSubframe(samples []int64, bps int) subframePlan {
+	verbatim := subframePlan{order: -1, bits: 8 + len(samples)*bps}
+	// The order whose residual has the smallest magnitude, as the reference
+	// encoder picks it.
+	bestOrder, bestSum := -1, uint64(0)
+	var bestResidual []int64
+	for order := 0; order <= 4 && order < len(samples); order++ {
+		residual := fixedResidual(samples, order)
+		var sum uint64
+		for _, r := range residual {
+			if r < 0 {
+				r = -r
+			}
+			sum += uint64(r)
+		}
+		if bestOrder < 0 || sum < bestSum {
+			bestOrder, bestSum, bestResidual = order, sum, residual
+		}
+	}
+	if bestOrder < 0 {
+		return verbatim
+	}
+	rice := planRice(bestResidual, len(samples), bestOrder)
+	plan := subframePlan{order: bestOrder, residual: bestResidual, rice: rice, bits: 8 + bestOrder*bps + rice.bits}
+	if plan.bits >= verbatim.bits {
+		return verbatim
+	}
+	return plan
+}
+
+// The residual of a fixed predictor of the given order.
+func fixedResidual(s []int64, order int) []int64 {
+	residual := make([]int64, len(s)-order)
+	for i := order; i < len(s); i++ {
+		var prediction int64
+		switch order {
+		case 1:
+			prediction = s[i-1]
+		case 2:
+			prediction = 2*s[i-1] - s[i-2]
+		case 3:
+			prediction = 3*s[i-1] - 3*s[i-2] + s[i-3]
+		case 4:
+			prediction = 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+		}
+		residual[i-order] = s[i] - prediction
+	}
+	return residual
+}
+
+// The partitioning of a residual into 2^order parts with a Rice parameter
+// each.
+type ricePlan struct {
+	order  int
+	params []int
+	// Whether the parameters need the 5-bit coding method.
+	wide bool
+	bits int
+}
+
+// Find the cheapest partitioning of the residual of a block of blockSize
+// samples with the given predictor order.
+func planRice(residual []int64, blockSize int, predictorOrder int) ricePlan {
+	unsigned := make([]uint64, len(residual))
+	for i, r := range residual {
+		unsigned[i] = uint64(r<<1) ^ uint64(r>>63)
+	}
+	var best ricePlan
+	for order := 0; order <= 8; order++ {
+		parts := 1 << order
+		if blockSize%parts != 0 || blockSize/parts <= predictorOrder {
+			break
+		}
+		plan := ricePlan{order: order, bits: 2 + 4}
+		i := 0
+		for p := 0; p < parts; p++ {
+			n := blockSize / parts
+			if p == 0 {
+				n -= predictorOrder
+			}
+			param, bits := bestRiceParam(unsigned[i : i+n])
+			i += n
+			plan.params = append(plan.params, param)
+			plan.bits += bits
+			if param > 14 {
+				plan.wide = true
+			}
+		}
+		paramBits := 4
+		if plan.wide {
+			paramBits = 5
+		}
+		plan.bits += parts * paramBits
+		if order == 0 || plan.bits < best.bits {
+			best = plan
+		}
+	}
+	return best
+}
+
+// The Rice parameter that codes values in the fewest bits, and how many.
+func bestRiceParam(values []uint64) (param int, size int) {
+	var sum uint64
+	for _, u := range values {
+		sum += u
+	}
+	guess := 0
+	if len(values) > 0 && sum > uint64(len(values)) {
+		guess = bits.Len64(sum/uint64(len(values))) - 1
+	}
+	size = -1
+	for k := guess - 1; k <= guess+1; k++ {
+		if k < 0 || k > 30 {
+			continue
+		}
+		n := len(values) * (k + 1)
+		for _, u := range values {
+			n += int(u >> uint(k))
+		}
+		if size < 0 || n < size {
+			param, size = k, n
+		}
+	}
+	return param, size
+}
+
+func encodeSubframe(bw *flacBitWriter, samples []int64, bps int) {
+	constant := true
+	for _, s := range samples[1:] {
+		if s != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		bw.write(0, 8) // zero bit, type 0, no wasted bits
+		bw.writeSigned(samples[0], uint(bps))
+		return
+	}
+	plan := planSubframe(samples, bps)
+	if plan.order < 0 {
+		bw.write(1<<1, 8)
+		for _, s := range samples {
+			bw.writeSigned(s, uint(bps))
+		}
+		return
+	}
+	bw.write(uint64(8+plan.order)<<1, 8)
+	for _, s := range samples[:plan.order] {
+		bw.writeSigned(s, uint(bps))
+	}
+	paramBits := uint(4)
+	if plan.rice.wide {
+		paramBits = 5
+		bw.write(1, 2)
+	} else {
+		bw.write(0, 2)
+	}
+	bw.write(uint64(plan.rice.order), 4)
+	parts := 1 << plan.rice.order
+	i := 0
+	for p := 0; p < parts; p++ {
+		n := len(samples) / parts
+		if p == 0 {
+			n -= plan.order
+		}
+		param := uint(plan.rice.params[p])
+		bw.write(uint64(param), paramBits)
+		for _, r := range plan.residual[i : i+n] {
+			u := uint64(r<<1) ^ uint64(r>>63)
+			bw.writeUnary(u >> param)
+			bw.write(u&(1<<param-1), param)
+		}
+		i += n
+	}
+}
+
+// Writes bits most significant first into a byte slice.
+type flacBitWriter struct {
+	buf []byte
+	// Bits not yet written to buf, in the low nbits bits.
+	acc   uint64
+	nbits uint
+}
+
+// Write the low n bits of v.
+func (w *flacBitWriter) write(v uint64, n uint) {
+	for n > 0 {
+		take := n
+		if take > 32 {
+			take = 32
+		}
+		n -= take
+		w.acc = w.acc<<take | v>>n&(1<<take-1)
+		w.nbits += take
+		for w.nbits >= 8 {
+			w.nbits -= 8
+			w.buf = append(w.buf, byte(w.acc>>w.nbits))
+		}
+	}
+}
+
+// Write v as an n-bit two's complement number.
+func (w *flacBitWriter) writeSigned(v int64, n uint) {
+	w.write(uint64(v)&(1<<n-1), n)
+}
+
+// Write q zero bits and a one bit.
+func (w *flacBitWriter) writeUnary(q uint64) {
+	for ; q >= 32; q -= 32 {
+		w.write(0, 32)
+	}
+	w.write(1, uint(q)+1)
+}
+
+// Write a frame number the way skipCodedNumber reads it, like UTF-8.
+func (w *flacBitWriter) writeCodedNumber(v uint64) {
+	if v < 0x80 {
+		w.write(v, 8)
+		return
+	}
+	extra := 1
+	for v >= 1<<(5*uint(extra)+6) {
+		extra++
+	}
+	first := uint64(0xff00>>uint(extra+1)) & 0xff
+	w.write(first|v>>(6*uint(extra)), 8)
+	for i := extra - 1; i >= 0; i-- {
+		w.write(0x80|v>>(6*uint(i))&0x3f, 8)
+	}
+}
+
+// Pad with zero bits to a byte boundary.
+func (w *flacBitWriter) align() {
+	if w.nbits > 0 {
+		w.write(0, 8-w.nbits)
+	}
+}
+
+func flacCRC8(data []byte) uint8 {
+	var crc uint8
+	for _, c := range data {
+		crc = flacCRC8Table[crc^c]
+	}
+	return crc
+}
+
+func flacCRC16(data []byte) uint16 {
+	var crc uint16
+	for _, c := range data {
+		crc = crc<<8 ^ flacCRC16Table[byte(crc>>8)^c]
+	}
+	return crc
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FLAC metadata block types, from https://xiph.org/flac/format.html.
+// Types 7-126 are reserved and 127 is invalid.
+const (
+	flacBlockStreamInfo    = 0
+	flacBlockPadding       = 1
+	flacBlockApplication   = 2
+	flacBlockSeekTable     = 3
+	flacBlockVorbisComment = 4
+	flacBlockCueSheet      = 5
+	flacBlockPicture       = 6
+)
+
+var errNotFlac = errors.New("not a FLAC file")
+
+// The parts of a FLAC file's metadata that flaclink uses.
+type flacMetadata struct {
+	SampleRate    int
+	BitsPerSample int
+	Channels      int
+	TotalSamples  uint64
+	// MD5 of the decoded audio, or all zeros if the encoder didn't set it.
+	MD5 [16]byte
+
+	// Vorbis comments, keyed by upper-cased field name. A field may repeat.
+	Tags map[string][]string
+}
+
+// Read the metadata blocks at the start of the FLAC file at path. Audio
+// frames are not read.
+func readFlacMetadata(path string) (*flacMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readFlacMetadataBlocks(path, bufio.NewReader(f))
+}
+
+// Like readFlacMetadata, reading the file at path from r, which is left at
+// the first audio frame.
+func readFlacMetadataBlocks(path string, r *bufio.Reader) (*flacMetadata, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "fLaC" {
+		return nil, errNotFlac
+	}
+
+	meta := &flacMetadata{Tags: make(map[string][]string)}
+	for last := false; !last; {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, fmt.Errorf("%s: metadata block header: %v", path, err)
+		}
+		last = header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+
+		switch blockType {
+		case flacBlockStreamInfo, flacBlockVorbisComment:
+			block := make([]byte, length)
+			if _, err := io.ReadFull(r, block); err != nil {
+				return nil, fmt.Errorf("%s: metadata block %d: %v", path, blockType, err)
+			}
+			var err error
+			if blockType == flacBlockStreamInfo {
+				err = meta.parseStreamInfo(block)
+			} else {
+				err = meta.parseVorbisComment(block)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		default:
+			if _, err := r.Discard(length); err != nil {
+				return nil, fmt.Errorf("%s: metadata block %d: %v", path, blockType, err)
+			}
+		}
+	}
+	return meta, nil
+}
+
+func (meta *flacMetadata) parseStreamInfo(block []byte) error {
+	if len(block) < 34 {
+		return errors.New("STREAMINFO block too short")
+	}
+	// Bytes 10-17 pack sample rate (20 bits), channels-1 (3), bits per
+	// sample-1 (5) and total samples (36).
+	packed := binary.BigEndian.Uint64(block[10:18])
+	meta.SampleRate = int(packed >> 44)
+	meta.Channels = int(packed>>41&0x7) + 1
+	meta.BitsPerSample = int(packed>>36&0x1f) + 1
+	meta.TotalSamples = packed & 0xfffffffff
+	copy(meta.MD5[:], block[18:34])
+	return nil
+}
+
+// Parse a VORBIS_COMMENT block. Unlike the rest of FLAC, its lengths are
+// little-endian.
+func (meta *flacMetadata) parseVorbisComment(block []byte) error {
+	next := func() (string, error) {
+		if len(block) < 4 {
+			return "", errors.New("VORBIS_COMMENT block truncated")
+		}
+		n := binary.LittleEndian.Uint32(block)
+		block = block[4:]
+		if uint32(len(block)) < n {
+			return "", errors.New("VORBIS_COMMENT block truncated")
+		}
+		s := string(block[:n])
+		block = block[n:]
+		return s, nil
+	}
+
+	if _, err := next(); err != nil { // vendor string
+		return err
+	}
+	if len(block) < 4 {
+		return errors.New("VORBIS_COMMENT block truncated")
+	}
+	count := binary.LittleEndian.Uint32(block)
+	block = block[4:]
+	for i := uint32(0); i < count; i++ {
+		comment, err := next()
+		if err != nil {
+			return err
+		}
+		if eq := strings.IndexByte(comment, '='); eq > 0 {
+			key := strings.ToUpper(comment[:eq])
+			meta.Tags[key] = append(meta.Tags[key], comment[eq+1:])
+		}
+	}
+	return nil
+}
+
+// Returns the first value of a tag, or "" if it isn't set.
+func (meta *flacMetadata) tag(name string) string {
+	if values := meta.Tags[name]; len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// Paths of the .flac files in an album directory and its subdirectories,
+// in sorted order.
+func albumFlacFiles(albumPath string) []string {
+	var paths []string
+	filepath.Walk(albumPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && filepath.Ext(path) == ".flac" {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths
+}
+
+// Metadata of the first readable FLAC file in the album, which is taken to
+// speak for the whole album. Returns nil if no FLAC file could be read.
+func albumMetadata(album Album) *flacMetadata {
+	for _, path := range albumFlacFiles(album.Path) {
+		if meta, err := readFlacMetadata(path); err == nil {
+			return meta
+		}
+	}
+	return nil
+}
+
+// A disc number at the end of an album tag, e.g. " (Disc 2)" or " CD1".
+var albumDiscSuffix = regexp.MustCompile(`(?i)[\s,:(\[-]*\b(cd|dis[ck])\s*\d+[)\]]?\s*$`)
+
+// What identifies the album the music in dirPath is tagged as, for the
+// scanner to tell albums from parts of one album: the album artist, or else
+// the artist, and the album of its first readable FLAC file, less any disc
+// number. Returns "" if it has no album tag.
+func albumTag(dirPath string) string {
+	meta := albumMetadata(Album{Path: dirPath})
+	album := albumDiscSuffix.ReplaceAllString(tagOr(meta, "ALBUM", ""), "")
+	if strings.TrimSpace(album) == "" {
+		return ""
+	}
+	return strings.ToLower(tagOr(meta, "ALBUMARTIST", tagOr(meta, "ARTIST", "")) + "\x00" + strings.TrimSpace(album))
+}
+
+// A short description of the audio format of the album, e.g. "FLAC 24/96"
+// for 24-bit 96 kHz. Just "FLAC" if no FLAC file could be read.
+func albumFormat(album Album) string {
+	return metadataFormat(albumMetadata(album))
+}
+
+// Like albumFormat, with the album's metadata already read.
+func metadataFormat(meta *flacMetadata) string {
+	if meta == nil || meta.SampleRate == 0 {
+		return "FLAC"
+	}
+	return fmt.Sprintf("FLAC %s", meta.quality("/"))
+}
+
+// Bit depth and sample rate in kHz, separated by sep, e.g. "24/96" or
+// "16-44.1".
+func (meta *flacMetadata) quality(sep string) string {
+	return fmt.Sprintf("%d%s%g", meta.BitsPerSample, sep, float64(meta.SampleRate)/1000)
+}
+
+// Reports whether the album is hi-res: deeper than 16 bits, or sampled
+// faster than 48 kHz, unlike a CD rip. False if meta is nil.
+func (meta *flacMetadata) hiRes() bool {
+	return meta != nil && (meta.BitsPerSample > 16 || meta.SampleRate > 48000)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Propagating deletions from the source. By default the target is the
+// permanent copy: an album stays linked after its torrent is removed and its
+// source deleted, since the target's hardlinks keep the data. With
+// sync_deletes, each run first removes albums whose source is gone from the
+// target and the DB, so the target mirrors the source; "flaclink gc" does the
+// same on demand, and reports what it would remove with -n.
+//
+// An album only counts as gone if its source was under one of the source
+// dirs, and that dir is there and has something in it, so an unmounted disk
+// never looks like every album was deleted. An album whose target holds files
+// flaclink didn't put there is left alone.
+
+// Buckets of data about an album, keyed by its target dir name, that go
+// when the album is removed.
+var albumDataBuckets = [][]byte{provenanceBucketName, sourceChecksBucketName, checksumsBucketName}
+
+// Remove albums whose source is gone from the target and the DB. With -n,
+// only list them. The source dirs default to the configured ones.
+func runGc(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "list albums whose source is gone without removing them")
+	flags.Parse(args)
+	sourceDirs := uniqueDirs(flags.Args())
+	if len(sourceDirs) == 0 {
+		sourceDirs = settings.sourceDirs()
+	}
+	if len(sourceDirs) == 0 {
+		fmt.Println("Usage: flaclink gc [-n] [source dir]...")
+		os.Exit(2)
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: *dryRun})
+	defer db.Close()
+	removed := 0
+	for _, store := range catalogStores(db) {
+		removed += syncDeletes(store, sourceDirs, db, *dryRun)
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	log.Printf("%s %d albums whose source is gone.", verb, removed)
+}
+
+// Remove the albums in store whose source under sourceDirs is gone from the
+// target and from store, or with dryRun, only list them. Returns the number
+// of albums removed.
+func syncDeletes(store flaclink.Store, sourceDirs []string, db *bolt.DB, dryRun bool) int {
+	var roots []string
+	for _, dir := range sourceDirs {
+		// Sources are recorded with absolute paths.
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) == 0 {
+			log.Printf("Warning: not removing albums linked from %s, which is missing or empty; is it mounted?", dir)
+			continue
+		}
+		roots = append(roots, dir)
+	}
+	if len(roots) == 0 {
+		return 0
+	}
+
+	var albums []Album
+	err := store.ForEach(func(contents []string, dirName string) error {
+		albums = append(albums, Album{DirName: dirName, Contents: contents})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Can't list albums to remove: %v", err)
+		return 0
+	}
+	removed := 0
+	for _, album := range albums {
+		record, ok := store.Record(album)
+		if !ok || record.Source == "" || record.Target == "" || !underAny(record.Source, roots) {
+			continue
+		}
+		if _, err := os.Lstat(record.Source); !os.IsNotExist(err) {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("gone       %s (was %s)\n", record.Target, record.Source)
+			removed++
+			continue
+		}
+		if err := removeAlbum(album, record, store, db); err != nil {
+			log.Printf("Not removing album %s: %v", record.DirName, err)
+			continue
+		}
+		log.Printf("Removed album %s, as its source %s is gone.", record.DirName, record.Source)
+		removed++
+	}
+	return removed
+}
+
+// Reports whether path is inside one of dirs.
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Move the album's target directory to the trash, remove the directories
+// above it that only held it, then forget the album. The target is left as it is if it
+// holds anything flaclink didn't put there.
+func removeAlbum(album Album, record flaclink.AlbumRecord, store flaclink.Store, db *bolt.DB) error {
+	expected := flaclinkFiles(record)
+	for _, file := range record.Files {
+		if file.Linked {
+			expected[filepath.ToSlash(file.TargetPath())] = true
+		}
+	}
+	err := filepath.Walk(record.Target, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(record.Target, path)
+		if !expected[filepath.ToSlash(rel)] {
+			return fmt.Errorf("%s wasn't put there by flaclink", path)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	root := targetRoot(record.Target, record.DirName)
+	if _, err := os.Stat(record.Target); err == nil {
+		if err := moveToTrash(record.Target, root); err != nil {
+			return err
+		}
+	}
+	for dir := filepath.Dir(record.Target); root != "" && len(dir) > len(root) && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	if err := store.Remove(album); err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range albumDataBuckets {
+			if bucket := tx.Bucket(name); bucket != nil {
+				if err := bucket.Delete([]byte(record.DirName)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
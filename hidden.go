@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+)
+
+// Folders that operating systems and NAS software create alongside music,
+// such as Synology's thumbnail folders, which are never albums.
+var systemDirs = map[string]bool{
+	"@eaDir":                    true,
+	"#recycle":                  true,
+	"#snapshot":                 true,
+	"$RECYCLE.BIN":              true,
+	"System Volume Information": true,
+	"lost+found":                true,
+}
+
+// Set by -include-hidden to scan hidden and system folders too.
+var includeHidden bool
+
+func registerHiddenFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&includeHidden, "include-hidden", false, "scan hidden and system folders such as .Trash-1000 and @eaDir too")
+}
+
+// Reports whether scans should ignore the folder with this name: hidden
+// folders and systemDirs, unless -include-hidden is given or the name
+// matches a pattern in include_hidden_dirs.
+func skippedDir(name string) bool {
+	if includeHidden || !(strings.HasPrefix(name, ".") || systemDirs[name]) {
+		return false
+	}
+	for _, pattern := range settings.IncludeHiddenDirs {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Scanner for finding albums in the source and target dirs. Scans of the
+// source dir leave out directories filtered by include_dirs and exclude_dirs,
+// and scans of either leave out paths listed in .flaclinkignore files and
+// keep to the scan rate. Folders of albums are told apart by their tags.
+func albumScanner() flaclink.Scanner {
+	return flaclink.Scanner{SkipDir: skippedDir, Include: sourceDirIncluded, Ignore: ignoredPath, FS: throttledFS{flaclink.OS}, AlbumTag: albumTag}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Buckets holding a record of each run and each album linked, keyed by
+	// start or link time as big-endian Unix nanoseconds, so they sort in time
+	// order.
+	runsBucketName  = []byte("runs")
+	linksBucketName = []byte("links")
+)
+
+// A record of one run: the default command, an import, a qbittorrent run or
+// a daemon cycle.
+type Run struct {
+	Start   time.Time
+	End     time.Time
+	Command string
+	Source  string
+	Target  string
+	Linked  int
+	Skipped int
+	Errors  []string
+	// Provenance of the run, as recorded with each album it links.
+	Version    string
+	LinkMode   string
+	ConfigHash string
+	// Albums rejected without an error, such as by the pre_link hook.
+	Warnings []string
+	// The post_process commands run on the albums linked, in order.
+	PostProcess []PostProcessRecord
+}
+
+// A post_process command run on an album, as recorded with its run.
+type PostProcessRecord struct {
+	Album    string
+	Command  []string
+	Duration time.Duration
+	// The error it failed with, or "" if it succeeded.
+	Err string
+	// Its output, trimmed to the last maxRecordedOutput bytes.
+	Output string
+}
+
+// Most output kept of each post_process command in a run's record. The log
+// has all of it.
+const maxRecordedOutput = 2000
+
+// A record of one album being linked, by the run that started at Run.
+type LinkOp struct {
+	Time   time.Time
+	Run    time.Time
+	Album  string
+	Source string
+	Target string
+	Files  int
+	Bytes  int64
+}
+
+// The run in progress. Runs in one process never overlap.
+var (
+	currentRunMu sync.Mutex
+	currentRun   Run
+)
+
+// Start recording a run. source describes where albums come from.
+func beginRun(command, source string) {
+	resetAlbumCache()
+	resetIgnoreFiles()
+	prov := currentProvenance()
+	currentRunMu.Lock()
+	defer currentRunMu.Unlock()
+	currentRun = Run{
+		Start:      prov.Time,
+		Command:    command,
+		Source:     source,
+		Skipped:    -int(metrics.albumsSkipped.Load()),
+		Version:    prov.Version,
+		LinkMode:   prov.LinkMode,
+		ConfigHash: prov.ConfigHash,
+	}
+}
+
+// Note an error for the current run's record and notifications. Called by
+// countError.
+func recordRunError(album string, err error) {
+	currentRunMu.Lock()
+	defer currentRunMu.Unlock()
+	if album != "" {
+		currentRun.Errors = append(currentRun.Errors, album+": "+err.Error())
+	} else {
+		currentRun.Errors = append(currentRun.Errors, err.Error())
+	}
+}
+
+// Note an album that was rejected for the current run's record.
+func recordRunWarning(album string, reason string) {
+	currentRunMu.Lock()
+	defer currentRunMu.Unlock()
+	currentRun.Warnings = append(currentRun.Warnings, album+": "+reason)
+}
+
+// Note the outcome of a post_process command on album for the current run's
+// record.
+func recordRunPostProcess(album string, result postProcessResult) {
+	record := PostProcessRecord{Album: album, Command: result.Command, Duration: result.Duration, Output: result.Output}
+	if result.Err != nil {
+		record.Err = result.Err.Error()
+	}
+	if len(record.Output) > maxRecordedOutput {
+		record.Output = "..." + strings.ToValidUTF8(record.Output[len(record.Output)-maxRecordedOutput:], "")
+	}
+	currentRunMu.Lock()
+	defer currentRunMu.Unlock()
+	currentRun.PostProcess = append(currentRun.PostProcess, record)
+}
+
+// Finish the current run and return its record.
+func endRun(linked []Album, targetDir string) Run {
+	currentRunMu.Lock()
+	defer currentRunMu.Unlock()
+	run := currentRun
+	run.End = time.Now()
+	run.Target = targetDir
+	run.Linked = len(linked)
+	run.Skipped += int(metrics.albumsSkipped.Load())
+	currentRun = Run{Start: time.Now()}
+	return run
+}
+
+// Start time of the run in progress.
+func currentRunStart() time.Time {
+	currentRunMu.Lock()
+	defer currentRunMu.Unlock()
+	return currentRun.Start
+}
+
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+func putGob(db *bolt.DB, bucketName []byte, key []byte, value interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, buf.Bytes())
+	})
+}
+
+func saveRun(run Run, db *bolt.DB) error {
+	return putGob(db, runsBucketName, timeKey(run.Start), run)
+}
+
+// Record that album was linked into targetDir with the given decisions.
+func saveLinkOp(album Album, targetDir string, decisions []FileDecision, db *bolt.DB) error {
+	op := LinkOp{
+		Time:   time.Now(),
+		Run:    currentRunStart(),
+		Album:  album.DirName,
+		Source: album.Path,
+		Target: albumTargetPath(album, targetDir),
+	}
+	for _, d := range decisions {
+		if d.Linked {
+			op.Files++
+			op.Bytes += d.Size
+		}
+	}
+	return putGob(db, linksBucketName, timeKey(op.Time), op)
+}
+
+// Print the runs of the last -since, oldest first, with the albums each
+// linked.
+func runHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	since := flags.Duration("since", 14*24*time.Hour, "show runs started this long ago or later")
+	quiet := flags.Bool("q", false, "don't list the albums and errors of each run")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Println("Usage: flaclink history [-since duration] [-q]")
+		os.Exit(2)
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+
+	from := timeKey(time.Now().Add(-*since))
+	runs := 0
+	db.View(func(tx *bolt.Tx) error {
+		runsBucket, linksBucket := tx.Bucket(runsBucketName), tx.Bucket(linksBucketName)
+		if runsBucket == nil {
+			return nil
+		}
+		var links *bolt.Cursor
+		var linkKey, linkValue []byte
+		if linksBucket != nil {
+			links = linksBucket.Cursor()
+			linkKey, linkValue = links.Seek(from)
+		}
+		cursor := runsBucket.Cursor()
+		for k, v := cursor.Seek(from); k != nil; k, v = cursor.Next() {
+			var run Run
+			if gob.NewDecoder(bytes.NewReader(v)).Decode(&run) != nil {
+				continue
+			}
+			runs++
+			fmt.Printf("%s  %-11s %s -> %s: %d linked, %d skipped, %d errors (%s)\n",
+				run.Start.Format("2006-01-02 15:04:05"), run.Command, run.Source, run.Target,
+				run.Linked, run.Skipped, len(run.Errors), run.End.Sub(run.Start).Round(time.Millisecond))
+			// Runs from before provenance was recorded have none.
+			if run.Version != "" && !*quiet {
+				fmt.Printf("    flaclink %s, %s, config %s\n", run.Version, run.LinkMode, run.ConfigHash)
+			}
+			// Link ops are in time order too, so walk them alongside the runs.
+			for ; linkKey != nil && bytes.Compare(linkKey, timeKey(run.End)) <= 0; linkKey, linkValue = links.Next() {
+				var op LinkOp
+				if gob.NewDecoder(bytes.NewReader(linkValue)).Decode(&op) != nil || !op.Run.Equal(run.Start) || *quiet {
+					continue
+				}
+				fmt.Printf("    linked %s (%d files, %d bytes)\n", op.Album, op.Files, op.Bytes)
+			}
+			if !*quiet {
+				for _, message := range run.Errors {
+					fmt.Printf("    error: %s\n", message)
+				}
+				for _, pp := range run.PostProcess {
+					fmt.Printf("    post-process %s on %s: %s\n", pp.summary(), pp.Album, pp.outcome())
+					for _, line := range strings.Split(pp.Output, "\n") {
+						if line != "" {
+							fmt.Printf("        %s\n", line)
+						}
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if runs == 0 {
+		fmt.Printf("No runs in the last %v.\n", *since)
+	}
+}
+
+// The command, quoted, for reports.
+func (pp PostProcessRecord) summary() string {
+	return fmt.Sprintf("%q", pp.Command)
+}
+
+// How the command went, e.g. "ok in 1.2s" or "failed after 5m0s: signal:
+// killed".
+func (pp PostProcessRecord) outcome() string {
+	if pp.Err != "" {
+		return fmt.Sprintf("failed after %v: %s", pp.Duration.Round(time.Millisecond), pp.Err)
+	}
+	return fmt.Sprintf("ok in %v", pp.Duration.Round(time.Millisecond))
+}
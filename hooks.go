@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Shell commands run around linking, under "hooks" in the config file. Each
+// is run with "sh -c", with details of the album or run in FLACLINK_*
+// environment variables.
+type HooksConfig struct {
+	// Run before an album is linked. If it exits non-zero, the album is skipped.
+	PreLink string `json:"pre_link"`
+	// Run after an album is linked and recorded in the DB.
+	PostLink string `json:"post_link"`
+	// Run at the end of a run that linked at least one album.
+	PostRun string `json:"post_run"`
+}
+
+const hookTimeout = 5 * time.Minute
+
+// Run the pre-link hook for album. Returns false if the hook vetoed linking
+// it, in which case the album is reported as skipped.
+func preLinkHook(album Album, targetDir string) bool {
+	if settings.Hooks == nil || settings.Hooks.PreLink == "" {
+		return true
+	}
+	if err := runHook("pre_link", settings.Hooks.PreLink, albumHookEnv(album, targetDir)); err != nil {
+		log.Printf("pre_link hook rejected %s: %v", album.DirName, err)
+		recordRunWarning(album.DirName, "rejected by pre_link hook")
+		emitEvent(Event{Event: "skipped", Album: album.DirName, Source: album.Path, Reason: "rejected by pre_link hook"})
+		return false
+	}
+	return true
+}
+
+// Run the post-link hook for a newly linked album.
+func postLinkHook(album Album, targetDir string) {
+	if settings.Hooks == nil || settings.Hooks.PostLink == "" {
+		return
+	}
+	if err := runHook("post_link", settings.Hooks.PostLink, albumHookEnv(album, targetDir)); err != nil {
+		countError(album.DirName, err)
+		log.Printf("post_link hook failed for %s: %v", album.DirName, err)
+	}
+}
+
+// Run the post-run hook for the albums linked into targetDir by a run.
+func postRunHook(linked []Album, targetDir string) {
+	if settings.Hooks == nil || settings.Hooks.PostRun == "" {
+		return
+	}
+	names := make([]string, len(linked))
+	for i, album := range linked {
+		names[i] = album.DirName
+	}
+	env := []string{
+		"FLACLINK_TARGET_DIR=" + targetDir,
+		fmt.Sprintf("FLACLINK_LINKED_COUNT=%d", len(linked)),
+		"FLACLINK_LINKED=" + strings.Join(names, "\n"),
+	}
+	if err := runHook("post_run", settings.Hooks.PostRun, env); err != nil {
+		countError("", err)
+		log.Printf("post_run hook failed: %v", err)
+	}
+}
+
+// Environment describing album for the pre- and post-link hooks.
+func albumHookEnv(album Album, targetDir string) []string {
+	var tracks int
+	var size int64
+	filepath.Walk(album.Path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+			if filepath.Ext(path) == ".flac" {
+				tracks++
+			}
+		}
+		return nil
+	})
+	return []string{
+		"FLACLINK_SOURCE=" + album.Path,
+		"FLACLINK_TARGET=" + albumTargetPath(album, targetDir),
+		"FLACLINK_TARGET_DIR=" + targetDir,
+		"FLACLINK_ALBUM=" + album.DirName,
+		fmt.Sprintf("FLACLINK_TRACKS=%d", tracks),
+		fmt.Sprintf("FLACLINK_SIZE=%d", size),
+	}
+}
+
+// Run a hook command through the shell with env added to flaclink's own
+// environment. Its output goes to flaclink's log.
+func runHook(name string, command string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		log.Printf("%s hook output:\n%s", name, strings.TrimSpace(string(output)))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", hookTimeout)
+	}
+	return err
+}
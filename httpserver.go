@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Serve the daemon's HTTP endpoints on addr in the background:
+//
+//	POST /scan     start a scan now, like "flaclink ctl scan"
+//	GET  /healthz  200 OK while the daemon is running
+//	GET  /status   the same report as "flaclink status"
+//	GET  /metrics  Prometheus metrics, see metrics.go
+//	GET  /feed.xml the Atom feed of new albums, if configured, see feed.go
+//
+// There is no authentication, so addr should normally be a loopback address.
+func listenHTTP(addr string, state *daemonState, scanRequests chan<- chan string) net.Listener {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST to start a scan", http.StatusMethodNotAllowed)
+			return
+		}
+		reply := make(chan string, 1)
+		scanRequests <- reply
+		message := <-reply
+		if message != "Scan started." {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		fmt.Fprintln(w, message)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		state.writeStatus(w)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		feed := state.config().Feed
+		if feed == nil || feed.Path == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		http.ServeFile(w, r, feed.Path)
+	})
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatalf("daemon: %v", err)
+	}
+	log.Printf("Listening for HTTP requests on %s.", listener.Addr())
+	go http.Serve(listener, mux)
+	return listener
+}
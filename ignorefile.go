@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Name of the files listing paths for flaclink to ignore, in the style of
+// .gitignore. An ignore file applies to its own directory and everything
+// below it, so one in the source dir covers the whole source.
+const ignoreFileName = ".flaclinkignore"
+
+// One line of an ignore file.
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	// The rule re-includes what it matches, from a leading "!".
+	negate bool
+	// The rule only matches directories, from a trailing "/".
+	dirOnly bool
+	// The pattern matches paths relative to the ignore file's directory,
+	// rather than just names, since it contains a "/".
+	anchored bool
+}
+
+// Parsed ignore files by directory, or nil entries for directories without
+// one. Cleared at the start of each run, so edits take effect on the next.
+var (
+	ignoreFilesMu sync.Mutex
+	ignoreFiles   = make(map[string][]ignoreRule)
+)
+
+func resetIgnoreFiles() {
+	ignoreFilesMu.Lock()
+	defer ignoreFilesMu.Unlock()
+	ignoreFiles = make(map[string][]ignoreRule)
+}
+
+// The rules of the ignore file in dir, if it has one.
+func ignoreRules(dir string) []ignoreRule {
+	ignoreFilesMu.Lock()
+	defer ignoreFilesMu.Unlock()
+	if rules, ok := ignoreFiles[dir]; ok {
+		return rules
+	}
+	rules := readIgnoreFile(filepath.Join(dir, ignoreFileName))
+	ignoreFiles[dir] = rules
+	return rules
+}
+
+// Parse the ignore file at path. Blank lines and lines starting with "#"
+// are skipped. Returns nil if the file can't be read.
+func readIgnoreFile(path string) (rules []ignoreRule) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		rule.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		rule.pattern = globRegexp(line)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Translate a gitignore-style glob to a regular expression. "*" and "?"
+// don't match "/", while "**" matches across directories.
+func globRegexp(glob string) *regexp.Regexp {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			if end := strings.IndexByte(glob[i:], ']'); end > 0 {
+				class := glob[i+1 : i+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				re.WriteString("[" + class + "]")
+				i += end
+			} else {
+				re.WriteString(`\[`)
+			}
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		// A malformed character class; match it literally instead.
+		return regexp.MustCompile("^" + regexp.QuoteMeta(glob) + "$")
+	}
+	return compiled
+}
+
+// Reports whether path is ignored by the ignore files in its ancestor
+// directories. Files nearer to path take precedence, and within a file the
+// last matching rule wins, as with .gitignore. Ignore files themselves are
+// never linked.
+func ignoredPath(path string, isDir bool) bool {
+	if filepath.Base(path) == ignoreFileName {
+		return true
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	var dirs []string
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], abs)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, rule := range ignoreRules(dirs[i]) {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			subject := rel
+			if !rule.anchored {
+				subject = filepath.Base(abs)
+			}
+			if rule.pattern.MatchString(subject) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Link a single album into targetDir and record it in the database, skipping
+// the full source scan. Intended to be called from a torrent client's "on
+// completion" hook, so anything that isn't an album is logged and ignored.
+// Imports wait for any other run on the library, or are handed to its running
+// daemon, and then wait for one of -jobs job slots.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	jobs := flags.Int("jobs", 1, "maximum number of flaclink processes linking at once, across all libraries")
+	events := registerEventFlags(flags)
+	registerVerifyFlags(flags)
+	registerMinimumFlags(flags)
+	registerThrottleFlags(flags)
+	registerWaitStableFlag(flags)
+	logging := registerLogFlags(flags)
+	registerFailOnFlag(flags)
+	registerHiddenFlag(flags)
+	registerDirFilterFlags(flags)
+	registerConflictFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: flaclink import [-jobs n] [-wait-stable duration] [-fail-on warnings|errors|never] [-verify-flac [-strict]] [-answers file] [-no-prompt] [-log-format json] [-events jsonl] [-events-out file] <album dir> <target dir>")
+		os.Exit(2)
+	}
+	logging.setup()
+	events.open()
+	setupConflicts(true)
+	albumPath := mapReportedPath(filepath.Clean(flags.Arg(0)))
+	targetDir := filepath.Clean(flags.Arg(1))
+
+	info, err := os.Stat(albumPath)
+	if err != nil {
+		fatalf("import: %v", err)
+	}
+	if !info.IsDir() {
+		log.Printf("import: %s is not a flac album, nothing to do.", albumPath)
+		return exitNothingLinked
+	}
+	if reason := dirFilterReason(filepath.Base(albumPath)); reason != "" {
+		log.Printf("import: skipping %s, %s.", albumPath, reason)
+		return exitNothingLinked
+	}
+	if ignoredPath(albumPath, true) {
+		log.Printf("import: skipping %s, it's listed in a %s file.", albumPath, ignoreFileName)
+		return exitNothingLinked
+	}
+	albums := albumScanner().FindAlbums(albumPath)
+	if len(albums) == 0 {
+		log.Printf("import: %s is not a flac album, nothing to do.", albumPath)
+		return exitNothingLinked
+	}
+
+	// Imports queue behind other flaclink runs on the instance lock, and
+	// then for a job slot. A daemon holds the lock for as long as it runs,
+	// so while one is running, it's handed the album instead.
+	for waiting := false; ; time.Sleep(slotPollInterval) {
+		if run, ok := importViaDaemon(albumPath, targetDir); ok {
+			return exitStatus(run)
+		}
+		holder, ok := tryLockInstance()
+		if ok {
+			break
+		}
+		if !waiting {
+			log.Printf("Another flaclink is running (%s), waiting for it to finish.", holder)
+			waiting = true
+		}
+	}
+	// Read-only commands may still hold the DB briefly, so wait for it
+	// rather than giving up after the usual 100ms.
+	db := openAlbumDb(&bolt.Options{Timeout: 30 * time.Second})
+	defer db.Close()
+	slot := acquireSlot(*jobs)
+	defer slot.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	_, run := importAlbums(ctx, albums, albumPath, targetDir, db)
+	return exitStatus(run)
+}
+
+// Link albums, found at albumPath, into targetDir and record the run.
+// Returns the albums linked and the run.
+func importAlbums(ctx context.Context, albums []Album, albumPath, targetDir string, db *bolt.DB) ([]Album, Run) {
+	beginRun("import", albumPath)
+	var linked []Album
+	for _, album := range albums {
+		if album, ok := processAlbum(ctx, album, targetDir, db); ok {
+			linked = append(linked, album)
+		}
+	}
+	return linked, finishRun(linked, targetDir, db)
+}
+
+// An import handed to the daemon by "flaclink import" over the control
+// socket. The daemon's loop answers on Reply once it's done.
+type importRequest struct {
+	AlbumPath string
+	TargetDir string
+	Reply     chan Run
+}
+
+// If a daemon is running for this library, have it import the album at
+// albumPath into targetDir, and return the run it reports. Returns false if
+// no daemon is running, or it stopped before finishing the import.
+func importViaDaemon(albumPath, targetDir string) (Run, bool) {
+	conn, err := net.Dial("unix", controlSocketPath())
+	if err != nil {
+		return Run{}, false
+	}
+	defer conn.Close()
+	absAlbum, _ := filepath.Abs(albumPath)
+	absTarget, _ := filepath.Abs(targetDir)
+	log.Printf("Handing %s to the running flaclink daemon.", albumPath)
+	fmt.Fprintf(conn, "import\t%s\t%s\n", absAlbum, absTarget)
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	var run Run
+	var errors, warnings int
+	if _, err := fmt.Sscanf(line, "linked %d, %d errors, %d warnings", &run.Linked, &errors, &warnings); err != nil {
+		log.Printf("The daemon didn't import %s, importing it here.", albumPath)
+		return Run{}, false
+	}
+	run.Errors = make([]string, errors)
+	run.Warnings = make([]string, warnings)
+	log.Printf("The daemon linked %d albums from %s, with %d errors and %d warnings; see its log for details.", run.Linked, albumPath, errors, warnings)
+	return run, true
+}
+
+// Like startCycle, but importing the album at request.AlbumPath for
+// "flaclink import". The run is sent on request.Reply unless the daemon is
+// stopping, in which case the import is left for the command to run itself.
+func startImport(ctx context.Context, cfg Config, db *bolt.DB, state *daemonState, request importRequest) <-chan struct{} {
+	settings = cfg
+	state.cycleStarted(cfg)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		slot := acquireSlot(1)
+		defer slot.Close()
+		albums := albumScanner().FindAlbums(request.AlbumPath)
+		linked, run := importAlbums(ctx, albums, request.AlbumPath, request.TargetDir, db)
+		if ctx.Err() == nil {
+			request.Reply <- run
+		}
+		if state.dashboard && ctx.Err() == nil {
+			state.setPending(pendingAlbums(db))
+		}
+		state.cycleFinished(linked)
+	}()
+	return done
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A portable record of the albums under a source dir, so links can be
+// planned while the source is offline, e.g. an archive disk that isn't
+// plugged in. Paths are relative to Root.
+type Index struct {
+	Root   string
+	Built  time.Time
+	Albums []IndexAlbum
+}
+
+// An album as found by findAlbums, with enough of it recorded to check the
+// database and apply the target template without reading the disk.
+type IndexAlbum struct {
+	Path      string
+	DirName   string
+	Contents  []string
+	Container string `json:",omitempty"`
+	Files     []FileDecision
+	Tags      map[string][]string `json:",omitempty"`
+}
+
+// Build or use an index of a source dir.
+func runIndex(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: flaclink index build [-o file] <source dir>")
+		fmt.Println("       flaclink index plan <index file> [target dir]")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "build":
+		runIndexBuild(args[1:])
+	case "plan":
+		runIndexPlan(args[1:])
+	default:
+		fmt.Printf("Unknown index command %q.\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// Write an index of the albums in a source dir, as JSON.
+func runIndexBuild(args []string) {
+	flags := flag.NewFlagSet("index build", flag.ExitOnError)
+	out := flags.String("o", "flaclink-index.json", "file to write the index to")
+	registerHiddenFlag(flags)
+	registerDirFilterFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: flaclink index build [-o file] <source dir>")
+		os.Exit(2)
+	}
+	sourceDir := filepath.Clean(flags.Arg(0))
+
+	index, err := buildIndex(sourceDir)
+	if err != nil {
+		fatalf("index build: %v", err)
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		fatalf("index build: %v", err)
+	}
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		fatalf("index build: %v", err)
+	}
+	log.Printf("Indexed %d albums in %s to %s.", len(index.Albums), sourceDir, *out)
+}
+
+func buildIndex(sourceDir string) (*Index, error) {
+	root, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{Root: root, Built: time.Now()}
+	for _, entry := range entries {
+		if entry.IsDir() && skippedDir(entry.Name()) {
+			continue
+		}
+		for _, album := range albumScanner().FindAlbums(filepath.Join(root, entry.Name())) {
+			indexed := IndexAlbum{DirName: album.DirName, Contents: album.Contents}
+			indexed.Path, _ = filepath.Rel(root, album.Path)
+			if album.Container != "" {
+				indexed.Container, _ = filepath.Rel(root, album.Container)
+			}
+			filepath.Walk(album.Path, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					relPath, _ := filepath.Rel(album.Path, path)
+					indexed.Files = append(indexed.Files, FileDecision{Path: relPath, Linked: !excludedFile(info.Name()), Size: info.Size()})
+				}
+				return nil
+			})
+			if meta := albumMetadata(album); meta != nil {
+				indexed.Tags = meta.Tags
+			}
+			index.Albums = append(index.Albums, indexed)
+		}
+	}
+	return index, nil
+}
+
+func loadIndex(path string) (*Index, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return index, nil
+}
+
+// Print what a run would do with the albums in an index: which would be
+// linked and where, which are already in the database, and which would
+// collide with something in the target. Nothing is linked or recorded. The
+// target dir defaults to target_dir from the config file.
+func runIndexPlan(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: flaclink index plan <index file> [target dir]")
+		os.Exit(2)
+	}
+	targetDir := settings.TargetDir
+	if len(args) == 2 {
+		targetDir = filepath.Clean(args[1])
+	}
+	if targetDir == "" {
+		fatalf("index plan: no target dir given and target_dir isn't set in %s", ConfigPath)
+	}
+	index, err := loadIndex(args[0])
+	if err != nil {
+		fatalf("index plan: %v", err)
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+
+	fmt.Printf("Index of %s, built %s.\n", index.Root, index.Built.Format(time.RFC1123))
+	var toLink, inDB, collisions int
+	var bytes int64
+	for _, indexed := range index.Albums {
+		album := indexed.album(index.Root)
+		if dirName, ok := lookupAlbum(album, db); ok {
+			inDB++
+			fmt.Printf("skip     %s (in DB as %s)\n", indexed.Path, dirName)
+			continue
+		}
+		var meta *flacMetadata
+		if indexed.Tags != nil {
+			meta = &flacMetadata{Tags: indexed.Tags}
+		}
+		applyTemplateMeta(&album, meta)
+		if settings.TargetTemplate != "" {
+			reconcileDirName(&album, targetDir)
+		}
+		if _, err := os.Lstat(albumTargetPath(album, targetDir)); err == nil {
+			collisions++
+			fmt.Printf("collide  %s -> %s (target exists)\n", indexed.Path, album.DirName)
+			continue
+		}
+		toLink++
+		for _, file := range indexed.Files {
+			if file.Linked {
+				bytes += file.Size
+			}
+		}
+		fmt.Printf("link     %s -> %s\n", indexed.Path, album.DirName)
+	}
+	fmt.Printf("%d albums to link (%d bytes), %d already in DB, %d collisions.\n", toLink, bytes, inDB, collisions)
+}
+
+// The album as findAlbums found it, with paths under root.
+func (indexed IndexAlbum) album(root string) Album {
+	album := Album{
+		DirName:  indexed.DirName,
+		Contents: indexed.Contents,
+		Path:     filepath.Join(root, indexed.Path),
+	}
+	if indexed.Container != "" {
+		album.Container = filepath.Join(root, indexed.Container)
+	}
+	return album
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// Set by -wait to queue behind a running flaclink instead of exiting.
+// Imports always wait. canWaitForLock is set for commands with -wait.
+var waitForLock, canWaitForLock bool
+
+// The instance lock file, once opened, and whether this process holds the
+// lock. It's held until exit.
+var (
+	instanceLock   *os.File
+	instanceLocked bool
+)
+
+func registerWaitLockFlag(flags *flag.FlagSet) {
+	canWaitForLock = true
+	flags.BoolVar(&waitForLock, "wait", false, "wait for a running flaclink to finish instead of exiting")
+}
+
+// Path of the lock file that only one flaclink writing the album DB can hold
+// at a time.
+func instanceLockPath() string {
+	return libraryPath("lock")
+}
+
+// Take the instance lock, so that only one flaclink process writes the album
+// DB at a time, rather than the second failing on the DB's own lock with a
+// timeout. If another process holds it, exit saying which, or with -wait,
+// wait for it to finish. The lock file records the holder's PID and command
+// line for that message.
+//
+// Commands that also take a job slot take this lock first; see acquireSlot.
+func lockInstance() {
+	holder, ok := tryLockInstance()
+	if ok {
+		return
+	}
+	if !waitForLock && canWaitForLock {
+		fatalf("another flaclink is running (%s); run with -wait to queue behind it", holder)
+	}
+	if !waitForLock {
+		fatalf("another flaclink is running (%s); try again once it's finished", holder)
+	}
+	log.Printf("Another flaclink is running (%s), waiting for it to finish.", holder)
+	if err := lockFile(instanceLock, true); err != nil {
+		fatalf("lock: %v", err)
+	}
+	claimInstanceLock()
+}
+
+// Take the instance lock if it's free. Otherwise return a description of
+// the process holding it, leaving instanceLock open but unlocked.
+func tryLockInstance() (holder string, ok bool) {
+	if instanceLock == nil {
+		f, err := os.OpenFile(instanceLockPath(), os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			fatalf("lock: %v", err)
+		}
+		instanceLock = f
+	} else if instanceLocked {
+		return "", true
+	}
+	if err := lockFile(instanceLock, false); err != nil {
+		contents, _ := ioutil.ReadFile(instanceLockPath())
+		holder = strings.TrimSpace(string(contents))
+		if holder == "" {
+			holder = "unknown process"
+		}
+		return holder, false
+	}
+	claimInstanceLock()
+	return "", true
+}
+
+// Record this process as the holder of the lock just taken.
+func claimInstanceLock() {
+	instanceLock.Truncate(0)
+	instanceLock.WriteAt([]byte(fmt.Sprintf("pid %d: %s\n", os.Getpid(), strings.Join(os.Args, " "))), 0)
+	instanceLocked = true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Settings for refreshing a Jellyfin or Emby library after a run, under
+// "jellyfin" in the config file. For Emby, include the "/emby" prefix in URL.
+type JellyfinConfig struct {
+	URL    string `json:"url"`
+	APIKey string `json:"api_key"`
+	// Name of the library to refresh. If empty, the library with a folder
+	// containing the target dir is used, or every library if none does.
+	Library string `json:"library"`
+}
+
+var jellyfinClient = &http.Client{Timeout: 30 * time.Second}
+
+// Ask Jellyfin or Emby to refresh the library holding targetDir. Does nothing
+// unless Jellyfin is configured. Failures are logged, since the albums are
+// linked either way.
+func refreshJellyfin(targetDir string) {
+	jf := settings.Jellyfin
+	if jf == nil || jf.URL == "" {
+		return
+	}
+	libraryID, libraryName, err := jf.libraryFor(targetDir)
+	if err != nil {
+		countError("", err)
+		log.Printf("Jellyfin refresh failed: %v", err)
+		return
+	}
+
+	apiPath := "/Library/Refresh"
+	if libraryID != "" {
+		apiPath = "/Items/" + libraryID + "/Refresh?Recursive=true"
+	}
+	resp, err := jf.request("POST", apiPath)
+	if err != nil {
+		countError("", err)
+		log.Printf("Jellyfin refresh failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if libraryName == "" {
+		libraryName = "all libraries"
+	}
+	log.Printf("Jellyfin accepted a refresh of %s.", libraryName)
+}
+
+// Find the library to refresh: the configured one, or the one whose folders
+// contain targetDir. Returns an empty ID to refresh every library.
+func (jf *JellyfinConfig) libraryFor(targetDir string) (id string, name string, err error) {
+	resp, err := jf.request("GET", "/Library/VirtualFolders")
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var folders []struct {
+		Name      string
+		ItemId    string
+		Locations []string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&folders); err != nil {
+		return "", "", fmt.Errorf("Library/VirtualFolders: %v", err)
+	}
+	for _, folder := range folders {
+		if jf.Library != "" {
+			if strings.EqualFold(folder.Name, jf.Library) {
+				return folder.ItemId, folder.Name, nil
+			}
+			continue
+		}
+		for _, location := range folder.Locations {
+			rel, err := filepath.Rel(location, targetDir)
+			if err == nil && !strings.HasPrefix(rel, "..") {
+				return folder.ItemId, folder.Name, nil
+			}
+		}
+	}
+	if jf.Library != "" {
+		return "", "", fmt.Errorf("no library named %q", jf.Library)
+	}
+	return "", "", nil
+}
+
+// Make an API request, returning the response if it succeeded. The caller
+// must close the response body.
+func (jf *JellyfinConfig) request(method string, apiPath string) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(jf.URL, "/")+apiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Emby-Token", jf.APIKey)
+	resp, err := jellyfinClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, apiPath, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Separate libraries on one machine, such as one for the family's music and
+// one for your own, each keep their own album DB, given with --db before or
+// after the subcommand:
+//
+//	flaclink --db ~/music/family.db /downloads/family /music/family
+//
+// Each library has its own instance lock and daemon control socket next to
+// its DB, so runs for one never wait on another. The config file, logs and
+// job slots are shared.
+
+// Whether the album DB is somewhere other than albums.db in the app data
+// dir, given with --db or by portable_db.
+var dbOverridden bool
+
+// Remove --db (or -db) and its value from os.Args, wherever it is, before
+// the subcommands parse their flags, and return its absolute path, or "" if
+// it wasn't given. Arguments after "--" are left alone.
+func takeDbFlag() string {
+	var path string
+	args := os.Args[:1]
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		if arg == "--" {
+			args = append(args, os.Args[i:]...)
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		switch {
+		case (arg == "-db" || arg == "--db") && i+1 < len(os.Args):
+			path = os.Args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-") && strings.HasPrefix(name, "db="):
+			path = strings.TrimPrefix(name, "db=")
+		default:
+			args = append(args, arg)
+		}
+	}
+	os.Args = args
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	dbOverridden = true
+	return path
+}
+
+// Path of the library's file with extension ext, such as its lock: in the
+// app data dir for the default DB, or next to a DB given with --db.
+func libraryPath(ext string) string {
+	if dbOverridden {
+		return AlbumDbPath + "." + ext
+	}
+	return filepath.Join(AppDataPath, "flaclink."+ext)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+)
+
+// How flaclink puts albums into the target. Hardlinks are the default: they
+// need no special rights, and the target keeps the music if the source goes.
+// They can't cross volumes, though, and on Windows some setups, such as
+// ReFS or network drives, don't support them, so link_mode can ask for
+// symlinks instead. Creating symlinks on Windows needs developer mode or
+// administrator rights. Junctions aren't offered: they only link whole
+// directories, which would leave nothing for exclude_files, disc_layout or
+// sanitize_names to work on.
+const (
+	linkModeHardlink = "hardlink"
+	linkModeSymlink  = "symlink"
+)
+
+func validateLinkMode(mode string) error {
+	switch mode {
+	case "", linkModeHardlink, linkModeSymlink:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, want %q or %q", mode, linkModeHardlink, linkModeSymlink)
+}
+
+// The link_mode in effect, hardlink unless set.
+func linkMode() string {
+	if settings.LinkMode == "" {
+		return linkModeHardlink
+	}
+	return settings.LinkMode
+}
+
+// An FS that creates symlinks where it's asked for hardlinks. Links point at
+// the absolute path of their source file, so they resolve from anywhere.
+type symlinkFS struct {
+	flaclink.FS
+}
+
+func (s symlinkFS) Link(oldname, newname string) error {
+	abs, err := filepath.Abs(oldname)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(abs, newname)
+}
+
+// Link the file at oldname to newname under the current link_mode, for files
+// linked outside a Linker.
+func linkFile(oldname, newname string) error {
+	if linkMode() == linkModeSymlink {
+		return symlinkFS{}.Link(oldname, newname)
+	}
+	return os.Link(oldname, newname)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings for the log file at logs/flaclink.log in the app data dir, under
+// "log_file" in the config file. Logs always go to stderr as well.
+type LogFileConfig struct {
+	Disabled bool `json:"disabled"`
+	// Size at which the log file is rotated. Defaults to 10.
+	MaxSizeMB int `json:"max_size_mb"`
+	// Rotated log files to keep, and how long to keep them. Default to 5
+	// files and 30 days.
+	MaxFiles   int `json:"max_files"`
+	MaxAgeDays int `json:"max_age_days"`
+}
+
+const (
+	logFileName          = "flaclink.log"
+	defaultLogMaxSizeMB  = 10
+	defaultLogMaxFiles   = 5
+	defaultLogMaxAgeDays = 30
+)
+
+// Where log output goes: stderr, and the log file once it's open.
+var logOutput io.Writer = os.Stderr
+
+// Send log output to the log file as well as stderr, unless it's disabled.
+// Without this, output from runs started by a torrent client is lost.
+func openLogFile() {
+	lc := LogFileConfig{}
+	if settings.LogFile != nil {
+		lc = *settings.LogFile
+	}
+	if lc.Disabled {
+		return
+	}
+	if lc.MaxSizeMB <= 0 {
+		lc.MaxSizeMB = defaultLogMaxSizeMB
+	}
+	if lc.MaxFiles <= 0 {
+		lc.MaxFiles = defaultLogMaxFiles
+	}
+	if lc.MaxAgeDays <= 0 {
+		lc.MaxAgeDays = defaultLogMaxAgeDays
+	}
+
+	dir := filepath.Join(AppDataPath, "logs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Can't create log dir: %v", err)
+		return
+	}
+	rw := &rotatingWriter{path: filepath.Join(dir, logFileName), config: lc}
+	if err := rw.open(); err != nil {
+		log.Printf("Can't open log file: %v", err)
+		return
+	}
+	logOutput = io.MultiWriter(os.Stderr, rw)
+	log.SetOutput(logOutput)
+}
+
+// A log file that is renamed with a timestamp suffix once it reaches the
+// maximum size, with the oldest rotated files removed. Several flaclink
+// processes may share the log file, so each write checks whether another
+// process has rotated it first.
+type rotatingWriter struct {
+	mu     sync.Mutex
+	path   string
+	config LogFileConfig
+	file   *os.File
+}
+
+func (rw *rotatingWriter) open() error {
+	f, err := os.OpenFile(rw.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	rw.file = f
+	return nil
+}
+
+func (rw *rotatingWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	current, err := os.Stat(rw.path)
+	open, openErr := rw.file.Stat()
+	if err != nil || openErr != nil || !os.SameFile(current, open) {
+		// Rotated by another process.
+		rw.file.Close()
+		if err := rw.open(); err != nil {
+			return 0, err
+		}
+	} else if current.Size()+int64(len(p)) > int64(rw.config.MaxSizeMB)<<20 {
+		rw.rotate()
+	}
+	return rw.file.Write(p)
+}
+
+// Rename the log file out of the way, start a new one, and prune old ones.
+// Errors are ignored, so a log file that can't be rotated just keeps growing.
+func (rw *rotatingWriter) rotate() {
+	rotated := strings.TrimSuffix(rw.path, ".log") + "-" + time.Now().Format("20060102T150405.000") + ".log"
+	if err := os.Rename(rw.path, rotated); err != nil {
+		return
+	}
+	rw.file.Close()
+	if err := rw.open(); err != nil {
+		// Keep writing to the renamed file rather than losing output.
+		rw.file, _ = os.OpenFile(rotated, os.O_WRONLY|os.O_APPEND, 0644)
+		return
+	}
+
+	old, _ := filepath.Glob(strings.TrimSuffix(rw.path, ".log") + "-*.log")
+	sort.Sort(sort.Reverse(sort.StringSlice(old)))
+	cutoff := time.Now().AddDate(0, 0, -rw.config.MaxAgeDays)
+	for i, path := range old {
+		info, err := os.Stat(path)
+		if i >= rw.config.MaxFiles || (err == nil && info.ModTime().Before(cutoff)) {
+			os.Remove(path)
+		}
+	}
+}
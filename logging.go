@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+)
+
+// Set by -log-format json. Log lines are then JSON objects, and each event
+// (see events.go) is also logged with its fields as attributes, so logs can
+// be shipped to Loki or similar and queried by album or error.
+var jsonLogs bool
+
+// The -log-format flag shared by commands that link albums.
+type logFlags struct {
+	format *string
+}
+
+func registerLogFlags(flags *flag.FlagSet) logFlags {
+	return logFlags{format: flags.String("log-format", "text", "log format, text or json")}
+}
+
+// Switch to JSON logging if the flags ask for it. Call after parsing flags.
+// Existing log.Printf calls go through slog's default handler from then on.
+func (lf logFlags) setup() {
+	switch *lf.format {
+	case "text":
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(logOutput, nil)))
+		jsonLogs = true
+	default:
+		fatalf("unknown -log-format %q, expected text or json", *lf.format)
+	}
+}
+
+// Log an event as a structured record, if JSON logging is on.
+func logEvent(event Event) {
+	if !jsonLogs {
+		return
+	}
+	attrs := []any{slog.String("event", event.Event)}
+	for _, field := range []struct{ key, value string }{
+		{"album", event.Album},
+		{"source", event.Source},
+		{"target", event.Target},
+		{"reason", event.Reason},
+		{"error", event.Error},
+	} {
+		if field.value != "" {
+			attrs = append(attrs, slog.String(field.key, field.value))
+		}
+	}
+	if event.Duration != 0 {
+		attrs = append(attrs, slog.Float64("duration", event.Duration))
+	}
+	level := slog.LevelInfo
+	if event.Event == "error" {
+		level = slog.LevelError
+	}
+	slog.Log(context.Background(), level, "album "+event.Event, attrs...)
+}
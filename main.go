@@ -2,260 +2,666 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
-	"os/user"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/kylegentle/flaclink/pkg/flaclink"
 	bolt "go.etcd.io/bbolt"
 )
 
 var (
 	AppDataPath string
 	AlbumDbPath string
-	bucketName  []byte = []byte("albums")
+	ConfigPath  string
+	bucketName  []byte = flaclink.AlbumsBucket
 )
 
 // Create local app data directory and initialize database.
 func init() {
-	AppDataPath = setupAppDataDir()
+	dropPrivileges()
+	AppDataPath = createAppDataDir()
 	AlbumDbPath = filepath.Join(AppDataPath, "albums.db")
+	if path := takeDbFlag(); path != "" {
+		AlbumDbPath = path
+	}
+	var err error
+	switch {
+	case os.Getenv(configEnv) != "":
+		ConfigPath = os.Getenv(configEnv)
+	case os.Getenv(dataDirEnv) != "":
+		ConfigPath = filepath.Join(AppDataPath, "config.json")
+	default:
+		if ConfigPath, err = defaultConfigPath(AppDataPath); err != nil {
+			fatal(err)
+		}
+	}
 }
 
-type Album struct {
-	DirName  string
-	Contents []string
-}
+// See flaclink.Album. Most of flaclink's core lives in pkg/flaclink, so that
+// other programs can embed it.
+type Album = flaclink.Album
 
 // Update the local album database with albums in target dir, then link
-// new albums from source dir.
+// new albums from source dir. Subcommands provide other ways of finding albums.
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Println("Usage: flaclink <source dir> <target dir>")
-		return
-	}
-	source := filepath.Clean(os.Args[1])
-	dest := filepath.Clean(os.Args[2])
-	updateAlbumDb(dest)
-	linkNewAlbums(source, dest)
-}
+	if cfg, err := loadConfig(ConfigPath); err == nil {
+		settings = cfg
+	} else if !os.IsNotExist(err) {
+		fatal(err)
+	}
+	openLogFile()
+	useAlbumDb(settings)
 
-// Find albums among directories in the top level of musicDir. When an album is found,
-// check to see if it's in the database. If not, add it.
-func updateAlbumDb(musicDir string) error {
-	log.Printf("Updating local DB with flac albums already in target dir %s.", musicDir)
-	musicFiles, err := ioutil.ReadDir(musicDir)
-	if err != nil {
-		log.Fatalf("updateAlbumDb: failed to read directory %s", musicDir)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "qbittorrent":
+			os.Exit(runQbittorrent(os.Args[2:]))
+		case "daemon":
+			runDaemon(os.Args[2:])
+			return
+		case "entrypoint":
+			runEntrypoint(os.Args[2:])
+			return
+		case "preview-name":
+			runPreviewName(os.Args[2:])
+			return
+		case "ctl":
+			runCtl(os.Args[2:])
+			return
+		case "status":
+			if len(os.Args) == 2 {
+				runCtl([]string{"status"})
+				return
+			}
+			runStatus(os.Args[2:])
+			return
+		case "db":
+			runDb(os.Args[2:])
+			return
+		case "check-source":
+			runCheckSource(os.Args[2:])
+			return
+		case "scrub":
+			runScrub(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "index":
+			runIndex(os.Args[2:])
+			return
+		case "history":
+			runHistory(os.Args[2:])
+			return
+		case "stats":
+			runStats(os.Args[2:])
+			return
+		case "dupes":
+			runDupes(os.Args[2:])
+			return
+		case "orphans":
+			runOrphans(os.Args[2:])
+			return
+		case "gc":
+			runGc(os.Args[2:])
+			return
+		case "trash":
+			runTrash(os.Args[2:])
+			return
+		case "dedupe":
+			runDedupe(os.Args[2:])
+			return
+		case "review":
+			runReview(os.Args[2:])
+			return
+		case "quarantine":
+			runQuarantine(os.Args[2:])
+			return
+		case "tui":
+			runTui(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "relink":
+			runRelink(os.Args[2:])
+			return
+		case "why":
+			runWhy(os.Args[2:])
+			return
+		case "adopt":
+			runAdopt(os.Args[2:])
+			return
+		case "support-bundle":
+			runSupportBundle(os.Args[2:])
+			return
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		case "version":
+			fmt.Printf("flaclink %s (config %s)\n", flaclinkVersion(), configHash())
+			return
+		}
 	}
+	os.Exit(runLink())
+}
 
-	db, err := bolt.Open(AlbumDbPath, 0640, &bolt.Options{Timeout: 100 * time.Millisecond})
-	if err != nil {
-		log.Fatal(err)
+// Link new albums from the source dir given on the command line into the
+// target dir. Returns the exit status.
+func runLink() int {
+	events := registerEventFlags(flag.CommandLine)
+	registerVerifyFlags(flag.CommandLine)
+	registerMinimumFlags(flag.CommandLine)
+	registerThrottleFlags(flag.CommandLine)
+	registerWaitLockFlag(flag.CommandLine)
+	logging := registerLogFlags(flag.CommandLine)
+	flag.Var(&activeShard, "shard", "only scan the k-th of n slices of the source and target dirs, as k/n")
+	registerFailOnFlag(flag.CommandLine)
+	registerHiddenFlag(flag.CommandLine)
+	registerDirFilterFlags(flag.CommandLine)
+	registerPermFlags(flag.CommandLine)
+	registerFullScanFlag(flag.CommandLine)
+	registerConflictFlags(flag.CommandLine)
+	flag.Var(&sourceFlags, "source", "another source dir to link albums from; repeatable")
+	flag.Parse()
+	// With profiles, the targets come from the config file, so every
+	// argument is a source dir.
+	targetArgs := 1
+	if len(settings.Profiles) > 0 {
+		targetArgs = 0
 	}
+	if flag.NArg()+len(sourceFlags) <= targetArgs || flag.NArg() < targetArgs {
+		fmt.Println("Usage: flaclink [-source dir]... [-wait] [-full-scan] [-shard k/n] [-include-hidden] [-include-dir pattern] [-exclude-dir pattern] [-min-tracks n] [-min-size bytes] [-io-limit bytes] [-scan-rate n] [-dir-mode mode] [-file-mode mode] [-fail-on warnings|errors|never] [-verify-flac [-strict]] [-answers file] [-no-prompt] [-log-format json] [-events jsonl] [-events-out file] [-json-events] <source dir>... <target dir>")
+		fmt.Println("       flaclink import [-jobs n] [-wait-stable duration] <album dir> <target dir>")
+		fmt.Println("       flaclink qbittorrent [-url url] [-category name] <target dir>")
+		fmt.Println("       flaclink daemon [-config file]")
+		fmt.Println("       flaclink entrypoint [daemon flags]")
+		fmt.Println("       flaclink preview-name <album dir> [target dir]")
+		fmt.Println("       flaclink ctl <scan|status|recent>")
+		fmt.Println("       flaclink status [<source dir> <target dir>]")
+		fmt.Println("       flaclink db merge <other albums.db>")
+		fmt.Println("       flaclink db migrate")
+		fmt.Println("       flaclink db export > albums.json")
+		fmt.Println("       flaclink db import <albums.json>")
+		fmt.Println("       flaclink db rebuild [-n] <source dir> <target dir>")
+		fmt.Println("       flaclink db remap [-n] -from <old prefix> -to <new prefix>")
+		fmt.Println("       flaclink check-source [-budget duration]")
+		fmt.Println("       flaclink scrub [-budget duration] [-rate bytes] [-accept]")
+		fmt.Println("       flaclink export [-format beets|musicbrainz] [-o file] [target dir]")
+		fmt.Println("       flaclink index build [-o file] <source dir>")
+		fmt.Println("       flaclink index plan <index file> [target dir]")
+		fmt.Println("       flaclink history [-since duration] [-q]")
+		fmt.Println("       flaclink stats")
+		fmt.Println("       flaclink dupes [-fs] [-similarity fraction]")
+		fmt.Println("       flaclink orphans <source dir>... <target dir>")
+		fmt.Println("       flaclink gc [-n] [source dir]...")
+		fmt.Println("       flaclink trash empty [-older-than age] [target dir]...")
+		fmt.Println("       flaclink dedupe [-n] [-min-size bytes] <target dir>")
+		fmt.Println("       flaclink review [approve|reject <n|album dir>...]")
+		fmt.Println("       flaclink quarantine list|approve [-as name]|reject <n|album dir>...")
+		fmt.Println("       flaclink tui [<source dir>... <target dir>]")
+		fmt.Println("       flaclink verify [-repair] <source dir> <target dir>")
+		fmt.Println("       flaclink relink [-n] <source dir> <target dir>")
+		fmt.Println("       flaclink why [-include-hidden] [-include-dir pattern] [-exclude-dir pattern] <album dir> [target dir]")
+		fmt.Println("       flaclink adopt [-n] <source dir> <target dir>")
+		fmt.Println("       flaclink support-bundle [-o file] [-max-entries n] [source dir] [target dir]")
+		fmt.Println("       flaclink analyze [-min-cutoff hz] <album dir|flac file>...")
+		fmt.Println("       flaclink version")
+		return 2
+	}
+	sources := uniqueDirs(append(append([]string(nil), flag.Args()[:flag.NArg()-targetArgs]...), sourceFlags...))
+	dest := ""
+	if targetArgs > 0 {
+		dest = filepath.Clean(flag.Arg(flag.NArg() - 1))
+	}
+	logging.setup()
+	events.open()
+	setupConflicts(true)
+	// Take the instance lock before a job slot, as every command does.
+	lockInstance()
+	slot := acquireSlot(1)
+	defer slot.Close()
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
 	defer db.Close()
 
-	for _, file := range musicFiles {
-		if !file.IsDir() {
-			log.Printf("skipping regular file: %s", file.Name())
-			continue
+	ctx, cancel := interruptContext()
+	defer cancel()
+	_, status := linkProfiles(ctx, "link", sources, dest, db)
+	return status
+}
+
+// Albums updateAlbumDb adds to the DB per transaction. Each transaction
+// waits for the disk, so adding albums one at a time to a new DB for a big
+// target takes minutes.
+const albumDbBatchSize = 1000
+
+// Find albums among directories in musicDir, at the depth where the target
+// template puts them. When an album is found, check to see if it's in the
+// database. If not, add it. Albums are added in batches, and the albums found
+// so far are added if ctx is cancelled.
+func updateAlbumDb(ctx context.Context, musicDir string, db *bolt.DB) error {
+	log.Printf("Updating local DB with flac albums already in target dir %s.", musicDir)
+	store := albumStore(db)
+	var batch []Album
+	// Contents of the albums in batch, which the store doesn't know yet.
+	batched := make(map[string]bool)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := store.AddAll(batch); err != nil {
+			log.Printf("Can't add %d existing albums to DB: %v", len(batch), err)
+		}
+		batch = batch[:0]
+		batched = make(map[string]bool)
+	}
+	defer flush()
+	var contentPaths []string
+	for _, relPath := range targetAlbumDirsWithRoutes(musicDir) {
+		if activeShard.includes(relPath) {
+			contentPaths = append(contentPaths, filepath.Join(musicDir, relPath))
+		}
+	}
+	scanned := scanInParallel(ctx, contentPaths, func(contentPath string) []Album {
+		if !albumScanner().IsAlbum(contentPath) {
+			return nil
 		}
-		contentPath := filepath.Join(musicDir, file.Name())
-		if isAlbum(contentPath) {
-			album := newAlbum(contentPath)
-			if !inDb(album, db) {
+		return []Album{flaclink.NewAlbum(contentPath)}
+	}, func(contentPath string, albums []Album) {
+		relPath, _ := filepath.Rel(musicDir, contentPath)
+		for _, album := range albums {
+			album.DirName = relPath
+			if matchesDecisions(contentPath, relPath, db) {
+				// Linked by flaclink; any missing files were excluded on purpose.
+				continue
+			}
+			key := strings.Join(album.Contents, "\x00")
+			if _, ok := store.Lookup(album); !ok && !batched[key] {
 				log.Printf("Adding existing album to DB: %v.", album.DirName)
-				addToDb(album, db)
+				batch = append(batch, album)
+				batched[key] = true
+				if len(batch) == albumDbBatchSize {
+					flush()
+				}
 			}
 		}
+	})
+	if !scanned {
+		log.Printf("Stopping DB update early.")
 	}
 	return nil
 }
 
-// Recursively search for .FLAC files, starting at dirPath. Returns true if any
-// .FLAC files are found in dirPath or its descendents.
-func isAlbum(dirPath string) bool {
-	contents, err := ioutil.ReadDir(dirPath)
+// Returns the paths, relative to musicDir, of the directories depth levels
+// below musicDir/relPath.
+func targetAlbumDirs(musicDir string, relPath string, depth int) (dirs []string) {
+	dirPath := filepath.Join(musicDir, relPath)
+	throttleOp()
+	musicFiles, err := os.ReadDir(dirPath)
 	if err != nil {
-		log.Printf("isAlbum: failed to read directory %s", dirPath)
-		return false
+		fatalf("updateAlbumDb: failed to read directory %s", dirPath)
 	}
-	for _, file := range contents {
-		path := filepath.Join(dirPath, file.Name())
-		if file.IsDir() {
-			return isAlbum(path)
+	for _, file := range musicFiles {
+		if !file.IsDir() {
+			if relPath == "" {
+				log.Printf("skipping regular file: %s", file.Name())
+			}
+			continue
 		}
-		if filepath.Ext(path) == (".flac") {
-			return true
+		if skippedDir(file.Name()) || flaclinkDirs[file.Name()] {
+			continue
+		}
+		fileRelPath := filepath.Join(relPath, file.Name())
+		if depth > 1 {
+			dirs = append(dirs, targetAlbumDirs(musicDir, fileRelPath, depth-1)...)
+		} else {
+			dirs = append(dirs, fileRelPath)
 		}
 	}
-	return false
-}
-
-// Constructor for Album. Called when isAlbum returns true.
-func newAlbum(path string) (album Album) {
-	album.DirName = filepath.Base(path)
-	contents, _ := ioutil.ReadDir(path)
-	for _, file := range contents {
-		album.Contents = append(album.Contents, file.Name())
-	}
-	return album
+	return dirs
 }
 
 // Returns true if album is in db, using gob-encoded album.Conents as key.
 func inDb(album Album, db *bolt.DB) bool {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(album.Contents); err != nil {
-		log.Fatalf("main:inDb:%v", err)
-	}
+	_, ok := lookupAlbum(album, db)
+	return ok
+}
 
-	keyExists := false
-	db.View(func(tx *bolt.Tx) error {
-		v := tx.Bucket(bucketName).Get(buf.Bytes())
-		if v != nil {
-			keyExists = true
-		}
-		return nil
-	})
-	return keyExists
+// Returns the directory name stored for album in db. ok is false if the
+// album isn't in db.
+func lookupAlbum(album Album, db *bolt.DB) (dirName string, ok bool) {
+	return albumStore(db).Lookup(album)
 }
 
-// Adds album to db, using gob-encoded album.Contents as key.
-func addToDb(album Album, db *bolt.DB) error {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(album.Contents); err != nil {
-		return err
+// Scans sourceDir for albums, calling found with each as it's found, and
+// stopping early once ctx is cancelled. Entries of sourceDir that haven't
+// changed since they were last scanned are taken from cache, if it isn't
+// nil; see scancache.go.
+func scanSourceDir(ctx context.Context, sourceDir string, cache *scanCache, found func(Album)) {
+	log.Printf("Scanning for albums in %s.", sourceDir)
+	contentPaths, regFiles, err := sourceContentPaths(sourceDir, cache)
+	if err != nil {
+		fatalf("scanSourceDir: failed to read directory %s", sourceDir)
 	}
-	return db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(bucketName).Put(buf.Bytes(), []byte(album.DirName))
+
+	scanned := scanInParallel(ctx, contentPaths, func(contentPath string) []Album {
+		return cache.findAlbums(sourceDir, contentPath)
+	}, func(_ string, albums []Album) {
+		for _, album := range albums {
+			found(album)
+		}
 	})
+	if !scanned {
+		log.Printf("Stopping scan early.")
+	}
+	log.Printf("Skipped %d regular files.", regFiles)
 }
 
-// Scans sourceDir for albums. When an album is found, checks to see if it already
-// exists in the local database, meaning it has already been copied to targetDir.
-// If not, the album is hardlinked and added to the local database.
-func linkNewAlbums(sourceDir string, targetDir string) {
-	log.Printf("Scanning for albums in %s.", sourceDir)
-	sourceFiles, err := ioutil.ReadDir(sourceDir)
-	db, err := bolt.Open(AlbumDbPath, 0640, &bolt.Options{Timeout: 100 * time.Millisecond})
+// The paths of the entries of sourceDir to scan for albums, and the number
+// of regular files in it, which are skipped. Snapshots of entries that are
+// gone are dropped from cache.
+func sourceContentPaths(sourceDir string, cache *scanCache) (contentPaths []string, regFiles int, err error) {
+	throttleOp()
+	sourceFiles, err := os.ReadDir(sourceDir)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, err
 	}
-	defer db.Close()
-
-	var regFiles, newAlbums, oldAlbums int
+	names := make([]string, len(sourceFiles))
+	for i, file := range sourceFiles {
+		names[i] = file.Name()
+	}
+	cache.forgetRemoved(sourceDir, names)
 
 	for _, file := range sourceFiles {
 		if !file.IsDir() {
 			regFiles++
 			continue
 		}
+		if skippedDir(file.Name()) || !sourceDirIncluded(file.Name()) || !activeShard.includes(file.Name()) {
+			continue
+		}
 		contentPath := filepath.Join(sourceDir, file.Name())
-		if isAlbum(contentPath) {
-			album := newAlbum(contentPath)
-			if !inDb(album, db) {
-				log.Printf("Linking album: %s.", file.Name())
-				linkAlbum(contentPath, targetDir)
-				addToDb(album, db)
-				newAlbums++
-			} else {
-				oldAlbums++
-			}
+		if ignoredPath(contentPath, true) {
+			continue
 		}
+		contentPaths = append(contentPaths, contentPath)
 	}
-	log.Printf("Skipped %d regular files.", regFiles)
-	log.Printf("Linked %d new albums, found %d already in DB or duplicate.", newAlbums, oldAlbums)
+	return contentPaths, regFiles, nil
 }
 
-// Recursively link directory at sourcePath to targetPath.
-func linkAlbum(sourcePath string, targetPath string) error {
-	sourceDirName := filepath.Base(sourcePath)
-	targetDirPath := filepath.Join(targetPath, sourceDirName)
+// Checks whether each album received from albums, as found by scanSourceDir,
+// already exists in the local database, meaning it has already been copied
+// to targetDir. If not, the album is hardlinked and added to the local
+// database, and counted in progress. Once ctx is cancelled, the album being
+// linked is removed again and the rest are received but left. Returns the
+// albums that were linked once albums is closed.
+func linkNewAlbums(ctx context.Context, albums <-chan Album, targetDir string, db *bolt.DB, progress *runProgress) (linked []Album) {
+	var newAlbums, oldAlbums int
+	for album := range albums {
+		if ctx.Err() != nil {
+			continue
+		}
+		progress.begin(album)
+		if album, ok := processAlbum(ctx, album, targetDir, db); ok {
+			linked = append(linked, album)
+			newAlbums++
+		} else {
+			oldAlbums++
+		}
+		progress.end(album)
+	}
+	log.Printf("Linked %d new albums, skipped %d already in DB, duplicate or rejected.", newAlbums, oldAlbums)
+	return linked
+}
 
-	// copy parent dir
-	err := os.Mkdir(targetDirPath, 0775)
+// A closed channel holding albums, for linkNewAlbums.
+func albumChan(albums []Album) <-chan Album {
+	c := make(chan Album, len(albums))
+	for _, album := range albums {
+		c <- album
+	}
+	close(c)
+	return c
+}
+
+// Link album into targetDir, then record it in db along with what was done
+// with each of its files, how it was linked and the discography it came from,
+// if any (see records.go). If ctx is cancelled while linking, the partly linked album is
+// removed and nothing is recorded. Once linked, the album is always recorded.
+func linkAndRecord(ctx context.Context, album Album, targetDir string, warnings []string, db *bolt.DB) error {
+	start := time.Now()
+	if err := markLinkStarted(album, targetDir, db); err != nil {
+		return fmt.Errorf("recording link as in progress: %v", err)
+	}
+	defer markLinkFinished(albumTargetPath(album, targetDir), db)
+	decisions, extras, err := linkAlbum(ctx, album, targetDir)
 	if err != nil {
-		log.Fatalf("linkAlbum:copy dir:%s", err)
+		return err
+	}
+	countLinked(decisions)
+	if err := saveRecord(album, targetDir, decisions, extras, warnings, db); err != nil {
+		return err
+	}
+	if err := saveProvenance(album, db); err != nil {
+		return err
+	}
+	if err := saveLinkOp(album, targetDir, decisions, db); err != nil {
+		return err
+	}
+	if err := saveChecksums(ctx, album, targetDir, db); err != nil {
+		// Linked all the same; the album's first scrub takes them.
+		log.Printf("Can't record checksums of %s: %v", album.DirName, err)
 	}
+	emitEvent(Event{Event: "linked", Album: album.DirName, Source: album.Path, Target: albumTargetPath(album, targetDir), Duration: time.Since(start).Seconds()})
+	return nil
+}
 
-	sourceContents, _ := ioutil.ReadDir(sourcePath)
-	for _, file := range sourceContents {
-		// recursively copy subdirectories
-		if file.IsDir() {
-			subSource := filepath.Join(sourcePath, file.Name())
-			linkAlbum(subSource, targetDirPath)
-		} else {
-			// link files
-			sourceFilePath := filepath.Join(sourcePath, file.Name())
-			targetFilePath := filepath.Join(targetDirPath, file.Name())
-			err := os.Link(sourceFilePath, targetFilePath)
-			if err != nil {
-				log.Fatalf("linkAlbum:link file:%s", err)
+// Tell media servers about the albums linked into targetDir by a run, once
+// the run is over, then update the feed and run the post-run hook. These are
+// part of the post-process stage, and skipped if no albums were linked.
+// Finally, record the run in db and send notifications about it, unless the
+// notify stage is disabled.
+func finishRun(linked []Album, targetDir string, db *bolt.DB) Run {
+	if len(linked) > 0 && stageEnabled(stagePostProcess) {
+		refreshJellyfin(targetDir)
+		startSubsonicScan()
+		updateMPD(linked, targetDir)
+		writeFeed(linked, targetDir)
+		postRunHook(linked, targetDir)
+	}
+	removeStagingDir(targetDir)
+	run := endRun(linked, targetDir)
+	emitRunSummary(run)
+	if err := saveRun(run, db); err != nil {
+		log.Printf("Can't record run: %v", err)
+	}
+	if stageEnabled(stageNotify) {
+		notifyRun(linked, run)
+	}
+	return run
+}
+
+// Path that album is linked to under targetDir.
+func albumTargetPath(album Album, targetDir string) string {
+	return filepath.Join(targetDir, album.DirName)
+}
+
+// targetDir as an absolute path. On Windows, a bare drive such as "D:" means
+// the current directory on that drive, not its root, so it's taken as "D:\".
+// Go only gets past Windows' 260-character path limit for absolute paths,
+// which deep templates and long album names can exceed.
+func absTargetDir(targetDir string) string {
+	if vol := filepath.VolumeName(targetDir); vol != "" && vol == targetDir {
+		targetDir += string(filepath.Separator)
+	}
+	if abs, err := filepath.Abs(targetDir); err == nil {
+		return abs
+	}
+	return targetDir
+}
+
+// What linking an album put in the target besides links to its files.
+type linkExtras struct {
+	// Tracks split from CUE images, relative to the album's target.
+	SplitTracks []string
+	// URL of cover art fetched from the Cover Art Archive, if any.
+	FetchedArt string
+}
+
+// Recursively link album into targetDir. Files matching settings.ExcludeFiles
+// are left out. Returns what was done with each file, and any files added. The
+// album is linked in the staging directory first and moved into place once
+// complete. On error, nothing of the album is left in the target.
+func linkAlbum(ctx context.Context, album Album, targetDir string) (decisions []FileDecision, extras linkExtras, err error) {
+	targetDir = absTargetDir(targetDir)
+	if escapesTarget(album.DirName) {
+		return nil, extras, fmt.Errorf("album name %q isn't inside the target dir", album.DirName)
+	}
+	linker := flaclink.Linker{
+		Exclude:     excludingFilteredFiles(excludedFile),
+		Ignore:      ignoringFilteredDirs(ignoredPath),
+		FS:          targetFS(),
+		StagingPath: albumStagingPath(album, targetDir),
+		MapPath:     linkPathMapper(album),
+	}
+	var addFiles []func(ctx context.Context, dir string) error
+	// With split_cue_images, CD images and their sheets are left out and
+	// split into tracks instead. See cue.go.
+	if images := albumCueImages(album); settings.SplitCueImages && len(images) > 0 {
+		linker.Ignore = ignoringCueImages(images, linker.Ignore)
+		addFiles = append(addFiles, func(ctx context.Context, dir string) error {
+			var err error
+			extras.SplitTracks, err = splitCueImages(ctx, album, images, dir, linker.MapPath)
+			return err
+		})
+	}
+	// With cover_art, embedded or fetched art is added and big scans scaled
+	// down. See coverart.go.
+	var addCoverArt func(context.Context, string) error
+	if linker.Ignore, addCoverArt = coverArtFiles(album, linker.Ignore, &extras); addCoverArt != nil {
+		addFiles = append(addFiles, addCoverArt)
+	}
+	// With file_mode or owner in target_dirs, every file gets them, added
+	// ones included. See targetdirs.go.
+	if tc := targetDirsConfig(); tc.FileMode != "" || tc.Owner != "" {
+		addFiles = append(addFiles, func(ctx context.Context, dir string) error {
+			return setupTargetFiles(dir)
+		})
+	}
+	if len(addFiles) > 0 {
+		linker.AddFiles = func(ctx context.Context, dir string) error {
+			for _, add := range addFiles {
+				if err := add(ctx, dir); err != nil {
+					return err
+				}
 			}
+			return nil
 		}
 	}
-	return nil
+	decisions, err = linker.LinkContext(ctx, album, albumTargetPath(album, targetDir))
+	return decisions, extras, err
 }
 
-// Create local app data directory and initialize database.
-func setupAppDataDir() string {
-	appDataPath := createAppDataDir()
-	createAlbumDb(appDataPath)
-	return appDataPath
+// Name of the hidden directory in the target dir that albums are linked in
+// before being moved into place. It's on the same filesystem as the albums'
+// final places, so the move is a rename.
+const stagingDirName = ".flaclink-tmp"
+
+// Directories flaclink keeps in a target dir for itself, which walks of the
+// target for albums and files leave out.
+var flaclinkDirs = map[string]bool{
+	stagingDirName:     true,
+	targetTrashDirName: true,
+	portableDbDirName:  true,
+}
+
+// Path that album is linked in before being moved to its place in targetDir.
+// The album's target path is escaped to a single name, so albums that the
+// target template puts in different folders can't clash.
+func albumStagingPath(album Album, targetDir string) string {
+	return filepath.Join(targetDir, stagingDirName, url.PathEscape(album.DirName))
+}
+
+// Remove targetDir's staging directory if it's empty, so that none is left in
+// the target between runs. One that still holds leftovers of a killed run is
+// kept for the next run to clean up.
+func removeStagingDir(targetDir string) {
+	os.Remove(filepath.Join(targetDir, stagingDirName))
+}
+
+// A context that is cancelled by the first SIGINT or SIGTERM, so that the
+// album being linked can be removed again before exiting. A second signal
+// kills the process as usual.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		cancel()
+	}()
+	return ctx, cancel
 }
 
-// Create local app data directory at ~/.flaclink.
+// Create local app data directory at $XDG_DATA_HOME/flaclink, or in the app
+// data folder on Windows, unless $FLACLINK_DATA_DIR names another.
 func createAppDataDir() (appDataPath string) {
-	usr, err := user.Current()
-	if err != nil {
-		log.Fatal(err)
+	appDataPath = os.Getenv(dataDirEnv)
+	if appDataPath == "" {
+		var err error
+		if appDataPath, err = defaultAppDataPath(); err != nil {
+			fatal(err)
+		}
 	}
-	appDataPath = filepath.Join(usr.HomeDir, ".flaclink")
 	if _, err := os.Stat(appDataPath); os.IsNotExist(err) {
-		err = os.Mkdir(appDataPath, 0755)
+		err = os.MkdirAll(appDataPath, 0755)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		log.Printf("Created data directory at %s.", appDataPath)
 	}
 	return appDataPath
 }
 
-// Create local album database at appDataPath, if it doesn't already exist.
-func createAlbumDb(appDataPath string) {
-	albumDbPath := filepath.Join(appDataPath, "albums.db")
-	dbOptions := &bolt.Options{Timeout: 100 * time.Millisecond}
-	if _, err := os.Stat(albumDbPath); os.IsNotExist(err) {
-		// Create db
-		db, err := bolt.Open(albumDbPath, 0640, dbOptions)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer db.Close()
+// Create an empty album database at albumDbPath, for opening read-only, as
+// bolt can only create a database when opening it for writing.
+func createAlbumDb(albumDbPath string) {
+	db, err := bolt.Open(albumDbPath, 0640, &bolt.Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+	initAlbumDb(db)
+}
 
-		// Create bucket for albums
-		err = db.Update(func(tx *bolt.Tx) error {
-			_, err := tx.CreateBucketIfNotExists(bucketName)
-			return err
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Printf("Created album database at %s.", albumDbPath)
-	} else {
-		log.Printf("Found album database at %s.", albumDbPath)
+// Create the bucket for albums in the new database db, and mark it as
+// needing no migrations.
+func initAlbumDb(db *bolt.DB) {
+	if err := flaclink.NewStore(db).Init(); err != nil {
+		fatal(err)
+	}
+	if err := setSchemaVersion(db, currentSchemaVersion()); err != nil {
+		fatal(err)
 	}
+	log.Printf("Created album database at %s.", db.Path())
 }
 
 // Not called in main program. Useful for debugging.
 func printAlbumDb() {
 	db, err := bolt.Open(AlbumDbPath, 0640, &bolt.Options{Timeout: 100 * time.Millisecond})
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	defer db.Close()
 
@@ -268,7 +674,7 @@ func printAlbumDb() {
 			dec := gob.NewDecoder(bytes.NewReader(k))
 			err = dec.Decode(&albumContents)
 			if err != nil {
-				log.Fatalf("printAlbumDb:dec.Decode:%v", err)
+				fatalf("printAlbumDb:dec.Decode:%v", err)
 			}
 			log.Printf("Album dir: %s, Contents: %s", v, albumContents)
 		}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Counters exported on the daemon's /metrics endpoint. They count from
+// process start, as Prometheus expects of counters.
+var metrics struct {
+	albumsLinked  atomic.Int64
+	albumsSkipped atomic.Int64
+	errors        atomic.Int64
+	bytesLinked   atomic.Int64
+	scans         atomic.Int64
+
+	// Duration of the last completed scan in nanoseconds, and when it ended
+	// as a Unix timestamp.
+	lastScanDuration atomic.Int64
+	lastScanEnd      atomic.Int64
+}
+
+// Count a newly linked album and the bytes of the files linked for it.
+func countLinked(decisions []FileDecision) {
+	metrics.albumsLinked.Add(1)
+	for _, decision := range decisions {
+		if decision.Linked {
+			metrics.bytesLinked.Add(decision.Size)
+		}
+	}
+}
+
+// Record a completed scan that started at start.
+func countScan(start time.Time) {
+	metrics.scans.Add(1)
+	metrics.lastScanDuration.Store(int64(time.Since(start)))
+	metrics.lastScanEnd.Store(time.Now().Unix())
+}
+
+// Write all metrics in the Prometheus text exposition format.
+func writeMetrics(w io.Writer) {
+	writeMetric(w, "flaclink_albums_linked_total", "counter", "Albums linked into a target.", metrics.albumsLinked.Load())
+	writeMetric(w, "flaclink_albums_skipped_total", "counter", "Albums skipped because they were already in the DB.", metrics.albumsSkipped.Load())
+	writeMetric(w, "flaclink_errors_total", "counter", "Errors that didn't stop flaclink, such as failed post-process commands.", metrics.errors.Load())
+	writeMetric(w, "flaclink_bytes_linked_total", "counter", "Total size of files linked into a target.", metrics.bytesLinked.Load())
+	writeMetric(w, "flaclink_scans_total", "counter", "Completed scan/link cycles.", metrics.scans.Load())
+	writeMetric(w, "flaclink_last_scan_duration_seconds", "gauge", "Duration of the last completed scan.", time.Duration(metrics.lastScanDuration.Load()).Seconds())
+	writeMetric(w, "flaclink_last_scan_timestamp_seconds", "gauge", "Unix time the last completed scan finished.", metrics.lastScanEnd.Load())
+	if info, err := os.Stat(AlbumDbPath); err == nil {
+		writeMetric(w, "flaclink_db_size_bytes", "gauge", "Size of the album database file.", info.Size())
+	}
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Set by -min-tracks and -min-size. When non-zero, they take the place of
+// min_tracks and min_size from the config file.
+var (
+	minTracksFlag int
+	minSizeFlag   int64
+)
+
+func registerMinimumFlags(flags *flag.FlagSet) {
+	flags.IntVar(&minTracksFlag, "min-tracks", 0, "skip albums with fewer tracks than this")
+	flags.Int64Var(&minSizeFlag, "min-size", 0, "skip albums whose FLAC files add up to fewer bytes than this")
+}
+
+// Check album against the minimum track count and size, if any are set.
+// Returns false if it falls short, in which case the album is reported as
+// skipped and should not be linked.
+func meetsMinimums(album Album) bool {
+	minTracks, minSize := settings.MinTracks, settings.MinSize
+	if minTracksFlag > 0 {
+		minTracks = minTracksFlag
+	}
+	if minSizeFlag > 0 {
+		minSize = minSizeFlag
+	}
+	if minTracks <= 0 && minSize <= 0 {
+		return true
+	}
+	files := albumFlacFiles(album.Path)
+	tracks := albumTrackCount(album)
+	var size int64
+	for _, path := range files {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	var reason string
+	switch {
+	case tracks < minTracks:
+		reason = fmt.Sprintf("%d tracks, fewer than %d", tracks, minTracks)
+	case size < minSize:
+		reason = fmt.Sprintf("%d bytes of FLAC, less than %d", size, minSize)
+	default:
+		return true
+	}
+	log.Printf("Album %s is too small, skipping: %s.", album.DirName, reason)
+	emitEvent(Event{Event: "skipped", Album: album.DirName, Source: album.Path, Reason: "too small: " + reason})
+	return false
+}
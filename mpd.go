@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Settings for telling MPD about newly linked albums, under "mpd" in the
+// config file.
+type MPDConfig struct {
+	// host:port, or the path of MPD's Unix socket.
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	// MPD's music_directory, as flaclink sees it. Album paths are sent to MPD
+	// relative to it. Defaults to the target dir.
+	MusicDir string `json:"music_dir"`
+}
+
+// Ask MPD to update its database for each album linked into targetDir in
+// this run. Does nothing unless MPD is configured. Failures are logged, since
+// the albums are linked either way.
+func updateMPD(linked []Album, targetDir string) {
+	mpd := settings.MPD
+	if mpd == nil || mpd.Address == "" {
+		return
+	}
+	musicDir := targetDir
+	if mpd.MusicDir != "" {
+		musicDir = filepath.Clean(mpd.MusicDir)
+	}
+
+	conn, err := mpd.dial()
+	if err != nil {
+		countError("", err)
+		log.Printf("MPD update failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	for _, album := range linked {
+		relPath, err := filepath.Rel(musicDir, albumTargetPath(album, targetDir))
+		if err != nil || strings.HasPrefix(relPath, "..") {
+			log.Printf("MPD update of %s skipped: not under music_dir %s", album.DirName, musicDir)
+			continue
+		}
+		if _, err := conn.command("update", relPath); err != nil {
+			countError(album.DirName, err)
+			log.Printf("MPD update of %s failed: %v", relPath, err)
+			continue
+		}
+		log.Printf("Asked MPD to update %s.", relPath)
+	}
+}
+
+// A connection speaking MPD's line-based protocol.
+type mpdConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Connect to MPD and log in if a password is configured.
+func (mpd *MPDConfig) dial() (*mpdConn, error) {
+	network := "tcp"
+	if strings.HasPrefix(mpd.Address, "/") || strings.HasPrefix(mpd.Address, "@") {
+		network = "unix"
+	}
+	c, err := net.DialTimeout(network, mpd.Address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(time.Minute))
+	conn := &mpdConn{Conn: c, r: bufio.NewReader(c)}
+
+	greeting, err := conn.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(greeting, "OK MPD ") {
+		conn.Close()
+		return nil, fmt.Errorf("%s doesn't look like MPD: %q", mpd.Address, greeting)
+	}
+	if mpd.Password != "" {
+		if _, err := conn.command("password", mpd.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Send a command with quoted arguments and return the response lines before
+// the final OK. An ACK response is returned as an error.
+func (conn *mpdConn) command(name string, args ...string) ([]string, error) {
+	line := name
+	for _, arg := range args {
+		arg = strings.ReplaceAll(arg, `\`, `\\`)
+		arg = strings.ReplaceAll(arg, `"`, `\"`)
+		line += ` "` + arg + `"`
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+		return nil, err
+	}
+
+	var response []string
+	for {
+		reply, err := conn.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		reply = strings.TrimSuffix(reply, "\n")
+		switch {
+		case reply == "OK":
+			return response, nil
+		case strings.HasPrefix(reply, "ACK "):
+			return nil, fmt.Errorf("%s: %s", name, reply)
+		}
+		response = append(response, reply)
+	}
+}
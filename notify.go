@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A channel to post a summary to after each run, from the "notifications"
+// list in the config file.
+type NotifyConfig struct {
+	// One of "discord", "slack", "pushover" or "ntfy".
+	Type string `json:"type"`
+	// Webhook URL for Discord and Slack, or topic URL for ntfy, e.g.
+	// "https://ntfy.sh/my-music". Not used for Pushover.
+	URL string `json:"url"`
+	// Pushover application token, or ntfy access token if the topic needs one.
+	Token string `json:"token"`
+	// Pushover user or group key.
+	User string `json:"user"`
+	// Only notify about runs with errors.
+	ErrorsOnly bool `json:"errors_only"`
+}
+
+var notifyTypes = map[string]func(NotifyConfig, string, string) error{
+	"discord":  notifyDiscord,
+	"slack":    notifySlack,
+	"pushover": notifyPushover,
+	"ntfy":     notifyNtfy,
+}
+
+// Longest list of album names or errors included in a notification. Chat
+// services cap message length, and a long list isn't useful on a phone.
+const maxNotifyItems = 20
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// Post a summary of a run to the configured notification channels. Nothing
+// is sent for runs that neither linked albums nor had errors. Failures are
+// logged and otherwise ignored.
+func notifyRun(linked []Album, run Run) {
+	errs := run.Errors
+	if len(linked) == 0 && len(errs) == 0 {
+		return
+	}
+	title, message := runSummary(linked, run)
+	for _, nc := range settings.Notifications {
+		if nc.ErrorsOnly && len(errs) == 0 {
+			continue
+		}
+		if err := notifyTypes[nc.Type](nc, title, message); err != nil {
+			log.Printf("%s notification failed: %v", nc.Type, err)
+		}
+	}
+}
+
+// Title and body of a run summary, with the last line of output of each
+// post_process command.
+func runSummary(linked []Album, run Run) (string, string) {
+	errs := run.Errors
+	title := fmt.Sprintf("flaclink: linked %d albums", len(linked))
+	if len(errs) > 0 {
+		title += fmt.Sprintf(", %d errors", len(errs))
+	}
+	var b strings.Builder
+	names := make([]string, len(linked))
+	for i, album := range linked {
+		names[i] = album.DirName
+	}
+	writeSummaryList(&b, "Linked:", names)
+	writeSummaryList(&b, "Errors:", errs)
+	var postProcessed []string
+	for _, pp := range run.PostProcess {
+		item := fmt.Sprintf("%s on %s: %s", pp.summary(), pp.Album, pp.outcome())
+		if output := strings.TrimSpace(pp.Output); output != "" {
+			item += ": " + output[strings.LastIndex(output, "\n")+1:]
+		}
+		postProcessed = append(postProcessed, item)
+	}
+	writeSummaryList(&b, "Post-process:", postProcessed)
+	return title, strings.TrimSpace(b.String())
+}
+
+func writeSummaryList(b *strings.Builder, heading string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintln(b, heading)
+	for i, item := range items {
+		if i == maxNotifyItems {
+			fmt.Fprintf(b, "... and %d more\n", len(items)-i)
+			break
+		}
+		fmt.Fprintf(b, "- %s\n", item)
+	}
+	fmt.Fprintln(b)
+}
+
+func notifyDiscord(nc NotifyConfig, title, message string) error {
+	content := "**" + title + "**\n" + message
+	// Discord rejects messages over 2000 characters.
+	if runes := []rune(content); len(runes) > 2000 {
+		content = string(runes[:1997]) + "..."
+	}
+	return postNotification(nc.URL, "application/json", jsonBody(map[string]string{"content": content}), nil)
+}
+
+func notifySlack(nc NotifyConfig, title, message string) error {
+	return postNotification(nc.URL, "application/json", jsonBody(map[string]string{"text": "*" + title + "*\n" + message}), nil)
+}
+
+func notifyPushover(nc NotifyConfig, title, message string) error {
+	// Pushover truncates messages over 1024 characters.
+	form := url.Values{"token": {nc.Token}, "user": {nc.User}, "title": {title}, "message": {message}}
+	return postNotification("https://api.pushover.net/1/messages.json", "application/x-www-form-urlencoded", []byte(form.Encode()), nil)
+}
+
+func notifyNtfy(nc NotifyConfig, title, message string) error {
+	headers := map[string]string{"Title": title}
+	if nc.Token != "" {
+		headers["Authorization"] = "Bearer " + nc.Token
+	}
+	return postNotification(nc.URL, "text/plain; charset=utf-8", []byte(message), headers)
+}
+
+func jsonBody(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+func postNotification(target, contentType string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Find what's in the target that flaclink didn't put there, such as albums
+// copied in by hand or left behind by an interrupted run: album directories
+// the DB doesn't know, albums none of whose files are links to the source,
+// files in linked albums that aren't links to the source, and leftovers in
+// the staging dir. Files flaclink writes itself, split tracks and cover art,
+// don't count. Nothing is changed. Exits with status 1 if anything is found.
+func runOrphans(args []string) {
+	flags := flag.NewFlagSet("orphans", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		fmt.Println("Usage: flaclink orphans <source dir>... <target dir>")
+		os.Exit(2)
+	}
+	sourceDirs := uniqueDirs(flags.Args()[:flags.NArg()-1])
+	targetDir := absTargetDir(filepath.Clean(flags.Arg(flags.NArg() - 1)))
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	records, err := catalogRecords(db)
+	db.Close()
+	if err != nil {
+		fatalf("orphans: %v", err)
+	}
+	byTarget := make(map[string]flaclink.AlbumRecord)
+	byDirName := make(map[string]flaclink.AlbumRecord)
+	for _, record := range records {
+		if record.Target != "" {
+			byTarget[record.Target] = record
+		} else {
+			byDirName[record.DirName] = record
+		}
+	}
+
+	sourceFiles := make(map[fileID]bool)
+	for _, dir := range sourceDirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				if id, ok := statFileID(path, info); ok {
+					sourceFiles[id] = true
+				}
+			}
+			return nil
+		})
+	}
+	log.Printf("Found %d files in %d source dirs.", len(sourceFiles), len(sourceDirs))
+
+	var untracked, copied, unlinked int
+	for _, relPath := range targetAlbumDirsWithRoutes(targetDir) {
+		albumPath := filepath.Join(targetDir, relPath)
+		if !albumScanner().IsAlbum(albumPath) {
+			continue
+		}
+		record, tracked := byTarget[albumPath]
+		if !tracked {
+			if _, tracked = byDirName[relPath]; !tracked {
+				untracked++
+				fmt.Printf("untracked  %s\n", relPath)
+				continue
+			}
+		}
+		own := flaclinkFiles(record)
+		var files, foreign []string
+		filepath.Walk(albumPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			rel, _ := filepath.Rel(albumPath, path)
+			if own[filepath.ToSlash(rel)] {
+				return nil
+			}
+			files = append(files, rel)
+			// Follow links made in symlink link mode to the source file.
+			if info.Mode()&os.ModeSymlink != 0 {
+				if info, err = os.Stat(path); err != nil {
+					foreign = append(foreign, rel)
+					return nil
+				}
+			}
+			if id, ok := statFileID(path, info); !ok || !sourceFiles[id] {
+				foreign = append(foreign, rel)
+			}
+			return nil
+		})
+		switch {
+		case len(foreign) == 0:
+		case len(foreign) == len(files):
+			copied++
+			fmt.Printf("copied     %s (%d files)\n", relPath, len(files))
+		default:
+			for _, rel := range foreign {
+				unlinked++
+				fmt.Printf("unlinked   %s\n", filepath.Join(relPath, rel))
+			}
+		}
+	}
+
+	staged, _ := ioutil.ReadDir(filepath.Join(targetDir, stagingDirName))
+	for _, entry := range staged {
+		fmt.Printf("staging    %s\n", filepath.Join(stagingDirName, entry.Name()))
+	}
+
+	log.Printf("Found %d untracked albums, %d albums not linked from the source, %d other files not linked from the source and %d leftovers in %s.", untracked, copied, unlinked, len(staged), stagingDirName)
+	if untracked+copied+unlinked+len(staged) > 0 {
+		os.Exit(1)
+	}
+}
+
+// The files flaclink may have written into the album's target directory
+// itself, rather than linking them, as slash-separated paths relative to it:
+// split tracks, cover art, and source files it didn't link, which are only
+// there if it wrote them, as it does cover art it scales down.
+func flaclinkFiles(record flaclink.AlbumRecord) map[string]bool {
+	own := make(map[string]bool)
+	for _, track := range record.SplitTracks {
+		own[filepath.ToSlash(track)] = true
+	}
+	for _, file := range record.Files {
+		if !file.Linked {
+			own[filepath.ToSlash(file.TargetPath())] = true
+		}
+	}
+	if ca := settings.CoverArt; ca != nil {
+		name := ca.Name
+		if name == "" {
+			name = defaultCoverArtName
+		}
+		own[filepath.ToSlash(name)] = true
+	}
+	return own
+}
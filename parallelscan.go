@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+)
+
+// Finding out whether a directory is an album takes a listing of it and of
+// its subfolders, each a round trip when the source or target is on a NAS,
+// so scanning one entry after another spends most of a run waiting. Entries
+// of the source dirs and album dirs of the target are instead scanned a few
+// at a time, with the results still handled in order, and the target is
+// read while the sources are scanned; see runProfiles.
+
+// Directories scanned at once unless scan_workers says otherwise.
+const defaultScanWorkers = 8
+
+func scanWorkers() int {
+	if settings.ScanWorkers > 0 {
+		return settings.ScanWorkers
+	}
+	return defaultScanWorkers
+}
+
+// Call scan with each of paths, up to scanWorkers at once, and found with
+// each path and the albums scan returned for it, in the order of paths.
+// Stops starting scans once ctx is cancelled, and returns once those started
+// are passed to found, reporting whether every path was scanned.
+func scanInParallel(ctx context.Context, paths []string, scan func(path string) []Album, found func(path string, albums []Album)) bool {
+	// Each path's result comes on a channel of its own, queued in order.
+	// The queue holds at most scanWorkers of them, which bounds the scans
+	// in flight.
+	queue := make(chan chan []Album, scanWorkers()-1)
+	var all bool
+	go func() {
+		defer close(queue)
+		for _, path := range paths {
+			if ctx.Err() != nil {
+				return
+			}
+			result := make(chan []Album, 1)
+			queue <- result
+			go func(path string) {
+				result <- scan(path)
+			}(path)
+		}
+		all = true
+	}()
+	i := 0
+	for result := range queue {
+		found(paths[i], <-result)
+		i++
+	}
+	return all
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Names of the processing stages, in the order they run. Albums go through
+// every stage up to and including post-process; notify runs once per run.
+const (
+	stageDetect      = "detect"
+	stageValidate    = "validate"
+	stageEnrich      = "enrich"
+	stageRoute       = "route"
+	stageReview      = "review"
+	stageLink        = "link"
+	stagePostProcess = "post-process"
+	stageNotify      = "notify"
+)
+
+// Stages that can't be disabled, since nothing would be linked without them.
+var requiredStages = map[string]bool{stageDetect: true, stageLink: true}
+
+// One step in processing an album found in the source. To add a stage, add
+// it to albumStages.
+type Stage interface {
+	Name() string
+	// Process the album in job. Returns false if the album should go no
+	// further, in which case the stage has reported why. Errors stop the run.
+	Process(job *albumJob) (bool, error)
+}
+
+// An album making its way through the stages.
+type albumJob struct {
+	Ctx       context.Context
+	Album     Album
+	TargetDir string
+	DB        *bolt.DB
+	// Tags of the album's first FLAC file, once the enrich stage has read
+	// them. nil if it has none or enrich is disabled.
+	Meta *flacMetadata
+	// The album as it was found, before the route stage renamed it.
+	Found Album
+	// Set when the album has been approved by "flaclink review approve" or
+	// "flaclink quarantine approve", so the review stage, and the checks
+	// that quarantine albums other than for their name being taken, let it
+	// through.
+	Approved bool
+	// Name in the target chosen by hand in "flaclink tui", which the route
+	// stage uses as it is.
+	Name string
+	// Problems found with the album that don't stop it being linked, such as
+	// suspected lossy transcodes, to keep in its record.
+	Warnings []string
+}
+
+// The per-album stages, in order.
+var albumStages = []Stage{
+	detectStage{},
+	validateStage{},
+	enrichStage{},
+	routeStage{},
+	reviewStage{},
+	linkStage{},
+	postProcessStage{},
+}
+
+// Every stage name, for validating disabled_stages.
+func stageNames() map[string]bool {
+	names := map[string]bool{stageNotify: true}
+	for _, stage := range albumStages {
+		names[stage.Name()] = true
+	}
+	return names
+}
+
+// Check a disabled_stages setting.
+func validateDisabledStages(disabled []string) error {
+	names := stageNames()
+	for _, name := range disabled {
+		if !names[name] {
+			return fmt.Errorf("unknown stage %q", name)
+		}
+		if requiredStages[name] {
+			return fmt.Errorf("stage %q can't be disabled", name)
+		}
+	}
+	return nil
+}
+
+// Reports whether the named stage is enabled in the current settings.
+func stageEnabled(name string) bool {
+	for _, disabled := range settings.DisabledStages {
+		if disabled == name {
+			return false
+		}
+	}
+	return true
+}
+
+// Run album through the enabled stages. Returns the album as linked, with
+// its target name, and true if it was linked. Cancelling ctx stops the
+// album where it is, removing it from the target if it was being linked.
+func processAlbum(ctx context.Context, album Album, targetDir string, db *bolt.DB) (Album, bool) {
+	emitEvent(Event{Event: "discovered", Album: album.DirName, Source: album.Path})
+	return runStages(&albumJob{Ctx: ctx, Album: album, Found: album, TargetDir: targetDir, DB: db})
+}
+
+// Run job through the enabled stages, as processAlbum does.
+func runStages(job *albumJob) (Album, bool) {
+	ctx := job.Ctx
+	for _, stage := range albumStages {
+		if !stageEnabled(stage.Name()) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return job.Album, false
+		}
+		ok, err := stage.Process(job)
+		if err != nil && ctx.Err() != nil {
+			log.Printf("Cancelled while linking %s, removed it from the target.", job.Album.DirName)
+			emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "cancelled"})
+			return job.Album, false
+		}
+		if err != nil {
+			fatalf("%s: %s: %v", stage.Name(), job.Album.DirName, err)
+		}
+		if !ok {
+			return job.Album, false
+		}
+	}
+	return job.Album, true
+}
+
+// Skips albums that are routed to another profile, are already in the
+// database, were rejected in review or quarantine, or are in quarantine.
+// Duplicates of albums linked from elsewhere are settled as conflicts; see
+// conflicts.go.
+type detectStage struct{}
+
+func (detectStage) Name() string { return stageDetect }
+
+func (detectStage) Process(job *albumJob) (bool, error) {
+	if !inActiveProfile(job.Album) {
+		return false, nil
+	}
+	if inDb(job.Album, job.DB) && !settleDuplicate(job) {
+		metrics.albumsSkipped.Add(1)
+		emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "already in DB"})
+		return false, nil
+	}
+	if isRejected(job.Album, job.DB) {
+		metrics.albumsSkipped.Add(1)
+		emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "rejected in review"})
+		return false, nil
+	}
+	if !job.Approved && inQuarantine(job) {
+		metrics.albumsSkipped.Add(1)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Skips albums that are still being written, are below min_tracks or
+// min_size, are refused as lossy transcodes, or are rejected by the
+// pre_link hook, and quarantines those that fail -verify-flac.
+type validateStage struct{}
+
+func (validateStage) Name() string { return stageValidate }
+
+func (validateStage) Process(job *albumJob) (bool, error) {
+	if !albumStable(job.Ctx, job.Album) || !meetsMinimums(job.Album) {
+		return false, nil
+	}
+	if err := checkAlbumFlac(job.Album); err != nil && !job.Approved {
+		log.Printf("Album %s failed FLAC verification: %v", job.Album.DirName, err)
+		countError(job.Album.DirName, err)
+		return false, quarantineAlbum(job, "failed FLAC verification: "+err.Error())
+	}
+	return passesTranscodeCheck(job) && preLinkHook(job.Album, job.TargetDir), nil
+}
+
+// Reads the album's tags, for the route stage's target template and routes.
+type enrichStage struct{}
+
+func (enrichStage) Name() string { return stageEnrich }
+
+func (enrichStage) Process(job *albumJob) (bool, error) {
+	if settings.TargetTemplate != "" || len(settings.Routes) > 0 {
+		job.Meta = albumMetadata(job.Album)
+	}
+	return true, nil
+}
+
+// Names the album in the target according to target_template, or the
+// template of the first route it matches, reusing existing artist folders if
+// reconcile_artists is set, and puts it in that route's subfolder, unless it
+// was named by hand.
+// Albums whose name looks wrong are quarantined, and other editions in the
+// target are settled as conflicts.
+type routeStage struct{}
+
+func (routeStage) Name() string { return stageRoute }
+
+func (routeStage) Process(job *albumJob) (bool, error) {
+	if job.Name != "" {
+		job.Album.DirName = job.Name
+		return true, nil
+	}
+	template, subpath := albumTemplate(job.Meta), ""
+	if route := matchingRoute(job.Album, job.Meta); route != nil {
+		subpath = filepath.Clean(route.Subpath)
+		if route.template() != "" {
+			template = route.template()
+		}
+	}
+	applyTemplateWith(&job.Album, job.Meta, template)
+	if template != "" {
+		reconcileDirName(&job.Album, filepath.Join(job.TargetDir, subpath))
+	}
+	if subpath != "" {
+		job.Album.DirName = filepath.Join(subpath, job.Album.DirName)
+	}
+	if reason := suspiciousName(job.Album.DirName); reason != "" && !job.Approved {
+		recordRunWarning(job.Album.DirName, reason)
+		return false, quarantineAlbum(job, reason)
+	}
+	if !job.Approved {
+		return settleEditionConflict(job)
+	}
+	return true, nil
+}
+
+// Puts the album in the review queue instead of linking it if review is on,
+// or in quarantine if its audio is corrupt, unless the album has been
+// approved. See review.go and quarantine.go.
+type reviewStage struct{}
+
+func (reviewStage) Name() string { return stageReview }
+
+func (reviewStage) Process(job *albumJob) (bool, error) {
+	if job.Approved {
+		return true, nil
+	}
+	if awaitingReview(job) {
+		return false, nil
+	}
+	if err := checkAlbumAudio(job.Album); err != nil {
+		log.Printf("Album %s has corrupt audio: %v", job.Album.DirName, err)
+		countError(job.Album.DirName, err)
+		return false, quarantineAlbum(job, "corrupt audio: "+err.Error())
+	}
+	if !settings.Review {
+		return true, nil
+	}
+	return false, queueForReview(job)
+}
+
+// Links the album into the target, if there's room for it, and records it in
+// the database. Albums whose name is taken in the target are settled as
+// conflicts.
+type linkStage struct{}
+
+func (linkStage) Name() string { return stageLink }
+
+func (linkStage) Process(job *albumJob) (bool, error) {
+	if !albumFits(job.Album, job.TargetDir) {
+		return false, nil
+	}
+	if ok, err := settleNameConflict(job); !ok || err != nil {
+		return ok, err
+	}
+	log.Printf("Linking album: %s.", job.Album.DirName)
+	return true, linkAndRecord(job.Ctx, job.Album, job.TargetDir, job.Warnings, job.DB)
+}
+
+// Runs post-process commands, noting how they went in the run's record, and
+// the post_link hook, and tells Plex about the album.
+type postProcessStage struct{}
+
+func (postProcessStage) Name() string { return stagePostProcess }
+
+func (postProcessStage) Process(job *albumJob) (bool, error) {
+	for _, result := range postProcess(job.Album, job.TargetDir) {
+		recordRunPostProcess(job.Album.DirName, result)
+	}
+	postLinkHook(job.Album, job.TargetDir)
+	refreshPlex(job.Album, job.TargetDir)
+	return true, nil
+}
@@ -0,0 +1,90 @@
+// Package flaclink finds FLAC albums, links them into a music library with
+// hardlinks, and keeps a bolt database of the albums it has seen, so that
+// each album is linked once. It is the core of the flaclink command, for
+// programs that want to embed it rather than run the binary:
+//
+//	store := flaclink.NewStore(db)
+//	if err := store.Init(); err != nil { ... }
+//	albums, err := flaclink.Scanner{}.Scan(sourceDir)
+//	...
+//	for _, album := range albums {
+//		if _, ok := store.Lookup(album); ok {
+//			continue
+//		}
+//		decisions, err := flaclink.Linker{}.Link(album, filepath.Join(targetDir, album.DirName))
+//		...
+//		store.Add(album)
+//		store.SaveDecisions(album.DirName, decisions)
+//	}
+//
+// Scanner and Linker work on the local filesystem unless given another FS,
+// such as a MemFS.
+package flaclink
+
+import (
+	"path/filepath"
+)
+
+// An album directory. Albums are identified by the names of the files and
+// directories directly inside them, so renaming an album doesn't make it new.
+type Album struct {
+	// Name of the album's directory under the target, which may contain
+	// slashes. Starts as the source directory name.
+	DirName  string
+	Contents []string
+
+	// Where the album was found, and the discography folder it was found in, if any.
+	Path      string
+	Container string
+}
+
+// Recursively search for .FLAC files, starting at dirPath. Returns true if any
+// .FLAC files are found in dirPath or its descendents.
+func IsAlbum(dirPath string) bool {
+	return Scanner{}.IsAlbum(dirPath)
+}
+
+// Like the package-level IsAlbum, but on s.FS, and not looking at files and
+// directories that s.SkipDir or s.Ignore match.
+func (s Scanner) IsAlbum(dirPath string) bool {
+	contents, err := orOS(s.FS).ReadDir(dirPath)
+	if err != nil {
+		return false
+	}
+	for _, file := range contents {
+		path := filepath.Join(dirPath, file.Name())
+		if s.ignored(path, file.IsDir()) {
+			continue
+		}
+		if file.IsDir() {
+			// Keep looking if this one has no flac files, e.g. a
+			// scans folder listed before the disc folders.
+			if !s.skipped(file.Name()) && s.IsAlbum(path) {
+				return true
+			}
+			continue
+		}
+		if filepath.Ext(path) == (".flac") {
+			return true
+		}
+	}
+	return false
+}
+
+// Constructor for Album. Called when IsAlbum returns true.
+func NewAlbum(path string) Album {
+	return newAlbum(OS, path)
+}
+
+func newAlbum(fsys FS, path string) (album Album) {
+	album.Path = path
+	album.DirName = NormalizeName(filepath.Base(path))
+	contents, _ := fsys.ReadDir(path)
+	for _, file := range contents {
+		album.Contents = append(album.Contents, file.Name())
+	}
+	if album.Contents != nil {
+		album.Contents = NormalizeContents(album.Contents)
+	}
+	return album
+}
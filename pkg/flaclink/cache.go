@@ -0,0 +1,101 @@
+package flaclink
+
+import (
+	"strings"
+	"sync"
+)
+
+// A Store that keeps the directory names of the albums in another Store in
+// memory, so that looking up an album that's already there doesn't touch the
+// underlying store. Most albums seen in a scan have been linked before, so
+// this saves a transaction per album. Lookups that miss still go to the
+// underlying store, since another process may have added the album since
+// the cache was loaded. Safe for concurrent use if the underlying Store is.
+type CachedStore struct {
+	Store
+
+	mu       sync.RWMutex
+	dirNames map[string]string // by cacheKey
+}
+
+// Load the albums in s into a new CachedStore.
+func NewCachedStore(s Store) (*CachedStore, error) {
+	c := &CachedStore{Store: s, dirNames: make(map[string]string)}
+	err := s.ForEach(func(contents []string, dirName string) error {
+		c.dirNames[cacheKey(contents)] = dirName
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// File names can't contain NUL, so joining on it can't make two albums'
+// contents equal.
+func cacheKey(contents []string) string {
+	return strings.Join(contents, "\x00")
+}
+
+// Number of albums in the cache.
+func (c *CachedStore) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.dirNames)
+}
+
+func (c *CachedStore) Lookup(album Album) (dirName string, ok bool) {
+	key := cacheKey(album.Contents)
+	c.mu.RLock()
+	dirName, ok = c.dirNames[key]
+	c.mu.RUnlock()
+	if ok {
+		return dirName, true
+	}
+	if dirName, ok = c.Store.Lookup(album); ok {
+		c.remember(key, dirName)
+	}
+	return dirName, ok
+}
+
+func (c *CachedStore) Add(album Album) error {
+	if err := c.Store.Add(album); err != nil {
+		return err
+	}
+	c.remember(cacheKey(album.Contents), album.DirName)
+	return nil
+}
+
+func (c *CachedStore) AddAll(albums []Album) error {
+	if err := c.Store.AddAll(albums); err != nil {
+		return err
+	}
+	for _, album := range albums {
+		c.remember(cacheKey(album.Contents), album.DirName)
+	}
+	return nil
+}
+
+func (c *CachedStore) SaveRecord(album Album, record AlbumRecord) error {
+	if err := c.Store.SaveRecord(album, record); err != nil {
+		return err
+	}
+	c.remember(cacheKey(album.Contents), record.DirName)
+	return nil
+}
+
+func (c *CachedStore) Remove(album Album) error {
+	if err := c.Store.Remove(album); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.dirNames, cacheKey(album.Contents))
+	return nil
+}
+
+func (c *CachedStore) remember(key string, dirName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirNames[key] = dirName
+}
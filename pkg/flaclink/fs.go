@@ -0,0 +1,104 @@
+package flaclink
+
+import (
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// The filesystem operations Scanner and Linker use, so that albums can be
+// scanned and linked on something other than the local disk, such as MemFS
+// in tests. Names are paths as used by the os package.
+type FS interface {
+	// Returns the entries of the directory name, sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	// Creates newname as a hardlink to the file oldname.
+	Link(oldname, newname string) error
+	RemoveAll(name string) error
+	// Moves oldname to newname, which must not exist if oldname is a
+	// directory.
+	Rename(oldname, newname string) error
+}
+
+// The local filesystem, used when Scanner.FS or Linker.FS is nil.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Mkdir(name string, perm os.FileMode) error    { return os.Mkdir(name, perm) }
+func (osFS) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFS) Link(oldname, newname string) error           { return os.Link(oldname, newname) }
+func (osFS) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (osFS) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+
+// Unlike ioutil.ReadDir, doesn't stat each entry up front. Scans mostly
+// need only names and whether entries are directories, which the directory
+// listing itself has, so an entry is only stat'ed if more is asked of it.
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, len(entries))
+	for i, entry := range entries {
+		infos[i] = &dirEntryInfo{DirEntry: entry}
+	}
+	return infos, nil
+}
+
+// An os.FileInfo for a directory entry, stat'ed on first use of anything
+// but its name and type.
+type dirEntryInfo struct {
+	fs.DirEntry
+	once sync.Once
+	info os.FileInfo
+}
+
+func (e *dirEntryInfo) stat() os.FileInfo {
+	e.once.Do(func() {
+		// An entry removed since it was listed, which ioutil.ReadDir
+		// would have left out, keeps its name and type and reports zero
+		// for the rest.
+		e.info, _ = e.DirEntry.Info()
+	})
+	return e.info
+}
+
+func (e *dirEntryInfo) Size() int64 {
+	if info := e.stat(); info != nil {
+		return info.Size()
+	}
+	return 0
+}
+
+func (e *dirEntryInfo) Mode() os.FileMode {
+	if info := e.stat(); info != nil {
+		return info.Mode()
+	}
+	return e.Type()
+}
+
+func (e *dirEntryInfo) ModTime() time.Time {
+	if info := e.stat(); info != nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+func (e *dirEntryInfo) Sys() interface{} {
+	if info := e.stat(); info != nil {
+		return info.Sys()
+	}
+	return nil
+}
+
+// fsys, or OS if it's nil.
+func orOS(fsys FS) FS {
+	if fsys == nil {
+		return OS
+	}
+	return fsys
+}
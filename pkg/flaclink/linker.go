@@ -0,0 +1,188 @@
+package flaclink
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// What Linker.Link did with one file of an album: linked it into the target,
+// or left it out because Exclude matched it. Path is relative to the album
+// directory.
+type FileDecision struct {
+	Path   string
+	Linked bool
+	Size   int64
+	// Where the file was linked, relative to the album's target directory,
+	// if that differs from Path because of Linker.MapPath.
+	Target string
+}
+
+// The file's path relative to the album's target directory.
+func (d FileDecision) TargetPath() string {
+	if d.Target != "" {
+		return d.Target
+	}
+	return d.Path
+}
+
+// Links albums into a library with hardlinks, so the library takes no extra
+// space and the source can keep seeding.
+type Linker struct {
+	// If set, files whose names it matches are left out.
+	Exclude func(name string) bool
+	// If set, source files and directories whose paths it matches are left
+	// out, e.g. those listed in ignore files.
+	Ignore func(path string, isDir bool) bool
+	// The filesystem holding both the album and the target, or nil for the
+	// local one.
+	FS FS
+	// If set, the album is linked here and then renamed to the target path
+	// once every file is linked, so that nothing scanning the target sees a
+	// partly linked album. It must not exist yet, and must be on the same
+	// filesystem as the target; its parent directories are created as
+	// needed.
+	StagingPath string
+	// If set, called with the directory the album was linked into once every
+	// file is linked, and before it's moved into place, to add files that
+	// aren't links, such as tracks split from a CD image. If it fails, the
+	// album is removed as for any other failure.
+	AddFiles func(ctx context.Context, dir string) error
+	// If set, maps each file's path relative to the album to the path it's
+	// linked to relative to the target, e.g. to rename disc folders. The
+	// target's directories are then created as files need them, rather than
+	// mirroring the source's.
+	MapPath func(relPath string) string
+}
+
+// Recursively link album to targetPath, which must not exist yet; its parent
+// directories are created as needed. Returns what was done with each file.
+// If linking fails, whatever was linked of the album is removed again.
+func (l Linker) Link(album Album, targetPath string) ([]FileDecision, error) {
+	return l.LinkContext(context.Background(), album, targetPath)
+}
+
+// Like Link, but stops between files once ctx is cancelled, removes the
+// partly linked album, and returns ctx.Err().
+func (l Linker) LinkContext(ctx context.Context, album Album, targetPath string) ([]FileDecision, error) {
+	// Parent dirs from a target template, e.g. the artist's, may be shared
+	// with other albums.
+	fsys := orOS(l.FS)
+	if err := fsys.MkdirAll(filepath.Dir(targetPath), 0775); err != nil {
+		return nil, err
+	}
+	// With a staging path, the empty target still claims the album's place,
+	// so that a clash is found before linking rather than after.
+	if err := fsys.Mkdir(targetPath, 0775); err != nil {
+		return nil, err
+	}
+	linkPath := targetPath
+	if l.StagingPath != "" {
+		linkPath = l.StagingPath
+		err := fsys.MkdirAll(filepath.Dir(linkPath), 0775)
+		if err == nil {
+			err = fsys.Mkdir(linkPath, 0775)
+		}
+		if err != nil {
+			return nil, removePartial(fsys, err, targetPath)
+		}
+	}
+	decisions, err := l.linkDir(ctx, fsys, album.Path, linkPath, linkPath, "")
+	if err == nil && l.AddFiles != nil {
+		err = l.AddFiles(ctx, linkPath)
+	}
+	if err != nil {
+		return nil, removePartial(fsys, err, linkPath, targetPath)
+	}
+	if linkPath != targetPath {
+		if err := moveIntoPlace(fsys, linkPath, targetPath); err != nil {
+			return nil, removePartial(fsys, err, linkPath)
+		}
+	}
+	return decisions, nil
+}
+
+// Replace the empty directory at targetPath with the linked album at
+// stagingPath. If something was put in targetPath meanwhile, it's left alone
+// and an error returned.
+func moveIntoPlace(fsys FS, stagingPath, targetPath string) error {
+	contents, err := fsys.ReadDir(targetPath)
+	if err != nil {
+		return err
+	}
+	if len(contents) > 0 {
+		return fmt.Errorf("%s is no longer empty", targetPath)
+	}
+	if err := fsys.RemoveAll(targetPath); err != nil {
+		return err
+	}
+	return fsys.Rename(stagingPath, targetPath)
+}
+
+// Remove the partly linked album at paths after linking failed with err,
+// returning err along with any error removing it.
+func removePartial(fsys FS, err error, paths ...string) error {
+	for _, path := range paths {
+		if rmErr := fsys.RemoveAll(path); rmErr != nil {
+			return fmt.Errorf("%v; removing partly linked album: %v", err, rmErr)
+		}
+	}
+	return err
+}
+
+// Recursively link the contents of the directory at sourcePath into
+// targetDirPath, which already exists unless MapPath is set. relPath is the
+// directory's path relative to the album root, used to record decisions,
+// and targetRoot is where the album is being linked.
+func (l Linker) linkDir(ctx context.Context, fsys FS, sourcePath string, targetDirPath string, targetRoot string, relPath string) (decisions []FileDecision, err error) {
+	sourceContents, err := fsys.ReadDir(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range sourceContents {
+		if err := ctx.Err(); err != nil {
+			return decisions, err
+		}
+		fileRelPath := filepath.Join(relPath, file.Name())
+		if l.Ignore != nil && l.Ignore(filepath.Join(sourcePath, file.Name()), file.IsDir()) {
+			if !file.IsDir() {
+				decisions = append(decisions, FileDecision{Path: fileRelPath, Linked: false, Size: file.Size()})
+			}
+			continue
+		}
+		if file.IsDir() {
+			subSource := filepath.Join(sourcePath, file.Name())
+			subTarget := filepath.Join(targetDirPath, file.Name())
+			if l.MapPath == nil {
+				if err := fsys.Mkdir(subTarget, 0775); err != nil {
+					return decisions, err
+				}
+			}
+			subDecisions, err := l.linkDir(ctx, fsys, subSource, subTarget, targetRoot, fileRelPath)
+			decisions = append(decisions, subDecisions...)
+			if err != nil {
+				return decisions, err
+			}
+		} else if l.Exclude != nil && l.Exclude(file.Name()) {
+			decisions = append(decisions, FileDecision{Path: fileRelPath, Linked: false, Size: file.Size()})
+		} else {
+			sourceFilePath := filepath.Join(sourcePath, file.Name())
+			targetFilePath := filepath.Join(targetDirPath, file.Name())
+			decision := FileDecision{Path: fileRelPath, Linked: true, Size: file.Size()}
+			if l.MapPath != nil {
+				if mapped := l.MapPath(fileRelPath); mapped != fileRelPath {
+					decision.Target = mapped
+				}
+				targetFilePath = filepath.Join(targetRoot, decision.TargetPath())
+				if err := fsys.MkdirAll(filepath.Dir(targetFilePath), 0775); err != nil {
+					return decisions, err
+				}
+			}
+			if err := fsys.Link(sourceFilePath, targetFilePath); err != nil {
+				return decisions, err
+			}
+			decisions = append(decisions, decision)
+		}
+	}
+	return decisions, nil
+}
@@ -0,0 +1,224 @@
+package flaclink
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The paths of the files under root in m, relative to it, or nil if root
+// doesn't exist.
+func memFiles(m *MemFS, root string) []string {
+	var files []string
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, _ := m.ReadDir(dir)
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				walk(path)
+				continue
+			}
+			rel, _ := filepath.Rel(root, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+	}
+	walk(root)
+	sort.Strings(files)
+	return files
+}
+
+func TestLinkContext(t *testing.T) {
+	source := []string{"/src/Album/01.flac", "/src/Album/CD2/01.flac", "/src/Album/rip.log"}
+	errAddFiles := errors.New("split failed")
+	tests := []struct {
+		name string
+		// The Linker for the case, apart from its FS, which is m.
+		linker func(m *MemFS) Linker
+		// Makes the target, or something inside it, exist before linking.
+		existing string
+		ctx      func() context.Context
+		// The files expected under the target, or nil if linking fails and
+		// leaves no target behind.
+		wantFiles     []string
+		wantDecisions []FileDecision
+		wantErr       func(error) bool
+	}{
+		{
+			name:      "links every file",
+			wantFiles: []string{"01.flac", "CD2/01.flac", "rip.log"},
+			wantDecisions: []FileDecision{
+				{Path: "01.flac", Linked: true, Size: 1},
+				{Path: "CD2/01.flac", Linked: true, Size: 1},
+				{Path: "rip.log", Linked: true, Size: 1},
+			},
+		},
+		{
+			name: "exclude",
+			linker: func(*MemFS) Linker {
+				return Linker{Exclude: func(name string) bool { return strings.HasSuffix(name, ".log") }}
+			},
+			wantFiles: []string{"01.flac", "CD2/01.flac"},
+			wantDecisions: []FileDecision{
+				{Path: "01.flac", Linked: true, Size: 1},
+				{Path: "CD2/01.flac", Linked: true, Size: 1},
+				{Path: "rip.log", Linked: false, Size: 1},
+			},
+		},
+		{
+			name: "ignore",
+			linker: func(*MemFS) Linker {
+				return Linker{Ignore: func(path string, isDir bool) bool { return isDir && filepath.Base(path) == "CD2" }}
+			},
+			wantFiles: []string{"01.flac", "rip.log"},
+			wantDecisions: []FileDecision{
+				{Path: "01.flac", Linked: true, Size: 1},
+				{Path: "rip.log", Linked: true, Size: 1},
+			},
+		},
+		{
+			name: "map path",
+			linker: func(*MemFS) Linker {
+				return Linker{MapPath: func(relPath string) string {
+					return strings.Replace(relPath, "CD2", "Disc 2", 1)
+				}}
+			},
+			wantFiles: []string{"01.flac", "Disc 2/01.flac", "rip.log"},
+			wantDecisions: []FileDecision{
+				{Path: "01.flac", Linked: true, Size: 1},
+				{Path: "CD2/01.flac", Linked: true, Size: 1, Target: "Disc 2/01.flac"},
+				{Path: "rip.log", Linked: true, Size: 1},
+			},
+		},
+		{
+			name: "add files",
+			linker: func(m *MemFS) Linker {
+				return Linker{AddFiles: func(ctx context.Context, dir string) error {
+					return m.WriteFile(filepath.Join(dir, "02.flac"), 1)
+				}}
+			},
+			wantFiles: []string{"01.flac", "02.flac", "CD2/01.flac", "rip.log"},
+			wantDecisions: []FileDecision{
+				{Path: "01.flac", Linked: true, Size: 1},
+				{Path: "CD2/01.flac", Linked: true, Size: 1},
+				{Path: "rip.log", Linked: true, Size: 1},
+			},
+		},
+		{
+			name: "add files fails",
+			linker: func(*MemFS) Linker {
+				return Linker{AddFiles: func(ctx context.Context, dir string) error { return errAddFiles }}
+			},
+			wantErr: func(err error) bool { return err == errAddFiles },
+		},
+		{
+			name: "cancelled",
+			ctx: func() context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx
+			},
+			wantErr: func(err error) bool { return err == context.Canceled },
+		},
+		{
+			name:     "target exists",
+			existing: "/dst/Album/cover.jpg",
+			// The existing target is left alone.
+			wantFiles: []string{"cover.jpg"},
+			wantErr:   func(err error) bool { return err != nil },
+		},
+		{
+			name:      "staging",
+			linker:    func(*MemFS) Linker { return Linker{StagingPath: "/dst/.staging/Album"} },
+			wantFiles: []string{"01.flac", "CD2/01.flac", "rip.log"},
+			wantDecisions: []FileDecision{
+				{Path: "01.flac", Linked: true, Size: 1},
+				{Path: "CD2/01.flac", Linked: true, Size: 1},
+				{Path: "rip.log", Linked: true, Size: 1},
+			},
+		},
+		{
+			name: "staging add files fails",
+			linker: func(*MemFS) Linker {
+				return Linker{StagingPath: "/dst/.staging/Album", AddFiles: func(ctx context.Context, dir string) error { return errAddFiles }}
+			},
+			wantErr: func(err error) bool { return err == errAddFiles },
+		},
+		{
+			name: "staging target filled meanwhile",
+			linker: func(m *MemFS) Linker {
+				return Linker{StagingPath: "/dst/.staging/Album", AddFiles: func(ctx context.Context, dir string) error {
+					return m.WriteFile("/dst/Album/cover.jpg", 1)
+				}}
+			},
+			// What was put in the target is left alone.
+			wantFiles: []string{"cover.jpg"},
+			wantErr:   func(err error) bool { return err != nil && strings.Contains(err.Error(), "no longer empty") },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := memFSWith(t, source...)
+			if test.existing != "" {
+				if err := m.WriteFile(test.existing, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx := context.Background()
+			if test.ctx != nil {
+				ctx = test.ctx()
+			}
+			album := newAlbum(m, "/src/Album")
+			var linker Linker
+			if test.linker != nil {
+				linker = test.linker(m)
+			}
+			linker.FS = m
+			decisions, err := linker.LinkContext(ctx, album, "/dst/Album")
+
+			if test.wantErr != nil {
+				if !test.wantErr(err) {
+					t.Errorf("LinkContext error = %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("LinkContext: %v", err)
+			}
+			for i := range decisions {
+				decisions[i].Path = filepath.ToSlash(decisions[i].Path)
+				decisions[i].Target = filepath.ToSlash(decisions[i].Target)
+			}
+			if !reflect.DeepEqual(decisions, test.wantDecisions) {
+				t.Errorf("decisions = %+v, want %+v", decisions, test.wantDecisions)
+			}
+			if got := memFiles(m, "/dst/Album"); !reflect.DeepEqual(got, test.wantFiles) {
+				t.Errorf("target files = %v, want %v", got, test.wantFiles)
+			}
+			if linker.StagingPath != "" {
+				if _, err := m.ReadDir(linker.StagingPath); err == nil {
+					t.Errorf("staging path %s was left behind", linker.StagingPath)
+				}
+			}
+			// Each source file has a second link only if it was linked.
+			linked := map[string]bool{}
+			for _, decision := range decisions {
+				if decision.Linked {
+					linked[decision.Path] = true
+				}
+			}
+			for _, path := range source {
+				rel := strings.TrimPrefix(path, "/src/Album/")
+				want := 1
+				if linked[rel] {
+					want = 2
+				}
+				if got := m.LinkCount(path); got != want {
+					t.Errorf("LinkCount(%s) = %d, want %d", path, got, want)
+				}
+			}
+		})
+	}
+}
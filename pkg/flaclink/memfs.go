@@ -0,0 +1,191 @@
+package flaclink
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An FS held in memory, for testing code that scans and links albums without
+// touching the disk. Files have a size but no contents. Paths are cleaned
+// with filepath.Clean; the root directory "/" always exists. Safe for
+// concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+// A file or directory. Hardlinks to a file share its node.
+type memNode struct {
+	dir     bool
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	links   int
+}
+
+func NewMemFS() *MemFS {
+	root := &memNode{dir: true, mode: os.ModeDir | 0775, modTime: time.Now(), links: 1}
+	return &MemFS{nodes: map[string]*memNode{"/": root}}
+}
+
+// Create a file of the given size at name, creating its parent directories
+// as needed. An existing file at name is replaced.
+func (m *MemFS) WriteFile(name string, size int64) error {
+	if err := m.MkdirAll(filepath.Dir(name), 0775); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if node, ok := m.nodes[name]; ok && node.dir {
+		return &os.PathError{Op: "write", Path: name, Err: os.ErrExist}
+	}
+	m.nodes[name] = &memNode{size: size, mode: 0664, modTime: time.Now(), links: 1}
+	return nil
+}
+
+// Returns the number of hardlinks to the file at name, or 0 if there's none.
+func (m *MemFS) LinkCount(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if node, ok := m.nodes[filepath.Clean(name)]; ok && !node.dir {
+		return node.links
+	}
+	return 0
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if node, ok := m.nodes[name]; !ok || !node.dir {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for path, node := range m.nodes {
+		if path != name && filepath.Dir(path) == name {
+			infos = append(infos, memFileInfo{name: filepath.Base(path), node: node})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mkdir(filepath.Clean(name), perm)
+}
+
+// Like Mkdir, but with m.mu held and name cleaned.
+func (m *MemFS) mkdir(name string, perm os.FileMode) error {
+	if _, ok := m.nodes[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if parent, ok := m.nodes[filepath.Dir(name)]; !ok || !parent.dir {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	m.nodes[name] = &memNode{dir: true, mode: os.ModeDir | perm, modTime: time.Now(), links: 1}
+	return nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if node, ok := m.nodes[name]; ok {
+		if !node.dir {
+			return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+		}
+		return nil
+	}
+	var missing []string
+	for dir := name; ; dir = filepath.Dir(dir) {
+		if _, ok := m.nodes[dir]; ok || dir == filepath.Dir(dir) {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := m.mkdir(missing[i], perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	node, ok := m.nodes[oldname]
+	if !ok || node.dir {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := m.nodes[newname]; ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if parent, ok := m.nodes[filepath.Dir(newname)]; !ok || !parent.dir {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	node.links++
+	m.nodes[newname] = node
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	prefix := name + string(filepath.Separator)
+	for path, node := range m.nodes {
+		if path != "/" && (path == name || strings.HasPrefix(path, prefix)) {
+			node.links--
+			delete(m.nodes, path)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	node, ok := m.nodes[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if parent, ok := m.nodes[filepath.Dir(newname)]; !ok || !parent.dir {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if existing, ok := m.nodes[newname]; ok && (existing.dir || node.dir) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	prefix := oldname + string(filepath.Separator)
+	for path, node := range m.nodes {
+		if path == oldname {
+			delete(m.nodes, path)
+			m.nodes[newname] = node
+		} else if strings.HasPrefix(path, prefix) {
+			delete(m.nodes, path)
+			m.nodes[filepath.Join(newname, strings.TrimPrefix(path, prefix))] = node
+		}
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	node *memNode
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.node.size }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.node.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.node.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.node.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
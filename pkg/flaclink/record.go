@@ -0,0 +1,89 @@
+package flaclink
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+// Everything recorded about an album in the store. Albums that were found
+// already in the target, rather than linked, have only DirName.
+type AlbumRecord struct {
+	DirName string
+	// Absolute path the album was linked from, and the path it was linked to.
+	Source string
+	Target string
+	// Discography folder the album was found in, if any.
+	Container string
+	Time      time.Time
+	// What was done with each file, including its size.
+	Files []FileDecision
+	// Number and total size of the files that were linked.
+	FileCount int
+	Bytes     int64
+	// Audio format, e.g. "FLAC 24/96", and how the album was put in the
+	// target, e.g. "hardlink".
+	Format   string
+	LinkMode string
+	// Bit depth and sample rate in Hz of the album's first FLAC file, or zero
+	// if it couldn't be read.
+	BitsPerSample int
+	SampleRate    int
+	// The album's edition, e.g. "Deluxe Edition", from the bracketed parts
+	// of its title or source folder name, or empty if it has none.
+	Edition string
+	// Problems found with the album when it was linked, such as suspected
+	// lossy transcodes.
+	Warnings []string
+	// CUE sheets in the album, relative to it, and the FLAC images among its
+	// files that hold a whole disc listed by one of them.
+	CueSheets []string
+	Images    []string
+	// Tracks the images were split into, relative to Target, if they were.
+	SplitTracks []string
+	// URL of the cover art fetched for the album from the Cover Art Archive,
+	// if any.
+	FetchedArt string
+}
+
+// Version of the AlbumRecord encoding in bolt. Bump it when a change to
+// AlbumRecord can't be read by gob from older records, and convert them in
+// decodeRecord.
+const recordVersion = 1
+
+// Set FileCount and Bytes from Files.
+func (r *AlbumRecord) CountFiles() {
+	r.FileCount, r.Bytes = 0, 0
+	for _, decision := range r.Files {
+		if decision.Linked {
+			r.FileCount++
+			r.Bytes += decision.Size
+		}
+	}
+}
+
+// Encode r as a value of the albums bucket: a zero byte, which no directory
+// name starts with, the record version, then the gob-encoded record without
+// Files and Container, which have buckets of their own.
+func encodeRecord(r AlbumRecord) ([]byte, error) {
+	r.Files, r.Container = nil, ""
+	buf := bytes.NewBuffer([]byte{0, recordVersion})
+	if err := gob.NewEncoder(buf).Encode(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode a value of the albums bucket. Values written before album records
+// are just the directory name; legacy is true for those.
+func decodeRecord(v []byte) (r AlbumRecord, legacy bool, err error) {
+	if len(v) == 0 || v[0] != 0 {
+		return AlbumRecord{DirName: string(v)}, true, nil
+	}
+	if len(v) < 2 || v[1] > recordVersion {
+		return r, false, fmt.Errorf("album record version %d is newer than this flaclink supports", v[1])
+	}
+	err = gob.NewDecoder(bytes.NewReader(v[2:])).Decode(&r)
+	return r, false, err
+}
@@ -0,0 +1,243 @@
+package flaclink
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Subfolder names used for the discs of a multi-disc album, e.g. "CD1",
+	// "Disc 2 - Live" or just "2".
+	discDirPattern = regexp.MustCompile(`(?i)^((cd|dis[ck])[\s._-]*\d+\b.*|\d{1,2})$`)
+	// The disc number in a name discDirPattern matches.
+	discNumberPattern = regexp.MustCompile(`(\d+)`)
+	// Everything from the word "discography" onwards in a folder name, along with
+	// separators before it, e.g. " - Discography (1967-2014) [FLAC]".
+	discographySuffix = regexp.MustCompile(`(?i)[\s\-–_(\[]*(complete\s+)?discography.*$`)
+)
+
+// The version of how FindAlbums divides folders into albums, bumped whenever
+// it would find different albums in folders that haven't changed, so that
+// anything remembering what it found can tell when to look again.
+const ScannerVersion = 5
+
+// Reports whether name is the name of a disc folder of a multi-disc album,
+// and if so returns the disc number and anything after it, such as a disc
+// title, e.g. 2 and "Live" for "CD2 - Live".
+func DiscFolder(name string) (disc int, rest string, ok bool) {
+	if !discDirPattern.MatchString(name) {
+		return 0, "", false
+	}
+	match := discNumberPattern.FindStringSubmatchIndex(name)
+	disc, _ = strconv.Atoi(name[match[2]:match[3]])
+	return disc, strings.Trim(name[match[1]:], " ._-"), true
+}
+
+// Finds the albums in a source directory.
+type Scanner struct {
+	// If set, only entries of the source directory whose names it accepts
+	// are scanned.
+	Include func(name string) bool
+	// If set, directories whose names it matches are ignored at every
+	// level, e.g. hidden ones or those that NAS software creates.
+	SkipDir func(name string) bool
+	// If set, files and directories whose paths it matches are ignored at
+	// every level, e.g. those listed in ignore files.
+	Ignore func(path string, isDir bool) bool
+	// The filesystem to scan, or nil for the local one.
+	FS FS
+	// If set, returns what identifies the album that the music in a folder
+	// is tagged as, such as its artist and title, or "" if it can't tell.
+	// A folder of album subfolders whose name doesn't mention a discography
+	// is only split into albums if they're tagged as different albums;
+	// otherwise they're taken to be parts of one album, such as "Vol 1" and
+	// "Vol 2". Without it, only discographies are split.
+	AlbumTag func(dirPath string) string
+}
+
+func (s Scanner) skipped(dirName string) bool {
+	return s.SkipDir != nil && s.SkipDir(dirName)
+}
+
+func (s Scanner) ignored(path string, isDir bool) bool {
+	return s.Ignore != nil && s.Ignore(path, isDir)
+}
+
+// Returns the albums in the entries of sourceDir, in name order.
+func (s Scanner) Scan(sourceDir string) ([]Album, error) {
+	return s.ScanContext(context.Background(), sourceDir)
+}
+
+// Like Scan, but stops once ctx is cancelled, returning the albums found so
+// far and ctx.Err().
+func (s Scanner) ScanContext(ctx context.Context, sourceDir string) ([]Album, error) {
+	entries, err := orOS(s.FS).ReadDir(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	var albums []Album
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return albums, err
+		}
+		if s.Include != nil && !s.Include(entry.Name()) {
+			continue
+		}
+		if entry.IsDir() && s.skipped(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(sourceDir, entry.Name())
+		if s.ignored(path, entry.IsDir()) {
+			continue
+		}
+		albums = append(albums, s.FindAlbums(path)...)
+	}
+	return albums, nil
+}
+
+// Returns the albums found at path: none if it contains no flac files, one
+// if it's an ordinary album, or one per inner album if it's a discography.
+func FindAlbums(path string) []Album {
+	return Scanner{}.FindAlbums(path)
+}
+
+// Like the package-level FindAlbums, but on s.FS, and ignoring directories
+// inside path that s.SkipDir matches, and files and directories inside it
+// that s.Ignore matches. Include isn't applied, nor Ignore to path itself.
+func (s Scanner) FindAlbums(path string) []Album {
+	fsys := orOS(s.FS)
+	if !s.IsAlbum(path) {
+		return nil
+	}
+	innerPaths := s.discographyAlbumPaths(path)
+	if innerPaths == nil {
+		return []Album{newAlbum(fsys, path)}
+	}
+	return s.discographyAlbums(path, innerPaths, folderArtist(path))
+}
+
+// The albums at innerPaths, the album subfolders of a discography inside
+// container, splitting any that are discographies in turn, as when a
+// torrent holds an Artist/Album folder for each album. Names are prefixed
+// with artist, or for an inner discography with its folderArtist, if they
+// don't include it already.
+func (s Scanner) discographyAlbums(container string, innerPaths []string, artist string) []Album {
+	fsys := orOS(s.FS)
+	albums := make([]Album, 0, len(innerPaths))
+	for _, innerPath := range innerPaths {
+		if nested := s.discographyAlbumPaths(innerPath); nested != nil {
+			albums = append(albums, s.discographyAlbums(container, nested, folderArtist(innerPath))...)
+			continue
+		}
+		album := newAlbum(fsys, innerPath)
+		album.Container = container
+		if artist != "" && !containsWord(album.DirName, artist) {
+			album.DirName = artist + " - " + album.DirName
+		}
+		albums = append(albums, album)
+	}
+	return albums
+}
+
+// If dirPath looks like a discography, i.e. it has no flac files of its own
+// but two or more subfolders that are albums rather than discs of a single
+// album, returns the paths of those subfolders. They're taken to be albums
+// if dirPath's name mentions a discography, AlbumTag tells them apart, or
+// one of them is a discography itself, e.g. the artist's folder in a torrent
+// of Artist/Album folders; a single subfolder counts then too. Otherwise
+// returns nil.
+func (s Scanner) discographyAlbumPaths(dirPath string) []string {
+	contents, err := orOS(s.FS).ReadDir(dirPath)
+	if err != nil {
+		return nil
+	}
+	var albumPaths []string
+	for _, file := range contents {
+		subPath := filepath.Join(dirPath, file.Name())
+		if s.ignored(subPath, file.IsDir()) {
+			continue
+		}
+		if !file.IsDir() {
+			if filepath.Ext(file.Name()) == ".flac" {
+				return nil
+			}
+			continue
+		}
+		if s.skipped(file.Name()) {
+			continue
+		}
+		if discDirPattern.MatchString(file.Name()) {
+			return nil
+		}
+		if s.IsAlbum(subPath) {
+			albumPaths = append(albumPaths, subPath)
+		}
+	}
+	if len(albumPaths) == 1 && s.discographyAlbumPaths(albumPaths[0]) != nil {
+		return albumPaths
+	}
+	if len(albumPaths) < 2 {
+		return nil
+	}
+	if DiscographyArtist(NormalizeName(filepath.Base(dirPath))) != "" || s.differentAlbums(albumPaths) {
+		return albumPaths
+	}
+	for _, albumPath := range albumPaths {
+		if s.discographyAlbumPaths(albumPath) != nil {
+			return albumPaths
+		}
+	}
+	return nil
+}
+
+// Reports whether AlbumTag tells any two of the folders at paths apart.
+// Untagged folders don't count either way.
+func (s Scanner) differentAlbums(paths []string) bool {
+	if s.AlbumTag == nil {
+		return false
+	}
+	first := ""
+	for _, path := range paths {
+		tag := s.AlbumTag(path)
+		if tag == "" {
+			continue
+		}
+		if first == "" {
+			first = tag
+		} else if tag != first {
+			return true
+		}
+	}
+	return false
+}
+
+// The artist that the albums in the discography folder at path are by: the
+// one its name gives if it mentions a discography, or else its name, since
+// such a folder is usually the artist's own, e.g. "Pink Floyd".
+func folderArtist(path string) string {
+	name := NormalizeName(filepath.Base(path))
+	if artist := DiscographyArtist(name); artist != "" {
+		return artist
+	}
+	return name
+}
+
+// Reports whether name contains word, ignoring case, other than as part of
+// a longer word, so "Yessongs" doesn't count as naming Yes.
+func containsWord(name, word string) bool {
+	return regexp.MustCompile(`(?i)(^|\W)` + regexp.QuoteMeta(word) + `(\W|$)`).MatchString(name)
+}
+
+// Guess the artist from a discography folder name such as
+// "Pink Floyd - Discography (1967-2014)". Returns "" if the name doesn't
+// mention a discography.
+func DiscographyArtist(dirName string) string {
+	if !discographySuffix.MatchString(dirName) {
+		return ""
+	}
+	artist := discographySuffix.ReplaceAllString(dirName, "")
+	return strings.TrimSpace(strings.Trim(artist, " -–_([])"))
+}
@@ -0,0 +1,229 @@
+package flaclink
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A MemFS holding an empty file at each of paths.
+func memFSWith(t *testing.T, paths ...string) *MemFS {
+	t.Helper()
+	m := NewMemFS()
+	for _, path := range paths {
+		if err := m.WriteFile(filepath.FromSlash(path), 1); err != nil {
+			t.Fatalf("WriteFile(%s): %v", path, err)
+		}
+	}
+	return m
+}
+
+// An AlbumTag for scanning m, which takes the name of the first flac file in
+// a folder as the album it's tagged as, and files named by track number as
+// untagged.
+func memAlbumTag(m *MemFS) func(dirPath string) string {
+	return func(dirPath string) string {
+		entries, _ := m.ReadDir(dirPath)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				if tag := memAlbumTag(m)(filepath.Join(dirPath, entry.Name())); tag != "" {
+					return tag
+				}
+				continue
+			}
+			if name := strings.TrimSuffix(entry.Name(), ".flac"); name != entry.Name() {
+				if _, err := strconv.Atoi(name); err == nil {
+					return ""
+				}
+				return name
+			}
+		}
+		return ""
+	}
+}
+
+func TestFindAlbums(t *testing.T) {
+	// What's compared of each album found.
+	type found struct {
+		DirName, Path, Container string
+	}
+	tests := []struct {
+		name  string
+		files []string
+		path  string
+		want  []found
+	}{
+		{
+			name:  "album",
+			files: []string{"/src/Album/01.flac", "/src/Album/cover.jpg"},
+			path:  "/src/Album",
+			want:  []found{{"Album", "/src/Album", ""}},
+		},
+		{
+			name:  "no flac files",
+			files: []string{"/src/Album/01.mp3"},
+			path:  "/src/Album",
+		},
+		{
+			name:  "flac files in a subfolder",
+			files: []string{"/src/Album/scans/front.jpg", "/src/Album/FLAC/01.flac"},
+			path:  "/src/Album",
+			want:  []found{{"Album", "/src/Album", ""}},
+		},
+		{
+			name:  "disc folders",
+			files: []string{"/src/Album/CD1/01.flac", "/src/Album/CD2/01.flac"},
+			path:  "/src/Album",
+			want:  []found{{"Album", "/src/Album", ""}},
+		},
+		{
+			name:  "discography",
+			files: []string{"/src/Yes - Discography/Fragile/01.flac", "/src/Yes - Discography/Yes - Relayer/01.flac"},
+			path:  "/src/Yes - Discography",
+			want: []found{
+				{"Yes - Fragile", "/src/Yes - Discography/Fragile", "/src/Yes - Discography"},
+				{"Yes - Relayer", "/src/Yes - Discography/Yes - Relayer", "/src/Yes - Discography"},
+			},
+		},
+		{
+			name:  "folder of albums not named as a discography",
+			files: []string{"/src/Best of/Fragile/Fragile.flac", "/src/Best of/Relayer/Relayer.flac"},
+			path:  "/src/Best of",
+			want: []found{
+				{"Best of - Fragile", "/src/Best of/Fragile", "/src/Best of"},
+				{"Best of - Relayer", "/src/Best of/Relayer", "/src/Best of"},
+			},
+		},
+		{
+			name:  "discography with a multi-disc album",
+			files: []string{"/src/Yes - Discography/Fragile/01.flac", "/src/Yes - Discography/Yessongs/CD1/01.flac", "/src/Yes - Discography/Yessongs/CD2/01.flac"},
+			path:  "/src/Yes - Discography",
+			want: []found{
+				{"Yes - Fragile", "/src/Yes - Discography/Fragile", "/src/Yes - Discography"},
+				{"Yes - Yessongs", "/src/Yes - Discography/Yessongs", "/src/Yes - Discography"},
+			},
+		},
+		{
+			name:  "artist folder",
+			files: []string{"/src/Yes/Fragile/Fragile.flac", "/src/Yes/Relayer/Relayer.flac"},
+			path:  "/src/Yes",
+			want: []found{
+				{"Yes - Fragile", "/src/Yes/Fragile", "/src/Yes"},
+				{"Yes - Relayer", "/src/Yes/Relayer", "/src/Yes"},
+			},
+		},
+		{
+			name:  "artist folder in a torrent",
+			files: []string{"/src/Torrent/Yes/Fragile/Fragile.flac", "/src/Torrent/Yes/Relayer/Relayer.flac"},
+			path:  "/src/Torrent",
+			want: []found{
+				{"Yes - Fragile", "/src/Torrent/Yes/Fragile", "/src/Torrent"},
+				{"Yes - Relayer", "/src/Torrent/Yes/Relayer", "/src/Torrent"},
+			},
+		},
+		{
+			name: "several artist folders in a torrent",
+			files: []string{
+				"/src/Torrent/Rush/Permanent Waves/Permanent Waves.flac", "/src/Torrent/Rush/Moving Pictures/Moving Pictures.flac",
+				"/src/Torrent/Yes - Discography (1969-2014)/Fragile/01.flac", "/src/Torrent/Yes - Discography (1969-2014)/Relayer/01.flac",
+			},
+			path: "/src/Torrent",
+			want: []found{
+				{"Rush - Moving Pictures", "/src/Torrent/Rush/Moving Pictures", "/src/Torrent"},
+				{"Rush - Permanent Waves", "/src/Torrent/Rush/Permanent Waves", "/src/Torrent"},
+				{"Yes - Fragile", "/src/Torrent/Yes - Discography (1969-2014)/Fragile", "/src/Torrent"},
+				{"Yes - Relayer", "/src/Torrent/Yes - Discography (1969-2014)/Relayer", "/src/Torrent"},
+			},
+		},
+		{
+			name:  "untagged folder of albums not named as a discography",
+			files: []string{"/src/Best of/Fragile/01.flac", "/src/Best of/Relayer/01.flac"},
+			path:  "/src/Best of",
+			want:  []found{{"Best of", "/src/Best of", ""}},
+		},
+		{
+			name:  "volume folders",
+			files: []string{"/src/Album/Vol 1/01.flac", "/src/Album/Vol 2/01.flac"},
+			path:  "/src/Album",
+			want:  []found{{"Album", "/src/Album", ""}},
+		},
+		{
+			name:  "disc folders with spelled out numbers",
+			files: []string{"/src/Album/Disc One/Album.flac", "/src/Album/Disc Two/Album.flac"},
+			path:  "/src/Album",
+			want:  []found{{"Album", "/src/Album", ""}},
+		},
+		{
+			name:  "side folders",
+			files: []string{"/src/Album/Side A/Album.flac", "/src/Album/Side B/Album.flac"},
+			path:  "/src/Album",
+			want:  []found{{"Album", "/src/Album", ""}},
+		},
+		{
+			name:  "format folders",
+			files: []string{"/src/Album/16-44/Album.flac", "/src/Album/24-96/Album.flac"},
+			path:  "/src/Album",
+			want:  []found{{"Album", "/src/Album", ""}},
+		},
+		{
+			name:  "single album in a wrapper folder",
+			files: []string{"/src/Torrent/Fragile/01.flac"},
+			path:  "/src/Torrent",
+			want:  []found{{"Torrent", "/src/Torrent", ""}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := memFSWith(t, test.files...)
+			var got []found
+			for _, album := range (Scanner{FS: m, AlbumTag: memAlbumTag(m)}).FindAlbums(filepath.FromSlash(test.path)) {
+				got = append(got, found{album.DirName, filepath.ToSlash(album.Path), filepath.ToSlash(album.Container)})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("FindAlbums(%s) = %v, want %v", test.path, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindAlbumsSkipsAndIgnores(t *testing.T) {
+	m := memFSWith(t,
+		"/src/Yes - Discography/Fragile/01.flac",
+		"/src/Yes - Discography/Relayer/01.flac",
+		"/src/Yes - Discography/.hidden/01.flac",
+		"/src/Yes - Discography/Ignored/01.flac",
+	)
+	s := Scanner{
+		FS:      m,
+		SkipDir: func(name string) bool { return strings.HasPrefix(name, ".") },
+		Ignore:  func(path string, isDir bool) bool { return filepath.Base(path) == "Ignored" },
+	}
+	var got []string
+	for _, album := range s.FindAlbums(filepath.FromSlash("/src/Yes - Discography")) {
+		got = append(got, album.DirName)
+	}
+	want := []string{"Yes - Fragile", "Yes - Relayer"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAlbums = %v, want %v", got, want)
+	}
+}
+
+func TestScan(t *testing.T) {
+	m := memFSWith(t, "/src/B/01.flac", "/src/A/01.flac", "/src/C/notes.txt", "/src/loose.flac")
+	albums, err := Scanner{FS: m}.Scan(filepath.FromSlash("/src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, album := range albums {
+		got = append(got, album.DirName)
+	}
+	if want := []string{"A", "B"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan = %v, want %v", got, want)
+	}
+	if want := []string{"01.flac"}; !reflect.DeepEqual(albums[0].Contents, want) {
+		t.Errorf("Contents = %v, want %v", albums[0].Contents, want)
+	}
+}
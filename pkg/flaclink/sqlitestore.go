@@ -0,0 +1,360 @@
+package flaclink
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Tables of a SQLiteStore. Album contents and other lists are stored as
+// JSON arrays, so they can be queried with SQLite's JSON functions, and link
+// times in RFC 3339 format.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS albums (
+	contents TEXT PRIMARY KEY,
+	dir_name TEXT NOT NULL,
+	source TEXT NOT NULL DEFAULT '',
+	target TEXT NOT NULL DEFAULT '',
+	link_time TEXT NOT NULL DEFAULT '',
+	file_count INTEGER NOT NULL DEFAULT 0,
+	bytes INTEGER NOT NULL DEFAULT 0,
+	format TEXT NOT NULL DEFAULT '',
+	link_mode TEXT NOT NULL DEFAULT '',
+	bits_per_sample INTEGER NOT NULL DEFAULT 0,
+	sample_rate INTEGER NOT NULL DEFAULT 0,
+	warnings TEXT NOT NULL DEFAULT '',
+	cue_sheets TEXT NOT NULL DEFAULT '',
+	images TEXT NOT NULL DEFAULT '',
+	split_tracks TEXT NOT NULL DEFAULT '',
+	fetched_art TEXT NOT NULL DEFAULT '',
+	edition TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS albums_dir_name ON albums (dir_name);
+CREATE TABLE IF NOT EXISTS files (
+	dir_name TEXT NOT NULL,
+	path TEXT NOT NULL,
+	linked INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	target TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (dir_name, path)
+);
+CREATE TABLE IF NOT EXISTS containers (
+	dir_name TEXT PRIMARY KEY,
+	container TEXT NOT NULL
+);
+`
+
+// A Store in a SQLite database, for sharing the album catalog with tools that
+// speak SQL. The caller opens db with a SQLite driver of its choice.
+type SQLiteStore struct {
+	DB *sql.DB
+}
+
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{DB: db}
+}
+
+// Columns added to the albums table after it was first released, with their
+// definitions, in the order they were added.
+var sqliteAddedColumns = [][2]string{
+	{"source", "TEXT NOT NULL DEFAULT ''"},
+	{"target", "TEXT NOT NULL DEFAULT ''"},
+	{"link_time", "TEXT NOT NULL DEFAULT ''"},
+	{"file_count", "INTEGER NOT NULL DEFAULT 0"},
+	{"bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"format", "TEXT NOT NULL DEFAULT ''"},
+	{"link_mode", "TEXT NOT NULL DEFAULT ''"},
+	{"bits_per_sample", "INTEGER NOT NULL DEFAULT 0"},
+	{"sample_rate", "INTEGER NOT NULL DEFAULT 0"},
+	{"warnings", "TEXT NOT NULL DEFAULT ''"},
+	{"cue_sheets", "TEXT NOT NULL DEFAULT ''"},
+	{"images", "TEXT NOT NULL DEFAULT ''"},
+	{"split_tracks", "TEXT NOT NULL DEFAULT ''"},
+	{"fetched_art", "TEXT NOT NULL DEFAULT ''"},
+	{"edition", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// Likewise for the files table.
+var sqliteAddedFileColumns = [][2]string{
+	{"target", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// Create the tables if they don't exist yet, and add any columns missing
+// from tables created by older versions.
+func (s *SQLiteStore) Init() error {
+	if _, err := s.DB.Exec(sqliteSchema); err != nil {
+		return err
+	}
+	if err := s.addMissingColumns("albums", sqliteAddedColumns); err != nil {
+		return err
+	}
+	if err := s.addMissingColumns("files", sqliteAddedFileColumns); err != nil {
+		return err
+	}
+	return s.normalizeContents()
+}
+
+// Like BoltStore.NormalizeKeys, rewrite the contents of albums stored before
+// they were normalized. If an album is stored under both, the normalized
+// row is kept.
+func (s *SQLiteStore) normalizeContents() error {
+	rows, err := s.DB.Query(`SELECT contents FROM albums`)
+	if err != nil {
+		return err
+	}
+	rewrites := make(map[string]string)
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			rows.Close()
+			return err
+		}
+		var contents []string
+		if json.Unmarshal([]byte(stored), &contents) != nil {
+			continue
+		}
+		normalized, err := json.Marshal(NormalizeContents(contents))
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if string(normalized) != stored {
+			rewrites[stored] = string(normalized)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for old, normalized := range rewrites {
+		if _, err := s.DB.Exec(`UPDATE OR IGNORE albums SET contents = ? WHERE contents = ?`, normalized, old); err != nil {
+			return err
+		}
+		if _, err := s.DB.Exec(`DELETE FROM albums WHERE contents = ?`, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) addMissingColumns(table string, columns [][2]string) error {
+	rows, err := s.DB.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	for _, column := range columns {
+		if existing[column[0]] {
+			continue
+		}
+		if _, err := s.DB.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column[0], column[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Lookup(album Album) (dirName string, ok bool) {
+	contents, err := json.Marshal(album.Contents)
+	if err != nil {
+		return "", false
+	}
+	err = s.DB.QueryRow(`SELECT dir_name FROM albums WHERE contents = ?`, string(contents)).Scan(&dirName)
+	return dirName, err == nil
+}
+
+func (s *SQLiteStore) Add(album Album) error {
+	return s.SaveRecord(album, AlbumRecord{DirName: album.DirName})
+}
+
+func (s *SQLiteStore) AddAll(albums []Album) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, album := range albums {
+		contents, err := json.Marshal(album.Contents)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO albums (contents, dir_name) VALUES (?, ?)`, string(contents), album.DirName); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Record(album Album) (record AlbumRecord, ok bool) {
+	contents, err := json.Marshal(album.Contents)
+	if err != nil {
+		return record, false
+	}
+	var linkTime, warnings, cueSheets, images, splitTracks string
+	err = s.DB.QueryRow(`SELECT dir_name, source, target, link_time, file_count, bytes, format, link_mode, bits_per_sample, sample_rate, warnings, cue_sheets, images, split_tracks, fetched_art, edition FROM albums WHERE contents = ?`, string(contents)).
+		Scan(&record.DirName, &record.Source, &record.Target, &linkTime, &record.FileCount, &record.Bytes, &record.Format, &record.LinkMode, &record.BitsPerSample, &record.SampleRate, &warnings, &cueSheets, &images, &splitTracks, &record.FetchedArt, &record.Edition)
+	if err != nil {
+		return record, false
+	}
+	if linkTime != "" {
+		record.Time, _ = time.Parse(time.RFC3339Nano, linkTime)
+	}
+	record.Warnings = parseSQLiteList(warnings)
+	record.CueSheets = parseSQLiteList(cueSheets)
+	record.Images = parseSQLiteList(images)
+	record.SplitTracks = parseSQLiteList(splitTracks)
+	record.Files, _ = s.Decisions(record.DirName)
+	record.Container, _ = s.Container(record.DirName)
+	return record, true
+}
+
+func (s *SQLiteStore) SaveRecord(album Album, record AlbumRecord) error {
+	contents, err := json.Marshal(album.Contents)
+	if err != nil {
+		return err
+	}
+	var linkTime string
+	if !record.Time.IsZero() {
+		linkTime = record.Time.Format(time.RFC3339Nano)
+	}
+	_, err = s.DB.Exec(`INSERT OR REPLACE INTO albums (contents, dir_name, source, target, link_time, file_count, bytes, format, link_mode, bits_per_sample, sample_rate, warnings, cue_sheets, images, split_tracks, fetched_art, edition) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		string(contents), record.DirName, record.Source, record.Target, linkTime, record.FileCount, record.Bytes, record.Format, record.LinkMode, record.BitsPerSample, record.SampleRate,
+		sqliteList(record.Warnings), sqliteList(record.CueSheets), sqliteList(record.Images), sqliteList(record.SplitTracks), record.FetchedArt, record.Edition)
+	if err != nil {
+		return err
+	}
+	if record.Files != nil {
+		if err := s.SaveDecisions(record.DirName, record.Files); err != nil {
+			return err
+		}
+	}
+	if record.Container != "" {
+		return s.SaveContainer(Album{DirName: record.DirName, Container: record.Container})
+	}
+	return nil
+}
+
+// A list as stored in a column: a JSON array, or an empty string for an
+// empty list.
+func sqliteList(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+func parseSQLiteList(column string) []string {
+	var values []string
+	if column != "" {
+		json.Unmarshal([]byte(column), &values)
+	}
+	return values
+}
+
+func (s *SQLiteStore) ForEach(fn func(contents []string, dirName string) error) error {
+	rows, err := s.DB.Query(`SELECT contents, dir_name FROM albums`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var encoded, dirName string
+		if err := rows.Scan(&encoded, &dirName); err != nil {
+			return err
+		}
+		var contents []string
+		if err := json.Unmarshal([]byte(encoded), &contents); err != nil {
+			return err
+		}
+		if err := fn(contents, dirName); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStore) SaveDecisions(dirName string, decisions []FileDecision) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM files WHERE dir_name = ?`, dirName); err != nil {
+		return err
+	}
+	for _, decision := range decisions {
+		_, err := tx.Exec(`INSERT INTO files (dir_name, path, linked, size, target) VALUES (?, ?, ?, ?, ?)`,
+			dirName, decision.Path, decision.Linked, decision.Size, decision.Target)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Decisions(dirName string) (decisions []FileDecision, ok bool) {
+	rows, err := s.DB.Query(`SELECT path, linked, size, target FROM files WHERE dir_name = ? ORDER BY path`, dirName)
+	if err != nil {
+		return nil, false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var decision FileDecision
+		if err := rows.Scan(&decision.Path, &decision.Linked, &decision.Size, &decision.Target); err != nil {
+			return nil, false
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, rows.Err() == nil && len(decisions) > 0
+}
+
+func (s *SQLiteStore) SaveContainer(album Album) error {
+	_, err := s.DB.Exec(`INSERT OR REPLACE INTO containers (dir_name, container) VALUES (?, ?)`, album.DirName, album.Container)
+	return err
+}
+
+func (s *SQLiteStore) Container(dirName string) (container string, ok bool) {
+	err := s.DB.QueryRow(`SELECT container FROM containers WHERE dir_name = ?`, dirName).Scan(&container)
+	return container, err == nil
+}
+
+func (s *SQLiteStore) Remove(album Album) error {
+	contents, err := json.Marshal(album.Contents)
+	if err != nil {
+		return err
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var dirName string
+	err = tx.QueryRow(`SELECT dir_name FROM albums WHERE contents = ?`, string(contents)).Scan(&dirName)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM albums WHERE contents = ?`, string(contents)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM files WHERE dir_name = ?`, dirName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM containers WHERE dir_name = ?`, dirName); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
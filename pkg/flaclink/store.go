@@ -0,0 +1,496 @@
+package flaclink
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Bucket mapping each album's gob-encoded Contents to its AlbumRecord,
+	// or to just its target dir name in databases from before records.
+	AlbumsBucket = []byte("albums")
+	// Bucket holding per-file link decisions, keyed by target dir name.
+	FilesBucket = []byte("files")
+	// Bucket mapping the target dir name of each album linked out of a
+	// discography folder to that folder's source path.
+	ContainersBucket = []byte("containers")
+
+	errMismatch = errors.New("album doesn't match its link decisions")
+)
+
+// The album database, which records each linked album, what was done with
+// its files, and the discography folder it came from.
+type Store interface {
+	// Prepare the store for use, e.g. by creating tables. Safe to call on an
+	// initialized store.
+	Init() error
+	// Returns the directory name stored for album. ok is false if the album
+	// isn't in the store.
+	Lookup(album Album) (dirName string, ok bool)
+	// Record album under its DirName, e.g. when it's found in the target.
+	Add(album Album) error
+	// Record each of albums as Add does, in a single transaction, which is
+	// much faster than adding them one at a time.
+	AddAll(albums []Album) error
+	// Returns everything recorded for album. ok is false if the album isn't
+	// in the store.
+	Record(album Album) (record AlbumRecord, ok bool)
+	// Record a linked album, including its per-file decisions and its
+	// container, if any.
+	SaveRecord(album Album, record AlbumRecord) error
+	// Call fn for every album in the store, in no particular order, stopping
+	// at the first error.
+	ForEach(fn func(contents []string, dirName string) error) error
+	// Record the per-file decisions made when linking the album to dirName.
+	SaveDecisions(dirName string, decisions []FileDecision) error
+	// Returns the per-file decisions recorded for the album linked to
+	// dirName. ok is false if none were recorded.
+	Decisions(dirName string) (decisions []FileDecision, ok bool)
+	// Record the discography folder that album was linked from.
+	SaveContainer(album Album) error
+	// Returns the discography folder recorded for the album linked to dirName.
+	Container(dirName string) (container string, ok bool)
+	// Forget album, along with its decisions and container. Removing an
+	// album that isn't in the store does nothing.
+	Remove(album Album) error
+}
+
+// A Store in a bolt database. Other buckets may be kept in the same bolt
+// database.
+type BoltStore struct {
+	DB *bolt.DB
+	// If set, the store's buckets are kept inside a top-level bucket of
+	// this name rather than at the top level, so that several stores can
+	// share a database.
+	Namespace []byte
+}
+
+func NewStore(db *bolt.DB) *BoltStore {
+	return &BoltStore{DB: db}
+}
+
+// A store kept in db under namespace. See BoltStore.Namespace.
+func NewNamespacedStore(db *bolt.DB, namespace string) *BoltStore {
+	return &BoltStore{DB: db, Namespace: []byte(namespace)}
+}
+
+// The store's bucket called name, or nil if it doesn't exist.
+func (s *BoltStore) bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	if s.Namespace == nil {
+		return tx.Bucket(name)
+	}
+	parent := tx.Bucket(s.Namespace)
+	if parent == nil {
+		return nil
+	}
+	return parent.Bucket(name)
+}
+
+// The store's bucket called name, created if it doesn't exist yet.
+func (s *BoltStore) createBucket(tx *bolt.Tx, name []byte) (*bolt.Bucket, error) {
+	if s.Namespace == nil {
+		return tx.CreateBucketIfNotExists(name)
+	}
+	parent, err := tx.CreateBucketIfNotExists(s.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	return parent.CreateBucketIfNotExists(name)
+}
+
+// Create the albums bucket if it doesn't exist yet.
+func (s *BoltStore) Init() error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, err := s.createBucket(tx, AlbumsBucket)
+		return err
+	})
+}
+
+// Gob numbers types other than its basic ones in the order a process first
+// encodes or decodes them, and includes the number in what it writes. Album
+// keys were always encoded before anything else, so make sure []string is
+// still the first type gob sees, or keys won't match those already stored.
+func init() {
+	contentsKey(Album{})
+}
+
+func contentsKey(album Album) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(album.Contents); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *BoltStore) Lookup(album Album) (dirName string, ok bool) {
+	key, err := contentsKey(album)
+	if err != nil {
+		return "", false
+	}
+	s.DB.View(func(tx *bolt.Tx) error {
+		if bucket := s.bucket(tx, AlbumsBucket); bucket != nil {
+			if v := bucket.Get(key); v != nil {
+				record, _, err := decodeRecord(v)
+				dirName, ok = record.DirName, err == nil
+			}
+		}
+		return nil
+	})
+	return dirName, ok
+}
+
+func (s *BoltStore) Add(album Album) error {
+	return s.SaveRecord(album, AlbumRecord{DirName: album.DirName})
+}
+
+func (s *BoltStore) AddAll(albums []Album) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		for _, album := range albums {
+			key, err := contentsKey(album)
+			if err != nil {
+				return err
+			}
+			if err := s.putRecord(tx, key, AlbumRecord{DirName: album.DirName}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Record(album Album) (record AlbumRecord, ok bool) {
+	key, err := contentsKey(album)
+	if err != nil {
+		return record, false
+	}
+	s.DB.View(func(tx *bolt.Tx) error {
+		if bucket := s.bucket(tx, AlbumsBucket); bucket != nil {
+			if v := bucket.Get(key); v != nil {
+				record, ok = s.readRecord(tx, v)
+			}
+		}
+		return nil
+	})
+	return record, ok
+}
+
+// Decode the albums bucket value v, and fill in the record's files and
+// container from their buckets. For legacy values, the counts are worked out
+// from the files.
+func (s *BoltStore) readRecord(tx *bolt.Tx, v []byte) (AlbumRecord, bool) {
+	record, legacy, err := decodeRecord(v)
+	if err != nil {
+		return record, false
+	}
+	if bucket := s.bucket(tx, FilesBucket); bucket != nil {
+		if v := bucket.Get([]byte(record.DirName)); v != nil {
+			gob.NewDecoder(bytes.NewReader(v)).Decode(&record.Files)
+		}
+	}
+	if bucket := s.bucket(tx, ContainersBucket); bucket != nil {
+		record.Container = string(bucket.Get([]byte(record.DirName)))
+	}
+	if legacy {
+		record.CountFiles()
+	}
+	return record, true
+}
+
+func (s *BoltStore) SaveRecord(album Album, record AlbumRecord) error {
+	key, err := contentsKey(album)
+	if err != nil {
+		return err
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return s.putRecord(tx, key, record)
+	})
+}
+
+func (s *BoltStore) putRecord(tx *bolt.Tx, key []byte, record AlbumRecord) error {
+	value, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	bucket, err := s.createBucket(tx, AlbumsBucket)
+	if err != nil {
+		return err
+	}
+	if err := bucket.Put(key, value); err != nil {
+		return err
+	}
+	if record.Files != nil {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(record.Files); err != nil {
+			return err
+		}
+		bucket, err := s.createBucket(tx, FilesBucket)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(record.DirName), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if record.Container != "" {
+		bucket, err := s.createBucket(tx, ContainersBucket)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(record.DirName), []byte(record.Container)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrite the keys of albums stored before their contents were normalized,
+// with NormalizeContents, so they're found by the albums scans now produce.
+// If an album is stored under both keys, the normalized one is kept.
+// Returns the number of keys rewritten.
+func (s *BoltStore) NormalizeKeys() (int, error) {
+	normalized := 0
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		bucket := s.bucket(tx, AlbumsBucket)
+		if bucket == nil {
+			return nil
+		}
+		// Collect the keys to rewrite first, since a bucket can't be
+		// modified while iterating over it.
+		rewrites := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var contents []string
+			if err := gob.NewDecoder(bytes.NewReader(k)).Decode(&contents); err != nil {
+				return err
+			}
+			key, err := contentsKey(Album{Contents: NormalizeContents(contents)})
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(key, k) {
+				rewrites[string(k)] = key
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for old, key := range rewrites {
+			if bucket.Get(key) == nil {
+				if err := bucket.Put(key, append([]byte(nil), bucket.Get([]byte(old))...)); err != nil {
+					return err
+				}
+			}
+			if err := bucket.Delete([]byte(old)); err != nil {
+				return err
+			}
+			normalized++
+		}
+		return nil
+	})
+	return normalized, err
+}
+
+// Rewrite albums stored before album records as records, filling them in
+// from the files and containers buckets. fill, if set, is called with each
+// record before it's written, to add what the caller knows about the album.
+// Returns the number of albums migrated.
+func (s *BoltStore) Migrate(fill func(record *AlbumRecord)) (int, error) {
+	migrated := 0
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		bucket := s.bucket(tx, AlbumsBucket)
+		if bucket == nil {
+			return nil
+		}
+		// Collect the legacy keys first, since a bucket can't be modified
+		// while iterating over it.
+		var keys [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if _, legacy, _ := decodeRecord(v); legacy {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, key := range keys {
+			record, _ := s.readRecord(tx, bucket.Get(key))
+			if fill != nil {
+				fill(&record)
+			}
+			if err := s.putRecord(tx, key, record); err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	return migrated, err
+}
+
+func (s *BoltStore) ForEach(fn func(contents []string, dirName string) error) error {
+	return s.DB.View(func(tx *bolt.Tx) error {
+		bucket := s.bucket(tx, AlbumsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var contents []string
+			if err := gob.NewDecoder(bytes.NewReader(k)).Decode(&contents); err != nil {
+				return err
+			}
+			record, _, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			return fn(contents, record.DirName)
+		})
+	})
+}
+
+func (s *BoltStore) SaveDecisions(dirName string, decisions []FileDecision) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(decisions); err != nil {
+		return err
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := s.createBucket(tx, FilesBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(dirName), buf.Bytes())
+	})
+}
+
+// ok is false if the album was linked before decisions were recorded, or
+// wasn't linked by flaclink at all.
+func (s *BoltStore) Decisions(dirName string) (decisions []FileDecision, ok bool) {
+	s.DB.View(func(tx *bolt.Tx) error {
+		bucket := s.bucket(tx, FilesBucket)
+		if bucket == nil {
+			return nil
+		}
+		if v := bucket.Get([]byte(dirName)); v != nil {
+			ok = gob.NewDecoder(bytes.NewReader(v)).Decode(&decisions) == nil
+		}
+		return nil
+	})
+	return decisions, ok
+}
+
+// Reports whether the target album at albumPath, linked to dirName, holds
+// exactly the files that were linked into it according to s, i.e. it
+// matches what flaclink intended. Files that were excluded at link time are
+// expected to be missing, so they don't count as a change.
+func MatchesDecisions(s Store, albumPath string, dirName string) bool {
+	decisions, ok := s.Decisions(dirName)
+	if !ok {
+		return false
+	}
+	linked := make(map[string]bool)
+	for _, decision := range decisions {
+		if decision.Linked {
+			linked[decision.TargetPath()] = true
+		}
+	}
+
+	found := 0
+	err := filepath.Walk(albumPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, _ := filepath.Rel(albumPath, path)
+		if !linked[relPath] {
+			return errMismatch
+		}
+		found++
+		return nil
+	})
+	return err == nil && found == len(linked)
+}
+
+func (s *BoltStore) SaveContainer(album Album) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := s.createBucket(tx, ContainersBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(album.DirName), []byte(album.Container))
+	})
+}
+
+func (s *BoltStore) Container(dirName string) (container string, ok bool) {
+	s.DB.View(func(tx *bolt.Tx) error {
+		if bucket := s.bucket(tx, ContainersBucket); bucket != nil {
+			if v := bucket.Get([]byte(dirName)); v != nil {
+				container, ok = string(v), true
+			}
+		}
+		return nil
+	})
+	return container, ok
+}
+
+func (s *BoltStore) Remove(album Album) error {
+	key, err := contentsKey(album)
+	if err != nil {
+		return err
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		bucket := s.bucket(tx, AlbumsBucket)
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get(key)
+		if v == nil {
+			return nil
+		}
+		record, _, err := decodeRecord(v)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{FilesBucket, ContainersBucket} {
+			if b := s.bucket(tx, name); b != nil {
+				if err := b.Delete([]byte(record.DirName)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Copy every album record from src into dst, e.g. when moving to another
+// backend. Albums already in dst are kept. Returns the number of albums
+// copied.
+func CopyStore(dst Store, src Store) (int, error) {
+	// List the albums first, so src isn't read from inside its own ForEach.
+	var albums []Album
+	err := src.ForEach(func(contents []string, dirName string) error {
+		albums = append(albums, Album{DirName: dirName, Contents: contents})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, album := range albums {
+		if _, ok := dst.Lookup(album); ok {
+			continue
+		}
+		record, ok := src.Record(album)
+		if !ok {
+			record = AlbumRecord{DirName: album.DirName}
+		}
+		if err := dst.SaveRecord(album, record); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
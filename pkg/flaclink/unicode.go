@@ -0,0 +1,32 @@
+package flaclink
+
+import (
+	"sort"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Names that look the same can be spelled differently in Unicode: "é" is
+// one character in NFC, the form most systems write, but "e" followed by a
+// combining accent in NFD, the form macOS has long used for file names. So
+// the same album copied from a Mac can have different names and contents,
+// and be taken for a different album, or clash with itself on filesystems
+// that normalize names. flaclink composes names to NFC wherever it reads
+// them from the source.
+
+// NormalizeName composes name to NFC, as NormalizeContents does. Names
+// already in NFC are returned as they are.
+func NormalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
+// A copy of contents with every name composed to NFC, sorted, so that the
+// same album read from NFC and NFD names has the same contents.
+func NormalizeContents(contents []string) []string {
+	normalized := make([]string, len(contents))
+	for i, name := range contents {
+		normalized[i] = NormalizeName(name)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
@@ -0,0 +1,34 @@
+package flaclink
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Album", "Album"},
+		{"Beyonce\u0301", "Beyonc\u00e9"},
+		{"Bjo\u0308rk", "Bj\u00f6rk"},
+		{"Bj\u00f6rk", "Bj\u00f6rk"},
+		// Composed characters are decomposed first, so that marks are put
+		// in order and composed with their base as NFC requires.
+		{"\u00e9\u0323", "\u1eb9\u0301"},
+		{"\u1100\u1161\u11a8", "\uac01"},
+	}
+	for _, test := range tests {
+		if got := NormalizeName(test.name); got != test.want {
+			t.Errorf("NormalizeName(%+q) = %+q, want %+q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeContents(t *testing.T) {
+	got := NormalizeContents([]string{"02 Re\u0301sume\u0301.flac", "01.flac"})
+	want := []string{"01.flac", "02 R\u00e9sum\u00e9.flac"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NormalizeContents = %q, want %q", got, want)
+	}
+}
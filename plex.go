@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Settings for asking Plex to scan each newly linked album, under "plex" in
+// the config file.
+type PlexConfig struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	// Library section to scan. If 0, the section whose folders contain the
+	// album is looked up.
+	SectionID int `json:"section_id"`
+}
+
+var plexClient = &http.Client{Timeout: 30 * time.Second}
+
+// Ask Plex to scan just the directory of a newly linked album, so it shows up
+// without waiting for a full library scan. Does nothing unless Plex is
+// configured. Failures are logged, since the album is linked either way.
+func refreshPlex(album Album, targetDir string) {
+	if settings.Plex == nil || settings.Plex.URL == "" {
+		return
+	}
+	albumPath := albumTargetPath(album, targetDir)
+	if err := settings.Plex.partialScan(albumPath); err != nil {
+		countError(album.DirName, err)
+		log.Printf("Plex scan of %s failed: %v", albumPath, err)
+		return
+	}
+	log.Printf("Asked Plex to scan %s.", albumPath)
+}
+
+// Request a scan of path in the configured or matching library section.
+func (plex *PlexConfig) partialScan(path string) error {
+	sectionID := plex.SectionID
+	if sectionID == 0 {
+		var err error
+		if sectionID, err = plex.sectionFor(path); err != nil {
+			return err
+		}
+	}
+	query := url.Values{"path": {path}}
+	resp, err := plex.get(fmt.Sprintf("/library/sections/%d/refresh?%s", sectionID, query.Encode()))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Find the library section with a folder containing path.
+func (plex *PlexConfig) sectionFor(path string) (int, error) {
+	resp, err := plex.get("/library/sections")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var sections struct {
+		MediaContainer struct {
+			Directory []struct {
+				Key      string `json:"key"`
+				Location []struct {
+					Path string `json:"path"`
+				} `json:"Location"`
+			} `json:"Directory"`
+		} `json:"MediaContainer"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sections); err != nil {
+		return 0, fmt.Errorf("library/sections: %v", err)
+	}
+	for _, section := range sections.MediaContainer.Directory {
+		for _, location := range section.Location {
+			rel, err := filepath.Rel(location.Path, path)
+			if err == nil && !strings.HasPrefix(rel, "..") {
+				var id int
+				fmt.Sscan(section.Key, &id)
+				return id, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no Plex library section contains %s", path)
+}
+
+// GET an API path, returning the response if Plex answered 200 OK. The
+// caller must close the response body.
+func (plex *PlexConfig) get(apiPath string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(plex.URL, "/")+apiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Token", plex.Token)
+	resp, err := plexClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", apiPath, resp.Status)
+	}
+	return resp, nil
+}
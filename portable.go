@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// With portable_db, the album DB lives in the target dir, at
+// .flaclink/albums.db, instead of the app data dir. It then goes wherever the
+// library goes, such as an external disk moved to another machine, and
+// flaclink there knows which albums it has already linked. The instance lock
+// and control socket sit next to it, as with --db, which takes precedence.
+
+// Name of the hidden directory in a portable target dir that holds its DB.
+const portableDbDirName = ".flaclink"
+
+// Settle which album DB this run uses: a portable one in cfg's target dir if
+// portable_db is set and --db wasn't given, or else the one already in
+// AlbumDbPath. It's created when it's first opened if it doesn't exist yet.
+func useAlbumDb(cfg Config) {
+	if cfg.PortableDb && !dbOverridden {
+		targetDir := absTargetDir(cfg.TargetDir)
+		// A missing target is usually a disk that isn't mounted; don't
+		// start a new DB on the mount point underneath.
+		if _, err := os.Stat(targetDir); err != nil {
+			fatalf("portable_db: %v", err)
+		}
+		dir := filepath.Join(targetDir, portableDbDirName)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fatalf("portable_db: %v", err)
+		}
+		AlbumDbPath = filepath.Join(dir, "albums.db")
+		dbOverridden = true
+	}
+	if _, err := os.Stat(AlbumDbPath); err == nil {
+		log.Printf("Found album database at %s.", AlbumDbPath)
+	}
+}
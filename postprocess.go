@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultPostProcessTimeout = 5 * time.Minute
+
+// A command run after each album is linked into a target, configured under
+// "post_process". Each argument may contain the placeholders {album_path}
+// (the linked album in the target), {album_name}, {source_path} and
+// {target_dir}. Commands are run directly, not through a shell; use
+// ["sh", "-c", "..."] for pipes and redirection.
+type PostProcessCommand struct {
+	// Only run for albums linked into this target dir. Empty means every target.
+	TargetDir      string   `json:"target_dir"`
+	Command        []string `json:"command"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+}
+
+// Outcome of one post-process command, logged and recorded with the run.
+type postProcessResult struct {
+	Command  []string
+	Output   string
+	Duration time.Duration
+	Err      error
+}
+
+// Run the post-process commands configured for targetDir on a newly linked
+// album, in order. Failures are logged and don't stop later commands.
+func postProcess(album Album, targetDir string) []postProcessResult {
+	var results []postProcessResult
+	absTarget, _ := filepath.Abs(targetDir)
+	for _, pp := range settings.PostProcess {
+		if len(pp.Command) == 0 {
+			continue
+		}
+		if abs, _ := filepath.Abs(pp.TargetDir); pp.TargetDir != "" && abs != absTarget {
+			continue
+		}
+		result := pp.run(album, targetDir)
+		if result.Err != nil {
+			countError(album.DirName, result.Err)
+			log.Printf("Post-process %q failed for %s after %v: %v\n%s", result.Command, album.DirName, result.Duration.Round(time.Millisecond), result.Err, result.Output)
+		} else {
+			log.Printf("Post-process %q finished for %s in %v.\n%s", result.Command, album.DirName, result.Duration.Round(time.Millisecond), result.Output)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Run the command for album with its placeholders filled in, capturing
+// stdout and stderr together.
+func (pp PostProcessCommand) run(album Album, targetDir string) postProcessResult {
+	replacer := strings.NewReplacer(
+		"{album_path}", albumTargetPath(album, targetDir),
+		"{album_name}", album.DirName,
+		"{source_path}", album.Path,
+		"{target_dir}", targetDir,
+	)
+	args := make([]string, len(pp.Command))
+	for i, arg := range pp.Command {
+		args[i] = replacer.Replace(arg)
+	}
+
+	timeout := defaultPostProcessTimeout
+	if pp.TimeoutSeconds > 0 {
+		timeout = time.Duration(pp.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = ctx.Err()
+	}
+	return postProcessResult{
+		Command:  args,
+		Output:   strings.TrimSpace(string(output)),
+		Duration: time.Since(start),
+		Err:      err,
+	}
+}
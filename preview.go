@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Show where the album at a source path would be linked, and whether linking
+// it would be skipped or fail, without touching the target or the database.
+// The target dir defaults to target_dir from the config file.
+func runPreviewName(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: flaclink preview-name <album dir> [target dir]")
+		os.Exit(2)
+	}
+	albumPath := filepath.Clean(args[0])
+	var targetDir string
+	if len(args) == 2 {
+		targetDir = filepath.Clean(args[1])
+	} else if settings.TargetDir != "" {
+		targetDir = settings.TargetDir
+	} else {
+		fatalf("preview-name: no target dir given and target_dir isn't set in %s", ConfigPath)
+	}
+
+	albums := albumScanner().FindAlbums(albumPath)
+	if len(albums) == 0 {
+		fmt.Printf("Source: %s\n", albumPath)
+		fmt.Println("Result: skipped, no flac files found")
+		return
+	}
+
+	// Open read-only so a running daemon or scan only makes us wait briefly.
+	db, err := bolt.Open(AlbumDbPath, 0640, &bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	if err != nil {
+		fmt.Printf("DB unavailable, assuming albums aren't in it: %v\n", err)
+		db = nil
+	} else {
+		defer db.Close()
+	}
+
+	for i, album := range albums {
+		if i > 0 {
+			fmt.Println()
+		}
+		previewAlbum(album, targetDir, db)
+	}
+}
+
+// Print the target path and expected outcome of linking album. db may be nil
+// if the database couldn't be opened.
+func previewAlbum(album Album, targetDir string, db *bolt.DB) {
+	fmt.Printf("Source: %s\n", album.Path)
+	if album.Container != "" {
+		fmt.Printf("Discography: %s\n", album.Container)
+	}
+	if settings.TargetTemplate != "" {
+		fmt.Printf("Template: %s\n", settings.TargetTemplate)
+	}
+	named := album
+	applyTemplate(&named)
+	if settings.TargetTemplate != "" {
+		reconcileDirName(&named, targetDir)
+	}
+	targetPath := albumTargetPath(named, targetDir)
+	fmt.Printf("Target: %s\n", targetPath)
+
+	if db != nil {
+		if dirName, ok := lookupAlbum(album, db); ok {
+			fmt.Printf("Result: skipped, already in DB as %s\n", dirName)
+			if prov, ok := loadProvenance(dirName, db); ok {
+				fmt.Printf("Linked: %s by flaclink %s (%s, config %s)\n", prov.Time.Format(time.RFC1123), prov.Version, prov.LinkMode, prov.ConfigHash)
+			}
+			return
+		}
+	}
+	if _, err := os.Lstat(targetPath); err == nil {
+		fmt.Println("Result: would fail, target already exists")
+		return
+	}
+	fmt.Println("Result: would link")
+}
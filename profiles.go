@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A named target that albums are routed to, with its own settings and its
+// own namespace in the album DB. Settings left empty are taken from the
+// rest of the config file.
+type ProfileConfig struct {
+	Name      string `json:"name"`
+	TargetDir string `json:"target_dir"`
+
+	TargetTemplate string   `json:"target_template"`
+	ExcludeFiles   []string `json:"exclude_files"`
+	IncludeDirs    []string `json:"include_dirs"`
+	ExcludeDirs    []string `json:"exclude_dirs"`
+	MinTracks      int      `json:"min_tracks"`
+	MinSize        int64    `json:"min_size"`
+
+	Routes []RouteRule `json:"routes"`
+
+	// Which albums go to this profile. Albums go to the first profile they
+	// match.
+	Match RouteMatch `json:"match"`
+}
+
+// Check a profiles setting.
+func validateProfiles(profiles []ProfileConfig, cfg Config) error {
+	if len(profiles) > 0 && cfg.SQLitePath != "" {
+		return fmt.Errorf("profiles can't be used with sqlite_path")
+	}
+	names := make(map[string]bool)
+	for _, p := range profiles {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("a profile has no name")
+		case names[p.Name]:
+			return fmt.Errorf("two profiles are named %q", p.Name)
+		case p.TargetDir == "":
+			return fmt.Errorf("%s: target_dir is required", p.Name)
+		}
+		names[p.Name] = true
+		if err := validateTemplate(p.TargetTemplate); err != nil {
+			return fmt.Errorf("%s: target_template: %v", p.Name, err)
+		}
+		for _, pattern := range p.ExcludeFiles {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: exclude_files: %q: %v", p.Name, pattern, err)
+			}
+		}
+		for _, patterns := range [][]string{p.IncludeDirs, p.ExcludeDirs} {
+			if err := validateDirPatterns(patterns); err != nil {
+				return fmt.Errorf("%s: %v", p.Name, err)
+			}
+		}
+		if err := validateRoutes(p.Routes); err != nil {
+			return fmt.Errorf("%s: routes: %v", p.Name, err)
+		}
+		if err := p.Match.validate(); err != nil {
+			return fmt.Errorf("%s: match: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// The settings for linking albums with profile p: cfg, with p's target and
+// any settings p overrides.
+func (cfg Config) forProfile(p ProfileConfig) Config {
+	cfg.profile = p.Name
+	cfg.TargetDir = filepath.Clean(p.TargetDir)
+	if p.TargetTemplate != "" {
+		cfg.TargetTemplate = p.TargetTemplate
+	}
+	if p.ExcludeFiles != nil {
+		cfg.ExcludeFiles = p.ExcludeFiles
+	}
+	if p.IncludeDirs != nil {
+		cfg.IncludeDirs = p.IncludeDirs
+	}
+	if p.ExcludeDirs != nil {
+		cfg.ExcludeDirs = p.ExcludeDirs
+	}
+	if p.MinTracks != 0 {
+		cfg.MinTracks = p.MinTracks
+	}
+	if p.MinSize != 0 {
+		cfg.MinSize = p.MinSize
+	}
+	if p.Routes != nil {
+		cfg.Routes = p.Routes
+	}
+	return cfg
+}
+
+// Name of the bucket holding the album catalog of the named profile.
+func profileNamespace(name string) string {
+	return "profile:" + name
+}
+
+// Names of the top-level buckets in db that hold profile catalogs.
+func profileNamespaces(db *bolt.DB) (namespaces []string) {
+	db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if bytes.HasPrefix(name, []byte(profileNamespace(""))) {
+				namespaces = append(namespaces, string(name))
+			}
+			return nil
+		})
+	})
+	return namespaces
+}
+
+// The name of the profile album is routed to, or "" if it matches none.
+func routeProfile(album Album) string {
+	meta := lazyMetadata(album, nil)
+	for _, p := range settings.Profiles {
+		if p.Match.matches(album, meta) {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+// Reports whether album belongs to the profile being linked, if any.
+func inActiveProfile(album Album) bool {
+	return settings.profile == "" || routeProfile(album) == settings.profile
+}
+
+// Link new albums from sourceDirs as one run per profile, each into the
+// profile's target with its settings and DB namespace. Returns the albums
+// linked and the worst exit status of the runs. Without profiles, it's a
+// single run into targetDir.
+func linkProfiles(ctx context.Context, command string, sourceDirs []string, targetDir string, db *bolt.DB) (linked []Album, status int) {
+	base := settings
+	defer func() { settings = base }()
+	profiles := base.Profiles
+	if len(profiles) == 0 {
+		profiles = []ProfileConfig{{TargetDir: targetDir}}
+	}
+	for _, p := range profiles {
+		if ctx.Err() != nil {
+			break
+		}
+		target := filepath.Clean(p.TargetDir)
+		if p.Name != "" {
+			settings = base.forProfile(p)
+			log.Printf("Linking albums for profile %s into %s.", p.Name, target)
+			// A profile's target is created on first use, unlike the target
+			// dir given on the command line.
+			if err := os.MkdirAll(target, 0775); err != nil {
+				fatalf("profile %s: %v", p.Name, err)
+			}
+		}
+		beginRun(command, strings.Join(sourceDirs, ", "))
+		if settings.SyncDeletes {
+			syncDeletes(albumStore(db), sourceDirs, db, false)
+		}
+		// The target is read while the sources are scanned, and linking
+		// waits for it.
+		targetUpdated := make(chan struct{})
+		go func() {
+			defer close(targetUpdated)
+			updateAlbumDb(ctx, target, db)
+		}()
+		var profileLinked []Album
+		if targetHasFreeSpace(target) {
+			profileLinked = linkNewAlbumsFrom(ctx, sourceDirs, target, db, targetUpdated)
+		}
+		<-targetUpdated
+		linked = append(linked, profileLinked...)
+		if s := exitStatus(finishRun(profileLinked, target, db)); s > status {
+			status = s
+		}
+	}
+	return linked, status
+}
+
+// The album catalogs in db: the main one, which may be SQLite, and each
+// profile's.
+func catalogStores(db *bolt.DB) []flaclink.Store {
+	return catalogStoresFor(db, settings)
+}
+
+// Like catalogStores, but under cfg rather than the current settings.
+func catalogStoresFor(db *bolt.DB, cfg Config) []flaclink.Store {
+	stores := []flaclink.Store{backingStoreFor(db, cfg)}
+	for _, p := range cfg.Profiles {
+		stores = append(stores, flaclink.NewNamespacedStore(db, profileNamespace(p.Name)))
+	}
+	return stores
+}
+
+// Every album record in db's catalogs, including those of albums found
+// already in the target, which have only DirName.
+func catalogRecords(db *bolt.DB) ([]flaclink.AlbumRecord, error) {
+	return storeRecords(catalogStores(db))
+}
+
+// Every album record in stores, as catalogRecords.
+func storeRecords(stores []flaclink.Store) ([]flaclink.AlbumRecord, error) {
+	var records []flaclink.AlbumRecord
+	for _, store := range stores {
+		var albums []Album
+		err := store.ForEach(func(contents []string, dirName string) error {
+			albums = append(albums, Album{DirName: dirName, Contents: contents})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, album := range albums {
+			if record, ok := store.Record(album); ok {
+				records = append(records, record)
+			}
+		}
+	}
+	return records, nil
+}
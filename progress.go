@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Progress through the new albums of a run with a backlog, e.g. the first
+// run over a big source dir: how many albums of how many are done, their
+// bytes, and an estimate of the time left. On a terminal it's a status line
+// kept under the log output; otherwise, such as under cron or the daemon, a
+// log line now and then. Albums are linked while the scan is still finding
+// them, so until it's done the totals are those found so far, and there's no
+// estimate.
+
+// How often progress is logged when stderr isn't a terminal.
+const progressLogInterval = 30 * time.Second
+
+// Longest album name shown in the status line.
+const progressNameWidth = 40
+
+// Progress through a run's new albums. A nil *runProgress reports nothing.
+type runProgress struct {
+	mu         sync.Mutex
+	db         *bolt.DB
+	start      time.Time
+	total      int
+	totalBytes int64
+	// Set until the scan finding the albums is over.
+	scanning bool
+	// Set once there are enough new albums for progress to be reported.
+	reporting bool
+	// Sizes of the albums still to do, by source path.
+	sizes     map[string]int64
+	done      int
+	doneBytes int64
+	current   string
+	// Whether progress is shown in a status line, and the length of the
+	// line last drawn, to blank it out.
+	tty      bool
+	shown    int
+	lastLog  time.Time
+	previous io.Writer
+}
+
+// Start tracking progress through the new albums of a run, as a scan finds
+// them and passes them to add. Nothing is reported until there are two.
+func startProgress(db *bolt.DB) *runProgress {
+	return &runProgress{db: db, start: time.Now(), sizes: make(map[string]int64), scanning: true}
+}
+
+// Count album, just found by the scan, if it isn't in the DB yet.
+func (p *runProgress) add(album Album) {
+	if p == nil || !inActiveProfile(album) || inDb(album, p.db) {
+		return
+	}
+	size := albumSize(album.Path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sizes[album.Path] = size
+	p.total++
+	p.totalBytes += size
+	if !p.reporting && p.total >= 2 {
+		p.reporting = true
+		p.lastLog = time.Now()
+		p.tty = !jsonLogs && stderrIsTerminal()
+		if p.tty {
+			// Log lines go above the status line.
+			p.previous = logOutput
+			log.SetOutput(progressLogWriter{p})
+		}
+	}
+	p.draw()
+}
+
+// Note that the scan is over, so the totals are final.
+func (p *runProgress) scanned() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.scanning = false
+	reporting, total, totalBytes := p.reporting, p.total, p.totalBytes
+	p.mu.Unlock()
+	if reporting {
+		log.Printf("%d new albums to link, %s.", total, formatSize(totalBytes))
+	}
+}
+
+// Total size of the files in the album at path.
+func albumSize(path string) (size int64) {
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Reports whether stderr is a terminal, rather than a file or pipe.
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Note that album is being processed.
+func (p *runProgress) begin(album Album) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.sizes[album.Path]; ok {
+		p.current = album.DirName
+		p.draw()
+	}
+}
+
+// Note that album is done with, whether it was linked or not.
+func (p *runProgress) end(album Album) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	size, ok := p.sizes[album.Path]
+	if !ok {
+		return
+	}
+	delete(p.sizes, album.Path)
+	p.done++
+	p.doneBytes += size
+	p.current = ""
+	if p.tty {
+		p.draw()
+	} else if p.reporting && time.Since(p.lastLog) >= progressLogInterval {
+		p.lastLog = time.Now()
+		log.Printf("Progress: %s.", p.summary())
+	}
+}
+
+// Stop reporting progress, clearing the status line.
+func (p *runProgress) stop() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		p.clear()
+		log.SetOutput(p.previous)
+	}
+}
+
+// E.g. "12 of 340 albums, 3.4 GiB of 97.1 GiB, about 12m30s left", or
+// "12 of 340 albums so far, 3.4 GiB of 97.1 GiB, still scanning".
+func (p *runProgress) summary() string {
+	if p.scanning {
+		return fmt.Sprintf("%d of %d albums so far, %s of %s, still scanning", p.done, p.total, formatSize(p.doneBytes), formatSize(p.totalBytes))
+	}
+	s := fmt.Sprintf("%d of %d albums, %s of %s", p.done, p.total, formatSize(p.doneBytes), formatSize(p.totalBytes))
+	if eta, ok := p.eta(); ok {
+		s += fmt.Sprintf(", about %v left", eta)
+	}
+	return s
+}
+
+// Time left at the rate so far, by bytes, or by albums if they're all empty.
+func (p *runProgress) eta() (time.Duration, bool) {
+	elapsed := time.Since(p.start)
+	var fraction float64
+	switch {
+	case p.totalBytes > 0:
+		fraction = float64(p.doneBytes) / float64(p.totalBytes)
+	case p.total > 0:
+		fraction = float64(p.done) / float64(p.total)
+	}
+	if fraction <= 0 || fraction >= 1 {
+		return 0, false
+	}
+	return time.Duration(float64(elapsed) * (1 - fraction) / fraction).Round(time.Second), true
+}
+
+// Redraw the status line, if there is one. Called with p.mu held.
+func (p *runProgress) draw() {
+	if !p.tty {
+		return
+	}
+	line := p.summary()
+	if p.current != "" {
+		name := []rune(p.current)
+		if len(name) > progressNameWidth {
+			name = append(name[:progressNameWidth-1], '…')
+		}
+		line += ": " + string(name)
+	}
+	p.clear()
+	fmt.Fprint(os.Stderr, line)
+	p.shown = len([]rune(line))
+}
+
+// Blank out the status line, leaving the cursor at its start. Spaces rather
+// than an escape sequence, so it works on any terminal. Called with p.mu held.
+func (p *runProgress) clear() {
+	if p.shown > 0 {
+		fmt.Fprint(os.Stderr, "\r"+strings.Repeat(" ", p.shown)+"\r")
+		p.shown = 0
+	}
+}
+
+// Clear the status line, if one is shown, and keep it clear until resume is
+// called, e.g. while asking the user something. Log output waits meanwhile,
+// so nothing may be logged before resume.
+func pauseProgress() (resume func()) {
+	w, ok := log.Writer().(progressLogWriter)
+	if !ok {
+		return func() {}
+	}
+	w.p.mu.Lock()
+	w.p.clear()
+	return func() {
+		w.p.draw()
+		w.p.mu.Unlock()
+	}
+}
+
+// Log output while a status line is shown: the line is cleared, the log
+// line written where it was, and the status line drawn again below it.
+type progressLogWriter struct {
+	p *runProgress
+}
+
+func (w progressLogWriter) Write(b []byte) (int, error) {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+	w.p.clear()
+	n, err := w.p.previous.Write(b)
+	w.p.draw()
+	return n, err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Set at build time with -ldflags "-X main.version=v1.2.3". Otherwise
+	// taken from the module version when installed with "go install".
+	version = ""
+
+	// Bucket recording how each album was linked, keyed by target dir name.
+	provenanceBucketName = []byte("provenance")
+)
+
+// What produced an album in the target: the flaclink version, link mode
+// and effective config, so later audits can tell why albums linked under
+// older settings were named or filtered differently. Source is the album's
+// absolute source path, and Run the start time of the run that linked it
+// (see history.go). Both are empty for albums linked before they were
+// recorded.
+type Provenance struct {
+	Version    string
+	LinkMode   string
+	ConfigHash string
+	Time       time.Time
+	Source     string
+	Run        time.Time
+}
+
+// The running flaclink's version.
+func flaclinkVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// A short hash of the effective settings. Runs with the same hash linked
+// albums under the same config.
+func configHash() string {
+	data, _ := json.Marshal(settings)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// Provenance for something linked now.
+func currentProvenance() Provenance {
+	return Provenance{
+		Version:    flaclinkVersion(),
+		LinkMode:   linkMode(),
+		ConfigHash: configHash(),
+		Time:       time.Now(),
+		Run:        currentRunStart(),
+	}
+}
+
+// Record the provenance of a newly linked album.
+func saveProvenance(album Album, db *bolt.DB) error {
+	prov := currentProvenance()
+	prov.Source, _ = filepath.Abs(album.Path)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(prov); err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(provenanceBucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(album.DirName), buf.Bytes())
+	})
+}
+
+// Returns the provenance recorded for the album linked to dirName. ok is
+// false for albums linked before provenance was recorded.
+func loadProvenance(dirName string, db *bolt.DB) (prov Provenance, ok bool) {
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(provenanceBucketName)
+		if bucket == nil {
+			return nil
+		}
+		if v := bucket.Get([]byte(dirName)); v != nil {
+			ok = gob.NewDecoder(bytes.NewReader(v)).Decode(&prov) == nil
+		}
+		return nil
+	})
+	return prov, ok
+}
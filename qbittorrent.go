@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A torrent as reported by the qBittorrent Web API's /torrents/info endpoint.
+type qbtTorrent struct {
+	Hash        string `json:"hash"`
+	Name        string `json:"name"`
+	SavePath    string `json:"save_path"`
+	ContentPath string `json:"content_path"`
+}
+
+// Client for the parts of the qBittorrent Web API (v2) that flaclink uses.
+type qbtClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+// Ask qBittorrent for completed torrents in a category and link any albums
+// among them that aren't in the database yet. This replaces the source scan
+// for users whose download directory is too large to walk on every run.
+func runQbittorrent(args []string) int {
+	flags := flag.NewFlagSet("qbittorrent", flag.ExitOnError)
+	apiURL := flags.String("url", "http://localhost:8080", "qBittorrent Web UI address")
+	username := flags.String("user", "admin", "qBittorrent Web UI username")
+	password := flags.String("password", os.Getenv("FLACLINK_QBT_PASSWORD"), "qBittorrent Web UI password (default $FLACLINK_QBT_PASSWORD)")
+	category := flags.String("category", "", "only consider torrents in this category")
+	events := registerEventFlags(flags)
+	registerVerifyFlags(flags)
+	registerMinimumFlags(flags)
+	registerThrottleFlags(flags)
+	registerWaitLockFlag(flags)
+	logging := registerLogFlags(flags)
+	registerFailOnFlag(flags)
+	registerHiddenFlag(flags)
+	registerDirFilterFlags(flags)
+	registerConflictFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: flaclink qbittorrent [-url url] [-user name] [-password pass] [-category name] [-fail-on warnings|errors|never] [-answers file] <target dir>")
+		os.Exit(2)
+	}
+	targetDir := filepath.Clean(flags.Arg(0))
+	logging.setup()
+	events.open()
+	setupConflicts(false)
+
+	client := newQbtClient(*apiURL)
+	if err := client.login(*username, *password); err != nil {
+		fatalf("qbittorrent: %v", err)
+	}
+	torrents, err := client.completedTorrents(*category)
+	if err != nil {
+		fatalf("qbittorrent: %v", err)
+	}
+	log.Printf("Found %d completed torrents in qBittorrent.", len(torrents))
+
+	lockInstance()
+	slot := acquireSlot(1)
+	defer slot.Close()
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	beginRun("qbittorrent", *apiURL)
+	var linked []Album
+	var oldAlbums, notAlbums int
+	for _, torrent := range torrents {
+		if ctx.Err() != nil {
+			log.Printf("Stopping early.")
+			break
+		}
+		contentPath := mapReportedPath(torrent.contentPath())
+		info, err := os.Stat(contentPath)
+		if err != nil {
+			log.Printf("qbittorrent: skipping %s: %v", torrent.Name, err)
+			continue
+		}
+		if reason := dirFilterReason(filepath.Base(contentPath)); reason != "" {
+			log.Printf("qbittorrent: skipping %s, %s.", torrent.Name, reason)
+			continue
+		}
+		if ignoredPath(contentPath, info.IsDir()) {
+			log.Printf("qbittorrent: skipping %s, it's listed in a %s file.", torrent.Name, ignoreFileName)
+			continue
+		}
+		var albums []Album
+		if info.IsDir() {
+			albums = albumScanner().FindAlbums(contentPath)
+		}
+		if len(albums) == 0 {
+			notAlbums++
+			continue
+		}
+		for _, album := range albums {
+			if album, ok := processAlbum(ctx, album, targetDir, db); ok {
+				linked = append(linked, album)
+			} else {
+				oldAlbums++
+			}
+		}
+	}
+	log.Printf("Skipped %d torrents without flac albums.", notAlbums)
+	log.Printf("Linked %d new albums, found %d already in DB or duplicate.", len(linked), oldAlbums)
+	return exitStatus(finishRun(linked, targetDir, db))
+}
+
+func newQbtClient(baseURL string) *qbtClient {
+	jar, _ := cookiejar.New(nil)
+	return &qbtClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Jar: jar, Timeout: 30 * time.Second},
+	}
+}
+
+// Log in to the Web API. On success qBittorrent sets a SID cookie, which the
+// client's cookie jar sends with every later request.
+func (c *qbtClient) login(username, password string) error {
+	form := url.Values{"username": {username}, "password": {password}}
+	req, err := http.NewRequest("POST", c.baseURL+"/api/v2/auth/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// qBittorrent rejects logins whose Referer doesn't match its own host.
+	req.Header.Set("Referer", c.baseURL)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != "Ok." {
+		return fmt.Errorf("login failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// List completed torrents, optionally restricted to a category.
+func (c *qbtClient) completedTorrents(category string) ([]qbtTorrent, error) {
+	query := url.Values{"filter": {"completed"}}
+	if category != "" {
+		query.Set("category", category)
+	}
+	resp, err := c.http.Get(c.baseURL + "/api/v2/torrents/info?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("torrents/info: %s", resp.Status)
+	}
+
+	var torrents []qbtTorrent
+	if err := json.NewDecoder(resp.Body).Decode(&torrents); err != nil {
+		return nil, fmt.Errorf("torrents/info: %v", err)
+	}
+	return torrents, nil
+}
+
+// Path of the torrent's content on disk. content_path was added in Web API
+// v2.6.1; older versions only report the save path and name.
+func (t qbtTorrent) contentPath() string {
+	if t.ContentPath != "" {
+		return filepath.Clean(t.ContentPath)
+	}
+	return filepath.Join(t.SavePath, t.Name)
+}
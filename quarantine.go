@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Albums with something wrong with them go into quarantine rather than
+// being skipped with a log line nobody reads, or stopping the run: those
+// that fail -verify-flac or -verify-audio, those whose name in the target
+// looks wrong, and those whose name in the target is taken by something
+// else. Later runs leave quarantined albums alone until someone approves
+// them with "flaclink quarantine approve", which links them regardless of
+// what was wrong, under another name if given one, or rejects them, which
+// leaves them out of later runs as rejecting them in review does.
+// Quarantined albums are kept like those awaiting review; see review.go.
+
+// Quarantined albums, keyed like the review queue.
+var quarantineBucketName = []byte("quarantine")
+
+// Longest name, in bytes, of a file or folder on most filesystems.
+const maxNameBytes = 255
+
+// Put the album in job in quarantine for reason, and report it as skipped.
+func quarantineAlbum(job *albumJob, reason string) error {
+	queued := newQueuedAlbum(job, reason)
+	if err := putGob(job.DB, quarantineBucketName, timeKey(queued.Queued), queued); err != nil {
+		return err
+	}
+	log.Printf("Quarantined album %s: %s.", job.Album.DirName, reason)
+	emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "quarantined: " + reason})
+	return nil
+}
+
+// Reports whether the album in job is in quarantine, and if so reports it
+// as skipped.
+func inQuarantine(job *albumJob) bool {
+	path, _ := filepath.Abs(job.Found.Path)
+	queue, _ := queuedAlbums(quarantineBucketName, job.DB)
+	for _, queued := range queue {
+		if queued.Album.Path == path {
+			emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "in quarantine"})
+			return true
+		}
+	}
+	return false
+}
+
+// Why name, an album's name in the target, looks wrong, or "" if it
+// doesn't: it isn't valid UTF-8 or has control characters, which a
+// template can pick up from broken tags, or one of its parts is empty, "."
+// or "..", or too long for most filesystems.
+func suspiciousName(name string) string {
+	if !utf8.ValidString(name) {
+		return "name in the target isn't valid UTF-8"
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "name in the target has control characters"
+	}
+	if escapesTarget(name) {
+		return fmt.Sprintf("name in the target %q isn't inside it", name)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		switch {
+		case part == "" || part == "." || part == "..":
+			return fmt.Sprintf("name in the target %q has an empty, . or .. part", name)
+		case len(part) > maxNameBytes:
+			return fmt.Sprintf("name in the target has a part longer than %d bytes", maxNameBytes)
+		}
+	}
+	return ""
+}
+
+// List the albums in quarantine, or approve or reject some of them.
+func runQuarantine(args []string) {
+	if len(args) == 0 {
+		quarantineUsage()
+	}
+	switch args[0] {
+	case "list":
+		runQuarantineList()
+	case "approve":
+		runQuarantineApprove(args[1:])
+	case "reject":
+		runQuarantineReject(args[1:])
+	default:
+		fmt.Printf("Unknown quarantine command %q.\n", args[0])
+		quarantineUsage()
+	}
+}
+
+func quarantineUsage() {
+	fmt.Println("Usage: flaclink quarantine list")
+	fmt.Println("       flaclink quarantine approve [-as name] <n|album dir>...")
+	fmt.Println("       flaclink quarantine reject <n|album dir>...")
+	os.Exit(2)
+}
+
+func runQuarantineList() {
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+
+	queue, _ := queuedAlbums(quarantineBucketName, db)
+	if len(queue) == 0 {
+		fmt.Println("No albums in quarantine.")
+		return
+	}
+	printQueued(queue)
+}
+
+// Link the selected albums despite what put them in quarantine, as a run of
+// their own. With -as, the one album selected is linked under that name.
+func runQuarantineApprove(args []string) {
+	flags := flag.NewFlagSet("quarantine approve", flag.ExitOnError)
+	as := flags.String("as", "", "link the album under this name in the target, e.g. when its name is taken")
+	flags.Parse(args)
+	if flags.NArg() == 0 || *as != "" && flags.NArg() != 1 {
+		quarantineUsage()
+	}
+	name := ""
+	if *as != "" {
+		var err error
+		if name, err = checkTargetName(*as); err != nil {
+			fatalf("quarantine approve: %v", err)
+		}
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+	selected, keys := pickQueued(quarantineBucketName, "quarantine approve", flags.Args(), db)
+	approveQueued(quarantineBucketName, "quarantine approve", selected, keys, name, db)
+}
+
+// Take the selected albums out of quarantine and remember them as rejected.
+func runQuarantineReject(args []string) {
+	if len(args) == 0 {
+		quarantineUsage()
+	}
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+	selected, keys := pickQueued(quarantineBucketName, "quarantine reject", args, db)
+	rejectQueued(quarantineBucketName, "quarantine reject", selected, keys, db)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Identifies a file on disk, so hardlinks to it can be recognized.
+type fileID struct {
+	dev, ino uint64
+}
+
+// The index in sources of the album each source file belongs to.
+func indexSourceFiles(sources []Album) map[fileID]int {
+	byFile := make(map[fileID]int)
+	for i, album := range sources {
+		filepath.Walk(album.Path, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				if id, ok := statFileID(path, info); ok {
+					byFile[id] = i
+				}
+			}
+			return nil
+		})
+	}
+	return byFile
+}
+
+// The index of the source album that a file of the album at targetPath is a
+// hardlink to, according to byFile, or -1 if none is.
+func linkedSource(targetPath string, byFile map[fileID]int) int {
+	source := -1
+	filepath.Walk(targetPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || source >= 0 || !info.Mode().IsRegular() {
+			return nil
+		}
+		if id, ok := statFileID(path, info); ok {
+			if i, ok := byFile[id]; ok {
+				source = i
+			}
+		}
+		return nil
+	})
+	return source
+}
+
+// Reconstruct the album DB from the target, for recovering from a lost or
+// corrupt albums.db without relinking everything. Each album in the target
+// is matched to the source album it was linked from, first by sharing a file
+// with it (a hardlink), then by having the same contents, and recorded under
+// the source album's contents, as if flaclink had just linked it. Albums in
+// the target that match nothing are recorded by name, as a normal run does.
+// With -n, only report the matches.
+func runDbRebuild(args []string) {
+	flags := flag.NewFlagSet("db rebuild", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "report matches without writing the DB")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: flaclink db rebuild [-n] <source dir> <target dir>")
+		os.Exit(2)
+	}
+	sourceDir := filepath.Clean(flags.Arg(0))
+	targetDir := filepath.Clean(flags.Arg(1))
+
+	sources, err := albumScanner().Scan(sourceDir)
+	if err != nil {
+		fatalf("db rebuild: %v", err)
+	}
+	byFile := indexSourceFiles(sources)
+	byContents := make(map[string]int)
+	for i, album := range sources {
+		byContents[strings.Join(album.Contents, "\x00")] = i
+	}
+	log.Printf("Found %d albums in %s.", len(sources), sourceDir)
+
+	var db *bolt.DB
+	if !*dryRun {
+		db = openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+		defer db.Close()
+	}
+	var byLink, byName, unmatched int
+	matched := make(map[int]bool)
+	for _, relPath := range targetAlbumDirs(targetDir, "", templateDepth()) {
+		targetPath := filepath.Join(targetDir, relPath)
+		if !albumScanner().IsAlbum(targetPath) {
+			continue
+		}
+		found := flaclink.NewAlbum(targetPath)
+		found.DirName = relPath
+
+		source, how := linkedSource(targetPath, byFile), "hardlink"
+		if source < 0 {
+			if i, ok := byContents[strings.Join(found.Contents, "\x00")]; ok {
+				source, how = i, "name"
+			}
+		}
+
+		switch {
+		case source < 0:
+			unmatched++
+			fmt.Printf("unmatched  %s\n", relPath)
+			if db != nil {
+				if err := albumStore(db).Add(found); err != nil {
+					fatalf("db rebuild: %v", err)
+				}
+			}
+			continue
+		case how == "hardlink":
+			byLink++
+		default:
+			byName++
+		}
+		matched[source] = true
+		album := sources[source]
+		fmt.Printf("%-9s  %s <- %s\n", how, relPath, album.Path)
+		if db == nil {
+			continue
+		}
+		album.DirName = relPath
+		if err := albumStore(db).SaveRecord(album, rebuiltRecord(album, targetPath, how)); err != nil {
+			fatalf("db rebuild: %v", err)
+		}
+	}
+	log.Printf("Matched %d albums by hardlink and %d by name; %d in the target matched no source album.", byLink, byName, unmatched)
+	if left := len(sources) - len(matched); left > 0 {
+		log.Printf("%d source albums aren't in the target and will be linked by the next run.", left)
+	}
+}
+
+// The record for album, found linked at targetPath. Source files missing from
+// the target count as excluded. The link time isn't known, so the album
+// directory's modification time stands in for it.
+func rebuiltRecord(album Album, targetPath string, how string) flaclink.AlbumRecord {
+	record := flaclink.AlbumRecord{
+		DirName:   album.DirName,
+		Container: album.Container,
+		Format:    albumFormat(album),
+	}
+	record.Source, _ = filepath.Abs(album.Path)
+	record.Target, _ = filepath.Abs(targetPath)
+	if how == "hardlink" {
+		record.LinkMode = linkMode()
+	}
+	if info, err := os.Stat(targetPath); err == nil {
+		record.Time = info.ModTime()
+	}
+	filepath.Walk(album.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(album.Path, path)
+		_, statErr := os.Lstat(filepath.Join(targetPath, relPath))
+		record.Files = append(record.Files, FileDecision{Path: relPath, Linked: statErr == nil, Size: info.Size()})
+		return nil
+	})
+	record.CountFiles()
+	return record
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Record album, just linked into targetDir, in db: where it came from and
+// went, the decisions made for its files, its format, bit depth, sample rate
+// and edition, how it was linked, its CUE sheets and images and any tracks split
+// from them or cover art fetched for it, and any warnings about it.
+func saveRecord(album Album, targetDir string, decisions []FileDecision, extras linkExtras, warnings []string, db *bolt.DB) error {
+	meta := albumMetadata(album)
+	record := flaclink.AlbumRecord{
+		DirName:   album.DirName,
+		Container: album.Container,
+		Time:      time.Now(),
+		Files:     decisions,
+		Format:    metadataFormat(meta),
+		LinkMode:  linkMode(),
+		Warnings:  warnings,
+
+		SplitTracks: extras.SplitTracks,
+		FetchedArt:  extras.FetchedArt,
+	}
+	for _, path := range albumCueSheets(album.Path) {
+		rel, _ := filepath.Rel(album.Path, path)
+		record.CueSheets = append(record.CueSheets, rel)
+	}
+	for _, image := range albumCueImages(album) {
+		rel, _ := filepath.Rel(album.Path, image.ImagePath)
+		record.Images = append(record.Images, rel)
+	}
+	if meta != nil {
+		record.BitsPerSample, record.SampleRate = meta.BitsPerSample, meta.SampleRate
+	}
+	record.Edition = albumEdition(album, meta)
+	record.Source, _ = filepath.Abs(album.Path)
+	record.Target, _ = filepath.Abs(albumTargetPath(album, targetDir))
+	record.CountFiles()
+	return albumStore(db).SaveRecord(album, record)
+}
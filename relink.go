@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Turn target files that have become copies of their source files back into
+// hardlinks, as after restoring the target from a backup, which doesn't keep
+// hardlinks to files outside it. Only copies with exactly the same content as
+// the source file are replaced, each in a single rename; files that differ,
+// such as ones retagged in the target, are reported and left alone. With -n,
+// only report what would be relinked.
+func runRelink(args []string) {
+	flags := flag.NewFlagSet("relink", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "report copies without replacing them")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: flaclink relink [-n] <source dir> <target dir>")
+		os.Exit(2)
+	}
+	sourceDir := filepath.Clean(flags.Arg(0))
+	targetDir := filepath.Clean(flags.Arg(1))
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+
+	var relinked, differing int
+	var saved int64
+	for _, linked := range albumsWithSources("relink", sourceDir, db) {
+		album := linked.Album
+		if album.Path == "" {
+			continue
+		}
+		targetPath := albumTargetPath(album, targetDir)
+		for _, file := range verifyAlbum(album.Path, targetPath, linked.Record.Files).CopiedFiles {
+			relPath := file.TargetPath()
+			sourceFile, targetFile := filepath.Join(album.Path, file.Path), filepath.Join(targetPath, relPath)
+			same, err := sameContent(sourceFile, targetFile)
+			if err != nil {
+				log.Printf("relink: %v", err)
+				continue
+			}
+			if !same {
+				differing++
+				fmt.Printf("differs   %s\n", filepath.Join(album.DirName, relPath))
+				continue
+			}
+			info, err := os.Stat(targetFile)
+			if err != nil {
+				log.Printf("relink: %v", err)
+				continue
+			}
+			fmt.Printf("relink    %s\n", filepath.Join(album.DirName, relPath))
+			if !*dryRun {
+				if err := replaceWithLink(sourceFile, targetFile, linkFile); err != nil {
+					fatalf("relink: %v", err)
+				}
+			}
+			relinked++
+			saved += info.Size()
+		}
+	}
+	verb := "Relinked"
+	if *dryRun {
+		verb = "Would relink"
+	}
+	log.Printf("%s %d copied files, %d bytes; left %d that differ from their source.", verb, relinked, saved, differing)
+}
+
+// Reports whether the files at a and b have the same content.
+func sameContent(a, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	if aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+	aSum, err := fileSHA256(a)
+	if err != nil {
+		return false, err
+	}
+	bSum, err := fileSHA256(b)
+	if err != nil {
+		return false, err
+	}
+	return aSum == bSum, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Rewrite the paths stored in the DB after the source or target has moved,
+// e.g. from /mnt/old to /mnt/tank: each album record's source and target,
+// its provenance, the review queue, quarantine and rejections, the latest
+// source checks and any interrupted links. Run history is left as it
+// happened. Then check the remapped albums as verify does, so
+// a mistyped prefix shows up straight away. With -n, only list the changes.
+func runDbRemap(args []string) {
+	flags := flag.NewFlagSet("db remap", flag.ExitOnError)
+	from := flags.String("from", "", "path prefix to replace")
+	to := flags.String("to", "", "path prefix to replace it with")
+	dryRun := flags.Bool("n", false, "list the paths that would change without writing the DB")
+	flags.Parse(args)
+	if *from == "" || *to == "" || flags.NArg() != 0 {
+		fmt.Println("Usage: flaclink db remap [-n] -from <old prefix> -to <new prefix>")
+		os.Exit(2)
+	}
+	remap := func(path string) (string, bool) {
+		return remapPrefix(path, filepath.Clean(*from), filepath.Clean(*to))
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: *dryRun})
+	defer db.Close()
+	if !*dryRun {
+		backupPath := fmt.Sprintf("%s.remap-%s.bak", db.Path(), time.Now().Format("20060102-150405"))
+		err := db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(backupPath, 0640)
+		})
+		if err != nil {
+			fatalf("db remap: backing up to %s: %v", backupPath, err)
+		}
+		log.Printf("Backed up %s to %s before remapping it.", db.Path(), backupPath)
+	}
+
+	var remapped []flaclink.AlbumRecord
+	for _, store := range catalogStores(db) {
+		records, err := remapRecords(store, remap, *dryRun)
+		if err != nil {
+			fatalf("db remap: %v", err)
+		}
+		remapped = append(remapped, records...)
+	}
+	others, err := remapOtherPaths(db, remap, *dryRun)
+	if err != nil {
+		fatalf("db remap: %v", err)
+	}
+	if *dryRun {
+		log.Printf("Would remap %d albums and %d other entries.", len(remapped), others)
+		return
+	}
+	log.Printf("Remapped %d albums and %d other entries from %s to %s.", len(remapped), others, *from, *to)
+
+	var bad, unchecked int
+	for _, record := range remapped {
+		if _, err := os.Stat(record.Source); record.Source == "" || err != nil {
+			unchecked++
+			fmt.Printf("no source  %s\n", record.DirName)
+			continue
+		}
+		problems := verifyAlbum(record.Source, record.Target, record.Files)
+		if !problems.ok() {
+			printProblems(record.DirName, problems)
+			bad++
+		}
+	}
+	log.Printf("Verified %d remapped albums: %d with problems, %d without a source to check against.", len(remapped), bad, unchecked)
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
+
+// path with its prefix from replaced by to, if it starts with from as whole
+// path elements.
+func remapPrefix(path, from, to string) (string, bool) {
+	if path != from && !strings.HasPrefix(path, strings.TrimSuffix(from, string(filepath.Separator))+string(filepath.Separator)) {
+		return path, false
+	}
+	return filepath.Join(to, strings.TrimPrefix(path, from)), true
+}
+
+// Remap the source and target of every record in store, printing each
+// change. Returns the records that changed, as remapped. With dryRun, the
+// store is left as it is.
+func remapRecords(store flaclink.Store, remap func(string) (string, bool), dryRun bool) ([]flaclink.AlbumRecord, error) {
+	var albums []Album
+	err := store.ForEach(func(contents []string, dirName string) error {
+		albums = append(albums, Album{DirName: dirName, Contents: contents})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var remapped []flaclink.AlbumRecord
+	for _, album := range albums {
+		record, ok := store.Record(album)
+		if !ok {
+			continue
+		}
+		source, sourceChanged := remap(record.Source)
+		target, targetChanged := remap(record.Target)
+		if !sourceChanged && !targetChanged {
+			continue
+		}
+		if sourceChanged {
+			fmt.Printf("source     %s: %s\n", album.DirName, source)
+		}
+		if targetChanged {
+			fmt.Printf("target     %s: %s\n", album.DirName, target)
+		}
+		record.Source, record.Target = source, target
+		if !dryRun {
+			if err := store.SaveRecord(album, record); err != nil {
+				return remapped, fmt.Errorf("%s: %v", album.DirName, err)
+			}
+		}
+		remapped = append(remapped, record)
+	}
+	return remapped, nil
+}
+
+// Remap the paths in provenance, the review queue, quarantine, rejections,
+// source checks, checksums and interrupted links. Returns the number of
+// entries changed.
+func remapOtherPaths(db *bolt.DB, remap func(string) (string, bool), dryRun bool) (int, error) {
+	changed := 0
+	update := db.Update
+	if dryRun {
+		update = db.View
+	}
+	err := update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{reviewBucketName, quarantineBucketName} {
+			n, err := remapBucket(tx, name, dryRun, func() interface{} { return &QueuedAlbum{} }, func(v interface{}) bool {
+				queued := v.(*QueuedAlbum)
+				var sourceChanged, targetChanged bool
+				queued.Album.Path, sourceChanged = remap(queued.Album.Path)
+				queued.TargetDir, targetChanged = remap(queued.TargetDir)
+				return sourceChanged || targetChanged
+			})
+			changed += n
+			if err != nil {
+				return err
+			}
+		}
+		n, err := remapBucket(tx, rejectedBucketName, dryRun, func() interface{} { return &Rejection{} }, func(v interface{}) bool {
+			var ok bool
+			rejection := v.(*Rejection)
+			rejection.Source, ok = remap(rejection.Source)
+			return ok
+		})
+		changed += n
+		if err != nil {
+			return err
+		}
+		n, err = remapBucket(tx, sourceChecksBucketName, dryRun, func() interface{} { return &SourceCheck{} }, func(v interface{}) bool {
+			var ok bool
+			check := v.(*SourceCheck)
+			check.Source, ok = remap(check.Source)
+			return ok
+		})
+		changed += n
+		if err != nil {
+			return err
+		}
+		n, err = remapBucket(tx, checksumsBucketName, dryRun, func() interface{} { return &AlbumChecksums{} }, func(v interface{}) bool {
+			var ok bool
+			sums := v.(*AlbumChecksums)
+			sums.Target, ok = remap(sums.Target)
+			return ok
+		})
+		changed += n
+		if err != nil {
+			return err
+		}
+		// Source checks take the sources they check from provenance.
+		n, err = remapBucket(tx, provenanceBucketName, dryRun, func() interface{} { return &Provenance{} }, func(v interface{}) bool {
+			var ok bool
+			prov := v.(*Provenance)
+			prov.Source, ok = remap(prov.Source)
+			return ok
+		})
+		changed += n
+		if err != nil {
+			return err
+		}
+		n, err = remapKeyedBucket(tx, inProgressBucketName, dryRun, func() interface{} { return &InProgressLink{} }, func(v interface{}) bool {
+			var sourceChanged, targetChanged, stagingChanged bool
+			link := v.(*InProgressLink)
+			link.Source, sourceChanged = remap(link.Source)
+			link.Target, targetChanged = remap(link.Target)
+			link.Staging, stagingChanged = remap(link.Staging)
+			return sourceChanged || targetChanged || stagingChanged
+		}, func(v interface{}) []byte {
+			return []byte(v.(*InProgressLink).Target)
+		})
+		changed += n
+		return err
+	})
+	return changed, err
+}
+
+// Decode each gob value in the named bucket of tx into a new value from
+// newValue, and store it again if remap reports changing it, unless dryRun
+// is set. Returns the number of values changed.
+func remapBucket(tx *bolt.Tx, name []byte, dryRun bool, newValue func() interface{}, remap func(v interface{}) bool) (int, error) {
+	return remapKeyedBucket(tx, name, dryRun, newValue, remap, nil)
+}
+
+// Like remapBucket, but for a bucket keyed by a path in its values: each
+// changed value is moved to the key that key gives for it, if key is set.
+func remapKeyedBucket(tx *bolt.Tx, name []byte, dryRun bool, newValue func() interface{}, remap func(v interface{}) bool, key func(v interface{}) []byte) (int, error) {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		return 0, nil
+	}
+	updates := make(map[string][]byte)
+	var moved [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		value := newValue()
+		if err := gob.NewDecoder(bytes.NewReader(v)).Decode(value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if !remap(value) {
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+			return err
+		}
+		if key != nil && !bytes.Equal(key(value), k) {
+			moved = append(moved, append([]byte(nil), k...))
+			k = key(value)
+		}
+		updates[string(k)] = buf.Bytes()
+		return nil
+	})
+	if err != nil || dryRun {
+		return len(updates), err
+	}
+	for _, k := range moved {
+		if err := bucket.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	for k, v := range updates {
+		if err := bucket.Put([]byte(k), v); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
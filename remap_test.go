@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// After db remap, source checks look for the sources at their new paths.
+func TestRemapThenCheckSources(t *testing.T) {
+	dir := t.TempDir()
+	oldSource := filepath.Join(dir, "old", "Album")
+	newSource := filepath.Join(dir, "new", "Album")
+	if err := os.MkdirAll(newSource, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(newSource, "01.flac"), []byte("flac"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "albums.db"), 0640, &bolt.Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	initAlbumDb(db)
+	album := Album{DirName: "Album", Contents: []string{"01.flac"}, Path: oldSource}
+	if err := saveProvenance(album, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := albumStore(db).SaveDecisions(album.DirName, []FileDecision{{Path: "01.flac", Linked: true, Size: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putGob(db, inProgressBucketName, []byte(filepath.Join(dir, "old", "target")), InProgressLink{Source: oldSource, Target: filepath.Join(dir, "old", "target")}); err != nil {
+		t.Fatal(err)
+	}
+
+	remap := func(path string) (string, bool) {
+		return remapPrefix(path, filepath.Join(dir, "old"), filepath.Join(dir, "new"))
+	}
+	if n, err := remapOtherPaths(db, remap, false); err != nil || n != 2 {
+		t.Fatalf("remapOtherPaths = %d, %v, want 2 entries changed", n, err)
+	}
+	if checked := checkSources(db, time.Minute); checked != 1 {
+		t.Fatalf("checkSources checked %d albums, want 1", checked)
+	}
+
+	var check SourceCheck
+	var links []InProgressLink
+	db.View(func(tx *bolt.Tx) error {
+		check, _ = decodeSourceCheck(tx.Bucket(sourceChecksBucketName).Get([]byte(album.DirName)))
+		return tx.Bucket(inProgressBucketName).ForEach(func(k, v []byte) error {
+			var link InProgressLink
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&link); err != nil {
+				return err
+			}
+			if string(k) != link.Target {
+				t.Errorf("in-progress link to %s is keyed %s", link.Target, k)
+			}
+			links = append(links, link)
+			return nil
+		})
+	})
+	if check.Source != newSource || check.state() != "intact" {
+		t.Errorf("source check = %+v, want %s intact", check, newSource)
+	}
+	if len(links) != 1 || links[0].Source != newSource {
+		t.Errorf("in-progress links = %+v, want one from %s", links, newSource)
+	}
+}
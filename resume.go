@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket of albums being linked, keyed by absolute target path. An entry is
+// written before an album's target directory is created and removed once
+// the album is recorded, so one left behind means flaclink was killed
+// mid-album.
+var inProgressBucketName = []byte("inprogress")
+
+// An album link that was started but not yet recorded.
+type InProgressLink struct {
+	Source  string
+	Target  string
+	Staging string
+	Started time.Time
+}
+
+// Note that album is about to be linked into targetDir.
+func markLinkStarted(album Album, targetDir string, db *bolt.DB) error {
+	source, err := filepath.Abs(album.Path)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.Abs(albumTargetPath(album, targetDir))
+	if err != nil {
+		return err
+	}
+	staging, err := filepath.Abs(albumStagingPath(album, targetDir))
+	if err != nil {
+		return err
+	}
+	return putGob(db, inProgressBucketName, []byte(target), InProgressLink{Source: source, Target: target, Staging: staging, Started: time.Now()})
+}
+
+// Note that the link to targetPath is over, whether it succeeded or not. On
+// failure, the linker has already removed what it linked.
+func markLinkFinished(targetPath string, db *bolt.DB) error {
+	target, err := filepath.Abs(targetPath)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(inProgressBucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(target))
+	})
+}
+
+// Deal with albums a killed flaclink left half linked. A leftover whose
+// album made it into the DB was complete, and only its entry is cleared.
+// Otherwise, its target directory is removed so that the album is linked
+// afresh, but only if everything in it is a link to the same file in the
+// source; anything else is left alone with a warning. Without this, the
+// leftover directory would make every later attempt to link the album fail,
+// or be taken for an album that was already in the target.
+func resumeInterruptedLinks(db *bolt.DB) {
+	var leftovers []InProgressLink
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(inProgressBucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var link InProgressLink
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&link); err != nil {
+				log.Printf("Skipping unreadable in-progress link %s: %v", k, err)
+				return nil
+			}
+			leftovers = append(leftovers, link)
+			return nil
+		})
+	})
+	for _, link := range leftovers {
+		if err := resumeLink(link, db); err != nil {
+			log.Printf("Can't clean up interrupted link of %s: %v", link.Target, err)
+			continue
+		}
+		if err := markLinkFinished(link.Target, db); err != nil {
+			log.Printf("Can't clear interrupted link of %s: %v", link.Target, err)
+		}
+	}
+}
+
+// Clean up after one interrupted link, leaving its entry for the caller to
+// clear. Its staging directory only ever holds what flaclink linked, so it's
+// always removed.
+func resumeLink(link InProgressLink, db *bolt.DB) error {
+	if link.Staging != "" {
+		if err := os.RemoveAll(link.Staging); err != nil {
+			return err
+		}
+		os.Remove(filepath.Dir(link.Staging))
+	}
+	if _, err := os.Lstat(link.Target); os.IsNotExist(err) {
+		log.Printf("Interrupted link of %s left nothing behind.", link.Target)
+		return nil
+	}
+	if _, err := os.Stat(link.Source); err == nil && inDb(flaclink.NewAlbum(link.Source), db) {
+		log.Printf("Interrupted link of %s had finished linking; keeping it.", link.Target)
+		return nil
+	}
+	if foreign := foreignFile(link.Source, link.Target); foreign != "" {
+		log.Printf("Warning: %s was being linked when flaclink stopped, but %s isn't linked from %s; leaving it for you to check.", link.Target, foreign, link.Source)
+		return nil
+	}
+	if err := os.RemoveAll(link.Target); err != nil {
+		return err
+	}
+	log.Printf("Removed %s, left half linked when flaclink stopped; it will be linked again.", link.Target)
+	return nil
+}
+
+var errFoundForeign = errors.New("found a file not linked from the source")
+
+// The first file under target, relative to it, that isn't a link to the
+// file at the same path under source, or "" if there's none.
+func foreignFile(source, target string) (foreign string) {
+	filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(target, path)
+		if err != nil || relErr != nil {
+			foreign = path
+			return errFoundForeign
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Linked under link_mode "symlink".
+			if info, err = os.Stat(path); err != nil {
+				foreign = rel
+				return errFoundForeign
+			}
+		}
+		sourceInfo, err := os.Stat(filepath.Join(source, rel))
+		if err != nil || !os.SameFile(info, sourceInfo) {
+			foreign = rel
+			return errFoundForeign
+		}
+		return nil
+	})
+	return foreign
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// With "review" set in the config file, new albums wait in the review queue
+// instead of being linked, until someone approves or rejects them with
+// "flaclink review". Rejected albums are remembered, so later runs skip them.
+var (
+	// Albums awaiting review, keyed by the time they were queued as
+	// big-endian Unix nanoseconds, so they list in the order they came in.
+	reviewBucketName = []byte("review")
+	// Albums rejected in review, keyed by their contents joined with NULs.
+	rejectedBucketName = []byte("rejected")
+)
+
+// An album in the review queue, with what a reviewer needs to decide on it.
+type QueuedAlbum struct {
+	// The album as found in the source, and the target dir it is for.
+	Album     Album
+	TargetDir string
+	Queued    time.Time
+	// Name it would get in the target.
+	TargetName string
+	Artist     string
+	Title      string
+	Year       string
+	Format     string
+	Files      int
+	Bytes      int64
+	// Why the album was quarantined, such as corrupt audio. Empty for
+	// albums queued for review, except those queued for corrupt audio
+	// before there was a quarantine.
+	Reason string
+}
+
+// A rejected album, kept so it isn't queued again.
+type Rejection struct {
+	Time    time.Time
+	DirName string
+	Source  string
+}
+
+func rejectedKey(album Album) []byte {
+	return []byte(strings.Join(album.Contents, "\x00"))
+}
+
+// Reports whether album was rejected in review.
+func isRejected(album Album, db *bolt.DB) bool {
+	rejected := false
+	db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(rejectedBucketName); bucket != nil {
+			rejected = bucket.Get(rejectedKey(album)) != nil
+		}
+		return nil
+	})
+	return rejected
+}
+
+// The review queue, oldest first, with the key of each entry.
+func reviewQueue(db *bolt.DB) (queue []QueuedAlbum, keys [][]byte) {
+	return queuedAlbums(reviewBucketName, db)
+}
+
+// The albums in the named bucket of queued albums, such as the review queue
+// or quarantine, oldest first, with the key of each.
+func queuedAlbums(name []byte, db *bolt.DB) (queue []QueuedAlbum, keys [][]byte) {
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var queued QueuedAlbum
+			if gob.NewDecoder(bytes.NewReader(v)).Decode(&queued) == nil {
+				queue = append(queue, queued)
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	return queue, keys
+}
+
+// Reports whether the album in job is already in the review queue, and if
+// so reports it as skipped.
+func awaitingReview(job *albumJob) bool {
+	path, _ := filepath.Abs(job.Found.Path)
+	queue, _ := reviewQueue(job.DB)
+	for _, queued := range queue {
+		if queued.Album.Path == path {
+			emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "awaiting review"})
+			return true
+		}
+	}
+	return false
+}
+
+// Add the album in job to the review queue. Paths are made absolute, so the
+// album can be approved from anywhere.
+func queueForReview(job *albumJob) error {
+	queued := newQueuedAlbum(job, "")
+	if err := putGob(job.DB, reviewBucketName, timeKey(queued.Queued), queued); err != nil {
+		return err
+	}
+	log.Printf("Queued album for review: %s.", job.Album.DirName)
+	emitEvent(Event{Event: "skipped", Album: job.Album.DirName, Source: job.Album.Path, Reason: "queued for review"})
+	return nil
+}
+
+// The album in job as an entry of the review queue or quarantine, queued
+// now for reason, if any.
+func newQueuedAlbum(job *albumJob, reason string) QueuedAlbum {
+	found := job.Found
+	found.Path, _ = filepath.Abs(found.Path)
+	meta := job.Meta
+	if meta == nil {
+		meta = albumMetadata(job.Album)
+	}
+	queued := QueuedAlbum{
+		Album:      found,
+		Queued:     time.Now(),
+		TargetName: job.Album.DirName,
+		Artist:     albumArtist(meta),
+		Title:      tagOr(meta, "ALBUM", job.Found.DirName),
+		Year:       tagOr(meta, "DATE", ""),
+		Format:     albumFormat(job.Album),
+		Reason:     reason,
+	}
+	queued.TargetDir, _ = filepath.Abs(job.TargetDir)
+	filepath.Walk(job.Album.Path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			queued.Files++
+			queued.Bytes += info.Size()
+		}
+		return nil
+	})
+	return queued
+}
+
+// List the albums awaiting review, or approve or reject some of them.
+// Approved albums are linked into the target dir they were found for;
+// rejected ones are left out of every later run.
+func runReview(args []string) {
+	if len(args) == 0 {
+		runReviewList()
+		return
+	}
+	switch args[0] {
+	case "approve":
+		runReviewApprove(args[1:])
+	case "reject":
+		runReviewReject(args[1:])
+	default:
+		fmt.Printf("Unknown review command %q.\n", args[0])
+		reviewUsage()
+	}
+}
+
+func reviewUsage() {
+	fmt.Println("Usage: flaclink review")
+	fmt.Println("       flaclink review approve <n|album dir>...")
+	fmt.Println("       flaclink review reject <n|album dir>...")
+	os.Exit(2)
+}
+
+func runReviewList() {
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+
+	queue, _ := reviewQueue(db)
+	if len(queue) == 0 {
+		fmt.Println("No albums awaiting review.")
+		return
+	}
+	printQueued(queue)
+}
+
+// Print queued albums, numbered as approve and reject take them.
+func printQueued(queue []QueuedAlbum) {
+	for i, queued := range queue {
+		title := queued.Artist + " - " + queued.Title
+		if queued.Year != "" {
+			title += " (" + queued.Year + ")"
+		}
+		fmt.Printf("%3d  %s  %s\n", i+1, queued.Queued.Local().Format("2006-01-02 15:04"), title)
+		fmt.Printf("     %s, %d files, %d bytes\n", queued.Format, queued.Files, queued.Bytes)
+		fmt.Printf("     %s -> %s\n", queued.Album.Path, albumTargetPath(Album{DirName: queued.TargetName}, queued.TargetDir))
+		if queued.Reason != "" {
+			fmt.Printf("     %s\n", queued.Reason)
+		}
+	}
+}
+
+// Find the queue entries named on the command line, by their number in the
+// review list or by album dir.
+func selectQueued(command string, args []string, db *bolt.DB) (selected []QueuedAlbum, keys [][]byte) {
+	if len(args) == 0 {
+		reviewUsage()
+	}
+	return pickQueued(reviewBucketName, "review "+command, args, db)
+}
+
+// Find the albums named in args, by their number in the list of the named
+// bucket of queued albums or by album dir. Albums that aren't there are
+// fatal, and reported as coming from command.
+func pickQueued(name []byte, command string, args []string, db *bolt.DB) (selected []QueuedAlbum, keys [][]byte) {
+	queue, queueKeys := queuedAlbums(name, db)
+	for _, arg := range args {
+		i := -1
+		if n, err := strconv.Atoi(arg); err == nil && n >= 1 && n <= len(queue) {
+			i = n - 1
+		} else if path, err := filepath.Abs(arg); err == nil {
+			for j, queued := range queue {
+				if queued.Album.Path == path {
+					i = j
+				}
+			}
+		}
+		if i < 0 {
+			fatalf("%s: %s is not in the %s", command, arg, queueName(name))
+		}
+		selected = append(selected, queue[i])
+		keys = append(keys, queueKeys[i])
+	}
+	return selected, keys
+}
+
+// What to call the named bucket of queued albums in messages.
+func queueName(name []byte) string {
+	if string(name) == string(quarantineBucketName) {
+		return "quarantine"
+	}
+	return "review queue"
+}
+
+func removeFromQueue(name []byte, key []byte, db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(key)
+	})
+}
+
+// Link the selected albums, as a run of their own.
+func runReviewApprove(args []string) {
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+	selected, keys := selectQueued("approve", args, db)
+	approveQueued(reviewBucketName, "review approve", selected, keys, "", db)
+}
+
+// Link the selected albums from the named bucket of queued albums as a run
+// of their own, under name if it isn't empty, and take them out of it.
+func approveQueued(bucketName []byte, command string, selected []QueuedAlbum, keys [][]byte, name string, db *bolt.DB) {
+	ctx, cancel := interruptContext()
+	defer cancel()
+	beginRun(strings.Fields(command)[0], queueName(bucketName))
+	var linked []Album
+	targetDir := ""
+	for i, queued := range selected {
+		if _, err := os.Stat(queued.Album.Path); err != nil {
+			log.Printf("%s: %v, dropping it from the %s.", command, err, queueName(bucketName))
+			removeFromQueue(bucketName, keys[i], db)
+			continue
+		}
+		// The album may have changed while it waited.
+		album := queued.Album
+		album.Contents = flaclink.NewAlbum(album.Path).Contents
+		emitEvent(Event{Event: "discovered", Album: album.DirName, Source: album.Path})
+		job := &albumJob{Ctx: ctx, Album: album, Found: album, TargetDir: queued.TargetDir, DB: db, Approved: true, Name: name}
+		if album, ok := runStages(job); ok {
+			linked = append(linked, album)
+			targetDir = queued.TargetDir
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err := removeFromQueue(bucketName, keys[i], db); err != nil {
+			fatalf("%s: %v", command, err)
+		}
+	}
+	finishRun(linked, targetDir, db)
+}
+
+// Remove the selected albums from the queue and remember them as rejected.
+func runReviewReject(args []string) {
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+	selected, keys := selectQueued("reject", args, db)
+	rejectQueued(reviewBucketName, "review reject", selected, keys, db)
+}
+
+// Take the selected albums out of the named bucket of queued albums and
+// remember them as rejected.
+func rejectQueued(bucketName []byte, command string, selected []QueuedAlbum, keys [][]byte, db *bolt.DB) {
+	for i, queued := range selected {
+		rejection := Rejection{Time: time.Now(), DirName: queued.Album.DirName, Source: queued.Album.Path}
+		if err := putGob(db, rejectedBucketName, rejectedKey(queued.Album), rejection); err != nil {
+			fatalf("%s: %v", command, err)
+		}
+		if err := removeFromQueue(bucketName, keys[i], db); err != nil {
+			fatalf("%s: %v", command, err)
+		}
+		log.Printf("Rejected album: %s.", queued.Album.DirName)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A rule placing the albums it matches in a subfolder of the target, e.g.
+// classical albums under "Classical". The first matching rule applies.
+type RouteRule struct {
+	Match   RouteMatch `json:"match"`
+	Subpath string     `json:"subpath"`
+	// Layout of the albums it matches under Subpath, instead of
+	// target_template, or "classical" for classicalTemplate.
+	Template string `json:"template"`
+}
+
+// The target template for the albums route matches, or "" for the usual one.
+func (route RouteRule) template() string {
+	if route.Template == classicalRouteTemplate {
+		return classicalTemplate
+	}
+	return route.Template
+}
+
+// Number of directory levels below Subpath at which albums are linked.
+func (route RouteRule) depth() int {
+	if template := route.template(); template != "" {
+		return templatePathDepth(template)
+	}
+	return templateDepth()
+}
+
+// Conditions on an album, for routes and profiles. Every condition that's
+// set must hold; a match with none set matches every album.
+type RouteMatch struct {
+	// Minimum bits per sample and sample rate in Hz of the album's first
+	// FLAC file, e.g. 24 and 88200 for hi-res.
+	MinBits       int `json:"min_bits"`
+	MinSampleRate int `json:"min_sample_rate"`
+	// If set, true matches only hi-res albums, deeper than 16 bits or
+	// faster than 48 kHz, and false only CD-quality ones.
+	HiRes *bool `json:"hires"`
+	// Name patterns of album folders in the source, as in include_dirs.
+	Dirs []string `json:"dirs"`
+	// Patterns for tag values of the album's first FLAC file, keyed by tag
+	// name, e.g. {"genre": "Classical"}. Each is a glob or a /regexp/, and
+	// globs ignore case. A tag with several values matches if any does.
+	Tags map[string]string `json:"tags"`
+}
+
+// Check the patterns in m.
+func (m RouteMatch) validate() error {
+	if err := validateDirPatterns(m.Dirs); err != nil {
+		return fmt.Errorf("dirs: %v", err)
+	}
+	for name, pattern := range m.Tags {
+		if _, err := matchTagPattern(pattern, ""); err != nil {
+			return fmt.Errorf("tags: %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Reports whether album satisfies m. meta returns the album's metadata, and
+// is only called if m needs it, since reading it means opening a file.
+func (m RouteMatch) matches(album Album, meta func() *flacMetadata) bool {
+	if len(m.Dirs) > 0 && matchingDirPattern(m.Dirs, filepath.Base(album.Path)) == "" {
+		return false
+	}
+	if m.MinBits == 0 && m.MinSampleRate == 0 && m.HiRes == nil && len(m.Tags) == 0 {
+		return true
+	}
+	md := meta()
+	if m.HiRes != nil && md.hiRes() != *m.HiRes {
+		return false
+	}
+	if (m.MinBits > 0 || m.MinSampleRate > 0 || len(m.Tags) > 0) && md == nil {
+		return false
+	}
+	if md != nil && (md.BitsPerSample < m.MinBits || md.SampleRate < m.MinSampleRate) {
+		return false
+	}
+	for name, pattern := range m.Tags {
+		matched := false
+		for _, value := range md.Tags[strings.ToUpper(name)] {
+			if ok, _ := matchTagPattern(pattern, strings.TrimSpace(value)); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether the tag value matches pattern, a glob, ignoring case, or a
+// regular expression between slashes. Returns an error if pattern is
+// invalid.
+func matchTagPattern(pattern, value string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, fmt.Errorf("%q: %v", pattern, err)
+		}
+		return re.MatchString(value), nil
+	}
+	matched, err := filepath.Match(strings.ToLower(pattern), strings.ToLower(value))
+	if err != nil {
+		return false, fmt.Errorf("%q: %v", pattern, err)
+	}
+	return matched, nil
+}
+
+// Returns a function that reads album's metadata once, for RouteMatch.matches,
+// starting from meta if it's already been read.
+func lazyMetadata(album Album, meta *flacMetadata) func() *flacMetadata {
+	read := meta != nil
+	return func() *flacMetadata {
+		if !read {
+			meta, read = albumMetadata(album), true
+		}
+		return meta
+	}
+}
+
+// Check a routes setting.
+func validateRoutes(routes []RouteRule) error {
+	for i, route := range routes {
+		subpath := filepath.Clean(route.Subpath)
+		if route.Subpath == "" || filepath.IsAbs(subpath) || subpath == "." || strings.HasPrefix(subpath, "..") {
+			return fmt.Errorf("route %d: subpath must be a relative path inside the target dir", i+1)
+		}
+		if err := route.Match.validate(); err != nil {
+			return fmt.Errorf("route %d: %v", i+1, err)
+		}
+		if err := validateTemplate(route.template()); err != nil {
+			return fmt.Errorf("route %d: template: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// The first route that matches album, or nil if none does.
+func matchingRoute(album Album, meta *flacMetadata) *RouteRule {
+	read := lazyMetadata(album, meta)
+	for i, route := range settings.Routes {
+		if route.Match.matches(album, read) {
+			return &settings.Routes[i]
+		}
+	}
+	return nil
+}
+
+// Reports whether relPath, a directory in the target, is a route's subpath,
+// is inside one, or contains one, so it isn't an album at the template's
+// depth.
+func onRouteSubpath(relPath string) bool {
+	for _, route := range settings.Routes {
+		subpath := filepath.Clean(route.Subpath)
+		sep := string(filepath.Separator)
+		if relPath == subpath || strings.HasPrefix(relPath, subpath+sep) || strings.HasPrefix(subpath, relPath+sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// The paths, relative to musicDir, of the directories where albums are
+// linked: those at the template's depth, and at that depth below each
+// route's subpath.
+func targetAlbumDirsWithRoutes(musicDir string) (dirs []string) {
+	for _, relPath := range targetAlbumDirs(musicDir, "", templateDepth()) {
+		if !onRouteSubpath(relPath) {
+			dirs = append(dirs, relPath)
+		}
+	}
+	// Routes sharing a subpath are scanned once per depth.
+	seen := make(map[string]bool)
+	for _, route := range settings.Routes {
+		subpath := filepath.Clean(route.Subpath)
+		key := fmt.Sprintf("%s:%d", subpath, route.depth())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if info, err := os.Stat(filepath.Join(musicDir, subpath)); err == nil && info.IsDir() {
+			dirs = append(dirs, targetAlbumDirs(musicDir, subpath, route.depth())...)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Making names safe for targets on Windows filesystems or Samba shares,
+// which refuse names with some characters, names ending in a dot or space,
+// and device names such as CON. Linking an album with such a name would
+// otherwise fail part-way through.
+type SanitizeNamesConfig struct {
+	// What characters such filesystems refuse are replaced with, e.g. "_".
+	// They're removed if empty.
+	Replacement string `json:"replacement"`
+	// Replace letters with accents and other non-ASCII characters with
+	// plain ASCII, e.g. "Motörhead" with "Motorhead". Characters that have
+	// no ASCII spelling are treated like refused ones.
+	Transliterate bool `json:"transliterate"`
+}
+
+func (sc *SanitizeNamesConfig) validate() error {
+	if sc.Replacement != "" && sc.Replacement != sanitizeName(sc.Replacement, SanitizeNamesConfig{Transliterate: sc.Transliterate}) {
+		return fmt.Errorf("replacement %q would itself need replacing", sc.Replacement)
+	}
+	return nil
+}
+
+// Characters Windows doesn't allow in names, besides control characters.
+const illegalNameChars = `<>:"/\|?*`
+
+// Names Windows reserves for devices, with or without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ASCII spellings of the non-ASCII characters most common in names, mostly
+// Latin letters with accents, and typographic punctuation.
+var transliterations = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Ā': "A", 'Ă': "A", 'Ą': "A",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'Æ': "AE", 'æ': "ae", 'Ç': "C", 'ç': "c", 'Ć': "C", 'ć': "c", 'Č': "C", 'č': "c",
+	'Ď': "D", 'ď': "d", 'Đ': "D", 'đ': "d", 'Ð': "D", 'ð': "d",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ē': "E", 'Ė': "E", 'Ę': "E", 'Ě': "E",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'Ğ': "G", 'ğ': "g", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I", 'Ī': "I", 'İ': "I",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ı': "i",
+	'Ł': "L", 'ł': "l", 'Ñ': "N", 'ñ': "n", 'Ń': "N", 'ń': "n", 'Ň': "N", 'ň': "n",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O", 'Ō': "O", 'Ő': "O",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o",
+	'Œ': "OE", 'œ': "oe", 'Ř': "R", 'ř': "r", 'Ś': "S", 'ś': "s", 'Š': "S", 'š': "s", 'Ş': "S", 'ş': "s",
+	'ß': "ss", 'Ť': "T", 'ť': "t", 'Þ': "Th", 'þ': "th",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ū': "U", 'Ů': "U", 'Ű': "U",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+	'Ý': "Y", 'Ÿ': "Y", 'ý': "y", 'ÿ': "y", 'Ź': "Z", 'ź': "z", 'Ż': "Z", 'ż': "z", 'Ž': "Z", 'ž': "z",
+	'‘': "'", '’': "'", '‚': "'", '“': `"`, '”': `"`, '„': `"`, '«': `"`, '»': `"`,
+	'–': "-", '—': "-", '‐': "-", '…': "...", '×': "x", '\u00a0': " ",
+}
+
+// name made safe under sc: characters Windows refuses replaced, trailing
+// dots and spaces trimmed, device names such as CON.flac changed to
+// CON_.flac, and, with Transliterate, non-ASCII characters spelled in
+// ASCII. Never returns an empty name.
+func sanitizeName(name string, sc SanitizeNamesConfig) string {
+	var b strings.Builder
+	write := func(r rune) {
+		if r < 0x20 || strings.ContainsRune(illegalNameChars, r) {
+			b.WriteString(sc.Replacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	for _, r := range name {
+		if !sc.Transliterate || r < utf8.RuneSelf {
+			write(r)
+			continue
+		}
+		ascii, ok := transliterations[r]
+		if !ok {
+			b.WriteString(sc.Replacement)
+			continue
+		}
+		for _, r := range ascii {
+			write(r)
+		}
+	}
+	clean := strings.TrimRight(b.String(), ". ")
+	base := clean
+	if dot := strings.IndexByte(clean, '.'); dot >= 0 {
+		base = clean[:dot]
+	}
+	if reservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		clean = base + "_" + clean[len(base):]
+	}
+	if clean == "" {
+		clean = "_"
+	}
+	return clean
+}
+
+// The sanitize_names in effect: as configured, or on Windows, which refuses
+// the names this guards against, replacing with "_" if unset. nil if names
+// are left as they are.
+func sanitizeNames() *SanitizeNamesConfig {
+	if settings.SanitizeNames != nil {
+		return settings.SanitizeNames
+	}
+	return defaultSanitizeNames()
+}
+
+// Each element of the slash-separated path sanitized under sanitize_names,
+// or path as it is if that isn't set.
+func sanitizePath(path string) string {
+	sc := sanitizeNames()
+	if sc == nil {
+		return path
+	}
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i, part := range parts {
+		parts[i] = sanitizeName(part, *sc)
+	}
+	return filepath.FromSlash(strings.Join(parts, "/"))
+}
+
+// The Linker.MapPath for album: its compilations track_template, then its
+// disc_layout, then sanitize_names. nil if none changes anything.
+func linkPathMapper(album Album) func(string) string {
+	tracks := compilationTrackMapper(album)
+	discs := discLayoutMapper(album)
+	if sanitizeNames() == nil && tracks == nil {
+		return discs
+	}
+	return func(relPath string) string {
+		if tracks != nil {
+			relPath = tracks(relPath)
+		}
+		if discs != nil {
+			relPath = discs(relPath)
+		}
+		return sanitizePath(relPath)
+	}
+}
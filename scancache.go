@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Scans of the source dir read every directory in it, which for a big
+// source means tens of thousands of directory listings per run, nearly all
+// of them unchanged. So the albums found in each entry of the source dir are
+// kept in the DB along with the modification times of the directories that
+// were read to find them. A directory's modification time changes whenever
+// an entry is added, removed or renamed in it, so while none of those times
+// has changed, nor the ignore files or the settings that filter the scan,
+// the albums found last time are used without reading the directories again.
+// -full-scan reads everything anyway.
+
+// Bucket of scan snapshots, keyed by the absolute path of the entry of the
+// source dir they're for.
+var scanCacheBucketName = []byte("scancache")
+
+// Modification times this close to the scan might be followed by another
+// change within the filesystem's timestamp resolution, which would go
+// unnoticed, so snapshots with them aren't kept.
+const scanCacheMinAge = 2 * time.Second
+
+// Set by -full-scan to read every directory of the source instead of using
+// the scan cache.
+var fullScan bool
+
+func registerFullScanFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&fullScan, "full-scan", false, "read every directory of the source dirs rather than only those that changed since the last scan")
+}
+
+// The albums found in an entry of the source dir by a scan, and what they
+// were found from.
+type scanSnapshot struct {
+	// The entry's path as it was scanned, which album paths start with.
+	Path string
+	// What else the scan depended on; see scanCache.stamp.
+	Stamp string
+	// Modification times, in Unix nanoseconds, of each directory read, and
+	// of the ignore files in them.
+	ModTimes map[string]int64
+	Albums   []Album
+}
+
+// The scan snapshots of a run: those in the DB, and those to save. Safe for
+// concurrent use.
+type scanCache struct {
+	mu        sync.Mutex
+	snapshots map[string]scanSnapshot
+	updated   map[string]*scanSnapshot // nil to delete
+	// Stamps by source dir.
+	stamps  map[string]string
+	reused  int
+	scanned int
+}
+
+// Load the scan snapshots in db. Returns nil, which scans everything, if
+// there's a problem.
+func loadScanCache(db *bolt.DB) *scanCache {
+	c := &scanCache{snapshots: make(map[string]scanSnapshot), updated: make(map[string]*scanSnapshot), stamps: make(map[string]string)}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scanCacheBucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var snapshot scanSnapshot
+			if gob.NewDecoder(bytes.NewReader(v)).Decode(&snapshot) == nil {
+				c.snapshots[string(k)] = snapshot
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Can't load the scan cache, scanning everything: %v", err)
+		return nil
+	}
+	return c
+}
+
+// What a scan of sourceDir depends on besides the directories it reads: the
+// scanner's version, the settings for skipping hidden dirs, and the ignore
+// files in sourceDir and the directories above it.
+// Called with c.mu held.
+func (c *scanCache) stamp(sourceDir string) string {
+	if stamp, ok := c.stamps[sourceDir]; ok {
+		return stamp
+	}
+	stamp := fmt.Sprintf("scanner %d %v %q", flaclink.ScannerVersion, includeHidden, settings.IncludeHiddenDirs)
+	if abs, err := filepath.Abs(sourceDir); err == nil {
+		for dir := abs; ; dir = filepath.Dir(dir) {
+			if info, err := os.Stat(filepath.Join(dir, ignoreFileName)); err == nil {
+				stamp += fmt.Sprintf(" %s@%d", dir, info.ModTime().UnixNano())
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+	c.stamps[sourceDir] = stamp
+	return stamp
+}
+
+// The albums in contentPath, an entry of sourceDir, from its snapshot if
+// nothing it was found from has changed, or else by scanning it.
+func (c *scanCache) findAlbums(sourceDir, contentPath string) []Album {
+	if c == nil {
+		return albumScanner().FindAlbums(contentPath)
+	}
+	key, err := filepath.Abs(contentPath)
+	if err != nil {
+		return albumScanner().FindAlbums(contentPath)
+	}
+	c.mu.Lock()
+	stamp := c.stamp(sourceDir)
+	snapshot, ok := c.snapshots[key]
+	c.mu.Unlock()
+	if ok && !fullScan && snapshot.Path == contentPath && snapshot.Stamp == stamp && snapshot.unchanged() {
+		c.mu.Lock()
+		c.reused++
+		c.mu.Unlock()
+		return snapshot.Albums
+	}
+
+	scanner := albumScanner()
+	fsys := &recordingFS{FS: scanner.FS, modTimes: make(map[string]int64)}
+	scanner.FS = fsys
+	albums := scanner.FindAlbums(contentPath)
+	cutoff := time.Now().Add(-scanCacheMinAge).UnixNano()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scanned++
+	for _, modTime := range fsys.modTimes {
+		if modTime > cutoff || fsys.failed {
+			c.updated[key] = nil
+			return albums
+		}
+	}
+	c.updated[key] = &scanSnapshot{Path: contentPath, Stamp: stamp, ModTimes: fsys.modTimes, Albums: albums}
+	return albums
+}
+
+// Reports whether the directories and files the snapshot was taken from
+// still have the same modification times.
+func (s scanSnapshot) unchanged() bool {
+	for path, modTime := range s.ModTimes {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().UnixNano() != modTime {
+			return false
+		}
+	}
+	return true
+}
+
+// Drop the snapshots of entries of sourceDir that are gone, given the names
+// of the entries it has now.
+func (c *scanCache) forgetRemoved(sourceDir string, names []string) {
+	if c == nil {
+		return
+	}
+	abs, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	present := make(map[string]bool)
+	for _, name := range names {
+		present[name] = true
+	}
+	for key := range c.snapshots {
+		if filepath.Dir(key) == abs && !present[filepath.Base(key)] {
+			c.updated[key] = nil
+		}
+	}
+}
+
+// Write the snapshots taken and drop those out of date, in one transaction,
+// and log how much of the scan they saved.
+func (c *scanCache) save(db *bolt.DB) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reused > 0 {
+		log.Printf("Reused the last scan of %d unchanged source folders, and scanned %d.", c.reused, c.scanned)
+	}
+	if len(c.updated) == 0 {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(scanCacheBucketName)
+		if err != nil {
+			return err
+		}
+		for key, snapshot := range c.updated {
+			if snapshot == nil {
+				if err := bucket.Delete([]byte(key)); err != nil {
+					return err
+				}
+				continue
+			}
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(snapshot); err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Can't save the scan cache: %v", err)
+	}
+	c.updated = make(map[string]*scanSnapshot)
+}
+
+// A flaclink.FS that notes the modification time of each directory it
+// lists, and of the ignore files in it.
+type recordingFS struct {
+	flaclink.FS
+	modTimes map[string]int64
+	// Set if a directory couldn't be listed, which may not change its
+	// modification time once it can be.
+	failed bool
+}
+
+func (fsys *recordingFS) ReadDir(name string) ([]os.FileInfo, error) {
+	// Stat before listing, so a change made in between shows up next time.
+	info, err := os.Stat(name)
+	if err != nil {
+		fsys.failed = true
+		return nil, err
+	}
+	entries, err := fsys.FS.ReadDir(name)
+	if err != nil {
+		fsys.failed = true
+		return nil, err
+	}
+	fsys.modTimes[name] = info.ModTime().UnixNano()
+	for _, entry := range entries {
+		if entry.Name() == ignoreFileName {
+			fsys.modTimes[filepath.Join(name, entry.Name())] = entry.ModTime().UnixNano()
+		}
+	}
+	return entries, nil
+}
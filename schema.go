@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Bucket holding facts about the database itself, such as its schema
+	// version.
+	metaBucketName   = []byte("meta")
+	schemaVersionKey = []byte("schema_version")
+)
+
+// A change to how data is stored in the album database. Upgrade converts a
+// database at the previous version in place.
+type migration struct {
+	Name    string
+	Upgrade func(db *bolt.DB) error
+}
+
+// Every migration, oldest first. The database's schema version is the number
+// of migrations applied to it, so add new ones at the end and never reorder
+// or remove them. Databases from before versioning are at version 0.
+var migrations = []migration{
+	{"album records", migrateAlbumRecords},
+	{"normalized contents", migrateNormalizedContents},
+	{"normalized profile contents", migrateNormalizedProfileContents},
+}
+
+func currentSchemaVersion() int {
+	return len(migrations)
+}
+
+// Returns the schema version recorded in db, or 0 if there's none.
+func schemaVersion(db *bolt.DB) (version int) {
+	db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(metaBucketName); bucket != nil {
+			if v := bucket.Get(schemaVersionKey); v != nil {
+				gob.NewDecoder(bytes.NewReader(v)).Decode(&version)
+			}
+		}
+		return nil
+	})
+	return version
+}
+
+func setSchemaVersion(db *bolt.DB, version int) error {
+	return putGob(db, metaBucketName, schemaVersionKey, version)
+}
+
+// Open the album database at AlbumDbPath, exiting if that fails. A writable
+// database from an older flaclink is upgraded to the current schema, after
+// making a backup copy of it. Either way, a database from a newer flaclink is
+// refused, since this one could misread it.
+//
+// Writable opens take the instance lock first; see instancelock.go. A
+// database that doesn't exist yet is created.
+func openAlbumDb(options *bolt.Options) *bolt.DB {
+	if !options.ReadOnly {
+		lockInstance()
+	}
+	_, err := os.Stat(AlbumDbPath)
+	missing := os.IsNotExist(err)
+	if missing && options.ReadOnly {
+		createAlbumDb(AlbumDbPath)
+		missing = false
+	}
+	db, err := bolt.Open(AlbumDbPath, 0640, options)
+	if err != nil {
+		fatal(err)
+	}
+	if missing {
+		initAlbumDb(db)
+	}
+	version := schemaVersion(db)
+	if version > currentSchemaVersion() {
+		db.Close()
+		fatalf("%s has schema version %d, but this flaclink only knows up to %d; upgrade flaclink", AlbumDbPath, version, currentSchemaVersion())
+	}
+	if version < currentSchemaVersion() && !options.ReadOnly {
+		if err := upgradeSchema(db, version); err != nil {
+			db.Close()
+			fatalf("upgrading %s: %v", AlbumDbPath, err)
+		}
+	}
+	if !options.ReadOnly {
+		resumeInterruptedLinks(db)
+	}
+	return db
+}
+
+// Apply the migrations after version to db, recording the new version after
+// each. The database is first copied next to itself, named after the
+// version it's being upgraded from.
+func upgradeSchema(db *bolt.DB, version int) error {
+	backupPath := fmt.Sprintf("%s.v%d.bak", db.Path(), version)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(backupPath, 0640)
+	})
+	if err != nil {
+		return fmt.Errorf("backing up to %s: %v", backupPath, err)
+	}
+	log.Printf("Backed up %s to %s before upgrading it.", db.Path(), backupPath)
+
+	for ; version < currentSchemaVersion(); version++ {
+		m := migrations[version]
+		if err := m.Upgrade(db); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", version+1, m.Name, err)
+		}
+		if err := setSchemaVersion(db, version+1); err != nil {
+			return err
+		}
+		log.Printf("Upgraded %s to schema version %d (%s).", db.Path(), version+1, m.Name)
+	}
+	return nil
+}
+
+// Migration 1: rewrite albums, which were stored as just their target dir
+// names, as full records, filling in what's known from their provenance.
+// Albums that were found in the target rather than linked keep just their
+// names.
+func migrateAlbumRecords(db *bolt.DB) error {
+	// Read the provenance up front, as Migrate holds a write transaction.
+	provenance := make(map[string]Provenance)
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(provenanceBucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var prov Provenance
+			if gob.NewDecoder(bytes.NewReader(v)).Decode(&prov) == nil {
+				provenance[string(k)] = prov
+			}
+			return nil
+		})
+	})
+	_, err := flaclink.NewStore(db).Migrate(func(record *flaclink.AlbumRecord) {
+		if prov, ok := provenance[record.DirName]; ok {
+			record.Source = prov.Source
+			record.Time = prov.Time
+			record.LinkMode = prov.LinkMode
+		}
+	})
+	return err
+}
+
+// Migration 2: rewrite the keys of albums whose file names were stored in
+// NFD, as read from sources copied from macOS, in NFC, which is how albums
+// are read now. Target dir names are left alone, since that's where the
+// albums are.
+func migrateNormalizedContents(db *bolt.DB) error {
+	normalized, err := flaclink.NewStore(db).NormalizeKeys()
+	if normalized > 0 {
+		log.Printf("Normalized the contents of %d albums.", normalized)
+	}
+	return err
+}
+
+// Migration 3: normalize the keys of the albums in every profile's catalog as
+// migration 2 did for the main one. Every namespaced catalog in the database
+// is done, not just those of profiles in the config, so a profile that's
+// added back later still finds its albums. A SQLite catalog normalizes its
+// contents whenever it's opened, and can't be used with profiles.
+func migrateNormalizedProfileContents(db *bolt.DB) error {
+	total := 0
+	for _, namespace := range profileNamespaces(db) {
+		normalized, err := flaclink.NewNamespacedStore(db, namespace).NormalizeKeys()
+		total += normalized
+		if err != nil {
+			return fmt.Errorf("%s: %v", namespace, err)
+		}
+	}
+	if total > 0 {
+		log.Printf("Normalized the contents of %d albums in profile catalogs.", total)
+	}
+	return nil
+}
+
+// Upgrade the album database to the current schema now, rather than when it
+// is next opened for writing.
+func runDbMigrate() {
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+	log.Printf("%s is at schema version %d.", AlbumDbPath, schemaVersion(db))
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A hardlink is only as good as the disk under it, and a library can sit
+// untouched for years while bits rot or something rewrites files behind
+// flaclink's back. So when an album is linked, the SHA-256 of each of its
+// files in the target is recorded, and "flaclink scrub" reads the files
+// again, a budget of time at a time and least recently scrubbed first, and
+// reports those that no longer match. A file whose modification time has
+// moved on since it was recorded was changed by something, such as a
+// tagger; one whose time hasn't was changed by nothing, which is bit rot.
+// Albums linked before checksums were recorded get theirs at their first
+// scrub. The daemon can scrub after each cycle; see ScrubConfig.
+
+// Bucket of the checksums of each album's files in the target, keyed by
+// target dir name.
+var checksumsBucketName = []byte("checksums")
+
+// Scrubbing the target after each daemon cycle.
+type ScrubConfig struct {
+	// Seconds the daemon spends scrubbing after each cycle. Off if zero.
+	Seconds int `json:"seconds"`
+	// Bytes per second read while scrubbing, on top of any throttle.
+	// Unlimited if zero.
+	IOLimit int64 `json:"io_limit"`
+}
+
+func (sc *ScrubConfig) validate() error {
+	if sc.Seconds < 0 {
+		return fmt.Errorf("seconds can't be negative")
+	}
+	if sc.IOLimit < 0 {
+		return fmt.Errorf("io_limit can't be negative")
+	}
+	return nil
+}
+
+// The checksums of an album's files in the target, and what the latest
+// scrub of them found. Paths are relative to Target.
+type AlbumChecksums struct {
+	Target string
+	Time   time.Time
+	Files  map[string][sha256.Size]byte
+	// When the album was last scrubbed, and the files that scrub found
+	// gone, changed by something since Time, or changed by nothing.
+	Scrubbed time.Time
+	Missing  []string
+	Modified []string
+	Corrupt  []string
+}
+
+func (c AlbumChecksums) problems() int {
+	return len(c.Missing) + len(c.Modified) + len(c.Corrupt)
+}
+
+// Paces scrub reads to scrub's own io_limit.
+var scrubLimiter rateLimiter
+
+// A reader of file contents that keeps to a scrub rate as well as the I/O
+// limit.
+type scrubReader struct {
+	r    io.Reader
+	rate int64
+}
+
+func (s scrubReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	scrubLimiter.wait(int64(n), s.rate)
+	throttleIO(n)
+	return n, err
+}
+
+// SHA-256 of the contents of the file at path, read at no more than rate
+// bytes per second if it isn't zero.
+func scrubHash(path string, rate int64) (sum [sha256.Size]byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, scrubReader{f, rate}); err != nil {
+		return sum, fmt.Errorf("%s: %v", path, err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// Checksum every file of the album at target, stopping once ctx is
+// cancelled.
+func takeChecksums(ctx context.Context, target string, rate int64) (AlbumChecksums, error) {
+	sums := AlbumChecksums{Target: target, Time: time.Now(), Files: make(map[string][sha256.Size]byte)}
+	err := filepath.WalkDir(target, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Symlinks are files in the target under link_mode symlink.
+		if entry.IsDir() || !entry.Type().IsRegular() && entry.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		sum, err := scrubHash(path, rate)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(target, path)
+		sums.Files[rel] = sum
+		return nil
+	})
+	return sums, err
+}
+
+// Record the checksums of a newly linked album's files in the target.
+func saveChecksums(ctx context.Context, album Album, targetDir string, db *bolt.DB) error {
+	target, _ := filepath.Abs(albumTargetPath(album, targetDir))
+	sums, err := takeChecksums(ctx, target, 0)
+	if err != nil {
+		return err
+	}
+	return putChecksums(album.DirName, sums, db)
+}
+
+func putChecksums(dirName string, sums AlbumChecksums, db *bolt.DB) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sums); err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(checksumsBucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(dirName), buf.Bytes())
+	})
+}
+
+func decodeChecksums(v []byte) (sums AlbumChecksums, ok bool) {
+	if v == nil {
+		return sums, false
+	}
+	return sums, gob.NewDecoder(bytes.NewReader(v)).Decode(&sums) == nil
+}
+
+// Scrub albums for up to budget, least recently scrubbed first, and print
+// what's wrong with the files of every album whose last scrub found
+// problems. Exits with status 1 if this scrub found any.
+func runScrub(args []string) {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	budget := flags.Duration("budget", time.Minute, "stop scrubbing after this long")
+	rate := flags.Int64("rate", 0, "read at most this many bytes per second; defaults to io_limit under scrub in the config file")
+	accept := flags.Bool("accept", false, "record new checksums for albums whose files changed, rather than report them")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Println("Usage: flaclink scrub [-budget duration] [-rate bytes] [-accept]")
+		os.Exit(2)
+	}
+	if *rate == 0 && settings.Scrub != nil {
+		*rate = settings.Scrub.IOLimit
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	scrubbed, bad := scrubAlbums(ctx, db, *budget, *rate, *accept)
+	log.Printf("Scrubbed %d albums, %d with problems.", scrubbed, bad)
+	printScrubReport(db)
+	if bad > 0 && !*accept {
+		os.Exit(1)
+	}
+}
+
+// Scrub the albums in the target, least recently scrubbed first, until
+// budget runs out or ctx is cancelled, taking the checksums of those that
+// have none. With accept, albums whose files changed get new checksums.
+// Returns the number of albums scrubbed, and of those with problems.
+func scrubAlbums(ctx context.Context, db *bolt.DB, budget time.Duration, rate int64, accept bool) (scrubbed, bad int) {
+	deadline := time.Now().Add(budget)
+	type candidate struct {
+		dirName string
+		sums    AlbumChecksums
+		ok      bool
+	}
+	// Albums linked by flaclink, which have a target recorded.
+	targets := make(map[string]string)
+	for _, store := range catalogStores(db) {
+		var albums []Album
+		store.ForEach(func(contents []string, dirName string) error {
+			albums = append(albums, Album{DirName: dirName, Contents: contents})
+			return nil
+		})
+		for _, album := range albums {
+			if record, ok := store.Record(album); ok && record.Target != "" {
+				targets[album.DirName] = record.Target
+			}
+		}
+	}
+	var candidates []candidate
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(checksumsBucketName)
+		for dirName, target := range targets {
+			c := candidate{dirName: dirName, sums: AlbumChecksums{Target: target}}
+			if bucket != nil {
+				if sums, ok := decodeChecksums(bucket.Get([]byte(dirName))); ok {
+					c.sums, c.ok = sums, true
+				}
+			}
+			candidates = append(candidates, c)
+		}
+		return nil
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].sums.Scrubbed.Equal(candidates[j].sums.Scrubbed) {
+			return candidates[i].sums.Scrubbed.Before(candidates[j].sums.Scrubbed)
+		}
+		return candidates[i].dirName < candidates[j].dirName
+	})
+
+	for _, c := range candidates {
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			break
+		}
+		if _, err := os.Stat(c.sums.Target); err != nil {
+			// Gone from the target; verify reports that.
+			continue
+		}
+		sums := c.sums
+		var err error
+		if c.ok {
+			err = scrubAlbum(ctx, &sums, rate)
+		} else {
+			log.Printf("Taking checksums of %s.", c.dirName)
+			sums, err = takeChecksums(ctx, c.sums.Target, rate)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			log.Printf("scrub: %s: %v", c.dirName, err)
+			continue
+		}
+		if sums.problems() > 0 {
+			bad++
+			printScrubProblems(c.dirName, sums)
+			if accept {
+				log.Printf("Taking new checksums of %s.", c.dirName)
+				if sums, err = takeChecksums(ctx, c.sums.Target, rate); err != nil {
+					log.Printf("scrub: %s: %v", c.dirName, err)
+					continue
+				}
+			}
+		}
+		sums.Scrubbed = time.Now()
+		if err := putChecksums(c.dirName, sums, db); err != nil {
+			log.Printf("scrub: %v", err)
+			return scrubbed, bad
+		}
+		scrubbed++
+	}
+	return scrubbed, bad
+}
+
+// Read every file of the album sums is for again, and note in sums those
+// that are gone or no longer match.
+func scrubAlbum(ctx context.Context, sums *AlbumChecksums, rate int64) error {
+	sums.Missing, sums.Modified, sums.Corrupt = nil, nil, nil
+	paths := make([]string, 0, len(sums.Files))
+	for rel := range sums.Files {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	for _, rel := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(sums.Target, rel)
+		info, err := os.Stat(path)
+		if err != nil {
+			sums.Missing = append(sums.Missing, rel)
+			continue
+		}
+		sum, err := scrubHash(path, rate)
+		switch {
+		case err != nil:
+			// Unreadable, which is what bad sectors usually look like.
+			log.Printf("scrub: %v", err)
+			sums.Corrupt = append(sums.Corrupt, rel)
+		case sum == sums.Files[rel]:
+		case info.ModTime().After(sums.Time):
+			sums.Modified = append(sums.Modified, rel)
+		default:
+			sums.Corrupt = append(sums.Corrupt, rel)
+		}
+	}
+	return nil
+}
+
+func printScrubProblems(dirName string, sums AlbumChecksums) {
+	for _, rel := range sums.Missing {
+		fmt.Printf("missing    %s\n", filepath.Join(dirName, rel))
+	}
+	for _, rel := range sums.Modified {
+		fmt.Printf("modified   %s\n", filepath.Join(dirName, rel))
+	}
+	for _, rel := range sums.Corrupt {
+		fmt.Printf("corrupt    %s\n", filepath.Join(dirName, rel))
+	}
+}
+
+// Print how many albums have checksums, how many of them have been
+// scrubbed, and the albums whose last scrub found problems, with their age.
+func printScrubReport(db *bolt.DB) {
+	var albums, scrubbed int
+	var lines []string
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(checksumsBucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			sums, ok := decodeChecksums(v)
+			if !ok {
+				return nil
+			}
+			albums++
+			if sums.Scrubbed.IsZero() {
+				return nil
+			}
+			scrubbed++
+			if sums.problems() > 0 {
+				lines = append(lines, fmt.Sprintf("  %s (scrubbed %s ago): %d missing, %d modified, %d corrupt", k, time.Since(sums.Scrubbed).Round(time.Second), len(sums.Missing), len(sums.Modified), len(sums.Corrupt)))
+			}
+			return nil
+		})
+	})
+	fmt.Printf("Albums with checksums: %d, of which scrubbed: %d\n", albums, scrubbed)
+	fmt.Printf("Problems at last scrub: %d albums\n", len(lines))
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const slotPollInterval = 250 * time.Millisecond
+
+// Block until one of n job slots is free, then hold it. Slots are lock files in
+// the app data directory, so the limit applies to every flaclink process run
+// by this user. The instance lock already lets only one process link into
+// each library, so slots limit linking across libraries. They're always taken
+// after the instance lock, never before, so that no process waits for the
+// lock while holding a slot. The slot is released when the returned file is
+// closed or the process exits.
+func acquireSlot(n int) *os.File {
+	if n < 1 {
+		n = 1
+	}
+	slotDir := filepath.Join(AppDataPath, "slots")
+	if err := os.MkdirAll(slotDir, 0755); err != nil {
+		fatalf("acquireSlot:%v", err)
+	}
+
+	waiting := false
+	for {
+		for i := 0; i < n; i++ {
+			slotPath := filepath.Join(slotDir, fmt.Sprintf("slot%d.lock", i))
+			f, err := os.OpenFile(slotPath, os.O_CREATE|os.O_RDWR, 0644)
+			if err != nil {
+				fatalf("acquireSlot:%v", err)
+			}
+			if err := lockFile(f, false); err == nil {
+				return f
+			}
+			f.Close()
+		}
+		if !waiting {
+			log.Printf("All %d job slots are busy, waiting for a free slot.", n)
+			waiting = true
+		}
+		time.Sleep(slotPollInterval)
+	}
+}
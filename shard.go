@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// A slice of the directories in a source or target dir, selected with
+// -shard k/n so that n machines or processes can each scan and link a
+// disjoint part of a huge library. The zero value selects everything.
+type shard struct {
+	k, n int
+}
+
+// The shard selected for this run.
+var activeShard shard
+
+func (s *shard) String() string {
+	if s.n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", s.k, s.n)
+}
+
+// Parse "k/n", as the value of the -shard flag.
+func (s *shard) Set(value string) error {
+	var k, n int
+	if _, err := fmt.Sscanf(value, "%d/%d", &k, &n); err != nil || n < 1 || k < 1 || k > n {
+		return fmt.Errorf("want k/n with 1 <= k <= n, got %q", value)
+	}
+	s.k, s.n = k, n
+	return nil
+}
+
+// Reports whether the directory with this name, relative to the source or
+// target dir, belongs to the shard. Names are assigned to shards by hash, so
+// every machine agrees on the split without coordinating.
+func (s shard) includes(name string) bool {
+	if s.n <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%uint32(s.n)) == s.k-1
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket holding the result of the latest source check of each album, keyed
+// by target dir name.
+var sourceChecksBucketName = []byte("sourcechecks")
+
+// Result of checking that an album's source files are still where they were
+// linked from, with the sizes they had then. Files, Missing and Changed
+// count files.
+type SourceCheck struct {
+	Time    time.Time
+	Source  string
+	Files   int
+	Missing int
+	Changed int
+}
+
+// Summary of a check: "intact", "gone" if no source files are left, or
+// "changed".
+func (c SourceCheck) state() string {
+	switch {
+	case c.Missing == 0 && c.Changed == 0:
+		return "intact"
+	case c.Missing == c.Files:
+		return "gone"
+	default:
+		return "changed"
+	}
+}
+
+// Check album sources for up to budget, starting with those checked least
+// recently, and print a report of every album's last check. Run it
+// regularly, e.g. from cron, to keep "safe to delete" decisions based on
+// recent checks without walking the whole source dir at once.
+func runCheckSource(args []string) {
+	flags := flag.NewFlagSet("check-source", flag.ExitOnError)
+	budget := flags.Duration("budget", time.Minute, "stop checking after this long")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Println("Usage: flaclink check-source [-budget duration]")
+		os.Exit(2)
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+
+	checked := checkSources(db, *budget)
+	log.Printf("Checked the sources of %d albums.", checked)
+	printSourceReport(db)
+}
+
+// Check the sources of albums with a recorded source path, least recently
+// checked first, until budget runs out. Returns the number checked.
+func checkSources(db *bolt.DB, budget time.Duration) int {
+	deadline := time.Now().Add(budget)
+	type candidate struct {
+		dirName string
+		source  string
+		last    time.Time
+	}
+	var candidates []candidate
+	db.View(func(tx *bolt.Tx) error {
+		provenance := tx.Bucket(provenanceBucketName)
+		if provenance == nil {
+			return nil
+		}
+		checks := tx.Bucket(sourceChecksBucketName)
+		return provenance.ForEach(func(k, v []byte) error {
+			var prov Provenance
+			if gob.NewDecoder(bytes.NewReader(v)).Decode(&prov) != nil || prov.Source == "" {
+				return nil
+			}
+			c := candidate{dirName: string(k), source: prov.Source}
+			if checks != nil {
+				if last, ok := decodeSourceCheck(checks.Get(k)); ok {
+					c.last = last.Time
+				}
+			}
+			candidates = append(candidates, c)
+			return nil
+		})
+	})
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].last.Before(candidates[j].last) })
+
+	checked := 0
+	for _, c := range candidates {
+		if time.Now().After(deadline) {
+			break
+		}
+		decisions, ok := loadDecisions(c.dirName, db)
+		if !ok {
+			continue
+		}
+		result := checkSource(c.source, decisions)
+		if err := saveSourceCheck(c.dirName, result, db); err != nil {
+			log.Printf("check-source: %v", err)
+			return checked
+		}
+		checked++
+	}
+	return checked
+}
+
+// Compare an album's source files with the decisions recorded when it was
+// linked.
+func checkSource(source string, decisions []FileDecision) SourceCheck {
+	result := SourceCheck{Time: time.Now(), Source: source, Files: len(decisions)}
+	for _, d := range decisions {
+		info, err := os.Stat(filepath.Join(source, d.Path))
+		switch {
+		case err != nil:
+			result.Missing++
+		case info.Size() != d.Size:
+			result.Changed++
+		}
+	}
+	return result
+}
+
+func saveSourceCheck(dirName string, check SourceCheck, db *bolt.DB) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(check); err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(sourceChecksBucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(dirName), buf.Bytes())
+	})
+}
+
+func decodeSourceCheck(v []byte) (check SourceCheck, ok bool) {
+	if v == nil {
+		return check, false
+	}
+	return check, gob.NewDecoder(bytes.NewReader(v)).Decode(&check) == nil
+}
+
+// Print each album's latest source check, grouped by state, with its age.
+// "gone" albums only exist in the target, so their sources are no longer
+// being seeded; "intact" albums' sources can be deleted without losing the
+// music, since the target holds hardlinks to the same data.
+func printSourceReport(db *bolt.DB) {
+	groups := make(map[string][]string)
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sourceChecksBucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			check, ok := decodeSourceCheck(v)
+			if !ok {
+				return nil
+			}
+			line := fmt.Sprintf("  %s (checked %s ago)", k, time.Since(check.Time).Round(time.Second))
+			if state := check.state(); state == "changed" {
+				line += fmt.Sprintf(": %d of %d files missing, %d changed", check.Missing, check.Files, check.Changed)
+			}
+			groups[check.state()] = append(groups[check.state()], line)
+			return nil
+		})
+	})
+	for _, state := range []string{"intact", "changed", "gone"} {
+		fmt.Printf("Source %s: %d albums\n", state, len(groups[state]))
+		for _, line := range groups[state] {
+			fmt.Println(line)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Source dirs given with -source, on top of any given as arguments.
+var sourceFlags sourceDirList
+
+// A list of source dirs, for a repeatable flag.
+type sourceDirList []string
+
+func (l *sourceDirList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *sourceDirList) Set(value string) error {
+	*l = append(*l, filepath.Clean(value))
+	return nil
+}
+
+// The source dirs in the config file: source_dir, then source_dirs, without
+// repeats.
+func (cfg Config) sourceDirs() []string {
+	return uniqueDirs(append([]string{cfg.SourceDir}, cfg.SourceDirs...))
+}
+
+// dirs, cleaned, without empty entries or repeats.
+func uniqueDirs(dirs []string) (unique []string) {
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			unique = append(unique, dir)
+		}
+	}
+	return unique
+}
+
+// How many albums the scan of a run may find before they're linked.
+const scanAheadAlbums = 1000
+
+// Link new albums from each of sourceDirs into targetDir, one after another,
+// as a single run. An album in more than one source is linked from the first.
+// Albums are linked as the scan finds them, while it goes on in the
+// background up to scanAheadAlbums albums ahead, so a big source starts
+// linking straight away and a run holds only a window of albums in memory.
+// The scan starts at once, but albums are only counted and linked once
+// targetUpdated is closed, when the DB knows the albums already in the
+// target.
+func linkNewAlbumsFrom(ctx context.Context, sourceDirs []string, targetDir string, db *bolt.DB, targetUpdated <-chan struct{}) (linked []Album) {
+	progress := startProgress(db)
+	defer progress.stop()
+	scanned := make(chan Album, scanAheadAlbums)
+	go func() {
+		defer close(scanned)
+		cache := loadScanCache(db)
+		for _, sourceDir := range sourceDirs {
+			if ctx.Err() != nil {
+				break
+			}
+			scanSourceDir(ctx, sourceDir, cache, func(album Album) {
+				select {
+				case scanned <- album:
+				case <-ctx.Done():
+				}
+			})
+		}
+		cache.save(db)
+	}()
+	found := make(chan Album, scanAheadAlbums)
+	go func() {
+		defer close(found)
+		<-targetUpdated
+		for album := range scanned {
+			progress.add(album)
+			select {
+			case found <- album:
+			case <-ctx.Done():
+			}
+		}
+		progress.scanned()
+	}()
+	// Returns once found is closed, so the scan is over before the caller
+	// changes settings for the next profile.
+	return linkNewAlbums(ctx, found, targetDir, db, progress)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Checking there's room on the target before linking. Hardlinks and symlinks
+// take next to no space, but splitting CUE images writes every track out
+// again, and a full disk fails the run partway through, or starves whatever
+// else shares the filesystem. Albums are only linked if the target's
+// filesystem has room for them above min_free_space, and a run doesn't link
+// anything once it's below that.
+
+// Space taken in the target by an album besides the data flaclink writes,
+// such as its directories, and cover art it extracts.
+const albumSpaceOverhead = 1 << 20
+
+// Bytes the album is expected to take on the target's filesystem.
+func albumSpaceNeeded(album Album) int64 {
+	need := int64(albumSpaceOverhead)
+	if settings.SplitCueImages {
+		for _, image := range albumCueImages(album) {
+			if info, err := os.Stat(image.ImagePath); err == nil {
+				need += info.Size()
+			}
+		}
+	}
+	return need
+}
+
+// Reports whether targetDir has more free space than min_free_space, logging
+// why not and recording it as an error if it doesn't. If the free space
+// can't be read, it's assumed there's room.
+func targetHasFreeSpace(targetDir string) bool {
+	free, err := freeSpace(targetDir)
+	if err != nil || free > settings.MinFreeSpace {
+		return true
+	}
+	reason := fmt.Sprintf("only %s is free, not more than min_free_space of %s", formatSize(free), formatSize(settings.MinFreeSpace))
+	log.Printf("Not linking anything into %s: %s.", targetDir, reason)
+	countError("", fmt.Errorf("no room in %s: %s", targetDir, reason))
+	return false
+}
+
+// Reports whether album fits in targetDir, leaving min_free_space free. If
+// it doesn't, it's skipped, to be linked by a later run once there's room.
+func albumFits(album Album, targetDir string) bool {
+	free, err := freeSpace(targetDir)
+	if err != nil {
+		return true
+	}
+	need := albumSpaceNeeded(album)
+	if free-need >= settings.MinFreeSpace {
+		return true
+	}
+	reason := fmt.Sprintf("it needs about %s, and %s is free of which min_free_space keeps %s", formatSize(need), formatSize(free), formatSize(settings.MinFreeSpace))
+	log.Printf("Not linking album %s, as there isn't room for it: %s.", album.DirName, reason)
+	metrics.albumsSkipped.Add(1)
+	recordRunWarning(album.DirName, "no room: "+reason)
+	emitEvent(Event{Event: "skipped", Album: album.DirName, Source: album.Path, Reason: "no room: " + reason})
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Name of the database/sql driver used for sqlite_path. It's registered by
+// sqlite_driver.go, which is only built with "-tags sqlite" since it needs
+// cgo.
+const sqliteDriver = "sqlite3"
+
+var (
+	sqliteOnce  sync.Once
+	sqliteStore *flaclink.SQLiteStore
+
+	// Stops ForEach at the first album.
+	errNotEmpty = errors.New("store isn't empty")
+)
+
+// The album catalog: the albums, files and containers buckets of db, or the
+// SQLite database at sqlite_path if it's set. Run history, provenance and
+// source checks stay in db either way. See albumStore for the cached
+// catalog that most code uses.
+func backingStore(db *bolt.DB) flaclink.Store {
+	return backingStoreFor(db, settings)
+}
+
+// Like backingStore, but under cfg rather than the current settings.
+func backingStoreFor(db *bolt.DB, cfg Config) flaclink.Store {
+	if cfg.profile != "" {
+		return flaclink.NewNamespacedStore(db, profileNamespace(cfg.profile))
+	}
+	if cfg.SQLitePath == "" {
+		return flaclink.NewStore(db)
+	}
+	sqliteOnce.Do(func() { sqliteStore = openSQLiteStore(cfg.SQLitePath, db) })
+	return sqliteStore
+}
+
+// Open the SQLite catalog at path, creating it if needed. A new catalog is
+// filled from the bolt database db, so switching backends doesn't forget
+// which albums were linked.
+func openSQLiteStore(path string, db *bolt.DB) *flaclink.SQLiteStore {
+	if !sqliteBuiltIn() {
+		fatalf("sqlite_path is set, but this flaclink was built without SQLite support; rebuild it with -tags sqlite")
+	}
+	sqlDB, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		fatalf("sqlite: %v", err)
+	}
+	// SQLite allows one writer at a time.
+	sqlDB.SetMaxOpenConns(1)
+	store := flaclink.NewSQLiteStore(sqlDB)
+	if err := store.Init(); err != nil {
+		fatalf("sqlite: %s: %v", path, err)
+	}
+
+	empty := store.ForEach(func(contents []string, dirName string) error { return errNotEmpty }) == nil
+	if empty {
+		copied, err := flaclink.CopyStore(store, flaclink.NewStore(db))
+		if err != nil {
+			fatalf("sqlite: copying albums from %s: %v", AlbumDbPath, err)
+		}
+		if copied > 0 {
+			log.Printf("Copied %d albums from %s to %s.", copied, AlbumDbPath, path)
+		}
+	}
+	return store
+}
+
+func sqliteBuiltIn() bool {
+	for _, driver := range sql.Drivers() {
+		if driver == sqliteDriver {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Suffixes of files that torrent and download clients write to while a
+// download is in progress. Albums containing one are never linked.
+var partialFileSuffixes = []string{".part", ".!qB", ".!ut", ".incomplete"}
+
+// How often -wait-stable checks an album that isn't stable yet.
+const stablePollInterval = 5 * time.Second
+
+// Set by -wait-stable: how long to wait for an album to become stable before
+// giving up on it, for imports run from a client's completion hook while
+// files are still being moved. Zero skips unstable albums at once.
+var stableWait time.Duration
+
+func registerWaitStableFlag(flags *flag.FlagSet) {
+	flags.DurationVar(&stableWait, "wait-stable", 0, "wait up to this long for an album that is still being written")
+}
+
+// The time an album's files must have been left alone before it's linked.
+func stableWindow() time.Duration {
+	return time.Duration(settings.StableSeconds) * time.Second
+}
+
+// Why album isn't ready to link, or "" if it is: it contains a partly
+// downloaded file, or a file or folder in it changed within the last
+// stable_seconds. Modification times are used, since clients that
+// preallocate files change their contents without changing their sizes,
+// and adding or removing a file changes the time of its folder.
+func unstableReason(album Album) string {
+	window := stableWindow()
+	var partial string
+	var newest time.Time
+	filepath.Walk(album.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || partial != "" {
+			return nil
+		}
+		for _, suffix := range partialFileSuffixes {
+			if !info.IsDir() && strings.HasSuffix(info.Name(), suffix) {
+				partial, _ = filepath.Rel(album.Path, path)
+			}
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	if partial != "" {
+		return fmt.Sprintf("%s is still downloading", partial)
+	}
+	if age := time.Since(newest); window > 0 && age < window {
+		return fmt.Sprintf("it changed %s ago, less than stable_seconds", age.Round(time.Second))
+	}
+	return ""
+}
+
+// Reports whether album is ready to link, waiting up to -wait-stable for it to
+// become so. Unstable albums are reported as skipped, and found again by
+// the next run.
+func albumStable(ctx context.Context, album Album) bool {
+	deadline := time.Now().Add(stableWait)
+	for {
+		reason := unstableReason(album)
+		if reason == "" {
+			return true
+		}
+		if time.Now().Add(stablePollInterval).After(deadline) {
+			log.Printf("Album %s isn't complete yet, skipping: %s.", album.DirName, reason)
+			emitEvent(Event{Event: "skipped", Album: album.DirName, Source: album.Path, Reason: "not stable: " + reason})
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(stablePollInterval):
+		}
+	}
+}
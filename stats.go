@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Number of newest and oldest albums stats lists.
+const statsAlbumsListed = 5
+
+// Print a summary of the library from the DB: how many albums and tracks are
+// linked and their size, how they break down by format and bit depth, the
+// newest and oldest albums linked, and the size of the DB itself. Albums
+// found already in the target have no details, so they're only counted.
+func runStats(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Println("Usage: flaclink stats")
+		os.Exit(2)
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+
+	all, err := catalogRecords(db)
+	if err != nil {
+		fatalf("stats: %v", err)
+	}
+	var records []flaclink.AlbumRecord
+	var untracked int
+	for _, record := range all {
+		if record.Time.IsZero() {
+			untracked++
+			continue
+		}
+		records = append(records, record)
+	}
+
+	var tracks int
+	var bytes int64
+	formats := make(map[string]int)
+	depths := make(map[string]int)
+	for _, record := range records {
+		tracks += len(albumTracks(record))
+		bytes += record.Bytes
+		format := record.Format
+		if format == "" {
+			format = "unknown"
+		}
+		formats[format]++
+		depth := "unknown"
+		if record.BitsPerSample > 0 {
+			depth = fmt.Sprintf("%d-bit", record.BitsPerSample)
+		}
+		depths[depth]++
+	}
+
+	fmt.Printf("Albums:  %d linked, %d found already in the target\n", len(records), untracked)
+	fmt.Printf("Tracks:  %d\n", tracks)
+	fmt.Printf("Size:    %s\n", formatSize(bytes))
+	printBreakdown("Formats", formats)
+	printBreakdown("Bit depths", depths)
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.After(records[j].Time) })
+	n := len(records)
+	if n > statsAlbumsListed {
+		n = statsAlbumsListed
+	}
+	if n > 0 {
+		fmt.Println("Newest:")
+		for _, record := range records[:n] {
+			fmt.Printf("    %s  %s\n", record.Time.Format("2006-01-02 15:04"), record.DirName)
+		}
+		fmt.Println("Oldest:")
+		for i := len(records) - 1; i >= len(records)-n; i-- {
+			fmt.Printf("    %s  %s\n", records[i].Time.Format("2006-01-02 15:04"), records[i].DirName)
+		}
+	}
+
+	dbFiles := []string{db.Path()}
+	if settings.SQLitePath != "" {
+		dbFiles = append(dbFiles, settings.SQLitePath)
+	}
+	for _, path := range dbFiles {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Printf("DB:      %s (%s)\n", formatSize(info.Size()), path)
+		}
+	}
+}
+
+// The tracks the album has in the target, relative to it: its linked FLAC
+// files, with any disc images that were split replaced by their tracks.
+func albumTracks(record flaclink.AlbumRecord) []string {
+	split := make(map[string]bool)
+	if len(record.SplitTracks) > 0 {
+		for _, image := range record.Images {
+			split[image] = true
+		}
+	}
+	var tracks []string
+	for _, file := range record.Files {
+		if file.Linked && strings.EqualFold(filepath.Ext(file.Path), ".flac") && !split[file.Path] {
+			tracks = append(tracks, file.TargetPath())
+		}
+	}
+	return append(tracks, record.SplitTracks...)
+}
+
+// Print the albums counted under each name, most first.
+func printBreakdown(title string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	fmt.Printf("%s:\n", title)
+	for _, name := range names {
+		fmt.Printf("    %-14s %d\n", name, counts[name])
+	}
+}
+
+// n bytes in the largest binary unit that keeps it at least 1, e.g. 1.5 GiB.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Report the work waiting in sourceDir: how many albums it holds, how many
+// albums the DB knows, and which albums the next run would link, under the
+// names they'd get. Nothing is linked or written to the DB. Albums already
+// in the target count as linked, as the next run would find them there.
+func runStatus(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: flaclink status [<source dir> <target dir>]")
+		os.Exit(2)
+	}
+	sourceDir := filepath.Clean(args[0])
+	targetDir := filepath.Clean(args[1])
+
+	sources, err := albumScanner().Scan(sourceDir)
+	if err != nil {
+		fatalf("status: %v", err)
+	}
+	inTarget := make(map[string]bool)
+	for _, relPath := range targetAlbumDirs(targetDir, "", templateDepth()) {
+		if targetPath := filepath.Join(targetDir, relPath); albumScanner().IsAlbum(targetPath) {
+			inTarget[strings.Join(flaclink.NewAlbum(targetPath).Contents, "\x00")] = true
+		}
+	}
+
+	// Open read-only so a running daemon or scan only makes us wait briefly.
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+	known := 0
+	albumStore(db).ForEach(func(contents []string, dirName string) error {
+		known++
+		return nil
+	})
+	queue, _ := reviewQueue(db)
+	queued := make(map[string]bool)
+	for _, q := range queue {
+		queued[q.Album.Path] = true
+	}
+
+	var pending []Album
+	var rejected, awaiting int
+	for _, album := range sources {
+		if inDb(album, db) || inTarget[strings.Join(album.Contents, "\x00")] {
+			continue
+		}
+		if isRejected(album, db) {
+			rejected++
+			continue
+		}
+		if path, _ := filepath.Abs(album.Path); queued[path] {
+			awaiting++
+			continue
+		}
+		pending = append(pending, album)
+	}
+
+	fmt.Printf("Albums in source: %d\n", len(sources))
+	fmt.Printf("Albums in DB: %d\n", known)
+	if settings.Review {
+		fmt.Printf("Awaiting review: %d\n", awaiting)
+	}
+	if rejected > 0 {
+		fmt.Printf("Rejected in review: %d\n", rejected)
+	}
+	verb := "link"
+	if settings.Review {
+		verb = "queue for review"
+	}
+	fmt.Printf("Pending: %d\n", len(pending))
+	if len(pending) > 0 {
+		fmt.Printf("\nThe next run would %s:\n", verb)
+	}
+	for _, album := range pending {
+		named := album
+		applyTemplate(&named)
+		if settings.TargetTemplate != "" {
+			reconcileDirName(&named, targetDir)
+		}
+		fmt.Printf("  %s -> %s\n", album.Path, albumTargetPath(named, targetDir))
+	}
+}
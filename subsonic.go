@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Settings for starting a library scan on a Subsonic-compatible server such
+// as Navidrome after a run, under "subsonic" in the config file.
+type SubsonicConfig struct {
+	URL      string `json:"url"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+var subsonicClient = &http.Client{Timeout: 30 * time.Second}
+
+// Ask the Subsonic server to start a library scan. Does nothing unless
+// Subsonic is configured. Failures are logged, since the albums are linked
+// either way.
+func startSubsonicScan() {
+	ss := settings.Subsonic
+	if ss == nil || ss.URL == "" {
+		return
+	}
+	if err := ss.call("startScan"); err != nil {
+		countError("", err)
+		log.Printf("Subsonic scan request failed: %v", err)
+		return
+	}
+	log.Printf("Asked %s to start a library scan.", ss.URL)
+}
+
+// Call a Subsonic API method with token authentication, so the password is
+// never sent in the clear.
+func (ss *SubsonicConfig) call(method string) error {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	saltHex := hex.EncodeToString(salt)
+	token := md5.Sum([]byte(ss.Password + saltHex))
+	query := url.Values{
+		"u": {ss.User},
+		"t": {hex.EncodeToString(token[:])},
+		"s": {saltHex},
+		"v": {"1.15.0"},
+		"c": {"flaclink"},
+		"f": {"json"},
+	}
+	resp, err := subsonicClient.Get(strings.TrimRight(ss.URL, "/") + "/rest/" + method + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+
+	// Errors are reported in the body with a 200 status.
+	var body struct {
+		Response struct {
+			Status string `json:"status"`
+			Error  struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"subsonic-response"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("%s: %v", method, err)
+	}
+	if body.Response.Status != "ok" {
+		return fmt.Errorf("%s: error %d: %s", method, body.Response.Error.Code, body.Response.Error.Message)
+	}
+	return nil
+}
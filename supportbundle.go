@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Config keys whose values are replaced in a support bundle.
+var secretConfigKeys = map[string]bool{"token": true, "password": true, "api_key": true, "secret": true}
+
+// Number of most recent runs put in a support bundle.
+const supportBundleRuns = 20
+
+// Write a tarball for attaching to a bug report: the config file with
+// secrets removed, recent runs, DB statistics, facts about the environment,
+// and the directory structure of the source and target dirs, with names
+// hashed. The source and target dirs default to those in the config file.
+func runSupportBundle(args []string) {
+	flags := flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	out := flags.String("o", "", "write the bundle to file (default flaclink-support-<time>.tar.gz)")
+	maxEntries := flags.Int("max-entries", 2000, "maximum number of files and dirs sampled from each dir")
+	flags.Parse(args)
+	if flags.NArg() > 2 {
+		fmt.Println("Usage: flaclink support-bundle [-o file] [-max-entries n] [source dir] [target dir]")
+		os.Exit(2)
+	}
+	dirs := map[string]string{"target": settings.TargetDir}
+	if sources := settings.sourceDirs(); len(sources) > 0 {
+		dirs["source"] = sources[0]
+	}
+	if flags.NArg() > 0 {
+		dirs["source"] = filepath.Clean(flags.Arg(0))
+	}
+	if flags.NArg() > 1 {
+		dirs["target"] = filepath.Clean(flags.Arg(1))
+	}
+	if *out == "" {
+		*out = "flaclink-support-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	}
+
+	files := map[string][]byte{
+		"environment.txt": environmentReport(dirs["source"], dirs["target"]),
+	}
+	if data, err := ioutil.ReadFile(ConfigPath); err == nil {
+		files["config.json"] = redactConfig(data)
+	}
+	if db, err := bolt.Open(AlbumDbPath, 0640, &bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true}); err == nil {
+		files["db.json"] = dbStats(db)
+		files["runs.json"] = recentRuns(db, supportBundleRuns)
+		db.Close()
+	} else {
+		files["db.json"] = []byte(fmt.Sprintf("{\"error\": %q}\n", err.Error()))
+	}
+	for name, dir := range dirs {
+		if dir != "" {
+			files[name+"-tree.txt"] = hashedTree(dir, *maxEntries)
+		}
+	}
+
+	if err := writeTarball(*out, files); err != nil {
+		fatalf("support-bundle: %v", err)
+	}
+	log.Printf("Wrote support bundle to %s.", *out)
+}
+
+// The JSON config file data with secrets replaced, and URLs cut down to
+// their scheme and host, since webhook URLs often embed a token. Data that
+// isn't valid JSON is left out.
+func redactConfig(data []byte) []byte {
+	var cfg interface{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return []byte(fmt.Sprintf("{\"error\": %q}\n", err.Error()))
+	}
+	redacted, _ := json.MarshalIndent(redactValue("", cfg), "", "  ")
+	return append(redacted, '\n')
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = redactValue(k, child)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactValue(key, child)
+		}
+		return v
+	case string:
+		if secretConfigKeys[key] && v != "" {
+			return "REDACTED"
+		}
+		if strings.HasSuffix(key, "url") {
+			if u, err := url.Parse(v); err == nil && u.Host != "" {
+				return u.Scheme + "://" + u.Host + "/REDACTED"
+			}
+		}
+	}
+	return value
+}
+
+// Facts about flaclink and the machine it runs on that bear on linking.
+func environmentReport(sourceDir, targetDir string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "flaclink %s (config %s)\n", flaclinkVersion(), configHash())
+	fmt.Fprintf(&buf, "go %s %s/%s, %d CPUs\n", runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	fmt.Fprintf(&buf, "uid %d, gid %d\n", os.Getuid(), os.Getgid())
+	fmt.Fprintf(&buf, "app data dir: %s\n", AppDataPath)
+	devices := make(map[string]uint64)
+	for _, name := range []string{"source", "target"} {
+		dir := map[string]string{"source": sourceDir, "target": targetDir}[name]
+		if dir == "" {
+			continue
+		}
+		device, description, err := describeFilesystem(dir)
+		if err != nil {
+			fmt.Fprintf(&buf, "%s dir: %v\n", name, err)
+			continue
+		}
+		devices[name] = device
+		fmt.Fprintf(&buf, "%s dir: %s\n", name, description)
+	}
+	if len(devices) == 2 {
+		fmt.Fprintf(&buf, "source and target on the same device: %v\n", devices["source"] == devices["target"])
+	}
+	return buf.Bytes()
+}
+
+// The number of entries in each bucket of db, and its schema version.
+func dbStats(db *bolt.DB) []byte {
+	stats := map[string]interface{}{"schema_version": schemaVersion(db)}
+	if info, err := os.Stat(db.Path()); err == nil {
+		stats["bytes"] = info.Size()
+	}
+	buckets := make(map[string]int)
+	db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			buckets[string(name)] = bucket.Stats().KeyN
+			return nil
+		})
+	})
+	stats["buckets"] = buckets
+	data, _ := json.MarshalIndent(stats, "", "  ")
+	return append(data, '\n')
+}
+
+// The last n runs recorded in db, newest first.
+func recentRuns(db *bolt.DB, n int) []byte {
+	var runs []Run
+	db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(runsBucketName)
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil && len(runs) < n; k, v = cursor.Prev() {
+			var run Run
+			if gob.NewDecoder(bytes.NewReader(v)).Decode(&run) == nil {
+				runs = append(runs, run)
+			}
+		}
+		return nil
+	})
+	data, _ := json.MarshalIndent(runs, "", "  ")
+	return append(data, '\n')
+}
+
+// The directory structure under dir, up to maxEntries files and dirs, one
+// per line, indented by depth. Names are replaced by a short hash, keeping
+// their extension; files show their size and link count.
+func hashedTree(dir string, maxEntries int) []byte {
+	var buf bytes.Buffer
+	entries := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		if entries >= maxEntries {
+			return filepath.SkipDir
+		}
+		entries++
+		relPath, _ := filepath.Rel(dir, path)
+		indent := strings.Repeat("  ", strings.Count(relPath, string(filepath.Separator)))
+		name := hashedName(info.Name())
+		if info.IsDir() {
+			fmt.Fprintf(&buf, "%s%s/\n", indent, name)
+			return nil
+		}
+		fmt.Fprintf(&buf, "%s%s %d bytes, %d links\n", indent, name, info.Size(), fileLinks(path, info))
+		return nil
+	})
+	if entries >= maxEntries {
+		fmt.Fprintf(&buf, "(stopped after %d entries)\n", maxEntries)
+	}
+	return buf.Bytes()
+}
+
+// name with everything but its extension replaced by a short hash. Hidden
+// names keep their leading dot, since flaclink treats them differently.
+func hashedName(name string) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	sum := sha256.Sum256([]byte(name))
+	hashed := hex.EncodeToString(sum[:4]) + ext
+	if strings.HasPrefix(name, ".") {
+		hashed = "." + hashed
+	}
+	return hashed
+}
+
+// Write files, keyed by name, to a gzipped tarball at path, under a
+// directory named after it.
+func writeTarball(path string, files map[string][]byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	root := strings.TrimSuffix(filepath.Base(path), ".tar.gz")
+	now := time.Now()
+	for name, data := range files {
+		header := &tar.Header{Name: root + "/" + name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
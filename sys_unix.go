@@ -0,0 +1,85 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Take an exclusive lock on f, waiting for it if wait is set, and otherwise
+// failing if another process holds it. It's released when f is closed.
+func lockFile(f *os.File, wait bool) error {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	return syscall.Flock(int(f.Fd()), how)
+}
+
+// Number of hardlinks to the file at path, whose info is given, or 1 if
+// that can't be told.
+func fileLinks(path string, info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
+
+func statFileID(path string, info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, true
+}
+
+// Bytes free for flaclink's use on the filesystem dir is on, less any
+// reserved for root.
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
+
+// The device dir is on, and a description of its filesystem and free space.
+func describeFilesystem(dir string) (device uint64, description string, err error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err != nil {
+		return 0, "", err
+	}
+	description = fmt.Sprintf("device %d", stat.Dev)
+	var fs syscall.Statfs_t
+	if syscall.Statfs(dir, &fs) == nil {
+		description += fmt.Sprintf(", filesystem type 0x%x, %d of %d bytes free", fs.Type, int64(fs.Bavail)*int64(fs.Bsize), int64(fs.Blocks)*int64(fs.Bsize))
+	}
+	return uint64(stat.Dev), description, nil
+}
+
+// Give dir the group of its parent, whose info is given, as a setgid
+// parent would.
+func inheritGroup(dir string, parent os.FileInfo) error {
+	if stat, ok := parent.Sys().(*syscall.Stat_t); ok {
+		return os.Lchown(dir, -1, int(stat.Gid))
+	}
+	return nil
+}
+
+// Names need no sanitizing unless sanitize_names says so.
+func defaultSanitizeNames() *SanitizeNamesConfig {
+	return nil
+}
+
+// Switch this process to run as uid and gid, with no other groups.
+func setIDs(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
@@ -0,0 +1,133 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32               = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx         = kernel32.NewProc("LockFileEx")
+	procGetDiskFreeSpaceEx = kernel32.NewProc("GetDiskFreeSpaceExW")
+)
+
+// Flags for LockFileEx.
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+)
+
+// The app data dir: flaclink in the roaming app data folder, usually
+// C:\Users\<name>\AppData\Roaming\flaclink.
+func defaultAppDataPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "flaclink"), nil
+}
+
+// The config file, config.json in the app data dir.
+func defaultConfigPath(appDataPath string) (string, error) {
+	return filepath.Join(appDataPath, "config.json"), nil
+}
+
+// Take an exclusive lock on f, waiting for it if wait is set, and otherwise
+// failing if another process holds it. It's released when f is closed.
+func lockFile(f *os.File, wait bool) error {
+	flags := uint32(lockfileExclusiveLock)
+	if !wait {
+		flags |= lockfileFailImmediately
+	}
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// Information Windows keeps about an open file, including its link count
+// and the ID that identifies it on its volume.
+func fileInformation(path string) (syscall.ByHandleFileInformation, error) {
+	var info syscall.ByHandleFileInformation
+	f, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+	err = syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &info)
+	return info, err
+}
+
+// Number of hardlinks to the file at path, or 1 if that can't be told.
+func fileLinks(path string, info os.FileInfo) uint64 {
+	fi, err := fileInformation(path)
+	if err != nil {
+		return 1
+	}
+	return uint64(fi.NumberOfLinks)
+}
+
+func statFileID(path string, info os.FileInfo) (fileID, bool) {
+	fi, err := fileInformation(path)
+	if err != nil {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(fi.VolumeSerialNumber), ino: uint64(fi.FileIndexHigh)<<32 | uint64(fi.FileIndexLow)}, true
+}
+
+// The volume dir is on, by serial number, and a description of its free
+// space.
+func describeFilesystem(dir string) (device uint64, description string, err error) {
+	fi, err := fileInformation(dir)
+	if err != nil {
+		return 0, "", err
+	}
+	description = fmt.Sprintf("volume %08x", fi.VolumeSerialNumber)
+	dirPtr, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, "", err
+	}
+	var free, total uint64
+	if r, _, _ := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(dirPtr)), uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), 0); r != 0 {
+		description += fmt.Sprintf(", %d of %d bytes free", free, total)
+	}
+	return uint64(fi.VolumeSerialNumber), description, nil
+}
+
+// Bytes free for flaclink's use on the volume dir is on, less any held back
+// by quotas.
+func freeSpace(dir string) (int64, error) {
+	dirPtr, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(dirPtr)), uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {
+		return 0, err
+	}
+	return int64(free), nil
+}
+
+// Windows directories have no group to inherit.
+func inheritGroup(dir string, parent os.FileInfo) error {
+	return nil
+}
+
+// Windows refuses names with some characters, so they're always replaced,
+// unless sanitize_names says otherwise.
+func defaultSanitizeNames() *SanitizeNamesConfig {
+	return &SanitizeNamesConfig{Replacement: "_"}
+}
+
+// Windows has no user and group IDs to switch to.
+func setIDs(uid, gid int) error {
+	return errors.New("not supported on Windows")
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+)
+
+// How directories flaclink creates in the target, and the files in them, get
+// their permissions and owner, for libraries shared with other users, e.g.
+// over Samba or with a media server in a container. By default directories
+// are created with mode 0775 less the umask, and files keep the mode and
+// owner of their source files.
+type TargetDirsConfig struct {
+	// An octal mode such as "2775", set after creating each directory so
+	// the umask doesn't apply, or "inherit" to copy the permission bits and
+	// group of the parent directory, like Samba's "inherit permissions".
+	Mode string `json:"mode"`
+	// ACL entries added to each new directory with "setfacl -m", e.g.
+	// "u:plex:rx,d:u:plex:rx". Directories already inherit their parent's
+	// default ACL; this is for targets without one.
+	ACL string `json:"acl"`
+	// Set the setgid bit on each new directory, on top of Mode, so files
+	// created in it later get its group.
+	Setgid bool `json:"setgid"`
+	// An octal mode such as "644" for the files of linked albums. Linked
+	// files are hardlinks, so this changes their source files' mode too.
+	FileMode string `json:"file_mode"`
+	// Owner of new directories and the files in them, as "user",
+	// "user:group" or ":group", by name or ID. Like FileMode, this changes
+	// the owner of source files too.
+	Owner string `json:"owner"`
+}
+
+// Check that Mode is "inherit" or an octal mode, that FileMode is an octal
+// mode, and that Owner names an existing user and group.
+func (tc *TargetDirsConfig) validate() error {
+	if err := validateDirMode(tc.Mode); err != nil {
+		return fmt.Errorf("mode: %v", err)
+	}
+	if err := validateFileMode(tc.FileMode); err != nil {
+		return fmt.Errorf("file_mode: %v", err)
+	}
+	if _, _, err := lookupOwner(tc.Owner); err != nil {
+		return fmt.Errorf("owner: %v", err)
+	}
+	return nil
+}
+
+func validateDirMode(mode string) error {
+	if mode == "" || mode == "inherit" {
+		return nil
+	}
+	if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+		return fmt.Errorf("%q is neither \"inherit\" nor an octal mode", mode)
+	}
+	return nil
+}
+
+func validateFileMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("%q isn't an octal mode", mode)
+	}
+	if bits&^0777 != 0 {
+		return fmt.Errorf("%q has bits besides the permission bits", mode)
+	}
+	return nil
+}
+
+// The user and group IDs that owner names, or -1 for either if it doesn't
+// name one.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+	userName, groupName, _ := strings.Cut(owner, ":")
+	if userName != "" {
+		if uid, err = strconv.Atoi(userName); err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return -1, -1, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if groupName != "" {
+		if gid, err = strconv.Atoi(groupName); err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return -1, -1, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// Set by -dir-mode and -file-mode. When set, they take the place of mode and
+// file_mode in target_dirs.
+var dirModeFlag, fileModeFlag string
+
+func registerPermFlags(flags *flag.FlagSet) {
+	flags.Func("dir-mode", "octal mode for directories created in the target, or \"inherit\"", func(mode string) error {
+		dirModeFlag = mode
+		return validateDirMode(mode)
+	})
+	flags.Func("file-mode", "octal mode for files linked into the target, which their source files share", func(mode string) error {
+		fileModeFlag = mode
+		return validateFileMode(mode)
+	})
+}
+
+// target_dirs with -dir-mode and -file-mode applied.
+func targetDirsConfig() TargetDirsConfig {
+	var tc TargetDirsConfig
+	if settings.TargetDirs != nil {
+		tc = *settings.TargetDirs
+	}
+	if dirModeFlag != "" {
+		tc.Mode = dirModeFlag
+	}
+	if fileModeFlag != "" {
+		tc.FileMode = fileModeFlag
+	}
+	return tc
+}
+
+// The filesystem to link albums with: the local one, applying target_dirs
+// to every directory created and linking as link_mode says, or just
+// flaclink.OS if neither is set.
+func targetFS() flaclink.FS {
+	var fsys flaclink.FS = throttledFS{flaclink.OS}
+	if tc := targetDirsConfig(); tc.Mode != "" || tc.ACL != "" || tc.Setgid || tc.Owner != "" {
+		fsys = permFS{FS: fsys, cfg: tc}
+	}
+	if linkMode() == linkModeSymlink {
+		fsys = symlinkFS{FS: fsys}
+	}
+	return fsys
+}
+
+// An FS that sets up the permissions of the directories it creates.
+type permFS struct {
+	flaclink.FS
+	cfg TargetDirsConfig
+}
+
+func (p permFS) Mkdir(name string, perm os.FileMode) error {
+	if err := p.FS.Mkdir(name, perm); err != nil {
+		return err
+	}
+	if err := p.setup(name); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+func (p permFS) MkdirAll(name string, perm os.FileMode) error {
+	// Find the directories that don't exist yet, outermost first, so each
+	// can inherit from its parent once that's set up.
+	var missing []string
+	for dir := filepath.Clean(name); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+		missing = append([]string{dir}, missing...)
+	}
+	if err := p.FS.MkdirAll(name, perm); err != nil {
+		return err
+	}
+	for _, dir := range missing {
+		if err := p.setup(dir); err != nil {
+			for i := len(missing) - 1; i >= 0; i-- {
+				os.Remove(missing[i])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the configured owner, mode and ACL to the new directory dir. The
+// owner comes first, as changing it can clear the setgid bit.
+func (p permFS) setup(dir string) error {
+	if p.cfg.Owner != "" {
+		uid, gid, err := lookupOwner(p.cfg.Owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+	switch p.cfg.Mode {
+	case "":
+	case "inherit":
+		parent, err := os.Stat(filepath.Dir(dir))
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(dir, parent.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		if err := inheritGroup(dir, parent); err != nil {
+			return err
+		}
+	default:
+		mode, _ := strconv.ParseUint(p.cfg.Mode, 8, 32)
+		if err := os.Chmod(dir, unixMode(uint32(mode))); err != nil {
+			return err
+		}
+	}
+	if p.cfg.Setgid {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(dir, info.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky)|os.ModeSetgid); err != nil {
+			return err
+		}
+	}
+	if p.cfg.ACL != "" {
+		if out, err := exec.Command("setfacl", "-m", p.cfg.ACL, dir).CombinedOutput(); err != nil {
+			return fmt.Errorf("setfacl %s: %v: %s", dir, err, out)
+		}
+	}
+	return nil
+}
+
+// Convert a Unix mode such as 02775 to an os.FileMode.
+func unixMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode) & os.ModePerm
+	if mode&syscall.S_ISUID != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
+
+// Apply the configured owner and file mode to every file in the album at
+// dir, after linking it or adding files to it. Symlinks are left alone, as
+// changing them would change what they point to.
+func setupTargetFiles(dir string) error {
+	tc := targetDirsConfig()
+	if tc.FileMode == "" && tc.Owner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(tc.Owner)
+	if err != nil {
+		return err
+	}
+	mode, _ := strconv.ParseUint(tc.FileMode, 8, 32)
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		if tc.Owner != "" {
+			if err := os.Lchown(path, uid, gid); err != nil {
+				return err
+			}
+		}
+		if tc.FileMode != "" {
+			return os.Chmod(path, os.FileMode(mode))
+		}
+		return nil
+	})
+}
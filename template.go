@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+)
+
+var (
+	templateVarPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+	// Leading articles moved to the end of sort names unless the config's
+	// sort_articles says otherwise.
+	defaultSortArticles = []string{"The", "A", "An"}
+
+	// Letters folded to their unaccented form when computing {artist_initial}.
+	initialFolds = map[rune]string{}
+)
+
+func init() {
+	for base, accented := range map[string]string{
+		"A": "ÀÁÂÃÄÅĀĂĄ", "C": "ÇĆĈĊČ", "D": "ĎĐ", "E": "ÈÉÊËĒĔĖĘĚ", "G": "ĜĞĠĢ",
+		"H": "ĤĦ", "I": "ÌÍÎÏĨĪĬĮİ", "J": "Ĵ", "K": "Ķ", "L": "ĹĻĽĿŁ", "N": "ÑŃŅŇ",
+		"O": "ÒÓÔÕÖØŌŎŐ", "R": "ŔŖŘ", "S": "ŚŜŞŠ", "T": "ŢŤŦ", "U": "ÙÚÛÜŨŪŬŮŰŲ",
+		"W": "Ŵ", "Y": "ÝŶŸ", "Z": "ŹŻŽ",
+	} {
+		for _, r := range accented {
+			initialFolds[r] = base
+		}
+	}
+}
+
+// Variables available in target_template, each computed from the album's
+// directory name or the tags of its first FLAC file.
+var templateVars = map[string]func(album Album, meta *flacMetadata) string{
+	"dir": func(album Album, meta *flacMetadata) string { return album.DirName },
+	"albumartist": func(album Album, meta *flacMetadata) string {
+		return albumArtist(meta)
+	},
+	"artist": func(album Album, meta *flacMetadata) string {
+		return resolveArtist(tagOr(meta, "ARTIST", "Unknown Artist"), tagOr(meta, "MUSICBRAINZ_ARTISTID", ""))
+	},
+	"album": func(album Album, meta *flacMetadata) string {
+		return tagOr(meta, "ALBUM", album.DirName)
+	},
+	"year": func(album Album, meta *flacMetadata) string {
+		date := tagOr(meta, "DATE", "")
+		if len(date) >= 4 {
+			return date[:4]
+		}
+		return "Unknown Year"
+	},
+	"composer": func(album Album, meta *flacMetadata) string {
+		return composer(meta)
+	},
+	"composer_sort": func(album Album, meta *flacMetadata) string {
+		return composerSort(meta)
+	},
+	"work": func(album Album, meta *flacMetadata) string {
+		return work(album, meta)
+	},
+	"conductor": func(album Album, meta *flacMetadata) string {
+		return resolveArtist(tagOr(meta, "CONDUCTOR", "Unknown Conductor"), "")
+	},
+	"performer": func(album Album, meta *flacMetadata) string {
+		return performer(meta)
+	},
+	"genre": func(album Album, meta *flacMetadata) string {
+		return tagOr(meta, "GENRE", "Unknown Genre")
+	},
+	"albumartist_sort": func(album Album, meta *flacMetadata) string {
+		return albumArtistSort(meta)
+	},
+	"artist_initial": func(album Album, meta *flacMetadata) string {
+		return sortInitial(albumArtistSort(meta))
+	},
+	"bits": func(album Album, meta *flacMetadata) string {
+		if meta == nil || meta.BitsPerSample == 0 {
+			return "Unknown"
+		}
+		return fmt.Sprint(meta.BitsPerSample)
+	},
+	"sample_rate": func(album Album, meta *flacMetadata) string {
+		if meta == nil || meta.SampleRate == 0 {
+			return "Unknown"
+		}
+		return fmt.Sprintf("%g", float64(meta.SampleRate)/1000)
+	},
+	// e.g. "24-96"; for "[24-96]" only on hi-res albums, use {hires}.
+	"quality": func(album Album, meta *flacMetadata) string {
+		if meta == nil || meta.SampleRate == 0 {
+			return "Unknown"
+		}
+		return meta.quality("-")
+	},
+	"hires": func(album Album, meta *flacMetadata) string {
+		if !meta.hiRes() {
+			return ""
+		}
+		return "[" + meta.quality("-") + "]"
+	},
+}
+
+// Check that a target template only uses known variables, and names a path
+// inside the target dir.
+func validateTemplate(template string) error {
+	for _, match := range templateVarPattern.FindAllStringSubmatch(template, -1) {
+		if _, ok := templateVars[match[1]]; !ok {
+			return fmt.Errorf("unknown variable {%s}", match[1])
+		}
+	}
+	if template != "" && escapesTarget(filepath.FromSlash(template)) {
+		return fmt.Errorf("%q must name a path inside the target dir", template)
+	}
+	return nil
+}
+
+// Set album.DirName to the path under the target dir that settings.TargetTemplate
+// gives it, or the compilations template for a compilation, sanitized under
+// sanitize_names. Without either, DirName is left
+// alone. Call this only once an album is going to be linked or previewed,
+// since it reads the album's tags.
+func applyTemplate(album *Album) {
+	if settings.TargetTemplate == "" {
+		album.DirName = sanitizePath(album.DirName)
+		return
+	}
+	applyTemplateMeta(album, albumMetadata(*album))
+}
+
+// Like applyTemplate, but with the album's tags already read, or nil if it
+// has none.
+func applyTemplateMeta(album *Album, meta *flacMetadata) {
+	applyTemplateWith(album, meta, albumTemplate(meta))
+}
+
+// Like applyTemplateMeta, but naming the album by template instead, leaving
+// DirName alone but for sanitizing if it's empty.
+func applyTemplateWith(album *Album, meta *flacMetadata, template string) {
+	if template == "" {
+		album.DirName = sanitizePath(album.DirName)
+		return
+	}
+	dirName := templateVarPattern.ReplaceAllStringFunc(template, func(match string) string {
+		return templateValue(templateVars[match[1:len(match)-1]](*album, meta))
+	})
+	album.DirName = sanitizePath(flaclink.NormalizeName(templateParts(dirName)))
+}
+
+// A variable's value as it goes into a path: tag values must not add path
+// components of their own, nor stand for the folder they're in or its
+// parent.
+func templateValue(value string) string {
+	value = strings.Trim(strings.NewReplacer("/", "-", string(filepath.Separator), "-").Replace(value), " ")
+	if value == "." || value == ".." {
+		return placeholderName
+	}
+	return value
+}
+
+// The slash-separated path a template gave with each folder name trimmed, so
+// an empty variable such as {hires} at the end of one leaves no trailing
+// space. A folder name left empty, "." or ".." is replaced, since it would
+// change the album's depth or leave the target.
+func templateParts(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+		if parts[i] == "" || parts[i] == "." || parts[i] == ".." {
+			parts[i] = placeholderName
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// The folder name a template gives in place of an empty one, "." or "..".
+const placeholderName = "_"
+
+// Reports whether dirName, an album's name in the target, isn't inside the
+// target dir: it's absolute, or the target dir itself, or cleans to a path
+// outside it.
+func escapesTarget(dirName string) bool {
+	clean := filepath.Clean(dirName)
+	return filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || clean == "." || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// Number of directory levels below the target dir at which albums are
+// linked, according to settings.TargetTemplate.
+func templateDepth() int {
+	return templatePathDepth(settings.TargetTemplate)
+}
+
+// Number of directory levels in the paths template gives.
+func templatePathDepth(template string) int {
+	return strings.Count(strings.Trim(template, "/"), "/") + 1
+}
+
+func tagOr(meta *flacMetadata, name string, fallback string) string {
+	if meta != nil {
+		if value := meta.tag(name); value != "" {
+			return value
+		}
+	}
+	return fallback
+}
+
+// The album artist, after artist_aliases and reconcile_artists.
+func albumArtist(meta *flacMetadata) string {
+	name := tagOr(meta, "ALBUMARTIST", tagOr(meta, "ARTIST", "Unknown Artist"))
+	return resolveArtist(name, tagOr(meta, "MUSICBRAINZ_ALBUMARTISTID", ""))
+}
+
+// The album artist as it should be sorted: the ALBUMARTISTSORT tag if set,
+// otherwise the album artist with any leading article moved to the end, so
+// "The Beatles" becomes "Beatles, The".
+func albumArtistSort(meta *flacMetadata) string {
+	if sortName := tagOr(meta, "ALBUMARTISTSORT", ""); sortName != "" {
+		return sortName
+	}
+	artist := albumArtist(meta)
+	articles := defaultSortArticles
+	if settings.SortArticles != nil {
+		articles = *settings.SortArticles
+	}
+	for _, article := range articles {
+		prefix := article + " "
+		if len(artist) > len(prefix) && strings.EqualFold(artist[:len(prefix)], prefix) {
+			return artist[len(prefix):] + ", " + artist[:len(article)]
+		}
+	}
+	return artist
+}
+
+// The letter a sort name is filed under: upper-cased with accents removed,
+// "0-9" for names starting with a digit, or "#" for anything else.
+func sortInitial(sortName string) string {
+	for _, r := range sortName {
+		switch {
+		case unicode.IsDigit(r):
+			return "0-9"
+		case unicode.IsLetter(r):
+			r = unicode.ToUpper(r)
+			if folded, ok := initialFolds[r]; ok {
+				return folded
+			}
+			return string(r)
+		case unicode.IsSpace(r):
+			continue
+		default:
+			return "#"
+		}
+	}
+	return "#"
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+)
+
+// When the source and target are on a NAS that also serves a media server,
+// a big import can take all the disk and network it has, and streams
+// stutter. Throttling caps the rate of filesystem operations, such as the
+// directory listings of scans and the links of albums, and the bandwidth of
+// file contents flaclink reads and writes itself, such as when verifying
+// FLAC audio, checking for transcodes or splitting CD images. Hardlinking
+// moves no file contents, so it's only counted as operations. The caps can
+// be lifted for a window of hours, e.g. at night, so heavy work gets done
+// at full speed then and trickles along the rest of the day.
+
+// Set by -io-limit and -scan-rate. When non-zero, they take the place of
+// io_limit and scan_rate from the config file.
+var (
+	ioLimitFlag  int64
+	scanRateFlag int
+)
+
+func registerThrottleFlags(flags *flag.FlagSet) {
+	flags.Int64Var(&ioLimitFlag, "io-limit", 0, "read and write at most this many bytes of file contents per second")
+	flags.IntVar(&scanRateFlag, "scan-rate", 0, "do at most this many filesystem operations, such as directory listings and links, per second")
+}
+
+// Caps on the filesystem operations and bandwidth flaclink uses, outside
+// full_speed_hours.
+type ThrottleConfig struct {
+	// Bytes per second of file contents read and written. Unlimited if zero.
+	IOLimit int64 `json:"io_limit"`
+	// Filesystem operations per second. Unlimited if zero.
+	ScanRate int `json:"scan_rate"`
+	// Local time window, e.g. "02:00-06:00", during which the limits are
+	// lifted. It may span midnight, e.g. "22:00-06:00".
+	FullSpeedHours string `json:"full_speed_hours"`
+}
+
+func (tc *ThrottleConfig) validate() error {
+	if tc.IOLimit < 0 {
+		return fmt.Errorf("io_limit can't be negative")
+	}
+	if tc.ScanRate < 0 {
+		return fmt.Errorf("scan_rate can't be negative")
+	}
+	if tc.FullSpeedHours != "" {
+		if _, _, err := parseHours(tc.FullSpeedHours); err != nil {
+			return fmt.Errorf("full_speed_hours: %v", err)
+		}
+	}
+	return nil
+}
+
+// Parse a window of hours such as "02:00-06:00" into its start and end, as
+// minutes since midnight.
+func parseHours(window string) (start, end int, err error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%q isn't a window like 02:00-06:00", window)
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q isn't a window like 02:00-06:00", window)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// Reports whether now is within full_speed_hours, if set.
+func fullSpeedNow(now time.Time) bool {
+	tc := settings.Throttle
+	if tc == nil || tc.FullSpeedHours == "" {
+		return false
+	}
+	start, end, err := parseHours(tc.FullSpeedHours)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return start <= minute && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// The limits in effect now: the flags, or else the config file, unless it's
+// within full_speed_hours. Zero means unlimited.
+func throttleLimits() (ioLimit int64, scanRate int) {
+	if tc := settings.Throttle; tc != nil {
+		ioLimit, scanRate = tc.IOLimit, tc.ScanRate
+	}
+	if ioLimitFlag > 0 {
+		ioLimit = ioLimitFlag
+	}
+	if scanRateFlag > 0 {
+		scanRate = scanRateFlag
+	}
+	if fullSpeedNow(time.Now()) {
+		return 0, 0
+	}
+	return ioLimit, scanRate
+}
+
+// Paces units of work, such as bytes or operations, to a rate per second,
+// allowing a burst of up to a second's worth after a pause. Shared by all
+// goroutines, so the rate is for the whole process.
+type rateLimiter struct {
+	mu sync.Mutex
+	// When the work so far is paid for.
+	next time.Time
+}
+
+var (
+	ioLimiter   rateLimiter
+	scanLimiter rateLimiter
+)
+
+// Wait until n units may go at rate per second. Doesn't wait if rate is
+// zero.
+func (l *rateLimiter) wait(n int64, rate int64) {
+	if rate <= 0 || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if earliest := now.Add(-time.Second); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Wait for the go-ahead for n bytes of file contents under the I/O limit.
+func throttleIO(n int) {
+	ioLimit, _ := throttleLimits()
+	ioLimiter.wait(int64(n), ioLimit)
+}
+
+// Wait for the go-ahead for a filesystem operation under the scan rate.
+func throttleOp() {
+	_, scanRate := throttleLimits()
+	scanLimiter.wait(1, int64(scanRate))
+}
+
+// A reader of file contents that keeps to the I/O limit.
+type throttledReader struct {
+	r io.Reader
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	throttleIO(n)
+	return n, err
+}
+
+// A writer of file contents that keeps to the I/O limit.
+type throttledWriter struct {
+	w io.Writer
+}
+
+func (t throttledWriter) Write(p []byte) (int, error) {
+	throttleIO(len(p))
+	return t.w.Write(p)
+}
+
+// An FS whose operations keep to the scan rate.
+type throttledFS struct {
+	flaclink.FS
+}
+
+func (t throttledFS) ReadDir(name string) ([]os.FileInfo, error) {
+	throttleOp()
+	return t.FS.ReadDir(name)
+}
+
+func (t throttledFS) Mkdir(name string, perm os.FileMode) error {
+	throttleOp()
+	return t.FS.Mkdir(name, perm)
+}
+
+func (t throttledFS) MkdirAll(name string, perm os.FileMode) error {
+	throttleOp()
+	return t.FS.MkdirAll(name, perm)
+}
+
+func (t throttledFS) Link(oldname, newname string) error {
+	throttleOp()
+	return t.FS.Link(oldname, newname)
+}
+
+func (t throttledFS) RemoveAll(name string) error {
+	throttleOp()
+	return t.FS.RemoveAll(name)
+}
+
+func (t throttledFS) Rename(oldname, newname string) error {
+	throttleOp()
+	return t.FS.Rename(oldname, newname)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+)
+
+// Spotting lossy audio repackaged as FLAC. MP3, AAC and Vorbis encoders drop
+// everything above a cutoff that depends on the bitrate, from about 16 kHz
+// at 128 kbps to 20 kHz at 320, and converting the decoded audio to FLAC
+// doesn't bring it back. So a FLAC whose spectrum falls off a cliff well
+// below the top of its range was likely made from a lossy file. Recordings
+// made losslessly roll off gradually, or only at the converter's filter close
+// to half the sample rate.
+
+// Files whose audio stops below this frequency, in Hz, are suspected
+// transcodes unless min_cutoff says otherwise.
+const defaultMinCutoff = 19000
+
+const (
+	// Samples per analysis window, and the most windows analyzed per file,
+	// about 20 seconds at 44.1 kHz.
+	spectrumWindow     = 4096
+	spectrumMaxWindows = 200
+	// Files with fewer loud windows than this aren't judged.
+	spectrumMinWindows = 10
+	// Windows quieter than this RMS level, in dBFS, are skipped, since
+	// silence and fades have no high end to measure.
+	spectrumMinLevel = -50
+	// Width in Hz of the bands compared on either side of a possible cutoff,
+	// and how many dB louder the band below must be than anything above for
+	// it to be a cliff.
+	cliffBand = 500
+	cliffDrop = 25
+	// Cutoffs are only looked for above this frequency, in Hz.
+	cliffMinFreq = 4000
+)
+
+// Checking incoming FLACs for lossy transcodes. With neither this nor
+// -check-transcodes, albums aren't analyzed.
+type TranscodeCheckConfig struct {
+	// Files whose audio stops below this frequency, in Hz, are suspected
+	// transcodes. Defaults to 19000.
+	MinCutoff int `json:"min_cutoff"`
+	// Skip albums with suspected transcodes instead of linking them with a
+	// warning.
+	Refuse bool `json:"refuse"`
+}
+
+func (tc *TranscodeCheckConfig) validate() error {
+	if tc.MinCutoff < 0 {
+		return fmt.Errorf("min_cutoff can't be negative")
+	}
+	return nil
+}
+
+// Set by -check-transcodes.
+var checkTranscodes bool
+
+func registerTranscodeFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&checkTranscodes, "check-transcodes", false, "analyze FLAC files for signs of lossy transcodes, and warn about them")
+}
+
+// The transcode check settings in effect, and whether the check is on.
+func transcodeCheck() (tc TranscodeCheckConfig, ok bool) {
+	if settings.TranscodeCheck != nil {
+		tc, ok = *settings.TranscodeCheck, true
+	}
+	ok = ok || checkTranscodes
+	if tc.MinCutoff == 0 {
+		tc.MinCutoff = defaultMinCutoff
+	}
+	return tc, ok
+}
+
+// What analyzing the spectrum of one FLAC file found.
+type spectrumAnalysis struct {
+	SampleRate int
+	// Loud windows analyzed.
+	Windows int
+	// Frequency in Hz above which the audio falls off a cliff, or 0 if there
+	// is none, or too few loud windows to tell.
+	Cutoff int
+}
+
+// Reports whether a reads as a lossy transcode with min_cutoff minCutoff.
+func (a spectrumAnalysis) suspect(minCutoff int) bool {
+	return a.Cutoff > 0 && a.Cutoff < minCutoff
+}
+
+// Decode the start of the FLAC file at path, mixed down to mono, and find
+// where its average spectrum over the loud windows falls off a cliff.
+func analyzeSpectrum(path string) (spectrumAnalysis, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return spectrumAnalysis{}, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(throttledReader{f}, 1<<16)
+	meta, err := readFlacMetadataBlocks(path, r)
+	if err != nil {
+		return spectrumAnalysis{}, err
+	}
+	if meta.SampleRate == 0 || meta.Channels == 0 || meta.BitsPerSample == 0 {
+		return spectrumAnalysis{}, fmt.Errorf("%s: STREAMINFO has no sample rate, channels or bit depth", path)
+	}
+	a := spectrumAnalysis{SampleRate: meta.SampleRate}
+
+	d := &flacDecoder{br: &flacBitReader{r: r}, meta: meta}
+	scale := 1 / (float64(meta.Channels) * math.Exp2(float64(meta.BitsPerSample-1)))
+	window := make([]float64, 0, spectrumWindow)
+	power := make([]float64, spectrumWindow/2+1)
+	for frame := 0; a.Windows < spectrumMaxWindows; frame++ {
+		n, err := d.decodeFrame()
+		if err == io.EOF || err == errFlacSync {
+			break
+		}
+		if err != nil {
+			return a, fmt.Errorf("%s: frame %d: %v", path, frame, err)
+		}
+		for i := 0; i < n; i++ {
+			var sum int64
+			for ch := 0; ch < meta.Channels; ch++ {
+				sum += d.channels[ch][i]
+			}
+			window = append(window, float64(sum)*scale)
+			if len(window) == spectrumWindow {
+				if addWindowPower(window, power) {
+					a.Windows++
+				}
+				window = window[:0]
+			}
+		}
+	}
+	if a.Windows >= spectrumMinWindows {
+		for k := range power {
+			power[k] /= float64(a.Windows)
+		}
+		a.Cutoff = spectrumCliff(power, meta.SampleRate)
+	}
+	return a, nil
+}
+
+// Add the power spectrum of window, with a Hann window applied, to power,
+// unless it's too quiet to tell anything from. Reports whether it was added.
+func addWindowPower(window []float64, power []float64) bool {
+	var sumSquares float64
+	for _, s := range window {
+		sumSquares += s * s
+	}
+	if 10*math.Log10(sumSquares/float64(len(window))+1e-30) < spectrumMinLevel {
+		return false
+	}
+	x := make([]complex128, len(window))
+	for i, s := range window {
+		hann := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(len(window)-1))
+		x[i] = complex(s*hann, 0)
+	}
+	fft(x)
+	for k := range power {
+		m := cmplx.Abs(x[k])
+		power[k] += m * m
+	}
+	return true
+}
+
+// Find the highest frequency in Hz where the average power spectrum drops by
+// cliffDrop dB within cliffBand and stays down to the top of the range, or 0
+// if there's none.
+func spectrumCliff(power []float64, sampleRate int) int {
+	binHz := float64(sampleRate) / spectrumWindow
+	band := int(math.Ceil(cliffBand / binHz))
+	level := make([]float64, len(power))
+	for k, p := range power {
+		level[k] = 10 * math.Log10(p+1e-30)
+	}
+	// Mean level of the band starting at each bin, and the loudest such band
+	// from each bin up.
+	top := len(level) - band
+	bandMean := make([]float64, top+1)
+	loudestAbove := make([]float64, top+2)
+	loudestAbove[top+1] = math.Inf(-1)
+	for k := top; k >= 0; k-- {
+		var sum float64
+		for _, l := range level[k : k+band] {
+			sum += l
+		}
+		bandMean[k] = sum / float64(band)
+		loudestAbove[k] = math.Max(bandMean[k], loudestAbove[k+1])
+	}
+
+	// Scan down from the top for the first cliff, then on down to its
+	// steepest point.
+	cutoff, steepest := 0, 0.0
+	for k := top; k >= band && float64(k)*binHz >= cliffMinFreq; k-- {
+		below := bandMean[k-band]
+		if below-loudestAbove[k] < cliffDrop {
+			if cutoff > 0 {
+				break
+			}
+			continue
+		}
+		if drop := below - bandMean[k]; drop > steepest {
+			cutoff, steepest = k, drop
+		}
+	}
+	return int(float64(cutoff) * binHz)
+}
+
+// Replace x, whose length is a power of two, with its discrete Fourier
+// transform.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = even+odd, even-odd
+				w *= step
+			}
+		}
+	}
+}
+
+// Analyze the FLAC files in the album in job if the transcode check is on,
+// adding a warning to job for each one that looks like a lossy transcode.
+// Returns false if the album should be skipped for them.
+func passesTranscodeCheck(job *albumJob) bool {
+	tc, ok := transcodeCheck()
+	if !ok {
+		return true
+	}
+	album := job.Album
+	for _, path := range albumFlacFiles(album.Path) {
+		a, err := analyzeSpectrum(path)
+		if err != nil {
+			log.Printf("Can't analyze %s for lossy transcodes: %v", path, err)
+			continue
+		}
+		if !a.suspect(tc.MinCutoff) {
+			continue
+		}
+		rel, _ := filepath.Rel(album.Path, path)
+		warning := fmt.Sprintf("%s may be a lossy transcode: its audio stops at %.1f kHz", rel, float64(a.Cutoff)/1000)
+		log.Printf("Warning: album %s: %s.", album.DirName, warning)
+		recordRunWarning(album.DirName, warning)
+		job.Warnings = append(job.Warnings, warning)
+	}
+	if len(job.Warnings) > 0 && tc.Refuse {
+		log.Printf("Skipping album %s with suspected lossy transcodes.", album.DirName)
+		emitEvent(Event{Event: "skipped", Album: album.DirName, Source: album.Path, Reason: "suspected lossy transcode"})
+		return false
+	}
+	return true
+}
+
+// Analyze the FLAC files in each album dir or file given, and print where
+// each one's audio stops and whether it looks like a lossy transcode.
+func runAnalyze(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	minCutoff := flags.Int("min-cutoff", 0, "suspect files whose audio stops below this frequency, in Hz (default 19000, or min_cutoff from transcode_check)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Println("Usage: flaclink analyze [-min-cutoff hz] <album dir|flac file>...")
+		os.Exit(2)
+	}
+	tc, _ := transcodeCheck()
+	if *minCutoff > 0 {
+		tc.MinCutoff = *minCutoff
+	}
+
+	status := 0
+	for _, arg := range flags.Args() {
+		paths := []string{arg}
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			paths = albumFlacFiles(arg)
+		}
+		for _, path := range paths {
+			a, err := analyzeSpectrum(path)
+			switch {
+			case err != nil:
+				fmt.Println(err)
+				status = 1
+			case a.Windows < spectrumMinWindows:
+				fmt.Printf("%s: too little loud audio to tell\n", path)
+			case a.Cutoff == 0:
+				fmt.Printf("%s: no cutoff found, %d Hz sample rate\n", path, a.SampleRate)
+			case a.suspect(tc.MinCutoff):
+				fmt.Printf("%s: stops at %.1f kHz, likely a lossy transcode\n", path, float64(a.Cutoff)/1000)
+			default:
+				fmt.Printf("%s: stops at %.1f kHz\n", path, float64(a.Cutoff)/1000)
+			}
+		}
+	}
+	os.Exit(status)
+}
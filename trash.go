@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What flaclink removes from the target, such as an album gc removes or a
+// file verify -repair replaces, goes to the trash rather than being deleted,
+// as it may hold the last copy of the music. The trash is a directory per day
+// in trash in the app data dir, holding each removed path under its absolute
+// path. A move can't cross filesystems, so anything on another filesystem than
+// the app data dir goes to a .flaclink-trash dir at the top of its target dir
+// instead. "flaclink trash empty" deletes days older than -older-than.
+
+// Name of the trash dir, in the app data dir or a target dir.
+const (
+	trashDirName       = "trash"
+	targetTrashDirName = ".flaclink-trash"
+)
+
+// Layout of the names of each day's dir in the trash.
+const trashDayLayout = "2006-01-02"
+
+// The trash dir in the app data dir.
+func appTrashDir() string {
+	return filepath.Join(AppDataPath, trashDirName)
+}
+
+// Move path, a file or directory under the target dir root, to the trash.
+// Moving it isn't possible across filesystems, in which case it goes to the
+// trash dir in root. path is left where it is if neither works.
+func moveToTrash(path, root string) error {
+	day := time.Now().Format(trashDayLayout)
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	// Keep the whole path, less any volume name, so that same-named albums
+	// from different targets don't collide.
+	err = renameToTrash(abs, appTrashDir(), filepath.Join(day, strings.TrimPrefix(abs, filepath.VolumeName(abs))))
+	if err == nil {
+		return nil
+	}
+	rel, relErr := filepath.Rel(root, abs)
+	if root == "" || relErr != nil || strings.HasPrefix(rel, "..") {
+		return err
+	}
+	return renameToTrash(abs, filepath.Join(root, targetTrashDirName), filepath.Join(day, rel))
+}
+
+// The target dir that holds the album dirName at albumPath, or "" if albumPath
+// doesn't end in dirName.
+func targetRoot(albumPath, dirName string) string {
+	root := strings.TrimSuffix(albumPath, filepath.FromSlash(dirName))
+	if root == albumPath {
+		return ""
+	}
+	return filepath.Clean(root)
+}
+
+// Rename path to rel in the trash dir trash, or to rel with a numbered
+// suffix if that exists, creating the dirs it goes in.
+func renameToTrash(path, trash, rel string) error {
+	dest := filepath.Join(trash, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	target := dest
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			break
+		}
+		target = dest + "." + strconv.Itoa(n)
+	}
+	if err := os.Rename(path, target); err != nil {
+		// Don't leave empty dirs behind when the move didn't work.
+		for dir := filepath.Dir(dest); len(dir) >= len(trash) && os.Remove(dir) == nil; dir = filepath.Dir(dir) {
+		}
+		return err
+	}
+	log.Printf("Moved %s to the trash at %s.", path, target)
+	return nil
+}
+
+// Manage the trash.
+func runTrash(args []string) {
+	if len(args) < 1 || args[0] != "empty" {
+		fmt.Println("Usage: flaclink trash empty [-older-than age] [target dir]...")
+		os.Exit(2)
+	}
+	runTrashEmpty(args[1:])
+}
+
+// Delete the days in the trash older than -older-than, in the app data dir
+// and in the target dirs given or configured.
+func runTrashEmpty(args []string) {
+	olderThan := 30 * 24 * time.Hour
+	flags := flag.NewFlagSet("trash empty", flag.ExitOnError)
+	flags.Func("older-than", "delete what was trashed longer ago than this, e.g. 30d or 12h (default 30d)", func(s string) error {
+		age, err := parseAge(s)
+		olderThan = age
+		return err
+	})
+	flags.Parse(args)
+	targets := flags.Args()
+	if len(targets) == 0 {
+		targets = append(targets, settings.TargetDir)
+		for _, p := range settings.Profiles {
+			targets = append(targets, p.TargetDir)
+		}
+	}
+	dirs := []string{appTrashDir()}
+	for _, target := range uniqueDirs(targets) {
+		dirs = append(dirs, filepath.Join(target, targetTrashDirName))
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	emptied := 0
+	for _, dir := range dirs {
+		days, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, day := range days {
+			date, err := time.ParseInLocation(trashDayLayout, day.Name(), time.Local)
+			// A day's trash is as old as the end of that day.
+			if err != nil || !date.AddDate(0, 0, 1).Before(cutoff) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(dir, day.Name())); err != nil {
+				log.Printf("trash empty: %v", err)
+				continue
+			}
+			emptied++
+			fmt.Printf("emptied    %s\n", filepath.Join(dir, day.Name()))
+		}
+		os.Remove(dir)
+	}
+	log.Printf("Emptied %d days of trash.", emptied)
+}
+
+// Parse an age such as "30d" or "12h".
+func parseAge(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%q isn't a number of days", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// "flaclink tui" is a middle ground between runs that link everything new and
+// managing files by hand: it lists the albums a run would link, with their
+// tags and the names they'd get in the target, and links the ones picked out
+// at a prompt, showing progress as it goes. Albums whose name is taken in the
+// target, or by another album in the list, can be renamed before linking.
+// Nothing is written until albums are linked, and the instance lock is only
+// taken then.
+
+// An album a run would link, as listed in the tui.
+type pendingAlbum struct {
+	Album    Album
+	Name     string
+	Artist   string
+	Title    string
+	Year     string
+	Format   string
+	Files    int
+	Bytes    int64
+	Selected bool
+	// Set once the name has been changed by hand.
+	Renamed bool
+}
+
+// Interactively pick which new albums in the source dirs to link into the
+// target dir. Both default to those in the config file.
+func runTui(args []string) {
+	sourceDirs := settings.sourceDirs()
+	targetDir := settings.TargetDir
+	if len(args) > 0 {
+		if len(args) < 2 {
+			tuiUsage()
+		}
+		sourceDirs = uniqueDirs(args[:len(args)-1])
+		targetDir = filepath.Clean(args[len(args)-1])
+	}
+	if len(sourceDirs) == 0 || targetDir == "" {
+		tuiUsage()
+	}
+	if !stdinIsTerminal() {
+		fatalf("tui: stdin isn't a terminal; to link without asking, run flaclink <source dir>... <target dir>")
+	}
+	targetDir = absTargetDir(targetDir)
+
+	input := bufio.NewScanner(os.Stdin)
+	pending := scanPending(sourceDirs, targetDir)
+	for {
+		printPending(pending, targetDir)
+		fmt.Print("> ")
+		if !input.Scan() {
+			fmt.Println()
+			return
+		}
+		fields := strings.Fields(input.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "q", "quit":
+			return
+		case "?", "h", "help":
+			printTuiHelp()
+		case "a", "all":
+			for i := range pending {
+				pending[i].Selected = true
+			}
+		case "n", "none":
+			for i := range pending {
+				pending[i].Selected = false
+			}
+		case "s", "scan":
+			pending = scanPending(sourceDirs, targetDir)
+		case "r", "rename":
+			renamePending(pending, fields[1:])
+		case "l", "link":
+			if linkPending(pending, sourceDirs, targetDir) {
+				pending = scanPending(sourceDirs, targetDir)
+			}
+		default:
+			togglePending(pending, fields)
+		}
+	}
+}
+
+func tuiUsage() {
+	fmt.Println("Usage: flaclink tui [<source dir>... <target dir>]")
+	os.Exit(2)
+}
+
+func printTuiHelp() {
+	fmt.Println("  1 3 5-7        select or deselect albums by number")
+	fmt.Println("  a, n           select all albums, or none")
+	fmt.Println("  r <n> <name>   rename album n in the target; slashes make subfolders")
+	fmt.Println("  l              link the selected albums")
+	fmt.Println("  s              scan the source dirs again")
+	fmt.Println("  q              quit")
+}
+
+// Reports whether stdin is a terminal, rather than a file or pipe.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// The albums in sourceDirs that a run into targetDir would link, named as the
+// route stage would name them. All are selected but those whose name is
+// taken.
+func scanPending(sourceDirs []string, targetDir string) (pending []pendingAlbum) {
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+	ctx, cancel := interruptContext()
+	defer cancel()
+	resetAlbumCache()
+	resetIgnoreFiles()
+	// The DB is read-only here, so the scan cache is used but not updated.
+	cache := loadScanCache(db)
+	for _, sourceDir := range sourceDirs {
+		scanSourceDir(ctx, sourceDir, cache, func(album Album) {
+			if !inActiveProfile(album) || inDb(album, db) || isRejected(album, db) {
+				return
+			}
+			meta := albumMetadata(album)
+			job := &albumJob{Ctx: ctx, Album: album, Found: album, TargetDir: targetDir, DB: db, Meta: meta}
+			if stageEnabled(stageRoute) {
+				routeStage{}.Process(job)
+			}
+			p := pendingAlbum{
+				Album:  album,
+				Name:   job.Album.DirName,
+				Artist: albumArtist(meta),
+				Title:  tagOr(meta, "ALBUM", album.DirName),
+				Year:   tagOr(meta, "DATE", ""),
+				Format: metadataFormat(meta),
+			}
+			filepath.Walk(album.Path, func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					p.Files++
+					p.Bytes += info.Size()
+				}
+				return nil
+			})
+			pending = append(pending, p)
+		})
+	}
+	for i := range pending {
+		pending[i].Selected = pendingConflict(pending, i, targetDir) == ""
+	}
+	return pending
+}
+
+// Why album i in pending can't be linked under its name, or "" if it can:
+// something is there already, or another selected album has the same name.
+func pendingConflict(pending []pendingAlbum, i int, targetDir string) string {
+	if _, err := os.Lstat(filepath.Join(targetDir, pending[i].Name)); err == nil {
+		return "already exists in the target"
+	}
+	for j, other := range pending {
+		if j != i && other.Selected && other.Name == pending[i].Name {
+			return fmt.Sprintf("same name as %d", j+1)
+		}
+	}
+	return ""
+}
+
+func printPending(pending []pendingAlbum, targetDir string) {
+	fmt.Println()
+	if len(pending) == 0 {
+		fmt.Printf("No new albums to link into %s. Type s to scan again, or q to quit.\n", targetDir)
+		return
+	}
+	var selected int
+	var bytes int64
+	for i, p := range pending {
+		mark := " "
+		if p.Selected {
+			mark = "x"
+			selected++
+			bytes += p.Bytes
+		}
+		title := p.Artist + " - " + p.Title
+		if p.Year != "" {
+			title += " (" + p.Year + ")"
+		}
+		fmt.Printf("[%s] %3d  %s\n", mark, i+1, title)
+		fmt.Printf("          %s, %d files, %s, from %s\n", p.Format, p.Files, formatSize(p.Bytes), p.Album.Path)
+		renamed := ""
+		if p.Renamed {
+			renamed = " (renamed)"
+		}
+		fmt.Printf("          -> %s%s\n", p.Name, renamed)
+		if conflict := pendingConflict(pending, i, targetDir); conflict != "" {
+			fmt.Printf("          ! %s; rename it with r %d <name>\n", conflict, i+1)
+		}
+	}
+	fmt.Printf("%d of %d albums selected, %s, for %s. Type ? for help.\n", selected, len(pending), formatSize(bytes), targetDir)
+}
+
+// Select or deselect the albums numbered in fields, such as "3" or "5-7".
+func togglePending(pending []pendingAlbum, fields []string) {
+	for _, field := range fields {
+		from, to, ok := parseRange(field, len(pending))
+		if !ok {
+			fmt.Printf("%q isn't an album number or command. Type ? for help.\n", field)
+			return
+		}
+		for i := from; i <= to; i++ {
+			pending[i-1].Selected = !pending[i-1].Selected
+		}
+	}
+}
+
+// Parse "n" or "n-m" as a range of album numbers from 1 to count.
+func parseRange(s string, count int) (from, to int, ok bool) {
+	first, last := s, s
+	if i := strings.Index(s, "-"); i > 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	from, err1 := strconv.Atoi(first)
+	to, err2 := strconv.Atoi(last)
+	if err1 != nil || err2 != nil || from < 1 || to < from || to > count {
+		return 0, 0, false
+	}
+	return from, to, true
+}
+
+// Rename an album in the target, given "<n> <name>".
+func renamePending(pending []pendingAlbum, args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: r <n> <name>")
+		return
+	}
+	i, _, ok := parseRange(args[0], len(pending))
+	if !ok {
+		fmt.Printf("There's no album %s.\n", args[0])
+		return
+	}
+	name := filepath.Clean(filepath.FromSlash(strings.Join(args[1:], " ")))
+	if filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		fmt.Printf("%q must be a name inside the target dir.\n", name)
+		return
+	}
+	pending[i-1].Name = sanitizePath(name)
+	pending[i-1].Renamed = true
+	pending[i-1].Selected = true
+}
+
+// Link the selected albums as a run of their own, with their names as shown,
+// after checking none of them conflict. Returns whether a run happened.
+func linkPending(pending []pendingAlbum, sourceDirs []string, targetDir string) bool {
+	var selected []pendingAlbum
+	for i, p := range pending {
+		if !p.Selected {
+			continue
+		}
+		if conflict := pendingConflict(pending, i, targetDir); conflict != "" {
+			fmt.Printf("Album %d %s; rename or deselect it first.\n", i+1, conflict)
+			return false
+		}
+		selected = append(selected, p)
+	}
+	if len(selected) == 0 {
+		fmt.Println("No albums selected.")
+		return false
+	}
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond})
+	defer db.Close()
+	ctx, cancel := interruptContext()
+	defer cancel()
+	beginRun("tui", strings.Join(sourceDirs, ", "))
+	progress := startProgress(db)
+	for _, p := range selected {
+		progress.add(p.Album)
+	}
+	progress.scanned()
+	var linked []Album
+	for _, p := range selected {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.begin(p.Album)
+		emitEvent(Event{Event: "discovered", Album: p.Album.DirName, Source: p.Album.Path})
+		job := &albumJob{Ctx: ctx, Album: p.Album, Found: p.Album, TargetDir: targetDir, DB: db, Name: p.Name}
+		if album, ok := runStages(job); ok {
+			linked = append(linked, album)
+		}
+		progress.end(p.Album)
+	}
+	progress.stop()
+	run := finishRun(linked, targetDir, db)
+	fmt.Printf("Linked %d of %d albums", run.Linked, len(selected))
+	if len(run.Errors)+len(run.Warnings) > 0 {
+		fmt.Printf(", with %d errors and %d warnings:\n", len(run.Errors), len(run.Warnings))
+		for _, message := range append(run.Errors, run.Warnings...) {
+			fmt.Printf("  %s\n", message)
+		}
+	} else {
+		fmt.Println(".")
+	}
+	return true
+}
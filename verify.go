@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kylegentle/flaclink/pkg/flaclink"
+	bolt "go.etcd.io/bbolt"
+)
+
+// What verify found wrong with an album in the target.
+type albumProblems struct {
+	// The album's directory is gone from the target.
+	Missing bool
+	// Files that should be in the target but aren't, and files that are but
+	// are copies of their source files rather than hardlinks to them.
+	MissingFiles []FileDecision
+	CopiedFiles  []FileDecision
+}
+
+// An album in the DB, with what was recorded about it. Album.Path is its
+// source, or empty if that can't be found.
+type linkedAlbum struct {
+	Album  Album
+	Record flaclink.AlbumRecord
+}
+
+// Every album in db, with its source. Albums recorded before their source
+// paths were are looked up in sourceDir by contents. Errors are fatal, and
+// reported as coming from command.
+func albumsWithSources(command, sourceDir string, db *bolt.DB) []linkedAlbum {
+	sources, err := albumScanner().Scan(sourceDir)
+	if err != nil {
+		fatalf("%s: %v", command, err)
+	}
+	byContents := make(map[string]string)
+	for _, album := range sources {
+		byContents[strings.Join(album.Contents, "\x00")] = album.Path
+	}
+
+	store := albumStore(db)
+	var albums []linkedAlbum
+	err = store.ForEach(func(contents []string, dirName string) error {
+		albums = append(albums, linkedAlbum{Album: Album{DirName: dirName, Contents: contents}})
+		return nil
+	})
+	if err != nil {
+		fatalf("%s: %v", command, err)
+	}
+	for i := range albums {
+		album := &albums[i].Album
+		albums[i].Record, _ = store.Record(*album)
+		album.Path = albums[i].Record.Source
+		if album.Path == "" {
+			album.Path = byContents[strings.Join(album.Contents, "\x00")]
+		}
+		if _, err := os.Stat(album.Path); err != nil {
+			album.Path = ""
+		}
+	}
+	return albums
+}
+
+func (p albumProblems) ok() bool {
+	return !p.Missing && len(p.MissingFiles) == 0 && len(p.CopiedFiles) == 0
+}
+
+// Check that every album in the DB is still linked into targetDir as it was:
+// its directory exists, all its linked files are present, and each is a
+// hardlink to the file in the source rather than a copy. With -repair,
+// missing albums and files are linked again and copies are replaced with
+// hardlinks. Exits with status 1 if problems remain.
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "relink missing albums and files, and replace copies with hardlinks")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("Usage: flaclink verify [-repair] <source dir> <target dir>")
+		os.Exit(2)
+	}
+	sourceDir := filepath.Clean(flags.Arg(0))
+	targetDir := filepath.Clean(flags.Arg(1))
+
+	db := openAlbumDb(&bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	defer db.Close()
+	albums := albumsWithSources("verify", sourceDir, db)
+
+	var bad, repaired, unchecked int
+	for _, linked := range albums {
+		album, record := linked.Album, linked.Record
+		if album.Path == "" {
+			unchecked++
+			fmt.Printf("no source  %s\n", album.DirName)
+			continue
+		}
+		targetPath := albumTargetPath(album, targetDir)
+		problems := verifyAlbum(album.Path, targetPath, record.Files)
+		if problems.ok() {
+			continue
+		}
+		printProblems(album.DirName, problems)
+		if !*repair {
+			bad++
+			continue
+		}
+		if err := repairAlbum(album, targetPath, problems); err != nil {
+			log.Printf("verify: can't repair %s: %v", album.DirName, err)
+			bad++
+			continue
+		}
+		fmt.Printf("repaired   %s\n", album.DirName)
+		repaired++
+	}
+	log.Printf("Verified %d albums: %d with problems, %d repaired, %d without a source to check against.", len(albums), bad+repaired, repaired, unchecked)
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
+
+// Compare the album linked at targetPath with its source. decisions are the
+// ones recorded when it was linked; without them, every source file that
+// isn't excluded is expected in the target.
+func verifyAlbum(sourcePath, targetPath string, decisions []FileDecision) (problems albumProblems) {
+	if _, err := os.Stat(targetPath); err != nil {
+		problems.Missing = true
+		return problems
+	}
+	var files []FileDecision
+	if decisions != nil {
+		for _, d := range decisions {
+			if d.Linked {
+				files = append(files, d)
+			}
+		}
+	} else {
+		filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && !excludedFile(info.Name()) && !ignoredPath(path, false) {
+				relPath, _ := filepath.Rel(sourcePath, path)
+				files = append(files, FileDecision{Path: relPath, Linked: true})
+			}
+			return nil
+		})
+	}
+	for _, file := range files {
+		sourceInfo, err := os.Stat(filepath.Join(sourcePath, file.Path))
+		if err != nil {
+			// Nothing to link it to; check-source reports changed sources.
+			continue
+		}
+		targetInfo, err := os.Stat(filepath.Join(targetPath, file.TargetPath()))
+		switch {
+		case err != nil:
+			problems.MissingFiles = append(problems.MissingFiles, file)
+		case !os.SameFile(sourceInfo, targetInfo):
+			problems.CopiedFiles = append(problems.CopiedFiles, file)
+		}
+	}
+	return problems
+}
+
+func printProblems(dirName string, problems albumProblems) {
+	if problems.Missing {
+		fmt.Printf("missing    %s\n", dirName)
+		return
+	}
+	for _, file := range problems.MissingFiles {
+		fmt.Printf("missing    %s\n", filepath.Join(dirName, file.TargetPath()))
+	}
+	for _, file := range problems.CopiedFiles {
+		fmt.Printf("copy       %s\n", filepath.Join(dirName, file.TargetPath()))
+	}
+}
+
+// Link album at targetPath again, or just its missing and copied files.
+func repairAlbum(album Album, targetPath string, problems albumProblems) error {
+	if problems.Missing {
+		linker := flaclink.Linker{
+			Exclude: excludingFilteredFiles(excludedFile),
+			Ignore:  ignoringFilteredDirs(ignoredPath),
+			FS:      targetFS(),
+			MapPath: linkPathMapper(album),
+		}
+		if _, err := linker.Link(album, targetPath); err != nil {
+			return err
+		}
+		return setupTargetFiles(targetPath)
+	}
+	for _, file := range problems.CopiedFiles {
+		// The copy may have been changed, e.g. retagged, so keep it.
+		if err := moveToTrash(filepath.Join(targetPath, file.TargetPath()), targetRoot(targetPath, album.DirName)); err != nil {
+			return err
+		}
+	}
+	for _, file := range append(problems.MissingFiles, problems.CopiedFiles...) {
+		targetFile := filepath.Join(targetPath, file.TargetPath())
+		if err := targetFS().MkdirAll(filepath.Dir(targetFile), 0775); err != nil {
+			return err
+		}
+		if err := replaceWithLink(filepath.Join(album.Path, file.Path), targetFile, linkFile); err != nil {
+			return err
+		}
+	}
+	return setupTargetFiles(targetPath)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+)
+
+// Padding beyond this is almost always a tagger bug, and some players read
+// the whole block into memory.
+const maxFlacPadding = 1 << 20
+
+// Set by -verify-flac, -strict and -verify-audio. With verifyFlac, albums
+// containing FLAC files that fail verification are quarantined rather than
+// linked. With verifyAudio, so are albums with FLAC files whose audio
+// doesn't decode. See flacdecode.go and quarantine.go.
+var (
+	verifyFlac  bool
+	strictFlac  bool
+	verifyAudio bool
+)
+
+func registerVerifyFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&verifyFlac, "verify-flac", false, "quarantine albums with unreadable FLAC metadata")
+	flags.BoolVar(&strictFlac, "strict", false, "with -verify-flac, also quarantine albums with FLAC files that players may choke on")
+	flags.BoolVar(&verifyAudio, "verify-audio", false, "decode FLAC files before linking, and quarantine albums with corrupt audio")
+	registerTranscodeFlag(flags)
+}
+
+// Check album's FLAC files if -verify-flac is set. Returns the first error
+// found, or nil if every file passes.
+func checkAlbumFlac(album Album) error {
+	if !verifyFlac {
+		return nil
+	}
+	for _, path := range albumFlacFiles(album.Path) {
+		if err := verifyFlacFile(path, strictFlac); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode album's FLAC files if -verify-audio or verify_audio is set.
+// Returns the first error found, or nil if every file decodes.
+func checkAlbumAudio(album Album) error {
+	if !verifyAudio && !settings.VerifyAudio {
+		return nil
+	}
+	for _, path := range albumFlacFiles(album.Path) {
+		if err := verifyFlacAudio(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that the FLAC file at path has a readable metadata block chain
+// starting with a valid STREAMINFO. In strict mode, also reject reserved
+// block types, duplicated blocks, oversized padding, unusual stream
+// parameters and channel masks, and files with no audio after the metadata.
+func verifyFlacFile(path string, strict bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(throttledReader{f})
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "fLaC" {
+		return fmt.Errorf("%s: %v", path, errNotFlac)
+	}
+
+	meta := &flacMetadata{Tags: make(map[string][]string)}
+	seen := make(map[byte]int)
+	for i, last := 0, false; !last; i++ {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return fmt.Errorf("%s: metadata block header: %v", path, err)
+		}
+		last = header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		seen[blockType]++
+
+		if i == 0 && blockType != flacBlockStreamInfo {
+			return fmt.Errorf("%s: first metadata block is type %d, not STREAMINFO", path, blockType)
+		}
+		if blockType == 127 {
+			return fmt.Errorf("%s: invalid metadata block type 127", path)
+		}
+		if strict {
+			switch {
+			case blockType > flacBlockPicture:
+				return fmt.Errorf("%s: reserved metadata block type %d", path, blockType)
+			case blockType == flacBlockStreamInfo && length != 34:
+				return fmt.Errorf("%s: STREAMINFO block is %d bytes, not 34", path, length)
+			case blockType == flacBlockPadding && length > maxFlacPadding:
+				return fmt.Errorf("%s: %d bytes of padding", path, length)
+			case seen[blockType] > 1 && blockType != flacBlockPadding && blockType != flacBlockApplication && blockType != flacBlockPicture:
+				return fmt.Errorf("%s: more than one metadata block of type %d", path, blockType)
+			}
+		}
+
+		switch blockType {
+		case flacBlockStreamInfo, flacBlockVorbisComment:
+			block := make([]byte, length)
+			if _, err := io.ReadFull(r, block); err != nil {
+				return fmt.Errorf("%s: metadata block %d: %v", path, blockType, err)
+			}
+			if blockType == flacBlockStreamInfo {
+				err = meta.parseStreamInfo(block)
+			} else {
+				err = meta.parseVorbisComment(block)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		default:
+			if _, err := r.Discard(length); err != nil {
+				return fmt.Errorf("%s: metadata block %d: %v", path, blockType, err)
+			}
+		}
+	}
+
+	if meta.SampleRate == 0 {
+		return fmt.Errorf("%s: STREAMINFO has a sample rate of 0", path)
+	}
+	if !strict {
+		return nil
+	}
+	if err := checkStreamParams(meta); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	// Every audio frame starts with the 14-bit sync code 0x3ffe.
+	sync := make([]byte, 2)
+	if _, err := io.ReadFull(r, sync); err != nil {
+		return fmt.Errorf("%s: no audio after metadata", path)
+	}
+	if sync[0] != 0xff || sync[1]&0xfc != 0xf8 {
+		return fmt.Errorf("%s: metadata is not followed by an audio frame", path)
+	}
+	return nil
+}
+
+// Check for stream parameters that are valid FLAC but that common players
+// don't handle.
+func checkStreamParams(meta *flacMetadata) error {
+	if meta.BitsPerSample < 8 || meta.BitsPerSample > 24 {
+		return fmt.Errorf("%d bits per sample", meta.BitsPerSample)
+	}
+	if meta.SampleRate > 384000 {
+		return fmt.Errorf("sample rate of %d Hz", meta.SampleRate)
+	}
+	// FLAC defines channel layouts for up to 8 channels. Files with more than
+	// two should either use the default layout or say which speakers they
+	// use, with a mask naming exactly one speaker per channel.
+	mask := meta.tag("WAVEFORMATEXTENSIBLE_CHANNEL_MASK")
+	if mask == "" {
+		return nil
+	}
+	value, err := strconv.ParseUint(mask, 0, 32)
+	if err != nil {
+		return errors.New("unreadable WAVEFORMATEXTENSIBLE_CHANNEL_MASK")
+	}
+	if n := bits.OnesCount64(value); n != meta.Channels {
+		return fmt.Errorf("channel mask %s names %d speakers for %d channels", mask, n, meta.Channels)
+	}
+	return nil
+}
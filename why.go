@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Explain why the directory at a source path was or wasn't linked, or what
+// the next run will do with it: whether it's found as an album at all, and
+// if so, whether it's in the DB, in the review queue or rejected, which of
+// its files exclude_files leaves out, and where it would be linked. Nothing
+// is linked or written to the DB. The target dir defaults to target_dir
+// from the config file.
+func runWhy(args []string) {
+	flags := flag.NewFlagSet("why", flag.ExitOnError)
+	registerHiddenFlag(flags)
+	registerDirFilterFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		fmt.Println("Usage: flaclink why [-include-hidden] [-include-dir pattern] [-exclude-dir pattern] <album dir> [target dir]")
+		os.Exit(2)
+	}
+	albumPath := filepath.Clean(flags.Arg(0))
+	targetDir := settings.TargetDir
+	if flags.NArg() == 2 {
+		targetDir = filepath.Clean(flags.Arg(1))
+	}
+
+	fmt.Printf("Source: %s\n", albumPath)
+	info, err := os.Stat(albumPath)
+	if err != nil {
+		fmt.Printf("Result: not scanned, %v\n", err)
+		return
+	}
+	if !info.IsDir() {
+		fmt.Println("Result: not scanned, it's a file rather than a directory")
+		return
+	}
+	if name := filepath.Base(albumPath); skippedDir(name) {
+		fmt.Printf("Result: not scanned, %s is a hidden or system folder; see -include-hidden and include_hidden_dirs\n", name)
+		return
+	}
+
+	if reason := dirFilterReason(filepath.Base(albumPath)); reason != "" {
+		fmt.Printf("Result: not scanned, %s\n", reason)
+		return
+	}
+	if ignoredPath(albumPath, true) {
+		fmt.Printf("Result: not scanned, it's listed in a %s file\n", ignoreFileName)
+		return
+	}
+
+	albums := albumScanner().FindAlbums(albumPath)
+	if len(albums) == 0 {
+		fmt.Printf("Result: not an album, %s\n", noAlbumReason(albumPath))
+		return
+	}
+	if albums[0].Container != "" {
+		fmt.Printf("Discography: split into %d albums, since it has no flac files of its own and two or more album folders\n", len(albums))
+	}
+
+	// Open read-only so a running daemon or scan only makes us wait briefly.
+	db, err := bolt.Open(AlbumDbPath, 0640, &bolt.Options{Timeout: 100 * time.Millisecond, ReadOnly: true})
+	if err != nil {
+		fmt.Printf("DB unavailable, assuming albums aren't in it: %v\n", err)
+		db = nil
+	} else {
+		defer db.Close()
+	}
+	for _, album := range albums {
+		fmt.Println()
+		explainAlbum(album, targetDir, db)
+	}
+}
+
+// Why albumScanner finds no album at dirPath: it has no flac files, or only
+// ones it doesn't recognize or doesn't look at.
+func noAlbumReason(dirPath string) string {
+	var flacs, upperCase int
+	var hidden []string
+	filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && path != dirPath && skippedDir(info.Name()) {
+			hidden = append(hidden, info.Name())
+			return filepath.SkipDir
+		}
+		switch ext := filepath.Ext(path); {
+		case ext == ".flac":
+			flacs++
+		case strings.EqualFold(ext, ".flac"):
+			upperCase++
+		}
+		return nil
+	})
+	switch {
+	case upperCase > 0:
+		return fmt.Sprintf("its %d flac files have upper-case extensions such as .FLAC, which aren't recognized", upperCase)
+	case len(hidden) > 0:
+		return fmt.Sprintf("any flac files are inside hidden or system folders (%s), which aren't scanned; see -include-hidden and include_hidden_dirs", strings.Join(hidden, ", "))
+	case flacs > 0:
+		return "its flac files can't be read"
+	}
+	return "no .flac files found in it or its subfolders"
+}
+
+// Print what the next run would do with album, and why. db may be nil if
+// the database couldn't be opened.
+func explainAlbum(album Album, targetDir string, db *bolt.DB) {
+	fmt.Printf("Album: %s\n", album.Path)
+	if db != nil {
+		if dirName, ok := lookupAlbum(album, db); ok {
+			fmt.Printf("Result: skipped, its file names match an album already in the DB as %s\n", dirName)
+			record, _ := albumStore(db).Record(album)
+			switch {
+			case record.Source != "":
+				fmt.Printf("Linked: %s from %s\n", record.Time.Format(time.RFC1123), record.Source)
+			default:
+				fmt.Println("Linked: not by flaclink; it was found already in the target")
+			}
+			for _, warning := range record.Warnings {
+				fmt.Printf("Warning: %s\n", warning)
+			}
+			if record.FetchedArt != "" {
+				fmt.Printf("Cover art: fetched from %s\n", record.FetchedArt)
+			}
+			return
+		}
+		if isRejected(album, db) {
+			fmt.Println("Result: skipped, it was rejected in review")
+			return
+		}
+		queue, _ := reviewQueue(db)
+		absPath, _ := filepath.Abs(album.Path)
+		for _, queued := range queue {
+			if queued.Album.Path == absPath {
+				fmt.Printf("Result: waiting in the review queue since %s; see flaclink review\n", queued.Queued.Format(time.RFC1123))
+				return
+			}
+		}
+	}
+
+	var excluded, filtered, ignored []string
+	filepath.Walk(album.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == album.Path {
+			return nil
+		}
+		relPath, _ := filepath.Rel(album.Path, path)
+		if ignoredPath(path, info.IsDir()) {
+			ignored = append(ignored, relPath)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		} else if info.IsDir() && filteredDir(info.Name()) {
+			filtered = append(filtered, relPath)
+			return filepath.SkipDir
+		} else if !info.IsDir() && filteredFile(info.Name()) {
+			filtered = append(filtered, relPath)
+		} else if !info.IsDir() && excludedFile(info.Name()) {
+			excluded = append(excluded, relPath)
+		}
+		return nil
+	})
+	if len(excluded) > 0 {
+		fmt.Printf("Excluded: %s, by exclude_files\n", strings.Join(excluded, ", "))
+	}
+	if len(filtered) > 0 {
+		fmt.Printf("Filtered: %s, by file_filter\n", strings.Join(filtered, ", "))
+	}
+	if len(ignored) > 0 {
+		fmt.Printf("Ignored: %s, by %s files\n", strings.Join(ignored, ", "), ignoreFileName)
+	}
+
+	if targetDir == "" {
+		fmt.Println("Result: would be linked; give a target dir to see where")
+		return
+	}
+	named := album
+	applyTemplate(&named)
+	if settings.TargetTemplate != "" {
+		reconcileDirName(&named, targetDir)
+	}
+	targetPath := albumTargetPath(named, targetDir)
+	fmt.Printf("Target: %s\n", targetPath)
+	switch _, err := os.Lstat(targetPath); {
+	case err == nil:
+		fmt.Println("Result: skipped or fails, the target already exists; if it holds this album, the next run records it in the DB instead of linking it")
+	case settings.Review:
+		fmt.Println("Result: would be queued for review, since review is set")
+	default:
+		fmt.Println("Result: would link")
+		if settings.Hooks != nil && settings.Hooks.PreLink != "" {
+			fmt.Println("Note: the pre_link hook may still reject it")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// flaclink keeps its data where the XDG base directory spec says to: the
+// album DB, logs and locks in $XDG_DATA_HOME/flaclink, ~/.local/share/flaclink
+// by default, and config.json in $XDG_CONFIG_HOME/flaclink, ~/.config/flaclink
+// by default. Older versions kept all of it in ~/.flaclink, which is moved
+// to the new places the first time it's found.
+
+// The directory named by the environment variable env, or fallback under
+// the home directory if it's unset. The spec says relative paths are to be
+// ignored like unset ones.
+func xdgDir(env, fallback string) (string, error) {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, fallback), nil
+}
+
+func homeDir() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return usr.HomeDir, nil
+}
+
+// The app data dir: $XDG_DATA_HOME/flaclink. An older ~/.flaclink is moved
+// there if it isn't there yet, or used as it is if it can't be moved, e.g.
+// because it's on another filesystem.
+func defaultAppDataPath() (string, error) {
+	dataHome, err := xdgDir("XDG_DATA_HOME", filepath.Join(".local", "share"))
+	if err != nil {
+		return "", err
+	}
+	appDataPath := filepath.Join(dataHome, "flaclink")
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	legacyPath := filepath.Join(home, ".flaclink")
+	if _, err := os.Stat(legacyPath); err != nil {
+		return appDataPath, nil
+	}
+	if _, err := os.Stat(appDataPath); err == nil {
+		log.Printf("Warning: using %s; %s from an older flaclink is no longer read, and can be removed once you've checked nothing in it is needed.", appDataPath, legacyPath)
+		return appDataPath, nil
+	}
+	if err = os.MkdirAll(dataHome, 0755); err == nil {
+		err = os.Rename(legacyPath, appDataPath)
+		if err == nil {
+			log.Printf("Moved data directory %s to %s.", legacyPath, appDataPath)
+			return appDataPath, nil
+		}
+	}
+	log.Printf("Warning: can't move data directory %s to %s, still using it: %v", legacyPath, appDataPath, err)
+	return legacyPath, nil
+}
+
+// The config file: $XDG_CONFIG_HOME/flaclink/config.json. A config.json in
+// appDataPath, where older versions kept it, is moved there if there isn't
+// one yet, or used as it is if it can't be moved.
+func defaultConfigPath(appDataPath string) (string, error) {
+	configHome, err := xdgDir("XDG_CONFIG_HOME", ".config")
+	if err != nil {
+		return "", err
+	}
+	configPath := filepath.Join(configHome, "flaclink", "config.json")
+	legacyPath := filepath.Join(appDataPath, "config.json")
+	if _, err := os.Stat(legacyPath); err != nil {
+		return configPath, nil
+	}
+	if _, err := os.Stat(configPath); err == nil {
+		log.Printf("Warning: using %s; %s is no longer read.", configPath, legacyPath)
+		return configPath, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(configPath), 0755); err == nil {
+		err = os.Rename(legacyPath, configPath)
+		if err == nil {
+			log.Printf("Moved config file %s to %s.", legacyPath, configPath)
+			return configPath, nil
+		}
+	}
+	log.Printf("Warning: can't move config file %s to %s, still using it: %v", legacyPath, configPath, err)
+	return legacyPath, nil
+}